@@ -0,0 +1,474 @@
+// Package feishu is an authenticator by Feishu (Lark) OAuth authorization code.
+//
+// The client obtains an authorization code from Feishu and sends it as the secret in the form
+// APP_ID:CODE where APP_ID identifies the Feishu app the code was issued for. The code is exchanged
+// for the user's access token which is used to fetch the user's profile. The user is identified
+// by Feishu union_id.
+package feishu
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default base URL of Feishu API. Lark international uses https://open.larksuite.com.
+	defaultBaseURL = "https://open.feishu.cn"
+
+	// Endpoint for exchanging the authorization code for the user access token.
+	tokenPath = "/open-apis/authen/v2/oauth/token"
+	// Endpoint for getting the profile of the user.
+	userInfoPath = "/open-apis/authen/v1/user_info"
+
+	// Authorization codes can be used only once. The result of the exchange in IsUnique is cached
+	// because the same secret is then passed to AddRecord.
+	profileCacheTTL = 5 * time.Minute
+)
+
+// authenticator is the type to map authentication methods to.
+type authenticator struct {
+	name string
+	// Base URL of Feishu API for apps which don't define their own.
+	baseURL string
+	// Redirect URI used to obtain the authorization code, if any.
+	redirectURI string
+	// Create a new account if the Feishu user is not known yet.
+	allowNewAccounts bool
+
+	httpClient *http.Client
+
+	// Cache of exchanged authorization codes.
+	cacheLock sync.Mutex
+	cache     map[string]*cachedProfile
+}
+
+// profile is the subset of Feishu user info used by the authenticator.
+type profile struct {
+	// ID of the Feishu app which issued the code.
+	AppId string `json:"-"`
+
+	Name      string `json:"name"`
+	AvatarUrl string `json:"avatar_url"`
+	OpenId    string `json:"open_id"`
+	UnionId   string `json:"union_id"`
+	Email     string `json:"email"`
+}
+
+type cachedProfile struct {
+	profile *profile
+	expires time.Time
+}
+
+func parseSecret(bsecret []byte) (appId, code string, err error) {
+	appId, code, found := strings.Cut(string(bsecret), ":")
+	if !found || appId == "" || code == "" {
+		err = types.ErrMalformed
+	}
+	return
+}
+
+// Init initializes the Feishu authenticator.
+func (a *authenticator) Init(jsonconf json.RawMessage, name string) error {
+	if name == "" {
+		return errors.New("auth_feishu: authenticator name cannot be blank")
+	}
+
+	if a.name != "" {
+		return errors.New("auth_feishu: already initialized as " + a.name + "; " + name)
+	}
+
+	type configType struct {
+		// Base URL of Feishu API for apps which don't define their own.
+		BaseURL string `json:"base_url"`
+		// Redirect URI used by the client to obtain the authorization code, if any.
+		RedirectURI string `json:"redirect_uri"`
+		// Create a new account if the Feishu user is not known yet.
+		AllowNewAccounts bool `json:"allow_new_accounts"`
+	}
+
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("auth_feishu: failed to parse config: " + err.Error() + "(" + string(jsonconf) + ")")
+	}
+
+	if config.BaseURL == "" {
+		config.BaseURL = defaultBaseURL
+	}
+	if baseURL, err := url.Parse(config.BaseURL); err != nil || !baseURL.IsAbs() {
+		return errors.New("auth_feishu: invalid base_url '" + config.BaseURL + "'")
+	}
+
+	a.name = name
+	a.baseURL = strings.TrimSuffix(config.BaseURL, "/")
+	a.redirectURI = config.RedirectURI
+	a.allowNewAccounts = config.AllowNewAccounts
+	a.httpClient = &http.Client{Timeout: 10 * time.Second}
+	a.cache = make(map[string]*cachedProfile)
+
+	return nil
+}
+
+// IsInitialized returns true if the handler is initialized.
+func (a *authenticator) IsInitialized() bool {
+	return a.name != ""
+}
+
+// callApi sends a request to Feishu API and decodes the response into result.
+func (a *authenticator) callApi(req *http.Request, result any) error {
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, result)
+}
+
+// exchangeCode exchanges the authorization code for the profile of the Feishu user.
+func (a *authenticator) exchangeCode(app *types.FeishuApp, code string) (*profile, error) {
+	baseURL := a.baseURL
+	if app.BaseUrl != "" {
+		baseURL = strings.TrimSuffix(app.BaseUrl, "/")
+	}
+
+	params := map[string]string{
+		"grant_type":    "authorization_code",
+		"client_id":     app.AppId,
+		"client_secret": app.AppSecret,
+		"code":          code,
+	}
+	if a.redirectURI != "" {
+		params["redirect_uri"] = a.redirectURI
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, baseURL+tokenPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	var token struct {
+		Code        int    `json:"code"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = a.callApi(req, &token); err != nil {
+		return nil, err
+	}
+	if token.Code != 0 || token.AccessToken == "" {
+		logs.Info.Printf("auth_feishu: code rejected: code=%d, error=%s, %s, app_id=%s",
+			token.Code, token.Error, token.Description, app.AppId)
+		return nil, types.ErrFailed
+	}
+
+	req, err = http.NewRequest(http.MethodGet, baseURL+userInfoPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	var info struct {
+		Code int     `json:"code"`
+		Msg  string  `json:"msg"`
+		Data profile `json:"data"`
+	}
+	if err = a.callApi(req, &info); err != nil {
+		return nil, err
+	}
+	if info.Code != 0 {
+		return nil, fmt.Errorf("auth_feishu: failed to get user info: code=%d, msg=%s", info.Code, info.Msg)
+	}
+	if info.Data.UnionId == "" {
+		return nil, errors.New("auth_feishu: user info has no union_id")
+	}
+
+	info.Data.AppId = app.AppId
+	return &info.Data, nil
+}
+
+// getProfile returns the Feishu profile for the secret, either cached or by exchanging the code.
+// If keep is true, the profile is cached for the subsequent call, otherwise the cached profile is consumed.
+func (a *authenticator) getProfile(secret []byte, keep bool) (*profile, error) {
+	appId, code, err := parseSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	key := string(secret)
+	now := time.Now()
+	a.cacheLock.Lock()
+	for k, cached := range a.cache {
+		if cached.expires.Before(now) {
+			delete(a.cache, k)
+		}
+	}
+	cached := a.cache[key]
+	if !keep {
+		delete(a.cache, key)
+	}
+	a.cacheLock.Unlock()
+	if cached != nil {
+		return cached.profile, nil
+	}
+
+	apps, err := store.FeishuApps.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var app *types.FeishuApp
+	for i := range apps {
+		if apps[i].AppId == appId {
+			app = &apps[i]
+			break
+		}
+	}
+	if app == nil {
+		return nil, types.ErrFailed
+	}
+
+	prof, err := a.exchangeCode(app, code)
+	if err != nil {
+		return nil, err
+	}
+
+	if keep {
+		a.keepProfile(secret, prof)
+	}
+
+	return prof, nil
+}
+
+// keepProfile caches the profile for the subsequent call with the same secret.
+func (a *authenticator) keepProfile(secret []byte, prof *profile) {
+	a.cacheLock.Lock()
+	a.cache[string(secret)] = &cachedProfile{profile: prof, expires: time.Now().Add(profileCacheTTL)}
+	a.cacheLock.Unlock()
+}
+
+// lookupUser finds the account of the Feishu user by the authentication record of the given scheme or,
+// if there is no record, by the Feishu user the account is linked to. The returned level is LevelNone
+// if the account has no authentication record. Returns zero uid if the Feishu user has no account.
+func lookupUser(scheme, unionId string) (types.Uid, auth.Level, error) {
+	uid, authLvl, _, _, err := store.Users.GetAuthUniqueRecord(scheme, unionId)
+	if err != nil || !uid.IsZero() {
+		return uid, authLvl, err
+	}
+	uid, err = store.Users.GetByUnionId(unionId)
+	return uid, auth.LevelNone, err
+}
+
+// FindUser returns the account of the Feishu user and the level of its authentication record
+// of the given scheme. An account linked to the Feishu user which has no authentication record,
+// such as one created by the directory sync before the authenticator was enabled, is given the
+// record. Returns zero uid if the Feishu user has no account.
+func FindUser(scheme, unionId string) (types.Uid, auth.Level, error) {
+	uid, authLvl, err := lookupUser(scheme, unionId)
+	if err != nil || uid.IsZero() || authLvl != auth.LevelNone {
+		return uid, authLvl, err
+	}
+
+	if err = store.Users.AddAuthRecord(uid, auth.LevelAuth, scheme, unionId, nil, time.Time{}); err != nil {
+		return types.ZeroUid, auth.LevelNone, err
+	}
+	return uid, auth.LevelAuth, nil
+}
+
+// linkUser makes sure the user account points to the Feishu user and the app.
+func linkUser(uid types.Uid, prof *profile) error {
+	user, err := store.Users.Get(uid)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return types.ErrUserNotFound
+	}
+	if user.UnionId == prof.UnionId && user.FeishuAppId == prof.AppId {
+		return nil
+	}
+	return store.Users.Update(uid, map[string]any{
+		"UnionId":     prof.UnionId,
+		"FeishuAppId": prof.AppId,
+		"UpdatedAt":   types.TimeNow(),
+	})
+}
+
+// newPublic builds user's public from Feishu profile.
+func newPublic(prof *profile) map[string]any {
+	public := map[string]any{"fn": prof.Name}
+	if prof.AvatarUrl != "" {
+		public["photo"] = map[string]any{"ref": prof.AvatarUrl}
+	}
+	return public
+}
+
+// AddRecord adds Feishu authentication record to a newly created account.
+func (a *authenticator) AddRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	prof, err := a.getProfile(secret, false)
+	if err != nil {
+		return nil, err
+	}
+
+	authLevel := rec.AuthLevel
+	if authLevel == auth.LevelNone {
+		authLevel = auth.LevelAuth
+	}
+
+	if err = store.Users.AddAuthRecord(rec.Uid, authLevel, a.name, prof.UnionId, nil, time.Time{}); err != nil {
+		return nil, err
+	}
+	if err = linkUser(rec.Uid, prof); err != nil {
+		return nil, err
+	}
+
+	rec.AuthLevel = authLevel
+	return rec, nil
+}
+
+// UpdateRecord links an existing account to a Feishu user or replaces the linked Feishu user.
+func (a *authenticator) UpdateRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	prof, err := a.getProfile(secret, false)
+	if err != nil {
+		return nil, err
+	}
+
+	uid, _, err := lookupUser(a.name, prof.UnionId)
+	if err != nil {
+		return nil, err
+	}
+	if !uid.IsZero() && uid != rec.Uid {
+		// The Feishu user is already linked to another account.
+		return nil, types.ErrDuplicate
+	}
+
+	unionId, authLevel, _, _, err := store.Users.GetAuthRecord(rec.Uid, a.name)
+	if err != nil {
+		return nil, err
+	}
+	if unionId == "" {
+		// The account has no Feishu record yet.
+		err = store.Users.AddAuthRecord(rec.Uid, auth.LevelAuth, a.name, prof.UnionId, nil, time.Time{})
+	} else {
+		err = store.Users.UpdateAuthRecord(rec.Uid, authLevel, a.name, prof.UnionId, nil, time.Time{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return rec, linkUser(rec.Uid, prof)
+}
+
+// Authenticate exchanges the authorization code and finds the account of the Feishu user.
+// If the user is not known and the authenticator is configured to allow new accounts,
+// the server is requested to create one.
+func (a *authenticator) Authenticate(secret []byte, remoteAddr string) (*auth.Rec, []byte, error) {
+	prof, err := a.getProfile(secret, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uid, authLvl, err := FindUser(a.name, prof.UnionId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if uid.IsZero() {
+		if !a.allowNewAccounts {
+			return nil, nil, types.ErrFailed
+		}
+
+		// The server creates the account with the default settings, then calls AddRecord with the same secret.
+		a.keepProfile(secret, prof)
+		return &auth.Rec{
+			AuthLevel: auth.LevelAuth,
+			Features:  auth.FeatureValidated,
+			State:     types.StateOK,
+			Public:    newPublic(prof)}, nil, nil
+	}
+
+	// The user may log in through a different app.
+	if err = linkUser(uid, prof); err != nil {
+		logs.Warn.Println("auth_feishu: failed to link user to feishu app", err, uid.UserId())
+	}
+
+	return &auth.Rec{
+		Uid:       uid,
+		AuthLevel: authLvl,
+		Features:  auth.FeatureValidated,
+		State:     types.StateUndefined}, nil, nil
+}
+
+// AsTag is not supported, will produce an empty string.
+func (*authenticator) AsTag(token string) string {
+	return ""
+}
+
+// IsUnique checks if the Feishu user is not linked to any account yet.
+func (a *authenticator) IsUnique(secret []byte, remoteAddr string) (bool, error) {
+	prof, err := a.getProfile(secret, true)
+	if err != nil {
+		return false, err
+	}
+
+	uid, _, err := lookupUser(a.name, prof.UnionId)
+	if err != nil {
+		return false, err
+	}
+
+	if uid.IsZero() {
+		return true, nil
+	}
+	return false, types.ErrDuplicate
+}
+
+// GenSecret is not supported, generates an error.
+func (*authenticator) GenSecret(rec *auth.Rec) ([]byte, time.Time, error) {
+	return nil, time.Time{}, types.ErrUnsupported
+}
+
+// DelRecords deletes saved authentication records of the given user.
+func (a *authenticator) DelRecords(uid types.Uid) error {
+	return store.Users.DelAuthRecords(uid, a.name)
+}
+
+// RestrictedTags returns tag namespaces restricted by this authenticator (none).
+func (*authenticator) RestrictedTags() ([]string, error) {
+	return nil, nil
+}
+
+// GetResetParams returns authenticator parameters passed to password reset handler (none).
+func (*authenticator) GetResetParams(uid types.Uid) (map[string]any, error) {
+	return nil, nil
+}
+
+const realName = "feishu"
+
+// GetRealName returns the hardcoded name of the authenticator.
+func (*authenticator) GetRealName() string {
+	return realName
+}
+
+func init() {
+	store.RegisterAuthScheme(realName, &authenticator{})
+}
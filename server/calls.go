@@ -438,6 +438,10 @@ func (t *Topic) terminateCallInProgress(callDidTimeout bool) {
 	if sess == nil || uid.IsZero() {
 		// Just drop the call.
 		logs.Warn.Printf("topic[%s]: video call seq %d has no originator, terminating.", t.name, t.currentCall.seq)
+		// No finalizing message is sent. Make sure the callee's phone stops ringing.
+		if pushRcpt := t.pushForCallEnd(uid, t.currentCall, types.TimeNow()); pushRcpt != nil {
+			sendPush(pushRcpt)
+		}
 		t.currentCall = nil
 		return
 	}
@@ -141,6 +141,9 @@ type ClusterSess struct {
 	// Device ID
 	DeviceID string
 
+	// PushKit VoIP token
+	VoipToken string
+
 	// Device platform: "web", "ios", "android"
 	Platform string
 
@@ -190,6 +193,8 @@ type ClusterReq struct {
 	Sess *ClusterSess
 	// True when the topic proxy is gone.
 	Gone bool
+	// True when the topic must be reloaded from the database.
+	Reload bool
 }
 
 // ClusterRoute is intra-cluster routing request message.
@@ -498,6 +503,12 @@ func (c *Cluster) TopicMaster(msg *ClusterReq, rejected *bool) error {
 		return nil
 	}
 
+	if msg.Reload {
+		// The topic was changed in the database by another node.
+		globals.hub.unreg <- &topicUnreg{rcptTo: msg.RcptTo, reload: true}
+		return nil
+	}
+
 	// Create a new multiplexing session if needed.
 	if msess == nil {
 		// If the session is not found, create it.
@@ -526,6 +537,7 @@ func (c *Cluster) TopicMaster(msg *ClusterReq, rejected *bool) error {
 			remoteAddr:  msg.Sess.RemoteAddr,
 			lang:        msg.Sess.Lang,
 			countryCode: msg.Sess.CountryCode,
+			voipToken:   msg.Sess.VoipToken,
 			proxyReq:    msg.ReqType,
 			background:  msg.Sess.Background,
 			uid:         msg.Sess.Uid,
@@ -848,6 +860,7 @@ func (c *Cluster) makeClusterReq(reqType ProxyReqType, msg *ClientComMessage, to
 			Lang:        sess.lang,
 			CountryCode: sess.countryCode,
 			DeviceID:    sess.deviceID,
+			VoipToken:   sess.voipToken,
 			Platform:    sess.platf,
 			Sid:         sess.sid,
 			Background:  sess.background,
@@ -924,6 +937,23 @@ func (c *Cluster) topicProxyGone(topicName string) error {
 	return n.proxyToMasterAsync(req)
 }
 
+// Topic was changed in the database. Ask the remote Master node to reload it.
+func (c *Cluster) topicReload(topicName string) error {
+	if c == nil {
+		// Cluster may be nil due to shutdown.
+		return nil
+	}
+
+	n := c.nodeForTopic(topicName)
+	if n == nil {
+		return errors.New("node for topic not found")
+	}
+
+	req := c.makeClusterReq(ProxyReqNone, nil, topicName, nil)
+	req.Reload = true
+	return n.proxyToMasterAsync(req)
+}
+
 // Returns snowflake worker id.
 func clusterInit(configString json.RawMessage, self *string) int {
 	if globals.cluster != nil {
@@ -71,6 +71,38 @@ type MsgSetDesc struct {
 	Trusted any `json:"trusted,omitempty"`
 	// Per-subscription private data.
 	Private any `json:"private,omitempty"`
+	// Message retention policy (group topics only).
+	Retention *MsgRetention `json:"retention,omitempty"`
+	// Push notification preferences ('me' topic only).
+	Notify *MsgNotifyPrefs `json:"notify,omitempty"`
+}
+
+// MsgNotifyPrefs is the user's push notification preferences. The object replaces the previous
+// preferences entirely, an empty object clears them.
+type MsgNotifyPrefs struct {
+	// Quiet hours "HH:MM-HH:MM", e.g. "22:00-08:00". Only incoming calls are notified of.
+	Quiet string `json:"quiet,omitempty"`
+	// IANA time zone of the quiet hours, e.g. "Europe/Berlin". UTC if missing.
+	TimeZone string `json:"tz,omitempty"`
+	// Notify of messages in group topics only if the user is @-mentioned.
+	MentionsOnly bool `json:"mentionsOnly,omitempty"`
+	// Topics muted until the given time. Mentions break through.
+	Mute map[string]time.Time `json:"mute,omitempty"`
+	// Opt out of email digests of unread messages.
+	NoEmailDigest bool `json:"noEmailDigest,omitempty"`
+}
+
+// MsgRetention is a topic's message retention policy.
+type MsgRetention struct {
+	// Seconds a message lives after being read: 0 - server default, -1 - never expires.
+	Period int `json:"period,omitempty"`
+	// The period takes precedence over the values requested in {pub} or set on subscriptions.
+	Enforced bool `json:"enforced,omitempty"`
+	// What starts the countdown: "first" reader (default), "all" readers, or each "recipient" separately.
+	Trigger string `json:"trigger,omitempty"`
+	// Seconds a message lives after being sent, read or not: 0 - server limit. In {meta} it's
+	// the effective value which includes the server limit.
+	Lifetime int `json:"lifetime,omitempty"`
 }
 
 // MsgCredClient is an account credential such as email or phone number.
@@ -124,6 +156,8 @@ type MsgClientHi struct {
 	Lang string `json:"lang,omitempty"`
 	// Platform code: ios, android, web.
 	Platform string `json:"platf,omitempty"`
+	// PushKit VoIP token of an iOS device. It's registered as a separate device with platform "voip".
+	Voip string `json:"voip,omitempty"`
 	// Session is initially in non-iteractive, i.e. issued by a service. Presence notifications are delayed.
 	Background bool `json:"bkg,omitempty"`
 }
@@ -456,6 +490,10 @@ type MsgTopicDesc struct {
 	// Per-subscription private data
 	Private      any `json:"private,omitempty"`
 	ExpirePeriod int `json:"expirePeriod,omitempty"`
+	// Message retention policy of the topic.
+	Retention *MsgRetention `json:"retention,omitempty"`
+	// Push notification preferences, 'me' topic only.
+	Notify *MsgNotifyPrefs `json:"notify,omitempty"`
 }
 
 func (src *MsgTopicDesc) describe() string {
@@ -638,6 +676,13 @@ func (src *MsgServerData) describe() string {
 	return s
 }
 
+// MsgExpiry is the expiration time of a message reported in {pres what="updateMsg"}.
+type MsgExpiry struct {
+	SeqId        int       `json:"seq"`
+	ExpirePeriod int       `json:"expirePeriod,omitempty"`
+	ExpiredAt    time.Time `json:"expired"`
+}
+
 // MsgServerPres is presence notification {pres} (authoritative update).
 type MsgServerPres struct {
 	Topic     string     `json:"topic"`
@@ -649,10 +694,10 @@ type MsgServerPres struct {
 	DelSeq    []MsgRange `json:"delseq,omitempty"`
 	AcsTarget string     `json:"tgt,omitempty"`
 	AcsActor  string     `json:"act,omitempty"`
-	// message expire field
-	ExpirePeriod int        `json:"expirePeriod,omitempty"`
-	ExpiredAt    *time.Time `json:"expired,omitempty"`
-	From         string     `json:"from,omitempty"`
+	// Expiration times of messages in "updateMsg".
+	Expired []MsgExpiry `json:"msgs,omitempty"`
+	// User who caused the expiration of messages in "updateMsg".
+	From string `json:"from,omitempty"`
 	// Acs or a delta Acs. Need to marshal it to json under a name different than 'acs'
 	// to allow different handling on the client
 	Acs *MsgAccessMode `json:"dacs,omitempty"`
@@ -51,8 +51,13 @@ type Adapter interface {
 	UserUpdate(uid t.Uid, update map[string]any) error
 	// UserUpdateTags adds, removes, or resets user's tags
 	UserUpdateTags(uid t.Uid, add, remove, reset []string) ([]string, error)
+	// UserSetLegalHold places (hold is not nil) or releases (hold is nil) legal hold on the user's conversations.
+	// Adapters which cannot retain deleted messages return ErrUnsupported.
+	UserSetLegalHold(uid t.Uid, hold *t.LegalHold) error
 	// UserGetByCred returns user ID for the given validated credential.
 	UserGetByCred(method, value string) (t.Uid, error)
+	// UserGetByUnionId returns ID of the active user linked to the given Feishu union ID.
+	UserGetByUnionId(unionId string) (t.Uid, error)
 	// UserUnreadCount returns the total number of unread messages in all topics with
 	// the R permission. If read fails, the counts are still returned with the original
 	// user IDs but with the unread count undefined and non-nil error.
@@ -60,6 +65,10 @@ type Adapter interface {
 	// UserGetUnvalidated returns a list of no more than 'limit' uids who never logged in,
 	// have no validated credentials and which haven't been updated since 'lastUpdatedBefore'.
 	UserGetUnvalidated(lastUpdatedBefore time.Time, limit int) ([]t.Uid, error)
+	// UserGetOffline returns no more than 'limit' active users last seen after 'lastSeenAfter' but no later
+	// than 'lastSeenBefore', ordered by the time last seen and ID. If 'afterId' is not zero, users last seen
+	// at 'lastSeenAfter' with ID greater than 'afterId' are returned too: the paging continues after this user.
+	UserGetOffline(lastSeenAfter time.Time, afterId t.Uid, lastSeenBefore time.Time, limit int) ([]t.User, error)
 
 	// Credential management
 
@@ -125,6 +134,9 @@ type Adapter interface {
 	TopicUpdate(topic string, update map[string]any) error
 	// TopicOwnerChange updates topic's owner
 	TopicOwnerChange(topic string, newOwner t.Uid) error
+	// TopicSetLegalHold places (hold is not nil) or releases (hold is nil) legal hold on the topic.
+	// Adapters which cannot retain deleted messages return ErrUnsupported.
+	TopicSetLegalHold(topic string, hold *t.LegalHold) error
 	// Topic subscriptions
 
 	// SubscriptionGet reads a subscription of a user to a topic
@@ -166,8 +178,21 @@ type Adapter interface {
 	MessageGetByTopicSeqId(topic string, seqId int) (*t.Message, error)
 	MessageListByTopicSeqIdRange(topic string, forUser t.Uid, seqIdStart int, seqIdEnd int) ([]t.Message, error)
 	MessageUpdate(topic string, seqId int, expired time.Time) error
-	MessageExpiredList() ([]t.Message, error)
+	// MessageExpiredList returns up to limit messages which expire before the given time, ordered by expiration
+	// time, topic and seq ID, starting after the given position or from the beginning if after is nil.
+	MessageExpiredList(after *t.MessageExpiry, before time.Time, limit int) ([]t.MessageExpiry, error)
+	// MessageAttachments returns IDs of files attached to messages in the topic with seq IDs within the ranges.
+	MessageAttachments(topic string, ranges []t.Range) ([]string, error)
+	// MessageExpireForUser sets the time when the message expires for the given user only.
+	MessageExpireForUser(topic string, forUser t.Uid, seqId int, expired time.Time) error
+	// MessageExpiredForUserList returns up to limit per-user message expirations which are due before the given time,
+	// ordered by expiration time, topic, seq ID and user, starting after the given position or from the beginning
+	// if after is nil.
+	MessageExpiredForUserList(after *t.MessageExpiry, before time.Time, limit int) ([]t.MessageExpiry, error)
 	MessageUpdateMissExpired() error
+	// MessageApplyLifetime makes messages in the topic expire no later than lifetime seconds after being sent.
+	// If topic is empty, the lifetime is applied to messages in all topics.
+	MessageApplyLifetime(topic string, lifetime int) error
 
 	// Devices (for push notifications)
 
@@ -190,6 +215,9 @@ type Adapter interface {
 	// unused records with UpdatedAt before olderThan.
 	// Returns array of FileDef.Location of deleted filerecords so actual files can be deleted too.
 	FileDeleteUnused(olderThan time.Time, limit int) ([]string, error)
+	// FileDeleteIfUnused deletes records of the given files which are not linked to any message, topic or user.
+	// Returns array of FileDef.Location of deleted filerecords so actual files can be deleted too.
+	FileDeleteIfUnused(fids []string) ([]string, error)
 	// FileLinkAttachments connects given topic or message to the file record IDs from the list.
 	FileLinkAttachments(topic string, userId, msgId t.Uid, fids []string) error
 
@@ -206,4 +234,10 @@ type Adapter interface {
 
 	// FeishuAppGetALL Feishu app get all
 	FeishuAppGetAll() ([]t.FeishuApp, error)
+	// FeishuAppCreate adds a new Feishu app.
+	FeishuAppCreate(app *t.FeishuApp) error
+	// FeishuAppUpdate replaces credentials of an existing Feishu app.
+	FeishuAppUpdate(app *t.FeishuApp) error
+	// FeishuAppDelete deletes a Feishu app.
+	FeishuAppDelete(appId string) error
 }
@@ -833,6 +833,13 @@ func (a *adapter) topicStateForUser(uid t.Uid, now time.Time, update any) error
 func (a *adapter) UserUpdate(uid t.Uid, update map[string]any) error {
 	// to get round the hardcoded "UpdatedAt" key in store.Users.Update()
 	update = normalizeUpdateMap(update)
+	// Feishu fields have custom names.
+	for key, name := range map[string]string{"unionid": "union_id", "feishuappid": "feishu_app_id"} {
+		if val, ok := update[key]; ok {
+			delete(update, key)
+			update[name] = val
+		}
+	}
 
 	_, err := a.db.Collection("users").UpdateOne(a.ctx, b.M{"_id": uid.String()}, b.M{"$set": update})
 	if err != nil {
@@ -902,6 +909,23 @@ func (a *adapter) UserGetByCred(method, value string) (t.Uid, error) {
 	return t.ParseUid(userId["user"]), nil
 }
 
+// UserGetByUnionId returns ID of the active user linked to the given Feishu union ID.
+func (a *adapter) UserGetByUnionId(unionId string) (t.Uid, error) {
+	var user map[string]string
+	err := a.db.Collection("users").FindOne(a.ctx,
+		b.M{"union_id": unionId, "state": b.M{"$ne": t.StateDeleted}},
+		mdbopts.FindOne().SetProjection(b.M{"_id": 1}),
+	).Decode(&user)
+	if err != nil {
+		if err == mdb.ErrNoDocuments {
+			return t.ZeroUid, nil
+		}
+		return t.ZeroUid, err
+	}
+
+	return t.ParseUid(user["_id"]), nil
+}
+
 // UserUnreadCount returns the total number of unread messages in all topics with
 // the R permission. If read fails, the counts are still returned with the original
 // user IDs but with the unread count undefined and non-nil error.
@@ -1063,6 +1087,46 @@ func (a *adapter) UserGetUnvalidated(lastUpdatedBefore time.Time, limit int) ([]
 	return uids, err
 }
 
+// UserGetOffline returns active users last seen within the (lastSeenAfter, lastSeenBefore] interval
+// or at lastSeenAfter with ID greater than afterId.
+func (a *adapter) UserGetOffline(lastSeenAfter time.Time, afterId t.Uid, lastSeenBefore time.Time, limit int) ([]t.User, error) {
+	filter := b.M{
+		"state":    t.StateOK,
+		"lastseen": b.M{"$gt": lastSeenAfter, "$lte": lastSeenBefore},
+	}
+	if !afterId.IsZero() {
+		// Continue after the last user of the previous page.
+		filter["lastseen"] = b.M{"$gte": lastSeenAfter, "$lte": lastSeenBefore}
+		filter["$or"] = b.A{
+			b.M{"lastseen": b.M{"$gt": lastSeenAfter}},
+			b.M{"_id": b.M{"$gt": afterId.String()}},
+		}
+	}
+	findOpts := mdbopts.Find().SetSort(b.D{{"lastseen", 1}, {"_id", 1}}).SetLimit(int64(limit))
+	cur, err := a.db.Collection("users").Find(a.ctx, filter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var users []t.User
+	for cur.Next(a.ctx) {
+		var user t.User
+		if err := cur.Decode(&user); err != nil {
+			return nil, err
+		}
+		user.Public = unmarshalBsonD(user.Public)
+		user.Trusted = unmarshalBsonD(user.Trusted)
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// UserSetLegalHold is not supported by this adapter: deleted messages are not retained.
+func (a *adapter) UserSetLegalHold(uid t.Uid, hold *t.LegalHold) error {
+	return t.ErrUnsupported
+}
+
 // Credential management
 
 // CredUpsert adds or updates a validation record. Returns true if inserted, false if updated.
@@ -1896,6 +1960,11 @@ func (a *adapter) TopicUpdate(topic string, update map[string]any) error {
 	return a.topicUpdate(topic, normalizeUpdateMap(update))
 }
 
+// TopicSetLegalHold is not supported by this adapter: deleted messages are not retained.
+func (a *adapter) TopicSetLegalHold(topic string, hold *t.LegalHold) error {
+	return t.ErrUnsupported
+}
+
 // TopicOwnerChange updates topic's owner
 func (a *adapter) TopicOwnerChange(topic string, newOwner t.Uid) error {
 	return a.topicUpdate(topic, map[string]any{"owner": newOwner.String()})
@@ -2570,6 +2639,27 @@ func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOp
 	return dmsgs, nil
 }
 
+// MessageAttachments returns IDs of files attached to messages in the topic with seq IDs within the ranges.
+func (a *adapter) MessageAttachments(topic string, ranges []t.Range) ([]string, error) {
+	if len(ranges) == 0 {
+		return nil, nil
+	}
+
+	filter := rangeToFilter(ranges, b.M{"topic": topic, "attachments": b.M{"$exists": true}})
+	ids, err := a.db.Collection("messages").Distinct(a.ctx, "attachments", filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var fids []string
+	for _, id := range ids {
+		if fid, ok := id.(string); ok {
+			fids = append(fids, fid)
+		}
+	}
+	return fids, nil
+}
+
 // Devices (for push notifications).
 
 // DeviceUpsert creates or updates a device record.
@@ -2772,6 +2862,39 @@ func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, er
 	return locations, err
 }
 
+// FileDeleteIfUnused deletes records of the given files which are not linked to any message, topic or user,
+// i.e. UseCount is zero. Returns array of FileDef.Location of deleted filerecords so actual files can be deleted too.
+func (a *adapter) FileDeleteIfUnused(fids []string) ([]string, error) {
+	if len(fids) == 0 {
+		return nil, nil
+	}
+
+	filter := b.M{
+		"_id": b.M{"$in": fids},
+		"$or": b.A{
+			b.M{"usecount": 0},
+			b.M{"usecount": b.M{"$exists": false}}},
+	}
+	findOpts := mdbopts.Find().SetProjection(b.M{"location": 1, "_id": 0})
+	cur, err := a.db.Collection("fileuploads").Find(a.ctx, filter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var locations []string
+	for cur.Next(a.ctx) {
+		var result map[string]string
+		if err := cur.Decode(&result); err != nil {
+			return nil, err
+		}
+		locations = append(locations, result["location"])
+	}
+
+	_, err = a.db.Collection("fileuploads").DeleteMany(a.ctx, filter)
+	return locations, err
+}
+
 // Given a filter query against 'messages' collection, decrement corresponding use counter in 'fileuploads' table.
 func (a *adapter) decFileUseCounter(ctx context.Context, collection string, msgFilter b.M) error {
 	// Copy msgFilter
@@ -2941,6 +3064,59 @@ func GetTestingAdapter() *adapter {
 	return &adapter{}
 }
 
+// Feishu apps. The app ID is stored in the "_id" field.
+
+// FeishuAppGetAll returns all active Feishu apps.
+func (a *adapter) FeishuAppGetAll() ([]t.FeishuApp, error) {
+	cur, err := a.db.Collection("feishuapp").Find(a.ctx, b.M{"state": 1})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	feishuApps := []t.FeishuApp{}
+	if err := cur.All(a.ctx, &feishuApps); err != nil {
+		return nil, err
+	}
+	return feishuApps, nil
+}
+
+// FeishuAppCreate adds a new Feishu app.
+func (a *adapter) FeishuAppCreate(app *t.FeishuApp) error {
+	_, err := a.db.Collection("feishuapp").InsertOne(a.ctx,
+		b.M{"_id": app.AppId, "appsecret": app.AppSecret, "baseurl": app.BaseUrl, "state": 1})
+	if isDuplicateErr(err) {
+		return t.ErrDuplicate
+	}
+	return err
+}
+
+// FeishuAppUpdate replaces credentials and endpoint of an existing Feishu app.
+func (a *adapter) FeishuAppUpdate(app *t.FeishuApp) error {
+	res, err := a.db.Collection("feishuapp").UpdateOne(a.ctx,
+		b.M{"_id": app.AppId, "state": 1},
+		b.M{"$set": b.M{"appsecret": app.AppSecret, "baseurl": app.BaseUrl}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return t.ErrNotFound
+	}
+	return nil
+}
+
+// FeishuAppDelete deletes a Feishu app.
+func (a *adapter) FeishuAppDelete(appId string) error {
+	res, err := a.db.Collection("feishuapp").DeleteOne(a.ctx, b.M{"_id": appId})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return t.ErrNotFound
+	}
+	return nil
+}
+
 func init() {
 	store.RegisterAdapter(&adapter{})
 }
@@ -226,6 +226,51 @@ func TestUserGetAll(t *testing.T) {
 	}
 }
 
+func TestUserGetOffline(t *testing.T) {
+	// users[2] is deleted and must be skipped.
+	for i, user := range []*types.User{users[0], users[1], users[2]} {
+		if err := adp.UserUpdate(types.ParseUserId("usr"+user.Id),
+			map[string]any{"LastSeen": now.Add(time.Duration(i+1) * time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer db.Collection("users").UpdateMany(ctx, b.M{}, b.M{"$unset": b.M{"lastseen": ""}})
+
+	got, err := adp.UserGetOffline(now, types.ZeroUid, now.Add(time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Id != users[0].Id || got[1].Id != users[1].Id {
+		t.Error(mismatchErrorString("Offline users", got, []*types.User{users[0], users[1]}))
+	}
+
+	// The interval excludes the start and includes the end.
+	got, err = adp.UserGetOffline(now.Add(time.Minute), types.ZeroUid, now.Add(2*time.Minute), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Id != users[1].Id {
+		t.Error(mismatchErrorString("Offline users", got, []*types.User{users[1]}))
+	}
+
+	got, err = adp.UserGetOffline(now, types.ZeroUid, now.Add(time.Hour), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Id != users[0].Id {
+		t.Error(mismatchErrorString("Limited offline users", got, []*types.User{users[0]}))
+	}
+
+	// The next page starts after the last user of the previous page.
+	got, err = adp.UserGetOffline(now.Add(time.Minute), types.ParseUserId("usr"+users[0].Id), now.Add(time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Id != users[1].Id {
+		t.Error(mismatchErrorString("Next page of offline users", got, []*types.User{users[1]}))
+	}
+}
+
 func TestUserGetByCred(t *testing.T) {
 	// Test not found
 	got, err := adp.UserGetByCred("foo", "bar")
@@ -45,7 +45,7 @@ const (
 	defaultDSN      = "root:@tcp(localhost:3306)/tinode?parseTime=true"
 	defaultDatabase = "tinode"
 
-	adpVersion = 115
+	adpVersion = 116
 
 	adapterName = "mysql"
 
@@ -336,9 +336,14 @@ func (a *adapter) CreateDb(reset bool) error {
 			public    JSON,
 			trusted   JSON,
 			tags      JSON,
+			legalhold JSON,
+			notifyprefs JSON,
+			unionid     VARCHAR(64) NOT NULL DEFAULT '',
+			feishuappid VARCHAR(64) NOT NULL DEFAULT '',
 			PRIMARY KEY(id),
 			INDEX users_state_stateat(state, stateat),
-			INDEX users_lastseen_updatedat(lastseen, updatedat)
+			INDEX users_lastseen_updatedat(lastseen, updatedat),
+			INDEX users_unionid(unionid)
 		)`); err != nil {
 		return err
 	}
@@ -411,6 +416,8 @@ func (a *adapter) CreateDb(reset bool) error {
 			trusted   JSON,
 			tags      JSON,
 			aux       JSON,
+			retention JSON,
+			legalhold JSON,
 			PRIMARY KEY(id),
 			UNIQUE INDEX topics_name(name),
 			INDEX topics_owner(owner),
@@ -475,9 +482,28 @@ func (a *adapter) CreateDb(reset bool) error {
 			"`from`   BIGINT NOT NULL," +
 			`head     JSON,
 			content   JSON,
+			expireperiod INT DEFAULT -1,
+			expiredat DATETIME(3),
 			PRIMARY KEY(id),
 			FOREIGN KEY(topic) REFERENCES topics(name),
-			UNIQUE INDEX messages_topic_seqid(topic, seqid)
+			UNIQUE INDEX messages_topic_seqid(topic, seqid),
+			INDEX messages_expiredat(expiredat)
+		);`); err != nil {
+		return err
+	}
+
+	// Expiration of messages for individual recipients.
+	if _, err = tx.Exec(
+		`CREATE TABLE msgexpiry(
+			id        INT NOT NULL AUTO_INCREMENT,
+			topic     CHAR(25) NOT NULL,
+			seqid     INT NOT NULL,
+			userid    BIGINT NOT NULL,
+			expiredat DATETIME(3) NOT NULL,
+			PRIMARY KEY(id),
+			UNIQUE INDEX msgexpiry_topic_seqid_userid(topic,seqid,userid),
+			INDEX msgexpiry_expiredat(expiredat),
+			INDEX msgexpiry_userid(userid)
 		);`); err != nil {
 		return err
 	}
@@ -572,6 +598,18 @@ func (a *adapter) CreateDb(reset bool) error {
 		return err
 	}
 
+	// Feishu apps used for sending notifications.
+	if _, err = tx.Exec(
+		`CREATE TABLE feishuapp(
+			appid     VARCHAR(64) NOT NULL,
+			appsecret VARCHAR(255) NOT NULL,
+			baseurl   VARCHAR(255) NOT NULL DEFAULT '',
+			state     SMALLINT NOT NULL DEFAULT 1,
+			PRIMARY KEY(appid)
+		)`); err != nil {
+		return err
+	}
+
 	// Find relevant subscriptions for given users efficiently, and use the join key too.
 	if _, err = tx.Exec("CREATE INDEX idx_subs_user_topic_del ON subscriptions(userid, topic, deletedat)"); err != nil {
 		return err
@@ -822,6 +860,93 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 115 {
+		// Perform database upgrade from version 115 to version 116.
+
+		// Topic-level message retention policy.
+		if _, err := a.db.Exec("ALTER TABLE topics ADD retention JSON"); err != nil {
+			return err
+		}
+
+		// Legal hold on users and topics.
+		if _, err := a.db.Exec("ALTER TABLE users ADD legalhold JSON"); err != nil {
+			return err
+		}
+		if _, err := a.db.Exec("ALTER TABLE topics ADD legalhold JSON"); err != nil {
+			return err
+		}
+
+		// Push notification preferences of users.
+		if _, err := a.db.Exec("ALTER TABLE users ADD notifyprefs JSON"); err != nil {
+			return err
+		}
+
+		// Index for loading messages which are about to expire.
+		if _, err := a.db.Exec("CREATE INDEX messages_expiredat ON messages(expiredat)"); err != nil {
+			return err
+		}
+
+		// Expiration of messages for individual recipients.
+		if _, err := a.db.Exec(
+			`CREATE TABLE msgexpiry(
+				id        INT NOT NULL AUTO_INCREMENT,
+				topic     CHAR(25) NOT NULL,
+				seqid     INT NOT NULL,
+				userid    BIGINT NOT NULL,
+				expiredat DATETIME(3) NOT NULL,
+				PRIMARY KEY(id),
+				UNIQUE INDEX msgexpiry_topic_seqid_userid(topic,seqid,userid),
+				INDEX msgexpiry_expiredat(expiredat),
+				INDEX msgexpiry_userid(userid)
+			)`); err != nil {
+			return err
+		}
+
+		// Feishu apps, the table could have been created manually.
+		if _, err := a.db.Exec(
+			`CREATE TABLE IF NOT EXISTS feishuapp(
+				appid     VARCHAR(64) NOT NULL,
+				appsecret VARCHAR(255) NOT NULL,
+				state     SMALLINT NOT NULL DEFAULT 1,
+				PRIMARY KEY(appid)
+			)`); err != nil {
+			return err
+		}
+		// Feishu API endpoint of the app, empty for the default.
+		if _, err := a.db.Exec("ALTER TABLE feishuapp ADD baseurl VARCHAR(255) NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+
+		// Feishu user and app the user is linked to. The columns could have been created manually.
+		for _, col := range []string{"unionid", "feishuappid"} {
+			var count int
+			if err := a.db.Get(&count, "SELECT COUNT(*) FROM information_schema.columns "+
+				"WHERE table_schema=? AND table_name='users' AND column_name=?", a.dbName, col); err != nil {
+				return err
+			}
+			if count == 0 {
+				if _, err := a.db.Exec("ALTER TABLE users ADD " + col + " VARCHAR(64) NOT NULL DEFAULT ''"); err != nil {
+					return err
+				}
+			}
+		}
+		// Users are looked up by Feishu union ID when logging in and syncing the directory.
+		var count int
+		if err := a.db.Get(&count, "SELECT COUNT(*) FROM information_schema.statistics "+
+			"WHERE table_schema=? AND table_name='users' AND index_name='users_unionid'", a.dbName); err != nil {
+			return err
+		}
+		if count == 0 {
+			if _, err := a.db.Exec("CREATE INDEX users_unionid ON users(unionid)"); err != nil {
+				return err
+			}
+		}
+
+		if err := bumpVersion(a, 116); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -903,11 +1028,13 @@ func (a *adapter) UserCreate(user *t.User) error {
 	}()
 
 	decoded_uid := store.DecodeUid(user.Uid())
-	if _, err = tx.Exec("INSERT INTO users(id,createdat,updatedat,state,access,public,trusted,tags) VALUES(?,?,?,?,?,?,?,?)",
+	if _, err = tx.Exec("INSERT INTO users(id,createdat,updatedat,state,access,public,trusted,tags,unionid,feishuappid) "+
+		"VALUES(?,?,?,?,?,?,?,?,?,?)",
 		decoded_uid,
 		user.CreatedAt, user.UpdatedAt,
 		user.State, user.Access,
-		common.ToJSON(user.Public), common.ToJSON(user.Trusted), user.Tags); err != nil {
+		common.ToJSON(user.Public), common.ToJSON(user.Trusted), user.Tags,
+		user.UnionId, user.FeishuAppId); err != nil {
 		return err
 	}
 
@@ -1155,6 +1282,18 @@ func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
 	decoded_uid := store.DecodeUid(uid)
 
 	if hard {
+		// Users under legal hold and owners of topics under legal hold cannot be purged.
+		var held bool
+		if err = tx.Get(&held, "SELECT EXISTS(SELECT 1 FROM users WHERE id=? AND legalhold IS NOT NULL) OR "+
+			"EXISTS(SELECT 1 FROM topics AS tp WHERE tp.owner=? AND "+topicOnHoldSql("tp.name")+")",
+			decoded_uid, decoded_uid); err != nil {
+			return err
+		}
+		if held {
+			err = t.ErrPolicy
+			return err
+		}
+
 		// Delete user's devices
 		// t.ErrNotFound = user has no devices.
 		if err = deviceDelete(tx, uid, ""); err != nil && err != t.ErrNotFound {
@@ -1171,6 +1310,11 @@ func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
 			return err
 		}
 
+		// Delete pending expirations of messages for the user.
+		if _, err = tx.Exec("DELETE FROM msgexpiry WHERE userid=?", decoded_uid); err != nil {
+			return err
+		}
+
 		// Can't delete user's messages in all topics because we cannot notify topics of such deletion.
 		// Just leave the messages there marked as sent by "not found" user.
 
@@ -1181,6 +1325,10 @@ func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
 			decoded_uid); err != nil {
 			return err
 		}
+		if _, err = tx.Exec("DELETE msgexpiry FROM msgexpiry LEFT JOIN topics ON topics.name=msgexpiry.topic WHERE topics.owner=?",
+			decoded_uid); err != nil {
+			return err
+		}
 		if _, err = tx.Exec("DELETE messages FROM messages LEFT JOIN topics ON topics.name=messages.topic WHERE topics.owner=?",
 			decoded_uid); err != nil {
 			return err
@@ -1419,6 +1567,26 @@ func (a *adapter) UserGetByCred(method, value string) (t.Uid, error) {
 	return t.ZeroUid, err
 }
 
+// UserGetByUnionId returns ID of the active user linked to the given Feishu union ID.
+func (a *adapter) UserGetByUnionId(unionId string) (t.Uid, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var decoded_uid int64
+	err := a.db.GetContext(ctx, &decoded_uid, "SELECT id FROM users WHERE unionid=? AND state!=? LIMIT 1",
+		unionId, t.StateDeleted)
+	if err == nil {
+		return store.EncodeUid(decoded_uid), nil
+	}
+
+	if err == sql.ErrNoRows {
+		// Clear the error if user does not exist
+		return t.ZeroUid, nil
+	}
+	return t.ZeroUid, err
+}
+
 // UserUnreadCount returns the total number of unread messages in all topics with
 // the R permission. If read fails, the counts are still returned with the original
 // user IDs but with the unread count undefined and non-nil error.
@@ -1496,14 +1664,60 @@ func (a *adapter) UserGetUnvalidated(lastUpdatedBefore time.Time, limit int) ([]
 	return uids, err
 }
 
+// UserGetOffline returns active users last seen within the (lastSeenAfter, lastSeenBefore] interval
+// or at lastSeenAfter with ID greater than afterId.
+func (a *adapter) UserGetOffline(lastSeenAfter time.Time, afterId t.Uid, lastSeenBefore time.Time, limit int) ([]t.User, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	after := "lastseen>?"
+	args := []any{t.StateOK, lastSeenAfter}
+	if !afterId.IsZero() {
+		// Continue after the last user of the previous page.
+		after = "(lastseen>? OR (lastseen=? AND id>?))"
+		args = append(args, lastSeenAfter, store.DecodeUid(afterId))
+	}
+	args = append(args, lastSeenBefore, limit)
+
+	rows, err := a.db.QueryxContext(ctx,
+		"SELECT * FROM users WHERE state=? AND "+after+" AND lastseen<=? ORDER BY lastseen ASC, id ASC LIMIT ?",
+		args...)
+	if err != nil {
+		return nil, err
+	}
+
+	users := []t.User{}
+	for rows.Next() {
+		var user t.User
+		if err = rows.StructScan(&user); err != nil {
+			users = nil
+			break
+		}
+
+		user.SetUid(common.EncodeUidString(user.Id))
+		user.Public = common.FromJSON(user.Public)
+		user.Trusted = common.FromJSON(user.Trusted)
+
+		users = append(users, user)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return users, err
+}
+
 // *****************************
 
 func (a *adapter) topicCreate(tx *sqlx.Tx, topic *t.Topic) error {
-	_, err := tx.Exec("INSERT INTO topics(createdat,updatedat,touchedat,state,name,usebt,owner,access,public,trusted,tags,aux) "+
-		"VALUES(?,?,?,?,?,?,?,?,?,?,?,?)",
+	_, err := tx.Exec("INSERT INTO topics(createdat,updatedat,touchedat,state,name,usebt,owner,access,public,trusted,tags,aux,retention) "+
+		"VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?)",
 		topic.CreatedAt, topic.UpdatedAt, topic.TouchedAt, topic.State, topic.Id, topic.UseBt,
 		store.DecodeUid(t.ParseUid(topic.Owner)), topic.Access, common.ToJSON(topic.Public), common.ToJSON(topic.Trusted),
-		topic.Tags, common.ToJSON(topic.Aux))
+		topic.Tags, common.ToJSON(topic.Aux), topic.Retention)
 	if err != nil {
 		return err
 	}
@@ -1611,7 +1825,7 @@ func (a *adapter) TopicGet(topic string) (*t.Topic, error) {
 	// Fetch topic by name
 	var tt = new(t.Topic)
 	err := a.db.GetContext(ctx, tt,
-		"SELECT createdat,updatedat,state,stateat,touchedat,name AS id,usebt,access,owner,seqid,delid,public,trusted,tags,aux "+
+		"SELECT createdat,updatedat,state,stateat,touchedat,name AS id,usebt,access,owner,seqid,delid,public,trusted,tags,aux,retention,legalhold "+
 			"FROM topics WHERE name=?",
 		topic)
 
@@ -2067,6 +2281,15 @@ func (a *adapter) TopicDelete(topic string, isChan, hard bool) error {
 		args = append(args, t.GrpToChn(topic))
 	}
 
+	if hard {
+		// Topics under legal hold are only marked as deleted.
+		var held bool
+		if held, err = topicOnHold(tx, topic); err != nil {
+			return err
+		}
+		hard = !held
+	}
+
 	if hard {
 		// Delete subscriptions. If this is a channel, delete both group subscriptions and channel subscriptions.
 		q, args, _ := sqlx.In("DELETE FROM subscriptions WHERE topic IN (?)", args)
@@ -2564,9 +2787,9 @@ func (a *adapter) MessageSave(msg *t.Message) error {
 	// Using a sequential ID provided by the database.
 	res, err := a.db.ExecContext(
 		ctx,
-		"INSERT INTO messages(createdAt,updatedAt,seqid,topic,`from`,head,content,expireperiod) VALUES(?,?,?,?,?,?,?,?)",
+		"INSERT INTO messages(createdAt,updatedAt,seqid,topic,`from`,head,content,expireperiod,expiredat) VALUES(?,?,?,?,?,?,?,?,?)",
 		msg.CreatedAt, msg.UpdatedAt, msg.SeqId, msg.Topic,
-		store.DecodeUid(t.ParseUid(msg.From)), msg.Head, common.ToJSON(msg.Content), msg.ExpirePeriod)
+		store.DecodeUid(t.ParseUid(msg.From)), msg.Head, common.ToJSON(msg.Content), msg.ExpirePeriod, msg.ExpiredAt)
 	if err == nil {
 		id, _ := res.LastInsertId()
 		// Replacing ID given by store by ID given by the DB.
@@ -2722,12 +2945,42 @@ func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOp
 	return dmsgs, err
 }
 
+// Condition which is true if the topic is under legal hold: either the topic itself or any of its subscribers.
+// The argument is an expression which evaluates to the name of the topic.
+func topicOnHoldSql(topic string) string {
+	return "(EXISTS(SELECT 1 FROM topics AS th WHERE th.name=" + topic + " AND th.legalhold IS NOT NULL) OR " +
+		"EXISTS(SELECT 1 FROM subscriptions AS sh INNER JOIN users AS uh ON uh.id=sh.userid " +
+		"WHERE sh.topic=" + topic + " AND uh.legalhold IS NOT NULL))"
+}
+
+// topicOnHold checks if the topic is under legal hold.
+func topicOnHold(tx *sqlx.Tx, topic string) (bool, error) {
+	var held bool
+	err := tx.Get(&held, "SELECT "+topicOnHoldSql("?"), topic, topic)
+	return held, err
+}
+
+// purgeRetained clears content of deleted messages which was retained because of a legal hold.
+// Messages still under hold are not affected.
+func purgeRetained(tx *sqlx.Tx, where string, args ...any) error {
+	where = "m.deletedat IS NOT NULL AND m.content IS NOT NULL AND " + where + " AND NOT " + topicOnHoldSql("m.topic")
+	_, err := tx.Exec("DELETE fml.* FROM filemsglinks AS fml INNER JOIN messages AS m ON m.id=fml.msgid WHERE "+
+		where, args...)
+	if err == nil {
+		_, err = tx.Exec("UPDATE messages AS m SET m.`from`=0,m.head=NULL,m.content=NULL WHERE "+where, args...)
+	}
+	return err
+}
+
 func messageDeleteList(tx *sqlx.Tx, topic string, toDel *t.DelMessage) error {
 	var err error
 
 	if toDel == nil {
 		// Whole topic is being deleted, thus also deleting all messages.
 		_, err = tx.Exec("DELETE FROM dellog WHERE topic=?", topic)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM msgexpiry WHERE topic=?", topic)
+		}
 		if err == nil {
 			_, err = tx.Exec("DELETE FROM messages WHERE topic=?", topic)
 		}
@@ -2783,20 +3036,45 @@ func messageDeleteList(tx *sqlx.Tx, topic string, toDel *t.DelMessage) error {
 
 		// No need to add anything else: deletedat etc is already accounted for.
 
-		_, err = tx.Exec("DELETE fml.* FROM filemsglinks AS fml INNER JOIN messages AS m ON m.id=fml.msgid WHERE "+
-			where, args...)
-		if err != nil {
+		// Content of messages under legal hold is retained.
+		var held bool
+		if held, err = topicOnHold(tx, topic); err != nil {
 			return err
 		}
 
-		// Instead of deleting messages, clear all content.
-		_, err = tx.Exec("UPDATE messages AS m SET m.deletedat=?,m.delId=?,m.`from`=0,m.head=NULL,m.content=NULL WHERE "+
-			where, append([]any{t.TimeNow(), toDel.DelId}, args...)...)
+		if held {
+			_, err = tx.Exec("UPDATE messages AS m SET m.deletedat=?,m.delId=?,m.expiredat=NULL WHERE "+
+				where, append([]any{t.TimeNow(), toDel.DelId}, args...)...)
+		} else {
+			_, err = tx.Exec("DELETE fml.* FROM filemsglinks AS fml INNER JOIN messages AS m ON m.id=fml.msgid WHERE "+
+				where, args...)
+			if err != nil {
+				return err
+			}
+
+			// Instead of deleting messages, clear all content.
+			_, err = tx.Exec("UPDATE messages AS m SET m.deletedat=?,m.delId=?,m.`from`=0,m.head=NULL,m.content=NULL,m.expiredat=NULL WHERE "+
+				where, append([]any{t.TimeNow(), toDel.DelId}, args...)...)
+		}
 		if err != nil {
 			return err
 		}
 	}
 
+	// Pending expirations of the deleted messages are no longer needed.
+	if len(delRanges) > 0 {
+		where := "topic=?"
+		args := []any{topic}
+		if toDel.DeletedFor != "" {
+			where += " AND userid=?"
+			args = append(args, common.DecodeUidString(toDel.DeletedFor))
+		}
+		rSql, rArgs := common.RangesToSql(delRanges)
+		if _, err = tx.Exec("DELETE FROM msgexpiry WHERE "+where+" AND seqid "+rSql, append(args, rArgs...)...); err != nil {
+			return err
+		}
+	}
+
 	// Now make log entries. Needed for both hard- and soft-deleting.
 	var insert *sql.Stmt
 	if insert, err = tx.Prepare(
@@ -2884,8 +3162,10 @@ func (a *adapter) MessageListByTopicSeqIdRange(topic string, forUser t.Uid, seqI
 		ctx,
 		"SELECT *"+
 			" FROM messages"+
-			" WHERE topic=? AND seqid between ? and ? and deletedat is null and expireperiod > 0 and expiredat is null and `from`!=?",
-		topic, seqIdStart, seqIdEnd, unum)
+			" WHERE topic=? AND seqid between ? and ? and deletedat is null and expireperiod > 0 and `from`!=?"+
+			// Messages not read yet or expiring at the end of lifetime later than they would after being read now.
+			" and (expiredat is null or expiredat > ? + INTERVAL expireperiod SECOND)",
+		topic, seqIdStart, seqIdEnd, unum, t.TimeNow())
 
 	if err != nil {
 		return nil, err
@@ -2919,39 +3199,194 @@ func (a *adapter) MessageUpdate(topic string, seqId int, expired time.Time) erro
 	return err
 }
 
-// MessageExpiredList return all expired message
-func (a *adapter) MessageExpiredList() ([]t.Message, error) {
+// MessageExpiredList returns up to limit messages which expire before the given time, ordered by expiration
+// time, topic and seq ID, starting after the given position or from the beginning if after is nil.
+func (a *adapter) MessageExpiredList(after *t.MessageExpiry, before time.Time, limit int) ([]t.MessageExpiry, error) {
 	ctx, cancel := a.getContext()
 	if cancel != nil {
 		defer cancel()
 	}
 
-	rows, err := a.db.QueryxContext(
-		ctx,
-		"SELECT *"+
-			" FROM messages"+
-			" WHERE deletedat is null and expireperiod > 0 and expiredat <= UTC_TIMESTAMP()"+
-			" Order by topic, seqid")
+	query := "SELECT topic,seqid,expiredat FROM messages WHERE expiredat<? AND deletedat IS NULL"
+	args := []any{before}
+	if after != nil {
+		query += " AND (expiredat>? OR expiredat=? AND (topic>? OR topic=? AND seqid>?))"
+		args = append(args, after.ExpiredAt, after.ExpiredAt, after.Topic, after.Topic, after.SeqId)
+	}
+	query += " ORDER BY expiredat,topic,seqid LIMIT ?"
+	args = append(args, limit)
 
+	rows, err := a.db.QueryxContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 
-	var msgs []t.Message
+	var exps []t.MessageExpiry
 	for rows.Next() {
-		var msg t.Message
-		if err = rows.StructScan(&msg); err != nil {
+		var exp t.MessageExpiry
+		if err = rows.Scan(&exp.Topic, &exp.SeqId, &exp.ExpiredAt); err != nil {
 			break
 		}
-		msg.From = encodeUidString(msg.From).String()
-		msg.Content = fromJSON(msg.Content)
-		msgs = append(msgs, msg)
+		exps = append(exps, exp)
 	}
 	if err == nil {
 		err = rows.Err()
 	}
 	rows.Close()
-	return msgs, err
+	return exps, err
+}
+
+// UserSetLegalHold places (hold is not nil) or releases (hold is nil) legal hold on the user's conversations.
+// When the hold is released, content retained in deleted messages which are no longer under hold is purged.
+func (a *adapter) UserSetLegalHold(uid t.Uid, hold *t.LegalHold) (err error) {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	decoded_uid := store.DecodeUid(uid)
+	res, err := tx.Exec("UPDATE users SET updatedat=?,legalhold=? WHERE id=?", t.TimeNow(), hold, decoded_uid)
+	if err != nil {
+		return err
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		err = t.ErrNotFound
+		return err
+	}
+
+	if hold == nil {
+		if err = purgeRetained(tx, "m.topic IN (SELECT topic FROM subscriptions WHERE userid=?)", decoded_uid); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// TopicSetLegalHold places (hold is not nil) or releases (hold is nil) legal hold on the topic.
+// When the hold is released, content retained in deleted messages which are no longer under hold is purged.
+func (a *adapter) TopicSetLegalHold(topic string, hold *t.LegalHold) (err error) {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	res, err := tx.Exec("UPDATE topics SET updatedat=?,legalhold=? WHERE name=?", t.TimeNow(), hold, topic)
+	if err != nil {
+		return err
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		err = t.ErrNotFound
+		return err
+	}
+
+	if hold == nil {
+		if err = purgeRetained(tx, "m.topic=?", topic); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// MessageAttachments returns IDs of files attached to messages in the topic with seq IDs within the ranges.
+func (a *adapter) MessageAttachments(topic string, ranges []t.Range) ([]string, error) {
+	if len(ranges) == 0 {
+		return nil, nil
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	rSql, rArgs := common.RangesToSql(ranges)
+	var ids []int64
+	if err := a.db.SelectContext(ctx, &ids, "SELECT DISTINCT fml.fileid FROM filemsglinks AS fml "+
+		"INNER JOIN messages AS m ON m.id=fml.msgid WHERE m.topic=? AND m.seqid "+rSql,
+		append([]any{topic}, rArgs...)...); err != nil {
+		return nil, err
+	}
+
+	fids := make([]string, len(ids))
+	for i, id := range ids {
+		fids[i] = store.EncodeUid(id).String()
+	}
+	return fids, nil
+}
+
+// MessageExpireForUser sets the time when the message expires for the given user only.
+// If the expiration time is already set, it's not changed.
+func (a *adapter) MessageExpireForUser(topic string, forUser t.Uid, seqId int, expired time.Time) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.ExecContext(ctx, "INSERT IGNORE INTO msgexpiry(topic,seqid,userid,expiredat) VALUES(?,?,?,?)",
+		topic, seqId, store.DecodeUid(forUser), expired)
+
+	return err
+}
+
+// MessageExpiredForUserList returns up to limit per-user message expirations which are due before the given time,
+// ordered by expiration time, topic, seq ID and user, starting after the given position or from the beginning
+// if after is nil.
+func (a *adapter) MessageExpiredForUserList(after *t.MessageExpiry, before time.Time, limit int) ([]t.MessageExpiry, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	query := "SELECT topic,seqid,userid,expiredat FROM msgexpiry WHERE expiredat<?"
+	args := []any{before}
+	if after != nil {
+		userId := store.DecodeUid(t.ParseUid(after.User))
+		query += " AND (expiredat>? OR expiredat=? AND (topic>? OR topic=? AND (seqid>? OR seqid=? AND userid>?)))"
+		args = append(args, after.ExpiredAt, after.ExpiredAt, after.Topic, after.Topic, after.SeqId, after.SeqId, userId)
+	}
+	query += " ORDER BY expiredat,topic,seqid,userid LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := a.db.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var exps []t.MessageExpiry
+	for rows.Next() {
+		var exp t.MessageExpiry
+		var userId int64
+		if err = rows.Scan(&exp.Topic, &exp.SeqId, &userId, &exp.ExpiredAt); err != nil {
+			break
+		}
+		exp.User = store.EncodeUid(userId).String()
+		exps = append(exps, exp)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	return exps, err
 }
 
 func (a *adapter) MessageUpdateMissExpired() error {
@@ -2961,6 +3396,7 @@ func (a *adapter) MessageUpdateMissExpired() error {
 	}
 	_, err := a.db.ExecContext(ctx, "UPDATE messages "+
 		"LEFT JOIN subscriptions ON messages.topic = subscriptions.topic "+
+		"LEFT JOIN topics ON messages.topic = topics.name "+
 		"SET expiredat = subscriptions.updatedat + INTERVAL messages.expireperiod SECOND "+
 		"WHERE "+
 		"messages.`from` != subscriptions.userid "+
@@ -2968,7 +3404,28 @@ func (a *adapter) MessageUpdateMissExpired() error {
 		"AND messages.deletedat IS NULL "+
 		"AND messages.expiredat IS NULL "+
 		"AND subscriptions.topic IS NOT NULL "+
-		"AND messages.expireperiod != - 1 ")
+		"AND messages.expireperiod != - 1 "+
+		// Only topics where the first reader starts the countdown.
+		"AND COALESCE(JSON_UNQUOTE(JSON_EXTRACT(topics.retention, '$.Trigger')), '') IN ('', 'first')")
+
+	return err
+}
+
+// MessageApplyLifetime makes messages in the topic expire no later than lifetime seconds after being sent.
+// If topic is empty, the lifetime is applied to messages in all topics.
+func (a *adapter) MessageApplyLifetime(topic string, lifetime int) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	where := "deletedat IS NULL AND (expiredat IS NULL OR expiredat>createdat + INTERVAL ? SECOND)"
+	args := []any{lifetime, lifetime}
+	if topic != "" {
+		where += " AND topic=?"
+		args = append(args, topic)
+	}
+	_, err := a.db.ExecContext(ctx, "UPDATE messages SET expiredat=createdat + INTERVAL ? SECOND WHERE "+where, args...)
 
 	return err
 }
@@ -3514,6 +3971,74 @@ func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, er
 	return locations, tx.Commit()
 }
 
+// FileDeleteIfUnused deletes records of the given files which are not linked to any message, topic or user.
+// Returns array of FileDef.Location of deleted filerecords so actual files can be deleted too.
+func (a *adapter) FileDeleteIfUnused(fids []string) ([]string, error) {
+	var dids []any
+	for _, fid := range fids {
+		id := t.ParseUid(fid)
+		if id.IsZero() {
+			return nil, t.ErrMalformed
+		}
+		dids = append(dids, store.DecodeUid(id))
+	}
+	if len(dids) == 0 {
+		return nil, nil
+	}
+
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	query, args, _ := sqlx.In("SELECT fu.id,fu.location FROM fileuploads AS fu "+
+		"LEFT JOIN filemsglinks AS fml ON fml.fileid=fu.id WHERE fml.id IS NULL AND fu.id IN (?)", dids)
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var locations []string
+	var ids []any
+	for rows.Next() {
+		var id int64
+		var loc string
+		if err = rows.Scan(&id, &loc); err != nil {
+			break
+		}
+		if loc != "" {
+			locations = append(locations, loc)
+		}
+		ids = append(ids, id)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) > 0 {
+		query, ids, _ = sqlx.In("DELETE FROM fileuploads WHERE id IN (?)", ids)
+		if _, err = tx.Exec(query, ids...); err != nil {
+			return nil, err
+		}
+	}
+
+	return locations, tx.Commit()
+}
+
 // FileLinkAttachments connects given topic or message to the file record IDs from the list.
 func (a *adapter) FileLinkAttachments(topic string, userId, msgId t.Uid, fids []string) error {
 	if len(fids) == 0 || (topic == "" && msgId.IsZero() && userId.IsZero()) {
@@ -3753,7 +4278,7 @@ func (a *adapter) FeishuAppGetAll() ([]t.FeishuApp, error) {
 
 	rows, err := a.db.QueryxContext(
 		ctx,
-		"SELECT appid, appsecret FROM feishuapp WHERE state = 1")
+		"SELECT appid, appsecret, baseurl FROM feishuapp WHERE state = 1")
 
 	if err != nil {
 		return nil, err
@@ -3773,6 +4298,64 @@ func (a *adapter) FeishuAppGetAll() ([]t.FeishuApp, error) {
 	return feishuApps, err
 }
 
+// FeishuAppCreate adds a new Feishu app.
+func (a *adapter) FeishuAppCreate(app *t.FeishuApp) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	_, err := a.db.ExecContext(ctx, "INSERT INTO feishuapp(appid,appsecret,baseurl,state) VALUES(?,?,?,1)",
+		app.AppId, app.AppSecret, app.BaseUrl)
+	if isDupe(err) {
+		return t.ErrDuplicate
+	}
+	return err
+}
+
+// FeishuAppUpdate replaces credentials and endpoint of an existing Feishu app.
+func (a *adapter) FeishuAppUpdate(app *t.FeishuApp) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	res, err := a.db.ExecContext(ctx, "UPDATE feishuapp SET appsecret=?,baseurl=? WHERE appid=? AND state=1",
+		app.AppSecret, app.BaseUrl, app.AppId)
+	if err != nil {
+		return err
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		// MySQL reports zero rows affected if nothing has changed.
+		var found int
+		if err = a.db.GetContext(ctx, &found, "SELECT COUNT(*) FROM feishuapp WHERE appid=? AND state=1",
+			app.AppId); err != nil {
+			return err
+		}
+		if found == 0 {
+			return t.ErrNotFound
+		}
+	}
+	return nil
+}
+
+// FeishuAppDelete deletes a Feishu app.
+func (a *adapter) FeishuAppDelete(appId string) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	res, err := a.db.ExecContext(ctx, "DELETE FROM feishuapp WHERE appid=?", appId)
+	if err != nil {
+		return err
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return t.ErrNotFound
+	}
+	return nil
+}
+
 func init() {
 	store.RegisterAdapter(&adapter{})
 }
@@ -25,6 +25,14 @@ CREATE TABLE kvmeta(
 
 INSERT INTO kvmeta(`key`, `value`) VALUES("version", "100");
 
+CREATE TABLE feishuapp(
+	appid		VARCHAR(64) NOT NULL,
+	appsecret	VARCHAR(255) NOT NULL,
+	baseurl		VARCHAR(255) NOT NULL DEFAULT '',
+	state		SMALLINT NOT NULL DEFAULT 1,
+	PRIMARY KEY(appid)
+);
+
 CREATE TABLE users(
 	id 			BIGINT NOT NULL,
 	createdat 	DATETIME(3) NOT NULL,
@@ -36,6 +44,10 @@ CREATE TABLE users(
 	useragent 	VARCHAR(255) DEFAULT '',
 	public 		JSON,
 	tags		JSON, -- Denormalized array of tags
+	legalhold	JSON,
+	notifyprefs	JSON, -- Push notification preferences
+	unionid		VARCHAR(64) NOT NULL DEFAULT '', -- Feishu union_id of the user
+	feishuappid	VARCHAR(64) NOT NULL DEFAULT '', -- Feishu app the user is linked to
 
 	PRIMARY KEY(id),
 	INDEX users_state_stateat(state, stateat),
@@ -104,6 +116,8 @@ CREATE TABLE topics(
 	trusted	JSON,
 	tags		JSON, -- Denormalized array of tags
 	aux			JSON,
+	retention	JSON,
+	legalhold	JSON,
 
 	PRIMARY KEY(id),
 	UNIQUE INDEX topics_name (name),
@@ -157,10 +171,13 @@ CREATE TABLE messages(
 	`from` 		BIGINT NOT NULL,
 	head 		JSON,
 	content 	JSON,
+	expireperiod INT DEFAULT -1,
+	expiredat 	DATETIME(3),
 
 	PRIMARY KEY(id),
 	FOREIGN KEY(topic) REFERENCES topics(name),
-	UNIQUE INDEX messages_topic_seqid (topic, seqid)
+	UNIQUE INDEX messages_topic_seqid (topic, seqid),
+	INDEX messages_expiredat (expiredat)
 );
 
 # Deletion log
@@ -182,6 +199,22 @@ CREATE TABLE dellog(
 	INDEX dellog_deletedfor(deletedfor)
 );
 
+# Expiration of messages for individual recipients
+CREATE TABLE msgexpiry(
+	id			INT NOT NULL AUTO_INCREMENT,
+	topic		CHAR(25) NOT NULL,
+	seqid		INT NOT NULL,
+	userid		BIGINT NOT NULL,
+	expiredat	DATETIME(3) NOT NULL,
+
+	PRIMARY KEY(id),
+	UNIQUE INDEX msgexpiry_topic_seqid_userid(topic,seqid,userid),
+	# For loading expirations which are due soon
+	INDEX msgexpiry_expiredat(expiredat),
+	# Used when deleting a user
+	INDEX msgexpiry_userid(userid)
+);
+
 # User credentials
 CREATE TABLE credentials(
 	id			INT NOT NULL AUTO_INCREMENT,
@@ -0,0 +1,190 @@
+//go:build mysql
+// +build mysql
+
+// Integration tests of the MySQL adapter. They need a running MySQL server configured in test.conf
+// and are skipped if the database cannot be opened. Run with:
+//
+//	go test -tags mysql ./db/mysql/tests -config=./test.conf
+package tests
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	adapter "github.com/tinode/chat/server/db"
+	_ "github.com/tinode/chat/server/db/mysql"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+	jcr "github.com/tinode/jsonco"
+)
+
+var adp adapter.Adapter
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	conffile := flag.String("config", "./test.conf", "config of the database connection")
+	flag.Parse()
+
+	var config json.RawMessage
+	if file, err := os.Open(*conffile); err != nil {
+		logs.Err.Fatal("Failed to read config file:", err)
+	} else if err = json.NewDecoder(jcr.New(file)).Decode(&config); err != nil {
+		logs.Err.Fatal("Failed to parse config file:", err)
+	}
+
+	if err := store.Store.InitDb(config, true); err != nil {
+		logs.Info.Println("Skipping mysql tests, database is not available:", err)
+		os.Exit(0)
+	}
+	adp = store.Store.GetAdapter()
+	code := m.Run()
+	store.Store.Close()
+	os.Exit(code)
+}
+
+func TestLegalHold(tt *testing.T) {
+	now := types.TimeNow()
+	owner := &types.User{Access: types.DefaultAccess{Auth: types.ModeCAuth, Anon: types.ModeNone}}
+	owner.SetUid(store.Store.GetUid())
+	owner.InitTimes()
+	if err := adp.UserCreate(owner); err != nil {
+		tt.Fatal(err)
+	}
+
+	topic := &types.Topic{Owner: owner.Id, Access: owner.Access}
+	topic.Id = "grp" + store.Store.GetUidString()
+	topic.InitTimes()
+	if err := adp.TopicCreate(topic); err != nil {
+		tt.Fatal(err)
+	}
+	sub := &types.Subscription{User: owner.Id, Topic: topic.Id, ModeWant: types.ModeCFull, ModeGiven: types.ModeCFull}
+	sub.InitTimes()
+	if err := adp.TopicShare([]*types.Subscription{sub}); err != nil {
+		tt.Fatal(err)
+	}
+	for seq := 1; seq <= 3; seq++ {
+		msg := &types.Message{Topic: topic.Id, From: owner.Id, SeqId: seq, Content: "message"}
+		msg.InitTimes()
+		if err := adp.MessageSave(msg); err != nil {
+			tt.Fatal(err)
+		}
+	}
+
+	if err := adp.TopicSetLegalHold(topic.Id, &types.LegalHold{By: owner.Id, At: now, Reason: "case 1"}); err != nil {
+		tt.Fatal(err)
+	}
+
+	// The owner of a topic under hold cannot be purged.
+	if err := adp.UserDelete(owner.Uid(), true); err != types.ErrPolicy {
+		tt.Fatal("hard-deleting owner of a topic under hold must fail, got", err)
+	}
+
+	// Messages are deleted for the users but the content is retained.
+	if err := adp.MessageDeleteList(topic.Id, &types.DelMessage{Topic: topic.Id, DelId: 1,
+		SeqIdRanges: []types.Range{{Low: 1}}}); err != nil {
+		tt.Fatal(err)
+	}
+	msgs, err := adp.MessageGetAll(topic.Id, owner.Uid(), nil)
+	if err != nil {
+		tt.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		tt.Error("deleted message must not be returned, got", len(msgs))
+	}
+
+	// The topic under hold is only marked as deleted.
+	if err := adp.TopicDelete(topic.Id, false, true); err != nil {
+		tt.Fatal(err)
+	}
+	stopic, err := adp.TopicGet(topic.Id)
+	if err != nil {
+		tt.Fatal(err)
+	}
+	if stopic == nil || stopic.State != types.StateDeleted {
+		tt.Fatal("topic under hold must be kept and marked as deleted", stopic)
+	}
+
+	// Once the hold is released, everything can be purged.
+	if err := adp.TopicSetLegalHold(topic.Id, nil); err != nil {
+		tt.Fatal(err)
+	}
+	if err := adp.TopicDelete(topic.Id, false, true); err != nil {
+		tt.Fatal(err)
+	}
+	if stopic, err = adp.TopicGet(topic.Id); err != nil || stopic != nil {
+		tt.Error("topic must be deleted after the hold is released", stopic, err)
+	}
+	if err := adp.UserDelete(owner.Uid(), true); err != nil {
+		tt.Error("user must be deleted after the hold is released", err)
+	}
+}
+
+func TestUserGetOffline(tt *testing.T) {
+	// Users last seen in the future don't interfere with the data of other tests.
+	base := types.TimeNow().Add(24 * time.Hour).Truncate(time.Second)
+	var uids []types.Uid
+	for i := 1; i <= 4; i++ {
+		user := &types.User{Access: types.DefaultAccess{Auth: types.ModeCAuth, Anon: types.ModeNone}}
+		user.SetUid(store.Store.GetUid())
+		user.InitTimes()
+		if err := adp.UserCreate(user); err != nil {
+			tt.Fatal(err)
+		}
+		// The last two users were seen at the same time.
+		if err := adp.UserUpdate(user.Uid(), map[string]any{"LastSeen": base.Add(time.Duration(min(i, 3)) * time.Minute)}); err != nil {
+			tt.Fatal(err)
+		}
+		uids = append(uids, user.Uid())
+	}
+	defer func() {
+		for _, uid := range uids {
+			adp.UserDelete(uid, true)
+		}
+	}()
+	// Deleted users are skipped.
+	if err := adp.UserDelete(uids[1], false); err != nil {
+		tt.Fatal(err)
+	}
+
+	ids := func(users []types.User) []types.Uid {
+		var ids []types.Uid
+		for i := range users {
+			ids = append(ids, users[i].Uid())
+		}
+		return ids
+	}
+
+	users, err := adp.UserGetOffline(base, types.ZeroUid, base.Add(time.Hour), 10)
+	if err != nil {
+		tt.Fatal(err)
+	}
+	if got := ids(users); !reflect.DeepEqual(got, []types.Uid{uids[0], uids[2], uids[3]}) {
+		tt.Error("expected active users ordered by last seen and ID, got", got)
+	}
+
+	// The interval excludes the start and includes the end.
+	if users, err = adp.UserGetOffline(base.Add(time.Minute), types.ZeroUid, base.Add(3*time.Minute), 1); err != nil {
+		tt.Fatal(err)
+	}
+	if got := ids(users); !reflect.DeepEqual(got, []types.Uid{uids[2]}) {
+		tt.Error("unexpected users", got)
+	}
+	// Users seen at the same time are paged by ID.
+	if users, err = adp.UserGetOffline(base.Add(3*time.Minute), uids[2], base.Add(time.Hour), 10); err != nil {
+		tt.Fatal(err)
+	}
+	if got := ids(users); !reflect.DeepEqual(got, []types.Uid{uids[3]}) {
+		tt.Error("users seen at the same time must not be skipped, got", got)
+	}
+	if users, err = adp.UserGetOffline(base, types.ZeroUid, base.Add(3*time.Minute), 1); err != nil {
+		tt.Fatal(err)
+	}
+	if got := ids(users); !reflect.DeepEqual(got, []types.Uid{uids[0]}) {
+		tt.Error("limit is not respected", got)
+	}
+}
@@ -47,7 +47,7 @@ type adapter struct {
 }
 
 const (
-	adpVersion  = 115
+	adpVersion  = 116
 	adapterName = "postgres"
 
 	defaultMaxResults = 1024
@@ -350,10 +350,13 @@ func (a *adapter) CreateDb(reset bool) error {
 			public    JSON,
 			trusted   JSON,
 			tags      JSON,
+			unionid     VARCHAR(64) NOT NULL DEFAULT '',
+			feishuappid VARCHAR(64) NOT NULL DEFAULT '',
 			PRIMARY KEY(id)
 		);
 		CREATE INDEX users_state_stateat ON users(state, stateat);
-		CREATE INDEX users_lastseen_updatedat ON users(lastseen, updatedat);`); err != nil {
+		CREATE INDEX users_lastseen_updatedat ON users(lastseen, updatedat);
+		CREATE INDEX users_unionid ON users(unionid);`); err != nil {
 		return err
 	}
 
@@ -586,6 +589,18 @@ func (a *adapter) CreateDb(reset bool) error {
 		return err
 	}
 
+	// Feishu apps used for sending notifications.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE feishuapp(
+			appid     VARCHAR(64) NOT NULL,
+			appsecret VARCHAR(255) NOT NULL,
+			baseurl   VARCHAR(255) NOT NULL DEFAULT '',
+			state     SMALLINT NOT NULL DEFAULT 1,
+			PRIMARY KEY(appid)
+		);`); err != nil {
+		return err
+	}
+
 	// Find relevant subscriptions for given users efficiently, and use the join key too.
 	if _, err = tx.Exec(ctx, "CREATE INDEX idx_subs_user_topic_del ON subscriptions(userid, topic, deletedat)"); err != nil {
 		return err
@@ -684,6 +699,40 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 115 {
+		// Perform database upgrade from version 115 to version 116.
+
+		// Feishu apps, the table could have been created manually.
+		if _, err := a.db.Exec(ctx,
+			`CREATE TABLE IF NOT EXISTS feishuapp(
+				appid     VARCHAR(64) NOT NULL,
+				appsecret VARCHAR(255) NOT NULL,
+				state     SMALLINT NOT NULL DEFAULT 1,
+				PRIMARY KEY(appid)
+			);`); err != nil {
+			return err
+		}
+		// Feishu API endpoint of the app, empty for the default.
+		if _, err := a.db.Exec(ctx, "ALTER TABLE feishuapp ADD COLUMN IF NOT EXISTS baseurl VARCHAR(255) NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+
+		// Feishu user and app the user is linked to. The columns could have been created manually.
+		for _, col := range []string{"unionid", "feishuappid"} {
+			if _, err := a.db.Exec(ctx, "ALTER TABLE users ADD COLUMN IF NOT EXISTS "+col+" VARCHAR(64) NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+		}
+		// Users are looked up by Feishu union ID when logging in and syncing the directory.
+		if _, err := a.db.Exec(ctx, "CREATE INDEX IF NOT EXISTS users_unionid ON users(unionid)"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 116); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -752,7 +801,8 @@ func (a *adapter) UserCreate(user *t.User) error {
 
 	decoded_uid := store.DecodeUid(user.Uid())
 	if _, err = tx.Exec(ctx,
-		"INSERT INTO users(id,createdat,updatedat,state,access,public,trusted,tags) VALUES($1,$2,$3,$4,$5,$6,$7,$8);",
+		"INSERT INTO users(id,createdat,updatedat,state,access,public,trusted,tags,unionid,feishuappid) "+
+			"VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10);",
 		decoded_uid,
 		user.CreatedAt,
 		user.UpdatedAt,
@@ -760,7 +810,9 @@ func (a *adapter) UserCreate(user *t.User) error {
 		user.Access,
 		common.ToJSON(user.Public),
 		common.ToJSON(user.Trusted),
-		user.Tags); err != nil {
+		user.Tags,
+		user.UnionId,
+		user.FeishuAppId); err != nil {
 		return err
 	}
 
@@ -942,7 +994,8 @@ func (a *adapter) UserGet(uid t.Uid) (*t.User, error) {
 		return nil, nil
 	}
 
-	err = row.Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.State, &user.StateAt, &user.Access, &user.LastSeen, &user.UserAgent, &user.Public, &user.Trusted, &user.Tags)
+	err = row.Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.State, &user.StateAt, &user.Access, &user.LastSeen, &user.UserAgent, &user.Public, &user.Trusted, &user.Tags,
+		&user.UnionId, &user.FeishuAppId)
 	if err == nil {
 		user.SetUid(uid)
 		return &user, nil
@@ -972,7 +1025,8 @@ func (a *adapter) UserGetAll(ids ...t.Uid) ([]t.User, error) {
 	for rows.Next() {
 		var user t.User
 		var id int64
-		if err = rows.Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.State, &user.StateAt, &user.Access, &user.LastSeen, &user.UserAgent, &user.Public, &user.Trusted, &user.Tags); err != nil {
+		if err = rows.Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.State, &user.StateAt, &user.Access, &user.LastSeen, &user.UserAgent, &user.Public, &user.Trusted, &user.Tags,
+			&user.UnionId, &user.FeishuAppId); err != nil {
 			users = nil
 			break
 		}
@@ -1286,6 +1340,26 @@ func (a *adapter) UserGetByCred(method, value string) (t.Uid, error) {
 	return t.ZeroUid, err
 }
 
+// UserGetByUnionId returns ID of the active user linked to the given Feishu union ID.
+func (a *adapter) UserGetByUnionId(unionId string) (t.Uid, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var decoded_uid int64
+	err := a.db.QueryRow(ctx, "SELECT id FROM users WHERE unionid=$1 AND state!=$2 LIMIT 1",
+		unionId, t.StateDeleted).Scan(&decoded_uid)
+	if err == nil {
+		return store.EncodeUid(decoded_uid), nil
+	}
+
+	if err == pgx.ErrNoRows {
+		// Clear the error if user does not exist
+		return t.ZeroUid, nil
+	}
+	return t.ZeroUid, err
+}
+
 // UserUnreadCount returns the total number of unread messages in all topics with
 // the R permission. If read fails, the counts are still returned with the original
 // user IDs but with the unread count undefined and non-nil error.
@@ -1364,6 +1438,55 @@ func (a *adapter) UserGetUnvalidated(lastUpdatedBefore time.Time, limit int) ([]
 	return uids, err
 }
 
+// UserGetOffline returns active users last seen within the (lastSeenAfter, lastSeenBefore] interval
+// or at lastSeenAfter with ID greater than afterId.
+func (a *adapter) UserGetOffline(lastSeenAfter time.Time, afterId t.Uid, lastSeenBefore time.Time, limit int) ([]t.User, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	after := "lastseen>$2"
+	args := []any{t.StateOK, lastSeenAfter, lastSeenBefore, limit}
+	if !afterId.IsZero() {
+		// Continue after the last user of the previous page.
+		after = "(lastseen>$2 OR (lastseen=$2 AND id>$5))"
+		args = append(args, store.DecodeUid(afterId))
+	}
+
+	rows, err := a.db.Query(ctx,
+		"SELECT * FROM users WHERE state=$1 AND "+after+" AND lastseen<=$3 ORDER BY lastseen ASC, id ASC LIMIT $4",
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []t.User{}
+	for rows.Next() {
+		var user t.User
+		var id int64
+		if err = rows.Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.State, &user.StateAt, &user.Access, &user.LastSeen, &user.UserAgent, &user.Public, &user.Trusted, &user.Tags,
+			&user.UnionId, &user.FeishuAppId); err != nil {
+			users = nil
+			break
+		}
+
+		user.SetUid(store.EncodeUid(id))
+		users = append(users, user)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return users, err
+}
+
+// UserSetLegalHold is not supported by this adapter: deleted messages are not retained.
+func (a *adapter) UserSetLegalHold(uid t.Uid, hold *t.LegalHold) error {
+	return t.ErrUnsupported
+}
+
 // *****************************
 
 func (a *adapter) topicCreate(ctx context.Context, tx pgx.Tx, topic *t.Topic) error {
@@ -2046,6 +2169,11 @@ func (a *adapter) TopicUpdate(topic string, update map[string]any) error {
 	return tx.Commit(ctx)
 }
 
+// TopicSetLegalHold is not supported by this adapter: deleted messages are not retained.
+func (a *adapter) TopicSetLegalHold(topic string, hold *t.LegalHold) error {
+	return t.ErrUnsupported
+}
+
 func (a *adapter) TopicOwnerChange(topic string, newOwner t.Uid) error {
 	ctx, cancel := a.getContext()
 	if cancel != nil {
@@ -2629,6 +2757,38 @@ func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOp
 	return dmsgs, err
 }
 
+// MessageAttachments returns IDs of files attached to messages in the topic with seq IDs within the ranges.
+func (a *adapter) MessageAttachments(topic string, ranges []t.Range) ([]string, error) {
+	if len(ranges) == 0 {
+		return nil, nil
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	rSql, rArgs := common.RangesToSql(ranges)
+	query, args := expandQuery("SELECT DISTINCT fml.fileid FROM filemsglinks AS fml "+
+		"INNER JOIN messages AS m ON m.id=fml.msgid WHERE m.topic=? AND m.seqid "+rSql,
+		append([]any{topic}, rArgs...)...)
+	rows, err := a.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fids []string
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		fids = append(fids, store.EncodeUid(id).String())
+	}
+	return fids, rows.Err()
+}
+
 func messageDeleteList(ctx context.Context, tx pgx.Tx, topic string, toDel *t.DelMessage) error {
 	var err error
 
@@ -3321,6 +3481,74 @@ func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, er
 	return locations, tx.Commit(ctx)
 }
 
+// FileDeleteIfUnused deletes records of the given files which are not linked to any message, topic or user.
+// Returns array of FileDef.Location of deleted filerecords so actual files can be deleted too.
+func (a *adapter) FileDeleteIfUnused(fids []string) ([]string, error) {
+	var dids []any
+	for _, fid := range fids {
+		id := t.ParseUid(fid)
+		if id.IsZero() {
+			return nil, t.ErrMalformed
+		}
+		dids = append(dids, store.DecodeUid(id))
+	}
+	if len(dids) == 0 {
+		return nil, nil
+	}
+
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	query, args := expandQuery("SELECT fu.id,fu.location FROM fileuploads AS fu "+
+		"LEFT JOIN filemsglinks AS fml ON fml.fileid=fu.id WHERE fml.id IS NULL AND fu.id IN (?)", dids)
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var locations []string
+	var ids []any
+	for rows.Next() {
+		var id int64
+		var loc string
+		if err = rows.Scan(&id, &loc); err != nil {
+			break
+		}
+		if loc != "" {
+			locations = append(locations, loc)
+		}
+		ids = append(ids, id)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) > 0 {
+		query, ids = expandQuery("DELETE FROM fileuploads WHERE id IN (?)", ids)
+		if _, err = tx.Exec(ctx, query, ids...); err != nil {
+			return nil, err
+		}
+	}
+
+	return locations, tx.Commit(ctx)
+}
+
 // FileLinkAttachments connects given topic or message to the file record IDs from the list.
 func (a *adapter) FileLinkAttachments(topic string, userId, msgId t.Uid, fids []string) error {
 	if len(fids) == 0 || (topic == "" && msgId.IsZero() && userId.IsZero()) {
@@ -3555,6 +3783,83 @@ func flatMap(slice []any) []any {
 	return result
 }
 
+// FeishuAppGetAll returns all active Feishu apps.
+func (a *adapter) FeishuAppGetAll() ([]t.FeishuApp, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	rows, err := a.db.Query(ctx, "SELECT appid,appsecret,baseurl FROM feishuapp WHERE state=1")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	feishuApps := []t.FeishuApp{}
+	for rows.Next() {
+		var feishuApp t.FeishuApp
+		if err = rows.Scan(&feishuApp.AppId, &feishuApp.AppSecret, &feishuApp.BaseUrl); err != nil {
+			break
+		}
+		feishuApps = append(feishuApps, feishuApp)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	return feishuApps, err
+}
+
+// FeishuAppCreate adds a new Feishu app.
+func (a *adapter) FeishuAppCreate(app *t.FeishuApp) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	_, err := a.db.Exec(ctx, "INSERT INTO feishuapp(appid,appsecret,baseurl,state) VALUES($1,$2,$3,1)",
+		app.AppId, app.AppSecret, app.BaseUrl)
+	if isDupe(err) {
+		return t.ErrDuplicate
+	}
+	return err
+}
+
+// FeishuAppUpdate replaces credentials and endpoint of an existing Feishu app.
+func (a *adapter) FeishuAppUpdate(app *t.FeishuApp) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	res, err := a.db.Exec(ctx, "UPDATE feishuapp SET appsecret=$1,baseurl=$2 WHERE appid=$3 AND state=1",
+		app.AppSecret, app.BaseUrl, app.AppId)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return t.ErrNotFound
+	}
+	return nil
+}
+
+// FeishuAppDelete deletes a Feishu app.
+func (a *adapter) FeishuAppDelete(appId string) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	res, err := a.db.Exec(ctx, "DELETE FROM feishuapp WHERE appid=$1", appId)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return t.ErrNotFound
+	}
+	return nil
+}
+
 func init() {
 	store.RegisterAdapter(&adapter{})
 }
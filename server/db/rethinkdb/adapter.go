@@ -35,7 +35,7 @@ const (
 	defaultHost     = "localhost:28015"
 	defaultDatabase = "tinode"
 
-	adpVersion = 114
+	adpVersion = 115
 
 	adapterName = "rethinkdb"
 
@@ -401,6 +401,11 @@ func (a *adapter) CreateDb(reset bool) error {
 		return err
 	}
 
+	// Feishu apps used for sending notifications.
+	if _, err := rdb.DB(a.dbName).TableCreate("feishuapp", rdb.TableCreateOpts{PrimaryKey: "AppId"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+
 	// Record current DB version.
 	if _, err := rdb.DB(a.dbName).Table("kvmeta").Insert(
 		map[string]any{"key": "version", "value": adpVersion}).RunWrite(a.conn); err != nil {
@@ -566,6 +571,19 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 114 {
+		// Perform database upgrade from version 114 to version 115.
+
+		// Feishu apps.
+		if _, err := rdb.DB(a.dbName).TableCreate("feishuapp", rdb.TableCreateOpts{PrimaryKey: "AppId"}).RunWrite(a.conn); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 115); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -1033,6 +1051,28 @@ func (a *adapter) UserGetByCred(method, value string) (t.Uid, error) {
 	return t.ParseUid(userId), nil
 }
 
+// UserGetByUnionId returns ID of the active user linked to the given Feishu union ID.
+func (a *adapter) UserGetByUnionId(unionId string) (t.Uid, error) {
+	cursor, err := rdb.DB(a.dbName).Table("users").
+		Filter(rdb.Row.Field("UnionId").Eq(unionId).And(rdb.Row.Field("State").Eq(t.StateDeleted).Not())).
+		Limit(1).Field("Id").Run(a.conn)
+	if err != nil {
+		return t.ZeroUid, err
+	}
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return t.ZeroUid, nil
+	}
+
+	var userId string
+	if err = cursor.One(&userId); err != nil {
+		return t.ZeroUid, err
+	}
+
+	return t.ParseUid(userId), nil
+}
+
 // UserUnreadCount returns the total number of unread messages in all topics with
 // the R permission. If read fails, the counts are still returned with the original
 // user IDs but with the unread count undefined and non-nil error.
@@ -1144,6 +1184,40 @@ func (a *adapter) UserGetUnvalidated(lastUpdatedBefore time.Time, limit int) ([]
 	return uids, err
 }
 
+// UserGetOffline returns active users last seen within the (lastSeenAfter, lastSeenBefore] interval
+// or at lastSeenAfter with ID greater than afterId.
+func (a *adapter) UserGetOffline(lastSeenAfter time.Time, afterId t.Uid, lastSeenBefore time.Time, limit int) ([]t.User, error) {
+	after := rdb.Row.Field("LastSeen").Gt(lastSeenAfter)
+	if !afterId.IsZero() {
+		// Continue after the last user of the previous page.
+		after = after.Or(rdb.Row.Field("LastSeen").Eq(lastSeenAfter).And(rdb.Row.Field("Id").Gt(afterId.String())))
+	}
+	cursor, err := rdb.DB(a.dbName).Table("users").
+		Filter(rdb.Row.Field("State").Eq(t.StateOK).
+			And(after).
+			And(rdb.Row.Field("LastSeen").Le(lastSeenBefore))).
+		OrderBy("LastSeen", "Id").
+		Limit(limit).
+		Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	users := []t.User{}
+	var user t.User
+	for cursor.Next(&user) {
+		users = append(users, user)
+	}
+
+	return users, cursor.Err()
+}
+
+// UserSetLegalHold is not supported by this adapter: deleted messages are not retained.
+func (a *adapter) UserSetLegalHold(uid t.Uid, hold *t.LegalHold) error {
+	return t.ErrUnsupported
+}
+
 // *****************************
 
 // TopicCreate creates a topic from template
@@ -1618,6 +1692,11 @@ func (a *adapter) TopicUpdate(topic string, update map[string]any) error {
 	return err
 }
 
+// TopicSetLegalHold is not supported by this adapter: deleted messages are not retained.
+func (a *adapter) TopicSetLegalHold(topic string, hold *t.LegalHold) error {
+	return t.ErrUnsupported
+}
+
 // TopicOwnerChange changes topic's owner.
 func (a *adapter) TopicOwnerChange(topic string, newOwner t.Uid) error {
 	_, err := rdb.DB(a.dbName).Table("topics").Get(topic).
@@ -2121,6 +2200,27 @@ func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOp
 	return dmsgs, nil
 }
 
+// MessageAttachments returns IDs of files attached to messages in the topic with seq IDs within the ranges.
+func (a *adapter) MessageAttachments(topic string, ranges []t.Range) ([]string, error) {
+	if len(ranges) == 0 {
+		return nil, nil
+	}
+
+	cursor, err := rangeToQuery(ranges, topic, rdb.DB(a.dbName).Table("messages")).
+		Filter(rdb.Row.HasFields("Attachments")).
+		ConcatMap(rdb.Row.Field("Attachments")).Distinct().Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var fids []string
+	if err = cursor.All(&fids); err != nil {
+		return nil, err
+	}
+	return fids, nil
+}
+
 // messagesHardDelete deletes all messages in the topic.
 func (a *adapter) messagesHardDelete(topic string) error {
 	var err error
@@ -2758,6 +2858,41 @@ func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, er
 	return locations, err
 }
 
+// FileDeleteIfUnused deletes records of the given files which are not linked to any message, topic or user,
+// i.e. UseCount is zero. Returns array of FileDef.Location of deleted filerecords so actual files can be deleted too.
+func (a *adapter) FileDeleteIfUnused(fids []string) ([]string, error) {
+	if len(fids) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]any, len(fids))
+	for i, id := range fids {
+		ids[i] = id
+	}
+	q := rdb.DB(a.dbName).Table("fileuploads").GetAll(ids...).
+		Filter(rdb.Row.Field("UseCount").Default(0).Eq(0))
+
+	cursor, err := q.Field("Location").Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var locations []string
+	var loc string
+	for cursor.Next(&loc) {
+		locations = append(locations, loc)
+	}
+
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = q.Delete().RunWrite(a.conn)
+
+	return locations, err
+}
+
 // Given a select query, decrement corresponding use counter in 'fileuploads' table.
 // The 'query' must return an array, i.e. GetAll, not Get.
 func (a *adapter) decFileUseCounter(query rdb.Term) error {
@@ -2869,6 +3004,72 @@ func isMissingDb(err error) bool {
 	return strings.Contains(msg, "Database `") && strings.Contains(msg, "` does not exist")
 }
 
+// FeishuAppGetAll returns all active Feishu apps.
+func (a *adapter) FeishuAppGetAll() ([]t.FeishuApp, error) {
+	cursor, err := rdb.DB(a.dbName).Table("feishuapp").Filter(map[string]any{"State": 1}).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	feishuApps := []t.FeishuApp{}
+	for {
+		// Fresh map for every row: fields missing in the row must not be carried over from the previous one.
+		var app map[string]any
+		if !cursor.Next(&app) {
+			break
+		}
+		appId, _ := app["AppId"].(string)
+		appSecret, _ := app["AppSecret"].(string)
+		baseUrl, _ := app["BaseUrl"].(string)
+		feishuApps = append(feishuApps, t.FeishuApp{AppId: appId, AppSecret: appSecret, BaseUrl: baseUrl})
+	}
+
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+	return feishuApps, nil
+}
+
+// FeishuAppCreate adds a new Feishu app.
+func (a *adapter) FeishuAppCreate(app *t.FeishuApp) error {
+	_, err := rdb.DB(a.dbName).Table("feishuapp").Insert(map[string]any{
+		"AppId":     app.AppId,
+		"AppSecret": app.AppSecret,
+		"BaseUrl":   app.BaseUrl,
+		"State":     1,
+	}).RunWrite(a.conn)
+	if rdb.IsConflictErr(err) {
+		return t.ErrDuplicate
+	}
+	return err
+}
+
+// FeishuAppUpdate replaces credentials and endpoint of an existing Feishu app.
+func (a *adapter) FeishuAppUpdate(app *t.FeishuApp) error {
+	res, err := rdb.DB(a.dbName).Table("feishuapp").GetAll(app.AppId).Filter(map[string]any{"State": 1}).
+		Update(map[string]any{"AppSecret": app.AppSecret, "BaseUrl": app.BaseUrl}).RunWrite(a.conn)
+	if err != nil {
+		return err
+	}
+	if res.Replaced == 0 && res.Unchanged == 0 {
+		return t.ErrNotFound
+	}
+	return nil
+}
+
+// FeishuAppDelete deletes a Feishu app.
+func (a *adapter) FeishuAppDelete(appId string) error {
+	res, err := rdb.DB(a.dbName).Table("feishuapp").Get(appId).Delete().RunWrite(a.conn)
+	if err != nil {
+		return err
+	}
+	if res.Deleted == 0 {
+		return t.ErrNotFound
+	}
+	return nil
+}
+
 func init() {
 	store.RegisterAdapter(&adapter{})
 }
@@ -0,0 +1,256 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Email digests of unread messages for users who have been offline for
+ *    a while.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+	"github.com/tinode/chat/server/validate/email"
+)
+
+const (
+	// Default period between checks for offline users, minutes.
+	defaultDigestCheckPeriod = 30
+	// Default maximum number of topics listed in one digest.
+	defaultDigestMaxTopics = 10
+	// Number of users to load from the database at once.
+	digestBlockSize = 100
+)
+
+// Email digest config.
+type emailDigestConfig struct {
+	Enabled bool `json:"enabled"`
+	// Send the digest to users who have been offline for this many hours.
+	OfflineHours int `json:"offline_hours"`
+	// How often to look for users who should receive the digest, minutes.
+	CheckPeriod int `json:"check_period"`
+	// The maximum number of topics listed in one digest.
+	MaxTopics int `json:"max_topics"`
+}
+
+// sendDigestEmail sends the digest email. A variable for testing.
+var sendDigestEmail = email.SendDigest
+
+// digestTopic is a topic with unread messages as passed to the digest template.
+type digestTopic struct {
+	// Name of the topic as seen by the user.
+	Topic string
+	// Human-readable name of the topic or the other user in P2P topics.
+	Name string
+	// Number of unread messages.
+	Unread int
+}
+
+// emailDigestStart starts the process which sends email digests of unread messages. The digest is sent
+// once after the user has been offline for config.OfflineHours. Returns channel which can be used to stop
+// the process or nil if digests are disabled.
+func emailDigestStart(conf *emailDigestConfig) (chan<- bool, error) {
+	if conf == nil || !conf.Enabled {
+		return nil, nil
+	}
+	if conf.OfflineHours <= 0 || conf.CheckPeriod < 0 || conf.MaxTopics < 0 {
+		return nil, errors.New("invalid email digest config")
+	}
+	if _, ok := globals.validators["email"]; !ok {
+		return nil, errors.New("email validator is not configured")
+	}
+	if !email.DigestConfigured() {
+		return nil, errors.New("email digest template 'digest_templ' is not configured")
+	}
+
+	period := time.Minute * time.Duration(conf.CheckPeriod)
+	if period == 0 {
+		period = time.Minute * defaultDigestCheckPeriod
+	}
+	maxTopics := conf.MaxTopics
+	if maxTopics == 0 {
+		maxTopics = defaultDigestMaxTopics
+	}
+	offline := time.Hour * time.Duration(conf.OfflineHours)
+
+	// Unbuffered stop channel. Whomever stops the process must wait for it to finish.
+	stop := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		logs.Info.Printf("Email digests started with period %s, offline threshold %s", period, offline)
+
+		// Each run handles users who crossed the offline threshold since the previous run. Users who crossed it
+		// while the server was down don't get a digest.
+		lastRun := time.Now().Add(-period)
+		for {
+			select {
+			case now := <-ticker.C:
+				sendEmailDigests(lastRun.Add(-offline), now.Add(-offline), maxTopics)
+				lastRun = now
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop, nil
+}
+
+// sendEmailDigests sends digests to users last seen within the (after, before] interval.
+func sendEmailDigests(after, before time.Time, maxTopics int) {
+	// The last user of the previous block. Users seen at the same time are paged by ID.
+	var afterId types.Uid
+	for {
+		users, err := store.Users.GetOffline(after, afterId, before, digestBlockSize)
+		if err != nil {
+			logs.Warn.Println("email digest: failed to load users", err)
+			return
+		}
+
+		for i := range users {
+			user := &users[i]
+			uid := user.Uid()
+			// Users are handled by the node which owns their 'me' topic. The 'me' topic is loaded
+			// if the user is online.
+			if globals.cluster.isRemoteTopic(uid.UserId()) || globals.hub.topicGet(uid.UserId()) != nil {
+				continue
+			}
+			if err := sendEmailDigest(user, maxTopics); err != nil {
+				logs.Warn.Println("email digest: failed to send to", uid.UserId(), err)
+			}
+		}
+
+		if len(users) < digestBlockSize {
+			return
+		}
+		last := &users[len(users)-1]
+		after, afterId = *last.LastSeen, last.Uid()
+	}
+}
+
+// sendEmailDigest sends the digest of unread messages to one user unless the user has opted out or has
+// no validated email or nothing new to read.
+func sendEmailDigest(user *types.User, maxTopics int) error {
+	if user.NotifyPrefs != nil && user.NotifyPrefs.NoEmailDigest {
+		return nil
+	}
+
+	uid := user.Uid()
+	creds, err := store.Users.GetAllCreds(uid, "email", true)
+	if err != nil || len(creds) == 0 {
+		return err
+	}
+
+	counts, err := store.Users.GetUnreadCount(uid)
+	if err != nil {
+		return err
+	}
+	total := counts[uid]
+	if total <= 0 {
+		return nil
+	}
+
+	topics, err := unreadTopics(user, time.Now())
+	if err != nil {
+		return err
+	}
+	if len(topics) == 0 {
+		// Nothing was received since the user went offline.
+		return nil
+	}
+	more := 0
+	if len(topics) > maxTopics {
+		more = len(topics) - maxTopics
+		topics = topics[:maxTopics]
+	}
+
+	return sendDigestEmail(creds[0].Value, userLanguage(uid), map[string]any{
+		"Name":   publicName(user.Public),
+		"Total":  total,
+		"Topics": topics,
+		"More":   more,
+	})
+}
+
+// unreadTopics returns topics which received messages after the user went offline, most recent first.
+// Muted topics are skipped.
+func unreadTopics(user *types.User, now time.Time) ([]digestTopic, error) {
+	subs, err := store.Users.GetTopics(user.Uid(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	type touchedTopic struct {
+		digestTopic
+		touched time.Time
+	}
+	var unread []touchedTopic
+	for i := range subs {
+		sub := &subs[i]
+		count := sub.GetSeqId() - sub.ReadSeqId
+		if count <= 0 || !(sub.ModeGiven & sub.ModeWant).IsReader() {
+			continue
+		}
+		if !sub.GetTouchedAt().After(*user.LastSeen) {
+			continue
+		}
+
+		topic := sub.Topic
+		if types.GetTopicCat(topic) == types.TopicCatP2P {
+			topic = sub.GetWith()
+		}
+		if user.NotifyPrefs != nil {
+			if until, ok := user.NotifyPrefs.Mute[topic]; ok && until.After(now) {
+				continue
+			}
+		}
+
+		unread = append(unread, touchedTopic{
+			digestTopic: digestTopic{Topic: topic, Name: publicName(sub.GetPublic()), Unread: count},
+			touched:     sub.GetTouchedAt(),
+		})
+	}
+
+	sort.Slice(unread, func(i, j int) bool {
+		return unread[i].touched.After(unread[j].touched)
+	})
+	topics := make([]digestTopic, len(unread))
+	for i := range unread {
+		topics[i] = unread[i].digestTopic
+	}
+	return topics, nil
+}
+
+// publicName returns the full name from the Public field of a user or a topic.
+func publicName(public any) string {
+	if info, ok := public.(map[string]any); ok {
+		name, _ := info["fn"].(string)
+		return name
+	}
+	return ""
+}
+
+// userLanguage returns the language of the device the user used most recently.
+func userLanguage(uid types.Uid) string {
+	devices, _, err := store.Devices.GetAll(uid)
+	if err != nil {
+		return ""
+	}
+
+	var lang string
+	var lastSeen time.Time
+	for _, dev := range devices[uid] {
+		if dev.Lang != "" && dev.LastSeen.After(lastSeen) {
+			lang, lastSeen = dev.Lang, dev.LastSeen
+		}
+	}
+	return lang
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// digestEmail is an email digest captured by the test.
+type digestEmail struct {
+	to, lang string
+	params   map[string]any
+}
+
+// captureDigests replaces sending of digest emails for the duration of the test.
+func captureDigests(t *testing.T) *[]digestEmail {
+	var sent []digestEmail
+	send := sendDigestEmail
+	sendDigestEmail = func(to, lang string, params map[string]any) error {
+		sent = append(sent, digestEmail{to, lang, params})
+		return nil
+	}
+	t.Cleanup(func() { sendDigestEmail = send })
+	return &sent
+}
+
+func TestEmailDigestStart(t *testing.T) {
+	defer func() { globals.validators = nil }()
+
+	if stop, err := emailDigestStart(nil); stop != nil || err != nil {
+		t.Error("missing config must disable digests", err)
+	}
+	if stop, err := emailDigestStart(&emailDigestConfig{OfflineHours: 24}); stop != nil || err != nil {
+		t.Error("disabled digests must not start", err)
+	}
+	if _, err := emailDigestStart(&emailDigestConfig{Enabled: true}); err == nil {
+		t.Error("missing offline threshold must be rejected")
+	}
+
+	conf := &emailDigestConfig{Enabled: true, OfflineHours: 24}
+	if _, err := emailDigestStart(conf); err == nil {
+		t.Error("digests must not start without email validator")
+	}
+	globals.validators = map[string]credValidator{"email": {}}
+	if _, err := emailDigestStart(conf); err == nil {
+		t.Error("digests must not start without the digest template")
+	}
+}
+
+func TestUnreadTopics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	store.Users = uu
+	defer func() { store.Users = nil }()
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	lastSeen := now.Add(-48 * time.Hour)
+	user := &types.User{
+		LastSeen:    &lastSeen,
+		NotifyPrefs: &types.NotifyPrefs{Mute: map[string]time.Time{"grpMuted": now.Add(time.Hour), "grpUnmuted": now.Add(-time.Hour)}},
+	}
+	user.SetUid(types.Uid(1))
+
+	sub := func(topic string, seq, read int, mode types.AccessMode, touched time.Time, name string) types.Subscription {
+		s := types.Subscription{Topic: topic, ReadSeqId: read, ModeWant: mode, ModeGiven: mode}
+		s.SetSeqId(seq)
+		s.SetTouchedAt(touched)
+		s.SetPublic(map[string]any{"fn": name})
+		return s
+	}
+	p2p := sub(types.Uid(1).P2PName(types.Uid(2)), 5, 3, types.ModeCP2P, now.Add(-time.Hour), "Bob")
+	p2p.SetWith(types.Uid(2).UserId())
+	subs := []types.Subscription{
+		sub("grpOld", 10, 2, types.ModeCPublic, lastSeen.Add(-time.Hour), "Old"),
+		sub("grpRead", 10, 10, types.ModeCPublic, now, "Read"),
+		sub("grpBanned", 10, 2, types.ModeNone, now, "Banned"),
+		sub("grpMuted", 10, 2, types.ModeCPublic, now, "Muted"),
+		sub("grpUnmuted", 10, 6, types.ModeCPublic, now.Add(-2*time.Hour), "Unmuted"),
+		p2p,
+	}
+	uu.EXPECT().GetTopics(user.Uid(), nil).Return(subs, nil)
+
+	topics, err := unreadTopics(user, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []digestTopic{
+		{Topic: types.Uid(2).UserId(), Name: "Bob", Unread: 2},
+		{Topic: "grpUnmuted", Name: "Unmuted", Unread: 4},
+	}
+	if !reflect.DeepEqual(topics, expected) {
+		t.Errorf("expected %+v, got %+v", expected, topics)
+	}
+
+	uu.EXPECT().GetTopics(user.Uid(), nil).Return(nil, types.ErrInternal)
+	if _, err := unreadTopics(user, now); err == nil {
+		t.Error("database error must be reported")
+	}
+}
+
+func TestSendEmailDigests(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	dd := mock_store.NewMockDevicePersistenceInterface(ctrl)
+	store.Users = uu
+	store.Devices = dd
+	globals.hub = &Hub{topics: &sync.Map{}}
+	defer func() {
+		store.Users = nil
+		store.Devices = nil
+		globals.hub = nil
+	}()
+	sent := captureDigests(t)
+
+	now := time.Now().UTC().Round(time.Millisecond)
+	after, before := now.Add(-time.Hour), now
+
+	// The first block is full: the users who opted out and one who is online.
+	var block []types.User
+	for i := 0; i < digestBlockSize; i++ {
+		lastSeen := after.Add(time.Duration(i+1) * time.Second)
+		user := types.User{LastSeen: &lastSeen, NotifyPrefs: &types.NotifyPrefs{NoEmailDigest: true}}
+		user.SetUid(types.Uid(i + 10))
+		block = append(block, user)
+	}
+	online := block[0].Uid()
+	block[0].NotifyPrefs = nil
+	globals.hub.topics.Store(online.UserId(), &Topic{})
+
+	// The second block has the user who gets the digest and the user without email.
+	lastSeen := before.Add(-time.Minute)
+	alice := types.User{LastSeen: &lastSeen, Public: map[string]any{"fn": "Alice"}}
+	alice.SetUid(types.Uid(1))
+	noEmail := types.User{LastSeen: &lastSeen}
+	noEmail.SetUid(types.Uid(2))
+
+	sub := types.Subscription{Topic: "grpAbc", ReadSeqId: 1, ModeWant: types.ModeCPublic, ModeGiven: types.ModeCPublic}
+	sub.SetSeqId(4)
+	sub.SetTouchedAt(before)
+	sub.SetPublic(map[string]any{"fn": "Group"})
+
+	gomock.InOrder(
+		uu.EXPECT().GetOffline(after, types.ZeroUid, before, digestBlockSize).Return(block, nil),
+		// The next block starts after the last user of the previous one.
+		uu.EXPECT().GetOffline(*block[digestBlockSize-1].LastSeen, block[digestBlockSize-1].Uid(), before,
+			digestBlockSize).Return([]types.User{alice, noEmail}, nil),
+	)
+	uu.EXPECT().GetAllCreds(alice.Uid(), "email", true).Return([]types.Credential{{Value: "alice@example.com"}}, nil)
+	uu.EXPECT().GetAllCreds(noEmail.Uid(), "email", true).Return(nil, nil)
+	uu.EXPECT().GetUnreadCount(alice.Uid()).Return(map[types.Uid]int{alice.Uid(): 5}, nil)
+	uu.EXPECT().GetTopics(alice.Uid(), nil).Return([]types.Subscription{sub}, nil)
+	dd.EXPECT().GetAll(alice.Uid()).Return(map[types.Uid][]types.DeviceDef{
+		alice.Uid(): {{Lang: "en", LastSeen: before.Add(-time.Hour)}, {Lang: "zh", LastSeen: before}},
+	}, 2, nil)
+
+	sendEmailDigests(after, before, 10)
+
+	expected := []digestEmail{{to: "alice@example.com", lang: "zh", params: map[string]any{
+		"Name":   "Alice",
+		"Total":  5,
+		"Topics": []digestTopic{{Topic: "grpAbc", Name: "Group", Unread: 3}},
+		"More":   0,
+	}}}
+	if !reflect.DeepEqual(*sent, expected) {
+		t.Errorf("expected %+v, got %+v", expected, *sent)
+	}
+}
+
+func TestSendEmailDigest(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	dd := mock_store.NewMockDevicePersistenceInterface(ctrl)
+	store.Users = uu
+	store.Devices = dd
+	defer func() {
+		store.Users = nil
+		store.Devices = nil
+	}()
+	sent := captureDigests(t)
+
+	now := time.Now()
+	lastSeen := now.Add(-48 * time.Hour)
+	user := &types.User{LastSeen: &lastSeen}
+	user.SetUid(types.Uid(1))
+	uid := user.Uid()
+	creds := []types.Credential{{Value: "alice@example.com"}}
+
+	var subs []types.Subscription
+	for i, topic := range []string{"grpA", "grpB", "grpC"} {
+		sub := types.Subscription{Topic: topic, ModeWant: types.ModeCPublic, ModeGiven: types.ModeCPublic}
+		sub.SetSeqId(i + 1)
+		sub.SetTouchedAt(now.Add(-time.Duration(i) * time.Minute))
+		subs = append(subs, sub)
+	}
+
+	// Only the most recent topics are listed.
+	uu.EXPECT().GetAllCreds(uid, "email", true).Return(creds, nil)
+	uu.EXPECT().GetUnreadCount(uid).Return(map[types.Uid]int{uid: 6}, nil)
+	uu.EXPECT().GetTopics(uid, nil).Return(subs, nil)
+	dd.EXPECT().GetAll(uid).Return(nil, 0, nil)
+	if err := sendEmailDigest(user, 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(*sent) != 1 {
+		t.Fatal("digest is not sent", *sent)
+	}
+	params := (*sent)[0].params
+	if topics := params["Topics"].([]digestTopic); len(topics) != 2 || topics[0].Topic != "grpA" || params["More"] != 1 {
+		t.Error("unexpected topics", params)
+	}
+
+	// Nothing to read.
+	uu.EXPECT().GetAllCreds(uid, "email", true).Return(creds, nil)
+	uu.EXPECT().GetUnreadCount(uid).Return(map[types.Uid]int{uid: 0}, nil)
+	if err := sendEmailDigest(user, 2); err != nil || len(*sent) != 1 {
+		t.Error("digest must not be sent without unread messages", err)
+	}
+
+	// Nothing received since the user went offline.
+	stale := types.Subscription{Topic: "grpA", ModeWant: types.ModeCPublic, ModeGiven: types.ModeCPublic}
+	stale.SetSeqId(6)
+	stale.SetTouchedAt(lastSeen)
+	uu.EXPECT().GetAllCreds(uid, "email", true).Return(creds, nil)
+	uu.EXPECT().GetUnreadCount(uid).Return(map[types.Uid]int{uid: 6}, nil)
+	uu.EXPECT().GetTopics(uid, nil).Return([]types.Subscription{stale}, nil)
+	if err := sendEmailDigest(user, 2); err != nil || len(*sent) != 1 {
+		t.Error("digest must not be sent without new messages", err)
+	}
+
+	uu.EXPECT().GetAllCreds(uid, "email", true).Return(nil, errors.New("db error"))
+	if err := sendEmailDigest(user, 2); err == nil {
+		t.Error("database error must be reported")
+	}
+
+	// The user opted out.
+	user.NotifyPrefs = &types.NotifyPrefs{NoEmailDigest: true}
+	if err := sendEmailDigest(user, 2); err != nil || len(*sent) != 1 {
+		t.Error("digest must not be sent to the user who opted out", err)
+	}
+}
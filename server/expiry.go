@@ -0,0 +1,805 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Message expiration: server-wide limits, topic retention policies and
+ *    the scheduler which deletes messages when they expire.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Messages which expire within this time window are loaded from the database into the scheduler.
+	expiryLoadWindow = time.Hour
+	// Maximum number of messages to load from the database at once.
+	expiryLoadLimit = 10000
+	// Delay before retrying to delete messages which failed to be deleted.
+	expiryRetryDelay = time.Second
+	// Messages handed over for deletion and not confirmed as deleted within this time are considered lost,
+	// e.g. because the topic was unloaded, and may be loaded from the database again.
+	expiryInflightTimeout = time.Minute
+)
+
+// msgExpiryInit validates and applies server-wide message expiration settings.
+func msgExpiryInit(conf *msgExpiryConfig) error {
+	globals.msgExpireDefault = defaultMsgExpirePeriod
+	if conf == nil {
+		return nil
+	}
+
+	if conf.DefaultPeriod < -1 || conf.MinPeriod < 0 || conf.MaxPeriod < 0 || conf.MaxLifetime < 0 {
+		return errors.New("expiration periods must not be negative")
+	}
+	if conf.MaxPeriod > 0 && conf.MinPeriod > conf.MaxPeriod {
+		return errors.New("min_period is greater than max_period")
+	}
+
+	if conf.DefaultPeriod != 0 {
+		globals.msgExpireDefault = conf.DefaultPeriod
+	}
+	globals.msgExpireMin = conf.MinPeriod
+	globals.msgExpireMax = conf.MaxPeriod
+	globals.msgMaxLifetime = conf.MaxLifetime
+
+	return nil
+}
+
+// clampExpirePeriod brings the expiration period within the server-wide limits.
+// -1 (never expire) is replaced with the maximum period if one is configured.
+func clampExpirePeriod(period int) int {
+	if period < 0 {
+		if globals.msgExpireMax > 0 {
+			return globals.msgExpireMax
+		}
+		return -1
+	}
+	if period < globals.msgExpireMin {
+		period = globals.msgExpireMin
+	}
+	if globals.msgExpireMax > 0 && period > globals.msgExpireMax {
+		period = globals.msgExpireMax
+	}
+	return period
+}
+
+// isValidRetention checks if the retention policy requested by the client is permitted by the server.
+func isValidRetention(ret *MsgRetention) bool {
+	switch ret.Trigger {
+	case "", types.MsgExpireFirstRead, types.MsgExpireAllRead, types.MsgExpireEachRead:
+	default:
+		return false
+	}
+
+	if ret.Period < -1 || ret.Lifetime < 0 {
+		return false
+	}
+	if globals.msgMaxLifetime > 0 && ret.Lifetime > globals.msgMaxLifetime {
+		return false
+	}
+	if ret.Period == -1 {
+		return globals.msgExpireMax == 0
+	}
+	if ret.Period == 0 {
+		return true
+	}
+	return ret.Period >= globals.msgExpireMin &&
+		(globals.msgExpireMax == 0 || ret.Period <= globals.msgExpireMax)
+}
+
+// msgExpirePeriod returns the expiration period for a new message published by the user
+// with the given subscription data. The values are checked in the following order, the first
+// non-zero value wins:
+//
+//  1. Topic retention policy if it's enforced (nothing else is checked then).
+//  2. Period requested by the sender in {pub}.
+//  3. Period set on the sender's subscription.
+//  4. Topic retention policy.
+//  5. Server default.
+//
+// The result is clamped to the server-wide limits. -1 means the message never expires.
+func (t *Topic) msgExpirePeriod(pud *perUserData, requested int) int {
+	if t.retention != nil && t.retention.Enforced {
+		// Enforced policy with zero period enforces the server default.
+		period := t.retention.Period
+		if period == 0 {
+			period = globals.msgExpireDefault
+		}
+		return clampExpirePeriod(period)
+	}
+
+	period := requested
+	if period == 0 && pud != nil && pud.expirePeriod > 0 {
+		// Subscriptions use -1 as 'not set'.
+		period = pud.expirePeriod
+	}
+	if period == 0 && t.retention != nil {
+		period = t.retention.Period
+	}
+	if period == 0 {
+		period = globals.msgExpireDefault
+	}
+
+	return clampExpirePeriod(period)
+}
+
+// retentionToWire converts topic retention policy to wire format.
+func retentionToWire(ret *types.MessageRetention) *MsgRetention {
+	if ret == nil {
+		return nil
+	}
+	return &MsgRetention{Period: ret.Period, Enforced: ret.Enforced, Trigger: ret.Trigger, Lifetime: ret.Lifetime}
+}
+
+// retentionFromWire converts topic retention policy from wire format. A policy
+// with zero period which is not enforced and uses the default trigger is the same as no policy.
+func retentionFromWire(ret *MsgRetention) *types.MessageRetention {
+	if ret == nil {
+		return nil
+	}
+	trigger := ret.Trigger
+	if trigger == types.MsgExpireFirstRead {
+		trigger = ""
+	}
+	if ret.Period == 0 && !ret.Enforced && trigger == "" && ret.Lifetime == 0 {
+		return nil
+	}
+	return &types.MessageRetention{Period: ret.Period, Enforced: ret.Enforced, Trigger: trigger, Lifetime: ret.Lifetime}
+}
+
+// msgLifetime returns the number of seconds messages in the topic live after being sent, 0 if unlimited.
+func (t *Topic) msgLifetime() int {
+	lifetime := globals.msgMaxLifetime
+	if t.retention != nil && t.retention.Lifetime > 0 && (lifetime == 0 || t.retention.Lifetime < lifetime) {
+		lifetime = t.retention.Lifetime
+	}
+	return lifetime
+}
+
+// msgExpireTrigger returns the event which starts the expiration countdown of messages in the topic.
+func (t *Topic) msgExpireTrigger() string {
+	if t.retention == nil || t.retention.Trigger == "" {
+		return types.MsgExpireFirstRead
+	}
+	return t.retention.Trigger
+}
+
+// readByAll returns messages which have been read by all subscribers except the sender.
+func (t *Topic) readByAll(msgs []types.Message) []types.Message {
+	// Find two subscribers who have read the least: the sender is excluded
+	// from the check, so if the sender is the slowest reader, the second one counts.
+	min1, min2 := -1, -1
+	var minUid types.Uid
+	for uid, pud := range t.perUser {
+		if !holdsExpiry(pud) {
+			continue
+		}
+		if min1 < 0 || pud.readID < min1 {
+			min2 = min1
+			min1, minUid = pud.readID, uid
+		} else if min2 < 0 || pud.readID < min2 {
+			min2 = pud.readID
+		}
+	}
+
+	var read []types.Message
+	for i := range msgs {
+		readID := min1
+		if msgs[i].From == minUid.String() {
+			readID = min2
+		}
+		if readID < 0 || msgs[i].SeqId <= readID {
+			read = append(read, msgs[i])
+		}
+	}
+	return read
+}
+
+// holdsExpiry checks if the subscriber holds back expiration of messages which expire after being read
+// by all subscribers. Channel readers and subscribers who left the topic, muted it or cannot read it don't.
+func holdsExpiry(pud perUserData) bool {
+	mode := pud.modeGiven & pud.modeWant
+	return !pud.deleted && !pud.isChan && mode.IsJoiner() && mode.IsReader() && mode.IsPresencer()
+}
+
+// expireReleased starts expiration of messages which expire after being read by all subscribers and were
+// held back by the subscriber uid only. It's called when the subscriber leaves the topic, mutes it or
+// loses access to it; old is the subscriber's data before the change.
+func (t *Topic) expireReleased(uid types.Uid, old perUserData) {
+	if t.msgExpireTrigger() != types.MsgExpireAllRead || !holdsExpiry(old) {
+		return
+	}
+	if pud, ok := t.perUser[uid]; ok && holdsExpiry(pud) {
+		return
+	}
+
+	// Messages read by the subscriber were not held back by the subscriber. Messages
+	// not read by anyone else are still held back, unless there is no one else.
+	last := -1
+	for _, pud := range t.perUser {
+		if holdsExpiry(pud) && pud.readID > last {
+			last = pud.readID
+		}
+	}
+	if last < 0 {
+		last = t.lastID
+	}
+	if last <= old.readID {
+		return
+	}
+
+	msgs, err := store.Messages.GetListBySeqIdRange(t.name, types.ZeroUid, old.readID+1, last)
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to get unexpired messages: %v", t.name, err)
+		return
+	}
+	t.expireMessages(t.xoriginal, uid.UserId(), types.ZeroUid, t.readByAll(msgs))
+}
+
+// expireMessages starts the expiration countdown of read messages for everyone or, if forUser
+// is not zero, for the given user only, and notifies subscribers of the expiration times.
+func (t *Topic) expireMessages(topic, from string, forUser types.Uid, msgs []types.Message) {
+	if len(msgs) == 0 {
+		return
+	}
+
+	now := types.TimeNow()
+	expired := make([]MsgExpiry, 0, len(msgs))
+	for _, msg := range msgs {
+		expiredAt := now.Add(time.Duration(msg.ExpirePeriod) * time.Second)
+
+		var err error
+		if forUser.IsZero() {
+			err = store.Messages.UpdateMessage(t.name, msg.SeqId, expiredAt)
+		} else {
+			err = store.Messages.ExpireForUser(t.name, forUser, msg.SeqId, expiredAt)
+		}
+		if err != nil {
+			logs.Warn.Printf("topic[%s]: update message err: %v", t.name, err)
+			break
+		}
+		globals.expiry.schedule(t.name, msg.SeqId, forUser, expiredAt)
+
+		expired = append(expired, MsgExpiry{
+			SeqId:        msg.SeqId,
+			ExpirePeriod: msg.ExpirePeriod,
+			ExpiredAt:    expiredAt,
+		})
+	}
+
+	if len(expired) > 0 {
+		t.presPubMessagesExpired(topic, from, forUser, expired)
+	}
+}
+
+// retentionEqual checks if two retention policies are the same.
+func retentionEqual(a, b *types.MessageRetention) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// expiryTarget identifies messages which expire together: all messages of a topic
+// or messages of a topic which expire for a single user.
+type expiryTarget struct {
+	topic string
+	// Messages expire for this user only; zero if they expire for everyone.
+	user types.Uid
+}
+
+// expiryKey identifies a message in the expiry scheduler.
+type expiryKey struct {
+	expiryTarget
+	seqId int
+}
+
+// expiredMessages is a list of messages to delete sent to topic.
+type expiredMessages struct {
+	// Delete for this user only; zero to delete for everyone.
+	forUser types.Uid
+	seqIds  []int
+}
+
+// expiryEntry is a message waiting to be deleted.
+type expiryEntry struct {
+	expiryKey
+	expireAt time.Time
+	// Index of the entry in the heap.
+	index int
+}
+
+// expiryQueue is a min-heap of messages ordered by expiration time.
+type expiryQueue []*expiryEntry
+
+func (eq expiryQueue) Len() int {
+	return len(eq)
+}
+
+func (eq expiryQueue) Less(i, j int) bool {
+	return eq[i].expireAt.Before(eq[j].expireAt)
+}
+
+func (eq expiryQueue) Swap(i, j int) {
+	eq[i], eq[j] = eq[j], eq[i]
+	eq[i].index = i
+	eq[j].index = j
+}
+
+func (eq *expiryQueue) Push(x any) {
+	e := x.(*expiryEntry)
+	e.index = len(*eq)
+	*eq = append(*eq, e)
+}
+
+func (eq *expiryQueue) Pop() any {
+	old := *eq
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*eq = old[:n-1]
+	return e
+}
+
+// expiryScheduler deletes messages when they expire. Messages which expire soon are kept in memory
+// ordered by expiration time; the rest are loaded from the database as the time approaches.
+// In a cluster each node handles only the topics it's the master of.
+//
+// The scheduler is fed by Save and UpdateMessage through schedule(). Messages which expire beyond the
+// load window are not kept in memory to keep the memory use bounded, so the indexed expiration query
+// runs at startup and then once per window (and when the load limit is hit) to pick them up.
+type expiryScheduler struct {
+	mu      sync.Mutex
+	queue   expiryQueue
+	entries map[expiryKey]*expiryEntry
+	// Messages which were handed over for deletion at the given time but are not deleted yet.
+	// They are still in the database and must not be loaded again.
+	inflight map[expiryKey]time.Time
+	// Messages which expire at or after the horizon are not kept in memory.
+	horizon time.Time
+
+	// Wakes up the scheduler when the earliest expiration time changes.
+	wakeup chan struct{}
+	// Unbuffered channel: whomever stops the scheduler must wait for it to finish.
+	done chan bool
+}
+
+func newExpiryScheduler() *expiryScheduler {
+	return &expiryScheduler{
+		entries:  make(map[expiryKey]*expiryEntry),
+		inflight: make(map[expiryKey]time.Time),
+		wakeup:   make(chan struct{}, 1),
+		done:     make(chan bool),
+	}
+}
+
+// start launches the scheduler.
+func (es *expiryScheduler) start() {
+	go es.run()
+}
+
+// stop terminates the scheduler.
+func (es *expiryScheduler) stop() {
+	es.done <- true
+}
+
+// schedule adds a message to the scheduler or updates its expiration time. If forUser is not zero,
+// the message expires for that user only. It's safe to call on a nil scheduler.
+func (es *expiryScheduler) schedule(topic string, seqId int, forUser types.Uid, expireAt time.Time) {
+	if es == nil {
+		return
+	}
+
+	if globals.cluster.isRemoteTopic(topic) {
+		// Another node is responsible for this topic.
+		return
+	}
+
+	key := expiryKey{expiryTarget{topic, forUser}, seqId}
+	es.mu.Lock()
+	if _, ok := es.inflight[key]; ok || !expireAt.Before(es.horizon) {
+		// The message is being deleted already or will be loaded from the database when the time comes.
+		es.mu.Unlock()
+		return
+	}
+	first := es.put(key, expireAt)
+	es.mu.Unlock()
+
+	if first {
+		es.notify()
+	}
+}
+
+// put adds or updates the entry. Returns true if the entry is now the first to expire.
+// Must be called with es.mu held.
+func (es *expiryScheduler) put(key expiryKey, expireAt time.Time) bool {
+	if e := es.entries[key]; e != nil {
+		e.expireAt = expireAt
+		heap.Fix(&es.queue, e.index)
+	} else {
+		e = &expiryEntry{expiryKey: key, expireAt: expireAt}
+		heap.Push(&es.queue, e)
+		es.entries[key] = e
+	}
+	return es.queue[0].expiryKey == key
+}
+
+// notify wakes up the scheduler without blocking.
+func (es *expiryScheduler) notify() {
+	select {
+	case es.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// retry reschedules messages which could not be deleted.
+func (es *expiryScheduler) retry(target expiryTarget, seqIds []int) {
+	expireAt := time.Now().Add(expiryRetryDelay)
+	es.mu.Lock()
+	for _, seq := range seqIds {
+		key := expiryKey{target, seq}
+		delete(es.inflight, key)
+		es.put(key, expireAt)
+	}
+	es.mu.Unlock()
+}
+
+// deleted marks messages handed over for deletion as done: they are deleted or no longer need to be.
+// It's safe to call on a nil scheduler.
+func (es *expiryScheduler) deleted(target expiryTarget, seqIds []int) {
+	if es == nil {
+		return
+	}
+
+	es.mu.Lock()
+	for _, seq := range seqIds {
+		delete(es.inflight, expiryKey{target, seq})
+	}
+	es.mu.Unlock()
+}
+
+// load fetches messages which expire soon from the database and advances the horizon. Messages in topics
+// which belong to other cluster nodes are skipped and don't count toward the load limit.
+func (es *expiryScheduler) load(now time.Time) {
+	horizon := now.Add(expiryLoadWindow)
+	msgs, more, err := loadExpiring(store.Messages.GetExpiredList, horizon)
+	if err != nil {
+		logs.Warn.Println("expiry: failed to load expiring messages:", err)
+		horizon = now
+	} else if more {
+		// More messages are waiting in the database. Load them after the last one is deleted.
+		horizon = msgs[len(msgs)-1].ExpiredAt
+	}
+
+	exps, more, err := loadExpiring(store.Messages.GetExpiredForUserList, horizon)
+	if err != nil {
+		logs.Warn.Println("expiry: failed to load expiring messages for users:", err)
+		horizon = now
+	} else if more {
+		horizon = exps[len(exps)-1].ExpiredAt
+	}
+
+	// The horizon is in the past if the loaded messages are overdue. Don't reload them in a tight loop:
+	// they are deleted right away and the messages after them are loaded on the next pass.
+	if earliest := now.Add(expiryRetryDelay); horizon.Before(earliest) {
+		horizon = earliest
+	}
+
+	es.mu.Lock()
+	es.horizon = horizon
+	for key, since := range es.inflight {
+		if now.Sub(since) > expiryInflightTimeout {
+			delete(es.inflight, key)
+		}
+	}
+	for i := range msgs {
+		msg := &msgs[i]
+		if !msg.ExpiredAt.Before(horizon) {
+			continue
+		}
+		if key := (expiryKey{expiryTarget{topic: msg.Topic}, msg.SeqId}); !es.isInflight(key) {
+			es.put(key, msg.ExpiredAt)
+		}
+	}
+	for i := range exps {
+		exp := &exps[i]
+		if !exp.ExpiredAt.Before(horizon) {
+			continue
+		}
+		if key := (expiryKey{expiryTarget{exp.Topic, types.ParseUid(exp.User)}, exp.SeqId}); !es.isInflight(key) {
+			es.put(key, exp.ExpiredAt)
+		}
+	}
+	es.mu.Unlock()
+}
+
+// loadExpiring pages through messages which expire before the given time and returns up to about
+// expiryLoadLimit of them in topics handled by this node. Returns true if there are more such messages.
+func loadExpiring(fetch func(*types.MessageExpiry, time.Time, int) ([]types.MessageExpiry, error),
+	before time.Time) ([]types.MessageExpiry, bool, error) {
+	var local []types.MessageExpiry
+	var after *types.MessageExpiry
+	for {
+		page, err := fetch(after, before, expiryLoadLimit)
+		if err != nil {
+			return local, false, err
+		}
+		for i := range page {
+			if !globals.cluster.isRemoteTopic(page[i].Topic) {
+				local = append(local, page[i])
+			}
+		}
+		if len(page) < expiryLoadLimit {
+			return local, false, nil
+		}
+		if len(local) >= expiryLoadLimit {
+			return local, true, nil
+		}
+		// Continue after the last message of the page.
+		after = &page[len(page)-1]
+	}
+}
+
+// isInflight checks if the message was handed over for deletion. Must be called with es.mu held.
+func (es *expiryScheduler) isInflight(key expiryKey) bool {
+	_, ok := es.inflight[key]
+	return ok
+}
+
+// rehash drops messages in topics which moved to other cluster nodes and reloads
+// messages from the database to pick up topics which moved to this node.
+func (es *expiryScheduler) rehash() {
+	if es == nil {
+		return
+	}
+
+	es.mu.Lock()
+	for key, e := range es.entries {
+		if globals.cluster.isRemoteTopic(key.topic) {
+			heap.Remove(&es.queue, e.index)
+			delete(es.entries, key)
+		}
+	}
+	es.mu.Unlock()
+
+	es.reload()
+}
+
+// reload makes the scheduler reload expiring messages from the database, e.g. after
+// expiration times were changed in bulk. It's safe to call on a nil scheduler.
+func (es *expiryScheduler) reload() {
+	if es == nil {
+		return
+	}
+
+	es.mu.Lock()
+	es.horizon = time.Time{}
+	es.mu.Unlock()
+
+	es.notify()
+}
+
+// popExpired removes messages which expire before the given time from the queue and returns them grouped
+// by topic and user. The messages stay in flight until they are reported as deleted or retried.
+func (es *expiryScheduler) popExpired(now time.Time) map[expiryTarget][]int {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	var expired map[expiryTarget][]int
+	for len(es.queue) > 0 && !es.queue[0].expireAt.After(now) {
+		e := heap.Pop(&es.queue).(*expiryEntry)
+		delete(es.entries, e.expiryKey)
+		es.inflight[e.expiryKey] = now
+		if expired == nil {
+			expired = make(map[expiryTarget][]int)
+		}
+		expired[e.expiryTarget] = append(expired[e.expiryTarget], e.seqId)
+	}
+	return expired
+}
+
+// nextWakeup returns the time until the first message expires or until the horizon is reached, whichever comes first.
+func (es *expiryScheduler) nextWakeup(now time.Time) time.Duration {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	next := es.horizon
+	if len(es.queue) > 0 && es.queue[0].expireAt.Before(next) {
+		next = es.queue[0].expireAt
+	}
+	if next.Before(now) {
+		return 0
+	}
+	return next.Sub(now)
+}
+
+func (es *expiryScheduler) run() {
+	// Catch up with messages which were read while the server was down.
+	if err := store.Messages.UpdateMissExpired(); err != nil {
+		logs.Warn.Println("expiry: failed to update missed expiration times:", err)
+	}
+	// Messages sent before the lifetime limit was configured must obey it too.
+	if globals.msgMaxLifetime > 0 {
+		if err := store.Messages.ApplyLifetime("", globals.msgMaxLifetime); err != nil {
+			logs.Warn.Println("expiry: failed to apply message lifetime:", err)
+		}
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-es.wakeup:
+		case <-es.done:
+			return
+		}
+
+		now := time.Now()
+		es.mu.Lock()
+		reload := !now.Before(es.horizon)
+		es.mu.Unlock()
+		if reload {
+			es.load(now)
+		}
+
+		for target, seqIds := range es.popExpired(now) {
+			es.expire(target, seqIds)
+		}
+
+		timer.Reset(es.nextWakeup(time.Now()))
+	}
+}
+
+// expire deletes expired messages: loaded topics delete the messages themselves and notify subscribers,
+// messages in topics which are not loaded are deleted directly from the database.
+func (es *expiryScheduler) expire(target expiryTarget, seqIds []int) {
+	if globals.cluster.isRemoteTopic(target.topic) {
+		// The topic has moved to another node which will load the messages from the database.
+		es.deleted(target, seqIds)
+		return
+	}
+	if globals.cluster.isPartitioned() {
+		// Don't delete anything while this node is cut off from the majority of the cluster:
+		// the topic may have already moved to another node.
+		es.retry(target, seqIds)
+		return
+	}
+
+	if t := globals.hub.topicGet(target.topic); t != nil && t.expire != nil {
+		select {
+		case t.expire <- &expiredMessages{forUser: target.user, seqIds: seqIds}:
+		default:
+			// The topic is busy, try again later.
+			es.retry(target, seqIds)
+		}
+		return
+	}
+
+	stopic, err := store.Topics.Get(target.topic)
+	if err != nil {
+		logs.Warn.Printf("expiry: failed to delete messages in topic[%s]: %v", target.topic, err)
+		es.retry(target, seqIds)
+		return
+	}
+	if stopic == nil {
+		es.deleted(target, seqIds)
+		return
+	}
+
+	ranges := seqIdsToRanges(seqIds)
+	if err = deleteExpiredMessages(target.topic, stopic.DelId+1, target.user, ranges); err != nil {
+		logs.Warn.Printf("expiry: failed to delete messages in topic[%s]: %v", target.topic, err)
+		es.retry(target, seqIds)
+		return
+	}
+	es.deleted(target, seqIds)
+
+	// The topic is not loaded, so no one is online: tell the devices to purge the messages.
+	uids := []types.Uid{target.user}
+	if target.user.IsZero() {
+		uids = nil
+		subs, err := store.Topics.GetSubs(target.topic, nil)
+		if err != nil {
+			logs.Warn.Printf("expiry: failed to load subscribers of topic[%s]: %v", target.topic, err)
+		}
+		for i := range subs {
+			if (subs[i].ModeGiven & subs[i].ModeWant).IsReader() {
+				uids = append(uids, types.ParseUid(subs[i].User))
+			}
+		}
+	}
+	sendPush(pushForExpired(target.topic, uids, ranges, types.TimeNow()))
+}
+
+// handleExpiredMessages deletes expired messages and notifies subscribers. The messages are
+// hard-deleted unless they expired for a single user.
+func (t *Topic) handleExpiredMessages(exp *expiredMessages) {
+	target := expiryTarget{topic: t.name, user: exp.forUser}
+	if t.isInactive() {
+		// The topic is paused or being deleted. If it's being deleted, the retry will find no topic.
+		globals.expiry.retry(target, exp.seqIds)
+		return
+	}
+
+	ranges := seqIdsToRanges(exp.seqIds)
+	if err := deleteExpiredMessages(t.name, t.delID+1, exp.forUser, ranges); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to delete expired messages: %v", t.name, err)
+		globals.expiry.retry(target, exp.seqIds)
+		return
+	}
+	globals.expiry.deleted(target, exp.seqIds)
+
+	t.delID++
+	dr := rangeDeserialize(ranges)
+	var uids []types.Uid
+	if exp.forUser.IsZero() {
+		for uid, pud := range t.perUser {
+			pud.delID = t.delID
+			t.perUser[uid] = pud
+			if !pud.deleted && (pud.modeGiven & pud.modeWant).IsReader() {
+				uids = append(uids, uid)
+			}
+		}
+
+		// Broadcast the change to all, online and offline.
+		params := &presParams{delID: t.delID, delSeq: dr}
+		filters := &presFilters{filterIn: types.ModeRead}
+		t.presSubsOnline("del", "", params, filters, "")
+		t.presSubsOffline("del", params, filters, nilPresFilters, "", true, &ServerComMessage{})
+	} else if pud, ok := t.perUser[exp.forUser]; ok {
+		pud.delID = t.delID
+		t.perUser[exp.forUser] = pud
+
+		// Notify the user's sessions.
+		t.presPubMessageDelete(exp.forUser, pud.modeGiven&pud.modeWant, t.delID, dr, "")
+		uids = append(uids, exp.forUser)
+	}
+
+	// Sessions in the background miss the notifications above, purge the messages with a silent push.
+	sendPush(pushForExpired(t.name, uids, ranges, types.TimeNow()))
+}
+
+// deleteExpiredMessages deletes expired messages from the database. Messages deleted for
+// everyone take their attachments with them unless the files are still used elsewhere.
+func deleteExpiredMessages(topic string, delID int, forUser types.Uid, ranges []types.Range) error {
+	var fids []string
+	if forUser.IsZero() {
+		var err error
+		// Attachment links are removed with the messages, collect the files before the deletion.
+		if fids, err = store.Messages.GetAttachments(topic, ranges); err != nil {
+			return err
+		}
+	}
+
+	if err := store.Messages.DeleteList(topic, delID, forUser, 0, ranges); err != nil {
+		return err
+	}
+
+	if len(fids) > 0 {
+		if err := store.Files.DeleteIfUnused(fids); err != nil {
+			// Not a fatal error: the files will be removed by the garbage collector.
+			logs.Warn.Printf("topic[%s]: failed to delete attachments of expired messages: %v", topic, err)
+		}
+	}
+	return nil
+}
+
+// seqIdsToRanges converts unsorted message IDs to ranges.
+func seqIdsToRanges(seqIds []int) []types.Range {
+	sort.Ints(seqIds)
+	return types.SliceToRanges(seqIds)
+}
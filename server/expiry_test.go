@@ -0,0 +1,340 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	rh "github.com/tinode/chat/server/ringhash"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestMsgExpirePeriod(t *testing.T) {
+	defer func(def, min, max int) {
+		globals.msgExpireDefault, globals.msgExpireMin, globals.msgExpireMax = def, min, max
+	}(globals.msgExpireDefault, globals.msgExpireMin, globals.msgExpireMax)
+
+	testCases := []struct {
+		name      string
+		def       int
+		min       int
+		max       int
+		retention *types.MessageRetention
+		subPeriod int
+		requested int
+		expected  int
+	}{
+		{name: "server default", def: 86400, subPeriod: -1, expected: 86400},
+		{name: "topic policy", def: 86400, retention: &types.MessageRetention{Period: 3600}, subPeriod: -1, expected: 3600},
+		{name: "subscription over topic", def: 86400, retention: &types.MessageRetention{Period: 3600},
+			subPeriod: 600, expected: 600},
+		{name: "sender over subscription", def: 86400, subPeriod: 600, requested: 60, expected: 60},
+		{name: "enforced topic policy", def: 86400, retention: &types.MessageRetention{Period: 3600, Enforced: true},
+			subPeriod: 600, requested: 60, expected: 3600},
+		{name: "enforced server default", def: 86400, retention: &types.MessageRetention{Enforced: true},
+			requested: 60, expected: 86400},
+		{name: "never expire", def: -1, subPeriod: -1, expected: -1},
+		{name: "never expire clamped", def: -1, max: 7200, subPeriod: -1, expected: 7200},
+		{name: "clamped to min", def: 86400, min: 300, requested: 60, expected: 300},
+		{name: "clamped to max", def: 86400, max: 7200, requested: 86400, expected: 7200},
+	}
+
+	for _, tc := range testCases {
+		globals.msgExpireDefault, globals.msgExpireMin, globals.msgExpireMax = tc.def, tc.min, tc.max
+		topic := &Topic{retention: tc.retention}
+		if period := topic.msgExpirePeriod(&perUserData{expirePeriod: tc.subPeriod}, tc.requested); period != tc.expected {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.expected, period)
+		}
+	}
+}
+
+func TestSeqIdsToRanges(t *testing.T) {
+	ranges := seqIdsToRanges([]int{7, 2, 1, 5, 3})
+	expected := []types.Range{{Low: 1, Hi: 4}, {Low: 5}, {Low: 7}}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("expected %v, got %v", expected, ranges)
+	}
+	if ranges = seqIdsToRanges(nil); len(ranges) != 0 {
+		t.Errorf("expected no ranges, got %v", ranges)
+	}
+}
+
+// expiryTestCluster makes globals.cluster a two-node cluster and returns names of two topics:
+// one owned by this node and one owned by the other node.
+func expiryTestCluster(t *testing.T) (string, string) {
+	t.Helper()
+	ring := rh.New(clusterHashReplicas, nil)
+	ring.Add("this", "other")
+	globals.cluster = &Cluster{thisNodeName: "this", ring: ring}
+	t.Cleanup(func() {
+		globals.cluster = nil
+	})
+
+	var local, remote string
+	for i := 0; local == "" || remote == ""; i++ {
+		name := "grp" + types.Uid(i+1).String()
+		if ring.Get(name) == "this" {
+			local = name
+		} else {
+			remote = name
+		}
+	}
+	return local, remote
+}
+
+func expiryTestStore(t *testing.T) *mock_store.MockMessagesPersistenceInterface {
+	t.Helper()
+	ctrl := gomock.NewController(t)
+	mm := mock_store.NewMockMessagesPersistenceInterface(ctrl)
+	store.Messages = mm
+	t.Cleanup(func() {
+		store.Messages = nil
+	})
+	return mm
+}
+
+func TestExpirySchedulerLoad(t *testing.T) {
+	mm := expiryTestStore(t)
+	uid := types.Uid(10)
+	now := time.Now()
+	past, soon := now.Add(-time.Minute), now.Add(time.Minute)
+
+	msgs := []types.MessageExpiry{{Topic: "grpA", SeqId: 1, ExpiredAt: past}, {Topic: "grpB", SeqId: 2, ExpiredAt: soon}}
+	exps := []types.MessageExpiry{{Topic: "grpA", SeqId: 3, User: uid.String(), ExpiredAt: past}}
+	mm.EXPECT().GetExpiredList(nil, now.Add(expiryLoadWindow), expiryLoadLimit).Return(msgs, nil).Times(2)
+	mm.EXPECT().GetExpiredForUserList(nil, now.Add(expiryLoadWindow), expiryLoadLimit).Return(exps, nil).Times(2)
+
+	es := newExpiryScheduler()
+	es.load(now)
+	if !es.horizon.Equal(now.Add(expiryLoadWindow)) {
+		t.Errorf("expected horizon %v, got %v", now.Add(expiryLoadWindow), es.horizon)
+	}
+	if len(es.queue) != 3 {
+		t.Fatalf("expected 3 messages in the queue, got %d", len(es.queue))
+	}
+
+	expired := es.popExpired(now)
+	expected := map[expiryTarget][]int{{topic: "grpA"}: {1}, {topic: "grpA", user: uid}: {3}}
+	if !reflect.DeepEqual(expired, expected) {
+		t.Errorf("expected %v, got %v", expected, expired)
+	}
+	if len(es.queue) != 1 || es.queue[0].topic != "grpB" {
+		t.Errorf("only grpB must remain in the queue")
+	}
+
+	// Messages which are being deleted are still in the database but must not be loaded again.
+	es.load(now)
+	if len(es.queue) != 1 {
+		t.Errorf("messages in flight must not be reloaded, queue length %d", len(es.queue))
+	}
+	es.schedule("grpA", 1, types.ZeroUid, past)
+	if len(es.queue) != 1 {
+		t.Errorf("messages in flight must not be rescheduled, queue length %d", len(es.queue))
+	}
+
+	// Failed deletions are retried.
+	es.retry(expiryTarget{topic: "grpA"}, []int{1})
+	es.deleted(expiryTarget{topic: "grpA", user: uid}, []int{3})
+	if len(es.inflight) != 0 {
+		t.Errorf("expected no messages in flight, got %v", es.inflight)
+	}
+	if len(es.queue) != 2 || es.queue[0].topic != "grpA" || es.queue[0].seqId != 1 {
+		t.Errorf("failed message must be rescheduled")
+	}
+}
+
+func TestExpirySchedulerLoadSkipsRemote(t *testing.T) {
+	local, remote := expiryTestCluster(t)
+	mm := expiryTestStore(t)
+	now := time.Now()
+	overdue := now.Add(-time.Hour)
+
+	// A full page of overdue messages of a topic owned by another node, followed by one local message.
+	page := make([]types.MessageExpiry, expiryLoadLimit)
+	for i := range page {
+		page[i] = types.MessageExpiry{Topic: remote, SeqId: i + 1, ExpiredAt: overdue}
+	}
+	last := page[len(page)-1]
+	horizon := now.Add(expiryLoadWindow)
+	gomock.InOrder(
+		mm.EXPECT().GetExpiredList(nil, horizon, expiryLoadLimit).Return(page, nil),
+		mm.EXPECT().GetExpiredList(&last, horizon, expiryLoadLimit).
+			Return([]types.MessageExpiry{{Topic: local, SeqId: 1, ExpiredAt: overdue}}, nil),
+	)
+	mm.EXPECT().GetExpiredForUserList(nil, horizon, expiryLoadLimit).Return(nil, nil)
+
+	es := newExpiryScheduler()
+	es.load(now)
+	if len(es.queue) != 1 || es.queue[0].topic != local {
+		t.Fatalf("expected the local message only, got %d messages", len(es.queue))
+	}
+	if !es.horizon.Equal(horizon) {
+		t.Errorf("expected horizon %v, got %v", horizon, es.horizon)
+	}
+}
+
+func TestExpirySchedulerHorizon(t *testing.T) {
+	mm := expiryTestStore(t)
+	now := time.Now()
+	overdue := now.Add(-time.Hour)
+
+	// The load limit is hit with overdue messages.
+	page := make([]types.MessageExpiry, expiryLoadLimit)
+	for i := range page {
+		page[i] = types.MessageExpiry{Topic: "grpA", SeqId: i + 1, ExpiredAt: overdue}
+	}
+	mm.EXPECT().GetExpiredList(nil, now.Add(expiryLoadWindow), expiryLoadLimit).Return(page, nil)
+	mm.EXPECT().GetExpiredForUserList(nil, overdue, expiryLoadLimit).Return(nil, nil)
+
+	es := newExpiryScheduler()
+	es.load(now)
+	if !es.horizon.After(now) {
+		t.Errorf("horizon %v must be after now %v", es.horizon, now)
+	}
+	if es.nextWakeup(now) != 0 {
+		t.Error("overdue messages must be deleted right away")
+	}
+	es.popExpired(now)
+	if wakeup := es.nextWakeup(now); wakeup <= 0 {
+		t.Errorf("scheduler must not reload in a tight loop, next wakeup in %v", wakeup)
+	}
+}
+
+func TestExpirySchedulerRehash(t *testing.T) {
+	local, remote := expiryTestCluster(t)
+	now := time.Now()
+
+	es := newExpiryScheduler()
+	es.horizon = now.Add(expiryLoadWindow)
+	es.schedule(local, 1, types.ZeroUid, now.Add(time.Minute))
+	es.schedule(remote, 1, types.ZeroUid, now.Add(time.Minute))
+	if len(es.queue) != 1 {
+		t.Fatalf("messages of remote topics must not be scheduled, queue length %d", len(es.queue))
+	}
+
+	// The other node leaves the cluster: all topics become local.
+	ring := rh.New(clusterHashReplicas, nil)
+	ring.Add("this")
+	globals.cluster.ring = ring
+	es.schedule(remote, 1, types.ZeroUid, now.Add(time.Minute))
+	if len(es.queue) != 2 {
+		t.Fatalf("expected 2 messages in the queue, got %d", len(es.queue))
+	}
+
+	// The other node is back.
+	ring = rh.New(clusterHashReplicas, nil)
+	ring.Add("this", "other")
+	globals.cluster.ring = ring
+	es.rehash()
+	if len(es.queue) != 1 || len(es.entries) != 1 || es.queue[0].topic != local {
+		t.Errorf("messages of topics which moved away must be dropped, queue length %d", len(es.queue))
+	}
+	if !es.horizon.IsZero() {
+		t.Error("rehash must trigger a reload")
+	}
+}
+
+func TestPresPubMessagesExpired(t *testing.T) {
+	uid1, uid2 := types.Uid(1), types.Uid(2)
+	// The user has one session attached to both the topic and 'me', and a session attached to 'me' only.
+	both := &Session{sid: "both", uid: uid1, send: make(chan any, 10)}
+	meOnly := &Session{sid: "me", uid: uid1, send: make(chan any, 10)}
+	other := &Session{sid: "other", uid: uid2, send: make(chan any, 10)}
+
+	globals.hub = &Hub{topics: &sync.Map{}}
+	defer func() {
+		globals.hub = nil
+	}()
+	me := &Topic{name: uid1.UserId(), sessions: map[*Session]perSessionData{both: {uid: uid1}, meOnly: {uid: uid1}}}
+	globals.hub.topics.Store(uid1.UserId(), me)
+
+	topic := &Topic{
+		name:      "grpTest",
+		xoriginal: "grpTest",
+		cat:       types.TopicCatGrp,
+		perUser:   map[types.Uid]perUserData{uid1: {}, uid2: {}},
+		sessions:  map[*Session]perSessionData{both: {uid: uid1}, other: {uid: uid2}},
+	}
+
+	expired := []MsgExpiry{{SeqId: 1, ExpirePeriod: 60}, {SeqId: 2, ExpirePeriod: 60}}
+	topic.presPubMessagesExpired("grpTest", uid2.UserId(), types.ZeroUid, expired)
+	for _, sess := range []*Session{both, meOnly, other} {
+		if len(sess.send) != 1 {
+			t.Fatalf("session %s: expected one notification, got %d", sess.sid, len(sess.send))
+		}
+		pres := (<-sess.send).(*ServerComMessage).Pres
+		if pres == nil || pres.What != "updateMsg" || len(pres.Expired) != 2 {
+			t.Errorf("session %s: unexpected notification %+v", sess.sid, pres)
+		}
+	}
+
+	// Messages expiring for one user only are not sent to others.
+	topic.presPubMessagesExpired("grpTest", uid2.UserId(), uid1, expired[:1])
+	if len(both.send) != 1 || len(meOnly.send) != 1 || len(other.send) != 0 {
+		t.Errorf("expected notifications to the reader only, got %d, %d, %d",
+			len(both.send), len(meOnly.send), len(other.send))
+	}
+}
+
+func TestExpireReleased(t *testing.T) {
+	uid1, uid2, uid3 := types.Uid(1), types.Uid(2), types.Uid(3)
+	globals.hub = &Hub{topics: &sync.Map{}}
+	defer func() {
+		globals.hub = nil
+	}()
+
+	newTopic := func() *Topic {
+		return &Topic{
+			name:      "grpTest",
+			xoriginal: "grpTest",
+			cat:       types.TopicCatGrp,
+			lastID:    5,
+			retention: &types.MessageRetention{Trigger: types.MsgExpireAllRead},
+			perUser: map[types.Uid]perUserData{
+				uid1: {readID: 5, modeWant: types.ModeCFull, modeGiven: types.ModeCFull},
+				uid2: {readID: 4, modeWant: types.ModeCPublic, modeGiven: types.ModeCPublic},
+				uid3: {readID: 2, modeWant: types.ModeCPublic, modeGiven: types.ModeCPublic},
+			},
+			sessions: map[*Session]perSessionData{},
+		}
+	}
+	msgs := []types.Message{
+		{SeqId: 3, From: uid1.UserId(), ExpirePeriod: 60},
+		{SeqId: 4, From: uid1.UserId(), ExpirePeriod: 60},
+		{SeqId: 5, From: uid1.UserId(), ExpirePeriod: 60},
+	}
+
+	// The slowest reader mutes the topic: messages read by everyone else expire.
+	mm := expiryTestStore(t)
+	mm.EXPECT().GetListBySeqIdRange("grpTest", types.ZeroUid, 3, 5).Return(msgs, nil)
+	mm.EXPECT().UpdateMessage("grpTest", 3, gomock.Any()).Return(nil)
+	mm.EXPECT().UpdateMessage("grpTest", 4, gomock.Any()).Return(nil)
+	topic := newTopic()
+	old := topic.perUser[uid3]
+	muted := old
+	muted.modeWant &= ^types.ModePres
+	topic.perUser[uid3] = muted
+	topic.expireReleased(uid3, old)
+
+	// A subscriber who was not the slowest reader leaves: nothing changes.
+	mm.EXPECT().GetListBySeqIdRange("grpTest", types.ZeroUid, 5, 5).Return(msgs[2:], nil)
+	topic = newTopic()
+	old = topic.perUser[uid2]
+	delete(topic.perUser, uid2)
+	topic.expireReleased(uid2, old)
+
+	// The subscriber is still a reader: nothing to do.
+	topic = newTopic()
+	topic.expireReleased(uid3, topic.perUser[uid3])
+
+	// Other triggers are not affected.
+	topic = newTopic()
+	topic.retention = nil
+	old = topic.perUser[uid3]
+	delete(topic.perUser, uid3)
+	topic.expireReleased(uid3, old)
+}
@@ -0,0 +1,617 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Synchronization of Feishu (Lark) organization directory: departments and
+ *    their members are mirrored into user accounts, user tags and a group topic
+ *    per department.
+ *
+ *    The apps need the contact:contact.base:readonly, contact:department.base:readonly
+ *    and contact:user.base:readonly permissions.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	authfeishu "github.com/tinode/chat/server/auth/feishu"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default base URL of Feishu API. Lark international uses https://open.larksuite.com.
+	feishuDefaultBaseURL = "https://open.feishu.cn"
+
+	feishuTokenPath      = "/open-apis/auth/v3/tenant_access_token/internal"
+	feishuDeptPath       = "/open-apis/contact/v3/departments/"
+	feishuDeptUsersPath  = "/open-apis/contact/v3/users/find_by_department"
+	feishuDeptPageSize   = 50
+	feishuRootDepartment = "0"
+
+	// Users are matched to Feishu accounts by the authentication record of this scheme or by union ID.
+	feishuAuthScheme = "feishu"
+	// Tag namespace of user's departments, e.g. dept:od-1a2b3c.
+	feishuDeptTagNS = "dept"
+	// Tag namespace which links the group topic to the department, e.g. feishudept:cli_a1b2c3:od-1a2b3c.
+	feishuDeptTopicTagNS = "feishudept"
+)
+
+// Feishu directory sync config.
+type feishuSyncConfig struct {
+	Enabled bool `json:"enabled"`
+	// How often to run the sync (seconds).
+	SyncPeriod int `json:"sync_period"`
+	// Base URL of Feishu API for apps which don't define their own.
+	BaseURL string `json:"base_url"`
+	// ID of the user who owns department topics, e.g. usrAbC123. Topics have no owner if blank.
+	Owner string `json:"owner"`
+}
+
+// feishuDepartment is a department from Feishu directory.
+type feishuDepartment struct {
+	Name             string `json:"name"`
+	OpenDepartmentId string `json:"open_department_id"`
+}
+
+// feishuMember is a user from Feishu directory.
+type feishuMember struct {
+	UnionId string `json:"union_id"`
+	Name    string `json:"name"`
+	Avatar  struct {
+		Avatar240 string `json:"avatar_240"`
+	} `json:"avatar"`
+	Status struct {
+		IsFrozen   bool `json:"is_frozen"`
+		IsResigned bool `json:"is_resigned"`
+	} `json:"status"`
+
+	// Open IDs of the departments the user belongs to, filled in while listing departments.
+	departments []string
+}
+
+// active checks if the Feishu account is usable.
+func (m *feishuMember) active() bool {
+	return !m.Status.IsFrozen && !m.Status.IsResigned
+}
+
+// feishuSync copies Feishu directory of every configured app into the store.
+type feishuSync struct {
+	baseURL    string
+	owner      types.Uid
+	httpClient *http.Client
+}
+
+func newFeishuSync(conf *feishuSyncConfig) (*feishuSync, error) {
+	fs := &feishuSync{
+		baseURL:    feishuDefaultBaseURL,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+	if conf.BaseURL != "" {
+		fs.baseURL = strings.TrimSuffix(conf.BaseURL, "/")
+	}
+	if conf.Owner != "" {
+		if fs.owner = types.ParseUserId(conf.Owner); fs.owner.IsZero() {
+			return nil, errors.New("invalid owner '" + conf.Owner + "'")
+		}
+	}
+	if conf.SyncPeriod <= 0 {
+		return nil, errors.New("invalid sync_period")
+	}
+
+	// Users must not be able to change their departments.
+	globals.immutableTagNS[feishuDeptTagNS] = true
+	globals.immutableTagNS[feishuDeptTopicTagNS] = true
+
+	return fs, nil
+}
+
+// start runs the sync right away, then periodically. Send to the returned channel to stop it.
+func (fs *feishuSync) start(period time.Duration) chan<- bool {
+	// Unbuffered stop channel. Whomever stops the sync must wait for the current run to finish.
+	stop := make(chan bool)
+	go func() {
+		// Add some randomness to the tick period like the account GC does.
+		period = period - (period >> 2) + time.Duration(rand.Intn(int(period>>1)))
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		logs.Info.Printf("Feishu directory sync started with period %s", period.Round(time.Second))
+		// Only the node which hosts 'sys' topic runs the sync.
+		if !globals.cluster.isRemoteTopic("sys") {
+			fs.syncAll()
+		}
+		for {
+			select {
+			case <-ticker.C:
+				if globals.cluster.isRemoteTopic("sys") {
+					continue
+				}
+				fs.syncAll()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
+
+// syncAll syncs the directory of every Feishu app.
+func (fs *feishuSync) syncAll() {
+	apps, err := store.FeishuApps.GetAll()
+	if err != nil {
+		logs.Warn.Println("feishu sync: failed to get apps", err)
+		return
+	}
+	for i := range apps {
+		if err = fs.syncApp(&apps[i]); err != nil {
+			logs.Warn.Println("feishu sync: app", apps[i].AppId, "failed:", err)
+		}
+	}
+}
+
+// syncApp fetches the full directory of the app, then applies it. The directory is applied only if
+// it was fetched completely, otherwise users missing from the partial directory would be suspended.
+func (fs *feishuSync) syncApp(app *types.FeishuApp) error {
+	token, err := fs.tenantAccessToken(app)
+	if err != nil {
+		return err
+	}
+
+	depts, err := fs.departments(app, token)
+	if err != nil {
+		return err
+	}
+
+	members := make(map[string]*feishuMember)
+	deptMembers := make(map[string][]*feishuMember, len(depts))
+	for _, dept := range depts {
+		list, err := fs.departmentMembers(app, token, dept.OpenDepartmentId)
+		if err != nil {
+			return err
+		}
+		for _, m := range list {
+			if known := members[m.UnionId]; known != nil {
+				m = known
+			} else {
+				members[m.UnionId] = m
+			}
+			m.departments = append(m.departments, dept.OpenDepartmentId)
+			deptMembers[dept.OpenDepartmentId] = append(deptMembers[dept.OpenDepartmentId], m)
+		}
+	}
+
+	// Create or update accounts of active members, suspend deactivated ones.
+	uids := make(map[string]types.Uid, len(members))
+	for unionId, m := range members {
+		uid, _, err := authfeishu.FindUser(feishuAuthScheme, unionId)
+		if err != nil {
+			return err
+		}
+		if !m.active() {
+			if !uid.IsZero() {
+				fs.suspendUser(uid)
+			}
+			continue
+		}
+		if uid, err = fs.syncUser(app, uid, m); err != nil {
+			logs.Warn.Println("feishu sync: failed to sync user", unionId, err)
+		}
+		// Keep the user even if the update failed: the account still belongs to an active member.
+		if !uid.IsZero() {
+			uids[unionId] = uid
+		}
+	}
+
+	// Users who were members of department topics but are no longer found in the directory.
+	gone := make(map[types.Uid]bool)
+	for _, dept := range depts {
+		var want []types.Uid
+		for _, m := range deptMembers[dept.OpenDepartmentId] {
+			if uid, ok := uids[m.UnionId]; ok {
+				want = append(want, uid)
+			}
+		}
+		prev, err := fs.syncDeptTopic(app, &dept, want)
+		if err != nil {
+			logs.Warn.Println("feishu sync: failed to sync department", dept.OpenDepartmentId, err)
+			continue
+		}
+		for _, uid := range prev {
+			gone[uid] = true
+		}
+	}
+	for _, uid := range uids {
+		delete(gone, uid)
+	}
+	for uid := range gone {
+		fs.suspendUser(uid)
+	}
+
+	return nil
+}
+
+// apiURL builds the URL of Feishu API endpoint for the app.
+func (fs *feishuSync) apiURL(app *types.FeishuApp, path string) string {
+	if app.BaseUrl != "" {
+		return strings.TrimSuffix(app.BaseUrl, "/") + path
+	}
+	return fs.baseURL + path
+}
+
+// callApi makes a GET request to Feishu API and decodes the data part of the response into result.
+func (fs *feishuSync) callApi(app *types.FeishuApp, token, path string, query url.Values, result any) error {
+	req, err := http.NewRequest(http.MethodGet, fs.apiURL(app, path)+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return fs.doRequest(req, result)
+}
+
+func (fs *feishuSync) doRequest(req *http.Request, result any) error {
+	resp, err := fs.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var fr struct {
+		Code int             `json:"code"`
+		Msg  string          `json:"msg"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err = json.Unmarshal(body, &fr); err != nil {
+		return fmt.Errorf("HTTP status %d: %w", resp.StatusCode, err)
+	}
+	if fr.Code != 0 {
+		return fmt.Errorf("feishu error %d: %s", fr.Code, fr.Msg)
+	}
+	if result == nil || len(fr.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(fr.Data, result)
+}
+
+// tenantAccessToken obtains a fresh tenant access token. The sync runs rarely, the token is not cached.
+func (fs *feishuSync) tenantAccessToken(app *types.FeishuApp) (string, error) {
+	payload, _ := json.Marshal(map[string]string{"app_id": app.AppId, "app_secret": app.AppSecret})
+	req, err := http.NewRequest(http.MethodPost, fs.apiURL(app, feishuTokenPath), bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	resp, err := fs.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var tr struct {
+		Code              int    `json:"code"`
+		Msg               string `json:"msg"`
+		TenantAccessToken string `json:"tenant_access_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", err
+	}
+	if tr.Code != 0 || tr.TenantAccessToken == "" {
+		return "", fmt.Errorf("failed to get tenant access token %d: %s", tr.Code, tr.Msg)
+	}
+	return tr.TenantAccessToken, nil
+}
+
+// departments lists the root department and all its descendants.
+func (fs *feishuSync) departments(app *types.FeishuApp, token string) ([]feishuDepartment, error) {
+	query := url.Values{"department_id_type": {"open_department_id"}}
+
+	var root struct {
+		Department feishuDepartment `json:"department"`
+	}
+	if err := fs.callApi(app, token, feishuDeptPath+feishuRootDepartment, query, &root); err != nil {
+		return nil, err
+	}
+	root.Department.OpenDepartmentId = feishuRootDepartment
+	if root.Department.Name == "" {
+		root.Department.Name = app.AppId
+	}
+	depts := []feishuDepartment{root.Department}
+
+	query.Set("fetch_child", "true")
+	query.Set("page_size", strconv.Itoa(feishuDeptPageSize))
+	for {
+		var page struct {
+			HasMore   bool               `json:"has_more"`
+			PageToken string             `json:"page_token"`
+			Items     []feishuDepartment `json:"items"`
+		}
+		if err := fs.callApi(app, token, feishuDeptPath+feishuRootDepartment+"/children", query, &page); err != nil {
+			return nil, err
+		}
+		depts = append(depts, page.Items...)
+		if !page.HasMore || page.PageToken == "" {
+			break
+		}
+		query.Set("page_token", page.PageToken)
+	}
+	return depts, nil
+}
+
+// departmentMembers lists direct members of the department.
+func (fs *feishuSync) departmentMembers(app *types.FeishuApp, token, deptId string) ([]*feishuMember, error) {
+	query := url.Values{
+		"department_id":      {deptId},
+		"department_id_type": {"open_department_id"},
+		"user_id_type":       {"union_id"},
+		"page_size":          {strconv.Itoa(feishuDeptPageSize)},
+	}
+
+	var members []*feishuMember
+	for {
+		var page struct {
+			HasMore   bool            `json:"has_more"`
+			PageToken string          `json:"page_token"`
+			Items     []*feishuMember `json:"items"`
+		}
+		if err := fs.callApi(app, token, feishuDeptUsersPath, query, &page); err != nil {
+			return nil, err
+		}
+		for _, m := range page.Items {
+			if m.UnionId != "" {
+				members = append(members, m)
+			}
+		}
+		if !page.HasMore || page.PageToken == "" {
+			break
+		}
+		query.Set("page_token", page.PageToken)
+	}
+	return members, nil
+}
+
+// feishuPublic updates user's or topic's public with the name and the avatar from Feishu.
+// Returns nil if nothing has changed.
+func feishuPublic(pub any, name, photo string) map[string]any {
+	public, _ := pub.(map[string]any)
+	var currentPhoto string
+	if p, ok := public["photo"].(map[string]any); ok {
+		currentPhoto, _ = p["ref"].(string)
+	}
+	if fn, _ := public["fn"].(string); fn == name && currentPhoto == photo {
+		return nil
+	}
+
+	updated := make(map[string]any, len(public)+2)
+	for k, v := range public {
+		updated[k] = v
+	}
+	updated["fn"] = name
+	if photo != "" {
+		updated["photo"] = map[string]any{"ref": photo}
+	} else {
+		delete(updated, "photo")
+	}
+	return updated
+}
+
+// deptTags returns user tags for the departments. The root department is not tagged: all users are in it.
+func deptTags(depts []string) []string {
+	var tags []string
+	for _, dept := range depts {
+		if dept != feishuRootDepartment {
+			tags = append(tags, feishuDeptTagNS+":"+dept)
+		}
+	}
+	return tags
+}
+
+// syncUser creates the account of an active Feishu user if uid is zero, or updates the existing one.
+// Returns ID of the account.
+func (fs *feishuSync) syncUser(app *types.FeishuApp, uid types.Uid, m *feishuMember) (types.Uid, error) {
+	tags := deptTags(m.departments)
+
+	if uid.IsZero() {
+		// Create account, then add the authentication record for logging in with Feishu.
+		user := types.User{
+			Access:      defaultUserAccess(),
+			Public:      feishuPublic(nil, m.Name, m.Avatar.Avatar240),
+			Tags:        tags,
+			UnionId:     m.UnionId,
+			FeishuAppId: app.AppId,
+		}
+		if _, err := store.Users.Create(&user, nil); err != nil {
+			return types.ZeroUid, err
+		}
+		uid = user.Uid()
+		if err := store.Users.AddAuthRecord(uid, auth.LevelAuth, feishuAuthScheme, m.UnionId, nil, time.Time{}); err != nil {
+			store.Users.Delete(uid, true)
+			return types.ZeroUid, err
+		}
+		logs.Info.Println("feishu sync: created account", uid.UserId(), "for union_id", m.UnionId)
+		return uid, nil
+	}
+
+	user, err := store.Users.Get(uid)
+	if err != nil {
+		return uid, err
+	}
+	if user == nil {
+		return uid, types.ErrUserNotFound
+	}
+
+	update := make(map[string]any)
+	if public := feishuPublic(user.Public, m.Name, m.Avatar.Avatar240); public != nil {
+		update["Public"] = public
+	}
+	if user.UnionId != m.UnionId || user.FeishuAppId == "" {
+		update["UnionId"] = m.UnionId
+		update["FeishuAppId"] = app.AppId
+	}
+	if len(update) > 0 {
+		update["UpdatedAt"] = types.TimeNow()
+		if err = store.Users.Update(uid, update); err != nil {
+			return uid, err
+		}
+	}
+
+	// Bring department tags in step with the directory, leave other tags alone.
+	want := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		want[tag] = true
+	}
+	var remove []string
+	for _, tag := range user.Tags {
+		if strings.HasPrefix(tag, feishuDeptTagNS+":") && !want[tag] {
+			remove = append(remove, tag)
+		}
+		delete(want, tag)
+	}
+	var add []string
+	for tag := range want {
+		add = append(add, tag)
+	}
+	if len(add) > 0 || len(remove) > 0 {
+		if _, err = store.Users.UpdateTags(uid, add, remove, nil); err != nil {
+			return uid, err
+		}
+	}
+
+	return uid, nil
+}
+
+// syncDeptTopic creates the group topic of the department or updates its name, then makes topic
+// subscribers match the department members. Returns the members the topic had before the update.
+func (fs *feishuSync) syncDeptTopic(app *types.FeishuApp, dept *feishuDepartment, members []types.Uid) ([]types.Uid, error) {
+	tag := feishuDeptTopicTagNS + ":" + app.AppId + ":" + dept.OpenDepartmentId
+	name, err := store.Users.FindOne(tag)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := false
+	if name == "" {
+		name = globals.cluster.genLocalTopicName()
+		stopic := &types.Topic{
+			ObjHeader: types.ObjHeader{Id: name},
+			// Only department members have access.
+			Access: types.DefaultAccess{Auth: types.ModeNone, Anon: types.ModeNone},
+			Public: feishuPublic(nil, dept.Name, ""),
+			Tags:   types.StringSlice{tag},
+		}
+		if !fs.owner.IsZero() {
+			stopic.GiveAccess(fs.owner, types.ModeCFull, types.ModeCFull)
+		}
+		if err = store.Topics.Create(stopic, fs.owner, nil); err != nil {
+			return nil, err
+		}
+		logs.Info.Println("feishu sync: created topic", name, "for department", dept.OpenDepartmentId)
+	} else {
+		stopic, err := store.Topics.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		if stopic == nil {
+			return nil, types.ErrTopicNotFound
+		}
+		if public := feishuPublic(stopic.Public, dept.Name, ""); public != nil {
+			if err = store.Topics.Update(name, map[string]any{"Public": public, "UpdatedAt": types.TimeNow()}); err != nil {
+				return nil, err
+			}
+			changed = true
+		}
+	}
+
+	subs, err := store.Topics.GetSubs(name, nil)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[types.Uid]bool, len(subs))
+	for i := range subs {
+		if uid := types.ParseUid(subs[i].User); uid != fs.owner {
+			current[uid] = true
+		}
+	}
+
+	prev := make([]types.Uid, 0, len(current))
+	for uid := range current {
+		prev = append(prev, uid)
+	}
+
+	mode := types.ModeCPublic
+	for _, uid := range members {
+		if current[uid] {
+			delete(current, uid)
+			continue
+		}
+		if err = store.Subs.Create(&types.Subscription{
+			User:      uid.String(),
+			Topic:     name,
+			ModeWant:  mode,
+			ModeGiven: mode,
+		}); err != nil {
+			logs.Warn.Println("feishu sync: failed to subscribe", uid.UserId(), "to", name, err)
+			continue
+		}
+		// Let the user's 'me' topic know about the new subscription.
+		presSingleUserOfflineOffline(uid, name, "acs",
+			&presParams{dWant: mode.String(), dGiven: mode.String(), actor: fs.owner.UserId()}, "")
+		changed = true
+	}
+
+	// Remaining subscribers are no longer members of the department.
+	for uid := range current {
+		if err = store.Subs.Delete(name, uid); err != nil {
+			logs.Warn.Println("feishu sync: failed to unsubscribe", uid.UserId(), "from", name, err)
+			continue
+		}
+		presSingleUserOfflineOffline(uid, name, "gone", nilPresParams, "")
+		changed = true
+	}
+
+	if changed {
+		// The topic may be loaded with stale subscriptions.
+		reloadTopic(name)
+	}
+
+	return prev, nil
+}
+
+// suspendUser suspends the account of a Feishu user. Accounts which are not linked to Feishu, e.g. added
+// to a department topic by its owner, are left alone. Accounts are not resumed automatically: it's up to
+// the administrator.
+func (fs *feishuSync) suspendUser(uid types.Uid) {
+	user, err := store.Users.Get(uid)
+	if err != nil || user == nil {
+		logs.Warn.Println("feishu sync: failed to get user", uid.UserId(), err)
+		return
+	}
+	if user.UnionId == "" || user.State != types.StateOK {
+		return
+	}
+	if changed, err := updateUserState(uid, user, types.StateSuspended); err != nil {
+		logs.Warn.Println("feishu sync: failed to suspend user", uid.UserId(), err)
+	} else if changed {
+		logs.Info.Println("feishu sync: suspended user", uid.UserId())
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/push/pushtest"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// newFeishuDirectory starts a stand-in for Feishu contact API with the given members of each department.
+// Departments other than the root are its children.
+func newFeishuDirectory(t *testing.T, depts map[string][]map[string]any) *pushtest.Server {
+	srv := pushtest.NewServer(t)
+	srv.Handle(feishuTokenPath, func(req *pushtest.Request) (int, any) {
+		return http.StatusOK, map[string]any{"code": 0, "tenant_access_token": "t-1", "expire": 7200}
+	})
+	srv.Handle(feishuDeptPath+feishuRootDepartment, func(req *pushtest.Request) (int, any) {
+		return http.StatusOK, map[string]any{"code": 0, "data": map[string]any{"department": map[string]any{"name": "Acme"}}}
+	})
+	srv.Handle(feishuDeptPath+feishuRootDepartment+"/children", func(req *pushtest.Request) (int, any) {
+		var items []map[string]any
+		for id := range depts {
+			if id != feishuRootDepartment {
+				items = append(items, map[string]any{"name": "Sales", "open_department_id": id})
+			}
+		}
+		return http.StatusOK, map[string]any{"code": 0, "data": map[string]any{"items": items}}
+	})
+	srv.Handle(feishuDeptUsersPath, func(req *pushtest.Request) (int, any) {
+		if req.Header.Get("Authorization") != "Bearer t-1" {
+			return http.StatusOK, map[string]any{"code": 99991663, "msg": "invalid token"}
+		}
+		items := depts[req.Form.Get("department_id")]
+		return http.StatusOK, map[string]any{"code": 0, "data": map[string]any{"items": items}}
+	})
+	return srv
+}
+
+func TestFeishuSyncApp(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ss := mock_store.NewMockPersistentStorageInterface(ctrl)
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	tt := mock_store.NewMockTopicsPersistenceInterface(ctrl)
+	sub := mock_store.NewMockSubsPersistenceInterface(ctrl)
+	savedStore := store.Store
+	store.Store = ss
+	store.Users = uu
+	store.Topics = tt
+	store.Subs = sub
+	globals.hub = &Hub{
+		unreg:      make(chan *topicUnreg, 10),
+		routeSrv:   make(chan *ServerComMessage, 10),
+		userStatus: make(chan *userStatusReq, 10),
+	}
+	globals.sessionStore = &SessionStore{lru: list.New(), lifeTime: time.Hour, sessCache: make(map[string]*Session)}
+	defer func() {
+		store.Store = savedStore
+		store.Users = nil
+		store.Topics = nil
+		store.Subs = nil
+		globals.hub = nil
+		globals.sessionStore = nil
+	}()
+
+	alice := map[string]any{"union_id": "on_a", "name": "Alice"}
+	srv := newFeishuDirectory(t, map[string][]map[string]any{
+		feishuRootDepartment: {alice},
+		"od_1": {
+			alice,
+			{"union_id": "on_b", "name": "Bob", "status": map[string]any{"is_resigned": true}},
+			{"union_id": "on_c", "name": "Carol"},
+		},
+	})
+	fs := &feishuSync{baseURL: srv.URL(), httpClient: &http.Client{Timeout: time.Second}}
+	app := &types.FeishuApp{AppId: "cli_a", AppSecret: "secret"}
+
+	aliceUid, bobUid, carolUid, daveUid := types.Uid(1), types.Uid(2), types.Uid(3), types.Uid(4)
+
+	// Alice was linked to Feishu without an authentication record.
+	uu.EXPECT().GetAuthUniqueRecord(feishuAuthScheme, "on_a").Return(types.ZeroUid, auth.LevelNone, nil, time.Time{}, nil)
+	uu.EXPECT().GetByUnionId("on_a").Return(aliceUid, nil)
+	uu.EXPECT().AddAuthRecord(aliceUid, auth.LevelAuth, feishuAuthScheme, "on_a", nil, time.Time{}).Return(nil)
+	uu.EXPECT().Get(aliceUid).Return(&types.User{
+		Public: map[string]any{"fn": "Alice"}, UnionId: "on_a", FeishuAppId: "cli_a"}, nil)
+	uu.EXPECT().UpdateTags(aliceUid, []string{"dept:od_1"}, nil, nil).Return(nil, nil)
+
+	// Bob has resigned.
+	uu.EXPECT().GetAuthUniqueRecord(feishuAuthScheme, "on_b").Return(bobUid, auth.LevelAuth, nil, time.Time{}, nil)
+	uu.EXPECT().Get(bobUid).Return(&types.User{UnionId: "on_b"}, nil)
+	uu.EXPECT().UpdateState(bobUid, types.StateSuspended).Return(nil)
+
+	// Carol has no account yet.
+	uu.EXPECT().GetAuthUniqueRecord(feishuAuthScheme, "on_c").Return(types.ZeroUid, auth.LevelNone, nil, time.Time{}, nil)
+	uu.EXPECT().GetByUnionId("on_c").Return(types.ZeroUid, nil)
+	uu.EXPECT().Create(gomock.Any(), nil).DoAndReturn(func(user *types.User, private any) (*types.User, error) {
+		if user.UnionId != "on_c" || user.FeishuAppId != "cli_a" || len(user.Tags) != 1 || user.Tags[0] != "dept:od_1" {
+			t.Error("unexpected new account", user)
+		}
+		user.SetUid(carolUid)
+		return user, nil
+	})
+	uu.EXPECT().AddAuthRecord(carolUid, auth.LevelAuth, feishuAuthScheme, "on_c", nil, time.Time{}).Return(nil)
+
+	// The root department topic exists, Dave is no longer in the directory.
+	uu.EXPECT().FindOne("feishudept:cli_a:0").Return("grpRoot", nil)
+	tt.EXPECT().Get("grpRoot").Return(&types.Topic{Public: map[string]any{"fn": "Acme"}}, nil)
+	tt.EXPECT().GetSubs("grpRoot", nil).Return([]types.Subscription{
+		{User: aliceUid.String()}, {User: daveUid.String()}}, nil)
+	sub.EXPECT().Delete("grpRoot", daveUid).Return(nil)
+	uu.EXPECT().Get(daveUid).Return(&types.User{UnionId: "on_d"}, nil)
+	uu.EXPECT().UpdateState(daveUid, types.StateSuspended).Return(nil)
+
+	// The topic of the new department is created.
+	uu.EXPECT().FindOne("feishudept:cli_a:od_1").Return("", nil)
+	ss.EXPECT().GetUidString().Return("Sales")
+	tt.EXPECT().Create(gomock.Any(), types.ZeroUid, nil).Return(nil)
+	tt.EXPECT().GetSubs("grpSales", nil).Return(nil, nil)
+	sub.EXPECT().Create(gomock.Any()).Times(2).DoAndReturn(func(subs ...*types.Subscription) error {
+		if subs[0].Topic != "grpSales" || (subs[0].User != aliceUid.String() && subs[0].User != carolUid.String()) {
+			t.Error("unexpected subscription", subs[0])
+		}
+		return nil
+	})
+
+	if err := fs.syncApp(app); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both topics are reloaded with the new subscriptions.
+	reloaded := map[string]bool{}
+	for len(globals.hub.unreg) > 0 {
+		if unreg := <-globals.hub.unreg; unreg.reload {
+			reloaded[unreg.rcptTo] = true
+		}
+	}
+	if len(reloaded) != 2 || !reloaded["grpRoot"] || !reloaded["grpSales"] {
+		t.Error("changed topics must be reloaded", reloaded)
+	}
+	if len(globals.hub.userStatus) != 2 {
+		t.Error("topics of suspended users must be suspended", len(globals.hub.userStatus))
+	}
+}
+
+func TestFeishuSyncStart(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ff := mock_store.NewMockFeishuAppInterface(ctrl)
+	savedApps := store.FeishuApps
+	store.FeishuApps = ff
+	defer func() { store.FeishuApps = savedApps }()
+
+	// The first sync runs right away, not after the sync period.
+	synced := make(chan bool, 1)
+	ff.EXPECT().GetAll().DoAndReturn(func() ([]types.FeishuApp, error) {
+		synced <- true
+		return nil, nil
+	})
+
+	fs := &feishuSync{baseURL: feishuDefaultBaseURL, httpClient: http.DefaultClient}
+	stop := fs.start(time.Hour)
+	select {
+	case <-synced:
+	case <-time.After(time.Second):
+		t.Error("sync must run at start")
+	}
+	stop <- true
+}
@@ -0,0 +1,323 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Handler of administrative HTTP requests. All requests must carry a valid
+ *    API key and be authenticated as a root user.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// writeAdminResponse sends {ctrl} message as a response to an administrative request.
+func writeAdminResponse(wrt http.ResponseWriter, req *http.Request, msg *ServerComMessage, err error) {
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+	wrt.WriteHeader(msg.Ctrl.Code)
+	json.NewEncoder(wrt).Encode(msg)
+
+	if err != nil {
+		logs.Info.Println("admin:", req.Method, req.URL.Path, msg.Ctrl.Code, err)
+	}
+}
+
+// authAdminRequest checks that the request is made by a root user. Authentication
+// is the same as for large file requests: either auth information or SID of a root session.
+// Returns ID of the root user or an error message to send back.
+func authAdminRequest(req *http.Request, now time.Time) (types.Uid, *ServerComMessage) {
+	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+		return types.ZeroUid, ErrAPIKeyRequired(now)
+	}
+
+	var uid types.Uid
+	var authLvl auth.Level
+	if authMethod, secret := getHttpAuth(req); authMethod != "" {
+		decodedSecret, err := base64.StdEncoding.DecodeString(secret)
+		if err != nil {
+			return types.ZeroUid, ErrMalformed("", "", now)
+		}
+		authhdl := store.Store.GetLogicalAuthHandler(authMethod)
+		if authhdl == nil {
+			return types.ZeroUid, ErrMalformed("", "", now)
+		}
+		rec, _, err := authhdl.Authenticate(decodedSecret, getRemoteAddr(req))
+		if err != nil {
+			return types.ZeroUid, decodeStoreError(err, "", now, nil)
+		}
+		if rec != nil {
+			uid, authLvl = rec.Uid, rec.AuthLevel
+		}
+	} else if sess := globals.sessionStore.Get(req.FormValue("sid")); sess != nil {
+		uid, authLvl = sess.uid, sess.authLvl
+	}
+
+	if uid.IsZero() {
+		return types.ZeroUid, ErrAuthRequired("", "", now, now)
+	}
+	if authLvl != auth.LevelRoot {
+		return types.ZeroUid, ErrPermissionDenied("", "", now)
+	}
+	return uid, nil
+}
+
+// serveLegalHold inspects, places, or releases legal hold on a user or a topic. The user is
+// specified as ?user=usrXXX, the topic as ?topic=grpXXX (or p2pXXX):
+//
+//	GET    - get the current hold, if any;
+//	POST   - place the hold, optional ?reason=... is recorded with the hold;
+//	DELETE - release the hold.
+func serveLegalHold(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+
+	rootUid, errMsg := authAdminRequest(req, now)
+	if errMsg != nil {
+		writeAdminResponse(wrt, req, errMsg, errors.New("not authorized"))
+		return
+	}
+
+	userId, topic := req.FormValue("user"), req.FormValue("topic")
+	var uid types.Uid
+	if userId != "" {
+		uid = types.ParseUserId(userId)
+	}
+	if types.IsChannel(topic) {
+		topic = types.ChnToGrp(topic)
+	}
+	if (userId == "") == (topic == "") || (userId != "" && uid.IsZero()) ||
+		(topic != "" && !strings.HasPrefix(topic, "grp") && !strings.HasPrefix(topic, "p2p")) {
+		writeAdminResponse(wrt, req, ErrMalformed("", "", now), errors.New("invalid user or topic"))
+		return
+	}
+
+	// Name of the held object for logging and responses.
+	what := topic
+	if topic == "" {
+		what = userId
+	}
+
+	var hold *types.LegalHold
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		if !uid.IsZero() {
+			var user *types.User
+			if user, err = store.Users.Get(uid); err == nil && user == nil {
+				err = types.ErrNotFound
+			} else if err == nil {
+				hold = user.LegalHold
+			}
+		} else {
+			var stopic *types.Topic
+			if stopic, err = store.Topics.Get(topic); err == nil && stopic == nil {
+				err = types.ErrNotFound
+			} else if err == nil {
+				hold = stopic.LegalHold
+			}
+		}
+	case http.MethodPost, http.MethodPut:
+		hold = &types.LegalHold{By: rootUid.UserId(), At: now, Reason: req.FormValue("reason")}
+		if !uid.IsZero() {
+			err = store.Users.SetLegalHold(uid, hold)
+		} else {
+			err = store.Topics.SetLegalHold(topic, hold)
+		}
+		if err == nil {
+			logs.Info.Println("admin: legal hold placed on", what, "by", hold.By)
+		}
+	case http.MethodDelete:
+		if !uid.IsZero() {
+			err = store.Users.SetLegalHold(uid, nil)
+		} else {
+			err = store.Topics.SetLegalHold(topic, nil)
+		}
+		if err == nil {
+			logs.Info.Println("admin: legal hold released on", what, "by", rootUid.UserId())
+		}
+	default:
+		writeAdminResponse(wrt, req, ErrOperationNotAllowed("", "", now),
+			errors.New("method '"+req.Method+"' not allowed"))
+		return
+	}
+
+	if err != nil {
+		writeAdminResponse(wrt, req, decodeStoreError(err, "", now, nil), err)
+		return
+	}
+
+	writeAdminResponse(wrt, req, NoErrParams("", what, now, map[string]any{"hold": hold}), nil)
+}
+
+// serveFeishuApps manages Feishu apps used for push notifications. The app is specified
+// as ?appid=...&appsecret=..., optional &baseurl=... sets the Feishu API endpoint of the app:
+//
+//	GET    - list IDs and endpoints of active apps;
+//	POST   - add a new app;
+//	PUT    - replace the secret and the endpoint of an existing app;
+//	DELETE - delete the app, the secret is not needed.
+//
+// The push handler on this node reloads the apps immediately, other cluster nodes pick up
+// the change after the configured reload interval.
+func serveFeishuApps(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+
+	rootUid, errMsg := authAdminRequest(req, now)
+	if errMsg != nil {
+		writeAdminResponse(wrt, req, errMsg, errors.New("not authorized"))
+		return
+	}
+
+	app := &types.FeishuApp{
+		AppId:     strings.TrimSpace(req.FormValue("appid")),
+		AppSecret: strings.TrimSpace(req.FormValue("appsecret")),
+		BaseUrl:   strings.TrimSpace(req.FormValue("baseurl")),
+	}
+
+	var action string
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		var apps []types.FeishuApp
+		if apps, err = store.FeishuApps.GetAll(); err != nil {
+			writeAdminResponse(wrt, req, decodeStoreError(err, "", now, nil), err)
+			return
+		}
+		// Don't expose the secrets.
+		list := make([]map[string]string, len(apps))
+		for i := range apps {
+			list[i] = map[string]string{"appid": apps[i].AppId, "baseurl": apps[i].BaseUrl}
+		}
+		writeAdminResponse(wrt, req, NoErrParams("", "", now, map[string]any{"apps": list}), nil)
+		return
+	case http.MethodPost:
+		action = "added"
+		err = store.FeishuApps.Create(app)
+	case http.MethodPut:
+		action = "updated"
+		err = store.FeishuApps.Update(app)
+	case http.MethodDelete:
+		action = "deleted"
+		if app.AppId == "" {
+			err = types.ErrMalformed
+		} else {
+			err = store.FeishuApps.Delete(app.AppId)
+		}
+	default:
+		writeAdminResponse(wrt, req, ErrOperationNotAllowed("", "", now),
+			errors.New("method '"+req.Method+"' not allowed"))
+		return
+	}
+
+	if err != nil {
+		writeAdminResponse(wrt, req, decodeStoreError(err, "", now, nil), err)
+		return
+	}
+
+	logs.Info.Println("admin: feishu app", app.AppId, action, "by", rootUid.UserId())
+	if err = push.Reload(); err != nil {
+		logs.Warn.Println("admin: failed to reload push handlers", err)
+	}
+
+	writeAdminResponse(wrt, req, NoErr("", "", now), nil)
+}
+
+// servePushDeadLetters inspects and replays push notifications which failed to be delivered
+// or did not fit into the queue of the push handler. The handler is specified as ?handler=fcm,
+// optional &id=1,2,3 selects dead letters, otherwise all dead letters of the handler are affected:
+//
+//	GET    - list dead letters, of all handlers if the handler is not specified;
+//	POST   - queue dead letters for delivery again;
+//	DELETE - discard dead letters.
+//
+// Dead letters are kept in memory of the cluster node which failed to deliver them.
+func servePushDeadLetters(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+
+	rootUid, errMsg := authAdminRequest(req, now)
+	if errMsg != nil {
+		writeAdminResponse(wrt, req, errMsg, errors.New("not authorized"))
+		return
+	}
+
+	name := strings.TrimSpace(req.FormValue("handler"))
+	var ids []int64
+	if val := strings.TrimSpace(req.FormValue("id")); val != "" {
+		for part := range strings.SplitSeq(val, ",") {
+			id, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+			if err != nil {
+				writeAdminResponse(wrt, req, ErrMalformed("", "", now), errors.New("invalid dead letter id"))
+				return
+			}
+			ids = append(ids, id)
+		}
+	}
+
+	if req.Method != http.MethodGet && name == "" {
+		writeAdminResponse(wrt, req, ErrMalformed("", "", now), errors.New("missing handler"))
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		letters := push.DeadLetters(name)
+		list := make([]map[string]any, 0, len(letters))
+		for i := range letters {
+			dl := &letters[i]
+			if len(ids) > 0 && !slices.Contains(ids, dl.Id) {
+				continue
+			}
+			to := make([]string, 0, len(dl.Receipt.To))
+			for uid := range dl.Receipt.To {
+				to = append(to, uid.UserId())
+			}
+			list = append(list, map[string]any{
+				"id":      dl.Id,
+				"handler": dl.Handler,
+				"when":    dl.When,
+				"error":   dl.Error,
+				"what":    dl.Receipt.Payload.What,
+				"topic":   dl.Receipt.Payload.Topic,
+				"seq":     dl.Receipt.Payload.SeqId,
+				"to":      to,
+				"channel": dl.Receipt.Channel,
+			})
+		}
+		writeAdminResponse(wrt, req, NoErrParams("", "", now, map[string]any{"deadletters": list}), nil)
+	case http.MethodPost:
+		count, err := push.Replay(name, ids...)
+		if count > 0 {
+			logs.Info.Println("admin: replayed", count, "push dead letters of", name, "by", rootUid.UserId())
+		}
+		if err == push.ErrQueueFull {
+			writeAdminResponse(wrt, req, ErrServiceUnavailableExplicitTs("", "", now, now), err)
+			return
+		}
+		if err != nil {
+			writeAdminResponse(wrt, req, ErrNotFound("", "", now), err)
+			return
+		}
+		writeAdminResponse(wrt, req, NoErrParams("", "", now, map[string]any{"count": count}), nil)
+	case http.MethodDelete:
+		count := push.Discard(name, ids...)
+		logs.Info.Println("admin: discarded", count, "push dead letters of", name, "by", rootUid.UserId())
+		writeAdminResponse(wrt, req, NoErrParams("", "", now, map[string]any{"count": count}), nil)
+	default:
+		writeAdminResponse(wrt, req, ErrOperationNotAllowed("", "", now),
+			errors.New("method '"+req.Method+"' not allowed"))
+	}
+}
@@ -0,0 +1,471 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Handler of Feishu (Lark) event callbacks. Text messages sent to the bot
+ *    are published to Tinode topics on behalf of the linked Tinode user:
+ *    messages in a Feishu group chat go to the group topic bound to the chat,
+ *    replies to notification cards go to the topic of the card.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"cmp"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	authfeishu "github.com/tinode/chat/server/auth/feishu"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push/feishu"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum size of the event callback body.
+	feishuMaxEventSize = 1 << 16
+	// Feishu retries event delivery if it's not acknowledged in time. Remember delivered events for this long.
+	feishuEventDedupTTL = 10 * time.Minute
+	// Bot command which manages quiet hours of Feishu notifications.
+	feishuQuietCommand = "/quiet"
+)
+
+// Feishu bridge config.
+type feishuBridgeConfig struct {
+	Enabled bool `json:"enabled"`
+	// Event subscription keys of Feishu apps by app ID.
+	Apps map[string]*feishuEventKeys `json:"apps"`
+}
+
+// Keys from the 'Events and callbacks' page of the Feishu app.
+type feishuEventKeys struct {
+	VerificationToken string `json:"verification_token"`
+	// Optional key for encrypting and signing events.
+	EncryptKey string `json:"encrypt_key"`
+}
+
+// feishuEvent is the envelope of Feishu event callback.
+type feishuEvent struct {
+	// URL verification request.
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Token     string `json:"token"`
+
+	// Event, schema 2.0.
+	Header struct {
+		EventId   string `json:"event_id"`
+		EventType string `json:"event_type"`
+		Token     string `json:"token"`
+		AppId     string `json:"app_id"`
+	} `json:"header"`
+	Event json.RawMessage `json:"event"`
+}
+
+// feishuMessageEvent is the im.message.receive_v1 event.
+type feishuMessageEvent struct {
+	Sender struct {
+		SenderId struct {
+			UnionId string `json:"union_id"`
+		} `json:"sender_id"`
+		SenderType string `json:"sender_type"`
+	} `json:"sender"`
+	Message struct {
+		MessageId   string `json:"message_id"`
+		ParentId    string `json:"parent_id"`
+		ChatId      string `json:"chat_id"`
+		ChatType    string `json:"chat_type"`
+		MessageType string `json:"message_type"`
+		Content     string `json:"content"`
+	} `json:"message"`
+}
+
+// Mentions of users and the bot in message text, e.g. @_user_1.
+var feishuMentionRegex = regexp.MustCompile(`@_user_\d+\s*`)
+
+// IDs of recently delivered events.
+var feishuEvents struct {
+	sync.Mutex
+	seen map[string]time.Time
+}
+
+// feishuEventSeen checks if the event was already delivered and remembers it otherwise.
+func feishuEventSeen(eventId string) bool {
+	now := time.Now()
+
+	feishuEvents.Lock()
+	defer feishuEvents.Unlock()
+
+	if feishuEvents.seen == nil {
+		feishuEvents.seen = make(map[string]time.Time)
+	}
+	for id, at := range feishuEvents.seen {
+		if now.Sub(at) > feishuEventDedupTTL {
+			delete(feishuEvents.seen, id)
+		}
+	}
+	if _, found := feishuEvents.seen[eventId]; found {
+		return true
+	}
+	feishuEvents.seen[eventId] = now
+	return false
+}
+
+// feishuVerifySignature checks the signature of the event signed with the encrypt key.
+func feishuVerifySignature(req *http.Request, body []byte, encryptKey string) bool {
+	signature := req.Header.Get("X-Lark-Signature")
+	if signature == "" {
+		return false
+	}
+	hash := sha256.New()
+	hash.Write([]byte(req.Header.Get("X-Lark-Request-Timestamp") + req.Header.Get("X-Lark-Request-Nonce") + encryptKey))
+	hash.Write(body)
+	expected := hex.EncodeToString(hash.Sum(nil))
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(signature)) == 1
+}
+
+// feishuDecrypt decrypts the event encrypted with AES-256-CBC. The key is SHA-256 of the encrypt key,
+// the IV is prepended to the ciphertext.
+func feishuDecrypt(encrypted, encryptKey string) ([]byte, error) {
+	buf, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < 2*aes.BlockSize || len(buf)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid ciphertext length")
+	}
+
+	key := sha256.Sum256([]byte(encryptKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	plain := buf[aes.BlockSize:]
+	cipher.NewCBCDecrypter(block, buf[:aes.BlockSize]).CryptBlocks(plain, plain)
+
+	// Remove PKCS#7 padding.
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("invalid padding")
+	}
+	for _, b := range plain[len(plain)-padding:] {
+		if int(b) != padding {
+			return nil, errors.New("invalid padding")
+		}
+	}
+	return plain[:len(plain)-padding], nil
+}
+
+// serveFeishuEvents handles event callbacks of the Feishu app specified as ?appid=...
+func serveFeishuEvents(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+
+	if req.Method != http.MethodPost {
+		writeAdminResponse(wrt, req, ErrOperationNotAllowed("", "", now), errors.New("method '"+req.Method+"' not allowed"))
+		return
+	}
+
+	appId := req.URL.Query().Get("appid")
+	keys := globals.feishuEventKeys[appId]
+	if keys == nil {
+		writeAdminResponse(wrt, req, ErrNotFound("", "", now), errors.New("unknown feishu app '"+appId+"'"))
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, feishuMaxEventSize))
+	if err != nil {
+		writeAdminResponse(wrt, req, ErrMalformed("", "", now), err)
+		return
+	}
+
+	// Events are signed only if they are encrypted.
+	signed := true
+	if keys.EncryptKey != "" {
+		signed = feishuVerifySignature(req, body, keys.EncryptKey)
+		var envelope struct {
+			Encrypt string `json:"encrypt"`
+		}
+		if err = json.Unmarshal(body, &envelope); err != nil || envelope.Encrypt == "" {
+			writeAdminResponse(wrt, req, ErrMalformed("", "", now), errors.New("event is not encrypted"))
+			return
+		}
+		if body, err = feishuDecrypt(envelope.Encrypt, keys.EncryptKey); err != nil {
+			writeAdminResponse(wrt, req, ErrMalformed("", "", now), err)
+			return
+		}
+	}
+
+	var event feishuEvent
+	if err = json.Unmarshal(body, &event); err != nil {
+		writeAdminResponse(wrt, req, ErrMalformed("", "", now), err)
+		return
+	}
+	// URL verification requests are not signed, but they are encrypted with the same key.
+	if !signed && event.Type != "url_verification" {
+		writeAdminResponse(wrt, req, ErrPermissionDenied("", "", now), errors.New("invalid event signature"))
+		return
+	}
+
+	token := event.Header.Token
+	if event.Type == "url_verification" {
+		token = event.Token
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(keys.VerificationToken)) != 1 {
+		writeAdminResponse(wrt, req, ErrPermissionDenied("", "", now), errors.New("invalid verification token"))
+		return
+	}
+
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if event.Type == "url_verification" {
+		json.NewEncoder(wrt).Encode(map[string]string{"challenge": event.Challenge})
+		return
+	}
+
+	// Acknowledge the event right away, Feishu expects a response within 3 seconds.
+	wrt.Write([]byte("{}"))
+
+	if event.Header.EventType != "im.message.receive_v1" || feishuEventSeen(event.Header.EventId) {
+		return
+	}
+	var msg feishuMessageEvent
+	if err = json.Unmarshal(event.Event, &msg); err != nil {
+		logs.Warn.Println("feishu bridge: invalid message event", err)
+		return
+	}
+	go feishuRelayMessage(appId, &msg)
+}
+
+// feishuRelayMessage publishes the text message received from Feishu to the Tinode topic.
+func feishuRelayMessage(appId string, msg *feishuMessageEvent) {
+	if msg.Sender.SenderType != "user" || msg.Message.MessageType != "text" {
+		return
+	}
+
+	var content struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal([]byte(msg.Message.Content), &content); err != nil {
+		logs.Warn.Println("feishu bridge: invalid message content", err)
+		return
+	}
+	text := strings.TrimSpace(feishuMentionRegex.ReplaceAllString(content.Text, ""))
+	if text == "" {
+		return
+	}
+
+	unionId := msg.Sender.SenderId.UnionId
+	// Users linked by the directory sync may have no authentication record yet.
+	uid, _, err := authfeishu.FindUser(feishuAuthScheme, unionId)
+	if err != nil || uid.IsZero() {
+		logs.Info.Println("feishu bridge: no account for union_id", unionId, err)
+		return
+	}
+	user, err := store.Users.Get(uid)
+	if err != nil || user == nil || user.State != types.StateOK {
+		logs.Info.Println("feishu bridge: account is not active", uid.UserId(), err)
+		return
+	}
+
+	if msg.Message.ChatType == "p2p" &&
+		(text == feishuQuietCommand || strings.HasPrefix(text, feishuQuietCommand+" ")) {
+		feishuSetQuietHours(appId, unionId, user, strings.TrimSpace(strings.TrimPrefix(text, feishuQuietCommand)))
+		return
+	}
+
+	var topic string
+	if msg.Message.ChatType == "p2p" {
+		// Reply to a notification card in the chat with the bot.
+		topic = feishu.TopicForReply(uid, msg.Message.ParentId)
+	} else {
+		topic, err = store.Users.FindOne(feishu.ChatTag(appId, msg.Message.ChatId))
+		if err != nil {
+			logs.Warn.Println("feishu bridge: failed to find topic for chat", msg.Message.ChatId, err)
+			return
+		}
+		if types.GetTopicCat(topic) != types.TopicCatGrp {
+			topic = ""
+		}
+	}
+	if topic == "" {
+		logs.Info.Println("feishu bridge: no topic for message", msg.Message.MessageId, "in chat", msg.Message.ChatId)
+		return
+	}
+
+	// The topic checks that the user is permitted to publish.
+	publishAsUser(uid, topic, map[string]any{"origin": "feishu"}, text)
+}
+
+// feishuSetQuietHours handles the bot command which shows or changes quiet hours in notification preferences
+// of the user: "/quiet" shows them, "/quiet off" removes them, "/quiet 22:00-08:00 [Asia/Shanghai]" sets them.
+// The time zone from the config is used if it's not specified.
+func feishuSetQuietHours(appId, unionId string, user *types.User, arg string) {
+	prefs := notifyPrefsToWire(user.NotifyPrefs)
+	if prefs == nil {
+		prefs = &MsgNotifyPrefs{}
+	}
+
+	var reply string
+	fields := strings.Fields(arg)
+	switch {
+	case len(fields) == 0:
+		reply = "Quiet hours are not set"
+		if prefs.Quiet != "" {
+			reply = "Quiet hours: " + prefs.Quiet + " " + cmp.Or(prefs.TimeZone, "UTC")
+		}
+		feishu.SendText(appId, unionId, reply)
+		return
+	case arg == "off":
+		prefs.Quiet, prefs.TimeZone = "", ""
+		reply = "Quiet hours removed"
+	case len(fields) > 2:
+		feishu.SendText(appId, unionId, "Quiet hours not changed: expected HH:MM-HH:MM [time zone]")
+		return
+	default:
+		prefs.Quiet = fields[0]
+		prefs.TimeZone = feishu.TimeZone()
+		if len(fields) == 2 {
+			prefs.TimeZone = fields[1]
+		}
+		reply = "Quiet hours: " + prefs.Quiet + " " + cmp.Or(prefs.TimeZone, "UTC")
+	}
+
+	if err := setNotifyPrefsAsUser(user.Uid(), prefs); err != nil {
+		logs.Info.Println("feishu bridge: failed to change quiet hours", user.Id, err)
+		reply = "Quiet hours not changed: " + err.Error()
+	}
+	feishu.SendText(appId, unionId, reply)
+}
+
+// publishAsUser publishes a message to the topic on behalf of the user without a session.
+// The topic is loaded if necessary.
+func publishAsUser(uid types.Uid, topic string, head map[string]any, content any) {
+	original := topic
+	if types.GetTopicCat(topic) == types.TopicCatP2P {
+		// P2P topic is known to the user as the ID of the other user.
+		uid1, uid2, err := types.ParseP2P(topic)
+		if err != nil {
+			logs.Warn.Println("publish as user: invalid topic", topic, err)
+			return
+		}
+		if uid1 == uid {
+			original = uid2.UserId()
+		} else {
+			original = uid1.UserId()
+		}
+	}
+
+	msg := &ClientComMessage{
+		Pub:       &MsgClientPub{Topic: original, Head: head, Content: content},
+		Original:  original,
+		RcptTo:    topic,
+		AsUser:    uid.UserId(),
+		Timestamp: types.TimeNow(),
+	}
+
+	if globals.cluster.isRemoteTopic(topic) {
+		if err := globals.cluster.routeToTopicMaster(ProxyReqBroadcast, msg, topic, nil); err != nil {
+			logs.Warn.Println("publish as user: failed to route to topic master", topic, err)
+		}
+		return
+	}
+	globals.hub.routeCli <- msg
+}
+
+// serveFeishuChats binds group topics to Feishu group chats. The topic is specified as ?topic=grp...,
+// the chat as &appid=...&chatid=...:
+//
+//	GET    - get the chat bound to the topic;
+//	POST   - bind the topic to the chat, replacing the current binding;
+//	DELETE - unbind the topic.
+func serveFeishuChats(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+
+	rootUid, errMsg := authAdminRequest(req, now)
+	if errMsg != nil {
+		writeAdminResponse(wrt, req, errMsg, errors.New("not authorized"))
+		return
+	}
+
+	topic := req.FormValue("topic")
+	if types.GetTopicCat(topic) != types.TopicCatGrp {
+		writeAdminResponse(wrt, req, ErrMalformed("", "", now), errors.New("invalid topic"))
+		return
+	}
+
+	stopic, err := store.Topics.Get(topic)
+	if err == nil && stopic == nil {
+		err = types.ErrTopicNotFound
+	}
+	if err != nil {
+		writeAdminResponse(wrt, req, decodeStoreError(err, "", now, nil), err)
+		return
+	}
+
+	// Current binding and the rest of the tags.
+	var current string
+	var tags []string
+	for _, tag := range stopic.Tags {
+		if strings.HasPrefix(tag, feishu.ChatTagNS+":") {
+			current = tag
+		} else {
+			tags = append(tags, tag)
+		}
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		var chat map[string]string
+		if appId, chatId, found := strings.Cut(strings.TrimPrefix(current, feishu.ChatTagNS+":"), ":"); found {
+			chat = map[string]string{"appid": appId, "chatid": chatId}
+		}
+		writeAdminResponse(wrt, req, NoErrParams("", topic, now, map[string]any{"chat": chat}), nil)
+		return
+	case http.MethodPost, http.MethodPut:
+		appId, chatId := strings.TrimSpace(req.FormValue("appid")), strings.TrimSpace(req.FormValue("chatid"))
+		if appId == "" || chatId == "" || strings.Contains(appId, ":") {
+			writeAdminResponse(wrt, req, ErrMalformed("", "", now), errors.New("invalid chat"))
+			return
+		}
+		tag := feishu.ChatTag(appId, chatId)
+		if bound, err := store.Users.FindOne(tag); err != nil {
+			writeAdminResponse(wrt, req, decodeStoreError(err, "", now, nil), err)
+			return
+		} else if bound != "" && bound != topic {
+			writeAdminResponse(wrt, req, ErrAlreadyExists("", topic, now), errors.New("chat is bound to "+bound))
+			return
+		}
+		tags = append(tags, tag)
+	case http.MethodDelete:
+		if current == "" {
+			writeAdminResponse(wrt, req, InfoNotModified("", topic, now), nil)
+			return
+		}
+	default:
+		writeAdminResponse(wrt, req, ErrOperationNotAllowed("", "", now),
+			errors.New("method '"+req.Method+"' not allowed"))
+		return
+	}
+
+	if err = store.Topics.Update(topic, map[string]any{"Tags": types.StringSlice(tags), "UpdatedAt": now}); err != nil {
+		writeAdminResponse(wrt, req, decodeStoreError(err, "", now, nil), err)
+		return
+	}
+	// Make the loaded topic pick up the new tags.
+	reloadTopic(topic)
+
+	logs.Info.Println("admin: feishu chat binding of", topic, "changed by", rootUid.UserId())
+	writeAdminResponse(wrt, req, NoErr("", topic, now), nil)
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/auth/mock_auth"
+	"github.com/tinode/chat/server/push/feishu"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// The example from Feishu documentation of event encryption.
+const (
+	feishuTestEncryptKey = "test key"
+	feishuTestEncrypted  = "P37w+VZImNgPEO1RBhJ6RtKl7n6zymIbEG1pReEzghk="
+)
+
+// feishuTestEncrypt encrypts the event the way Feishu does: AES-256-CBC with PKCS#7
+// padding, the key is SHA-256 of the encrypt key, the IV is prepended to the ciphertext.
+func feishuTestEncrypt(t *testing.T, plain []byte, encryptKey string) string {
+	t.Helper()
+	padding := aes.BlockSize - len(plain)%aes.BlockSize
+	return feishuTestEncryptRaw(t, append(plain, bytes.Repeat([]byte{byte(padding)}, padding)...), encryptKey)
+}
+
+// feishuTestEncryptRaw encrypts the data which is already padded to the block size.
+func feishuTestEncryptRaw(t *testing.T, padded []byte, encryptKey string) string {
+	t.Helper()
+	key := sha256.Sum256([]byte(encryptKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, aes.BlockSize+len(padded))
+	copy(buf, "0123456789abcdef")
+	cipher.NewCBCEncrypter(block, buf[:aes.BlockSize]).CryptBlocks(buf[aes.BlockSize:], padded)
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// feishuTestSign signs the event body the way Feishu does.
+func feishuTestSign(req *http.Request, body []byte, encryptKey string) {
+	req.Header.Set("X-Lark-Request-Timestamp", "1700000000")
+	req.Header.Set("X-Lark-Request-Nonce", "a1b2c3")
+	hash := sha256.Sum256([]byte("1700000000" + "a1b2c3" + encryptKey + string(body)))
+	req.Header.Set("X-Lark-Signature", hex.EncodeToString(hash[:]))
+}
+
+func TestFeishuVerifySignature(t *testing.T) {
+	body := []byte(`{"encrypt":"` + feishuTestEncrypted + `"}`)
+	// sha256("1700000000" + "a1b2c3" + "test key" + body)
+	signature := "0ca8bd34346b0b96d48bcd23b48d9b8f8ed8ec34ce4909403d0c68245ca7a123"
+
+	cases := []struct {
+		name      string
+		timestamp string
+		nonce     string
+		signature string
+		body      []byte
+		key       string
+		valid     bool
+	}{
+		{"valid", "1700000000", "a1b2c3", signature, body, feishuTestEncryptKey, true},
+		{"missing signature", "1700000000", "a1b2c3", "", body, feishuTestEncryptKey, false},
+		{"tampered body", "1700000000", "a1b2c3", signature, append([]byte(" "), body...), feishuTestEncryptKey, false},
+		{"replayed timestamp", "1700000001", "a1b2c3", signature, body, feishuTestEncryptKey, false},
+		{"other nonce", "1700000000", "a1b2c4", signature, body, feishuTestEncryptKey, false},
+		{"other key", "1700000000", "a1b2c3", signature, body, "other key", false},
+		{"uppercase signature", "1700000000", "a1b2c3", strings.ToUpper(signature), body, feishuTestEncryptKey, false},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/feishu/events", nil)
+		req.Header.Set("X-Lark-Request-Timestamp", tc.timestamp)
+		req.Header.Set("X-Lark-Request-Nonce", tc.nonce)
+		if tc.signature != "" {
+			req.Header.Set("X-Lark-Signature", tc.signature)
+		}
+		if valid := feishuVerifySignature(req, tc.body, tc.key); valid != tc.valid {
+			t.Errorf("%s: expected %t, got %t", tc.name, tc.valid, valid)
+		}
+	}
+}
+
+func TestFeishuDecrypt(t *testing.T) {
+	block := bytes.Repeat([]byte("a"), aes.BlockSize)
+	cases := []struct {
+		name      string
+		encrypted string
+		key       string
+		plain     string
+		err       bool
+	}{
+		{"documentation example", feishuTestEncrypted, feishuTestEncryptKey, "hello world", false},
+		{"full block of padding", feishuTestEncrypt(t, block, "key"), "key", string(block), false},
+		{"one byte of padding", feishuTestEncrypt(t, block[1:], "key"), "key", string(block[1:]), false},
+		{"wrong key", feishuTestEncrypted, "other key", "", true},
+		{"not base64", "not base64!", feishuTestEncryptKey, "", true},
+		{"no ciphertext", base64.StdEncoding.EncodeToString(block), feishuTestEncryptKey, "", true},
+		{"partial block", base64.StdEncoding.EncodeToString(append(block, block[1:]...)), feishuTestEncryptKey, "", true},
+		{"zero padding", feishuTestEncryptRaw(t, append(block[1:], 0), "key"), "key", "", true},
+		{"padding too long", feishuTestEncryptRaw(t, append(block[1:], aes.BlockSize+1), "key"), "key", "", true},
+		{"inconsistent padding", feishuTestEncryptRaw(t, append(block[2:], 1, 2), "key"), "key", "", true},
+	}
+	for _, tc := range cases {
+		plain, err := feishuDecrypt(tc.encrypted, tc.key)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got '%s'", tc.name, plain)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		} else if string(plain) != tc.plain {
+			t.Errorf("%s: expected '%s', got '%s'", tc.name, tc.plain, plain)
+		}
+	}
+}
+
+func TestFeishuEventSeen(t *testing.T) {
+	feishuEvents.Lock()
+	feishuEvents.seen = nil
+	feishuEvents.Unlock()
+
+	if feishuEventSeen("ev-1") {
+		t.Error("new event must not be seen")
+	}
+	if !feishuEventSeen("ev-1") {
+		t.Error("redelivered event must be seen")
+	}
+	if feishuEventSeen("ev-2") {
+		t.Error("another event must not be seen")
+	}
+
+	// Events are forgotten after a while.
+	feishuEvents.Lock()
+	feishuEvents.seen["ev-1"] = time.Now().Add(-feishuEventDedupTTL - time.Second)
+	feishuEvents.Unlock()
+	if feishuEventSeen("ev-1") {
+		t.Error("expired event must not be seen")
+	}
+}
+
+func TestServeFeishuEvents(t *testing.T) {
+	globals.feishuEventKeys = map[string]*feishuEventKeys{
+		"cli_plain":     {VerificationToken: "vtoken"},
+		"cli_encrypted": {VerificationToken: "vtoken", EncryptKey: feishuTestEncryptKey},
+	}
+	defer func() {
+		globals.feishuEventKeys = nil
+	}()
+
+	challenge := `{"type":"url_verification","challenge":"ch-1","token":"vtoken"}`
+	// Events other than messages are acknowledged and ignored.
+	event := `{"schema":"2.0","header":{"event_id":"ev-serve","event_type":"im.chat.updated_v1","token":"vtoken"},"event":{}}`
+	encrypted := func(plain string) []byte {
+		return []byte(`{"encrypt":"` + feishuTestEncrypt(t, []byte(plain), feishuTestEncryptKey) + `"}`)
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		app    string
+		body   []byte
+		sign   bool
+		// Modify the body after signing it.
+		tamper bool
+		code   int
+		resp   string
+	}{
+		{"not a POST", http.MethodGet, "cli_plain", nil, false, false, http.StatusMethodNotAllowed, ""},
+		{"unknown app", http.MethodPost, "cli_other", []byte(challenge), false, false, http.StatusNotFound, ""},
+		{"url verification", http.MethodPost, "cli_plain", []byte(challenge), false, false, http.StatusOK, `{"challenge":"ch-1"}`},
+		{"url verification, wrong token", http.MethodPost, "cli_plain",
+			[]byte(strings.Replace(challenge, "vtoken", "other", 1)), false, false, http.StatusForbidden, ""},
+		{"event", http.MethodPost, "cli_plain", []byte(event), false, false, http.StatusOK, "{}"},
+		{"event, wrong token", http.MethodPost, "cli_plain",
+			[]byte(strings.Replace(event, "vtoken", "other", 1)), false, false, http.StatusForbidden, ""},
+		{"event, no token", http.MethodPost, "cli_plain",
+			[]byte(strings.Replace(event, `,"token":"vtoken"`, "", 1)), false, false, http.StatusForbidden, ""},
+		{"malformed event", http.MethodPost, "cli_plain", []byte("{"), false, false, http.StatusBadRequest, ""},
+		{"encrypted url verification", http.MethodPost, "cli_encrypted", encrypted(challenge), false, false,
+			http.StatusOK, `{"challenge":"ch-1"}`},
+		{"encrypted event", http.MethodPost, "cli_encrypted", encrypted(event), true, false, http.StatusOK, "{}"},
+		{"unsigned event", http.MethodPost, "cli_encrypted", encrypted(event), false, false, http.StatusForbidden, ""},
+		{"tampered event", http.MethodPost, "cli_encrypted", encrypted(event), true, true, http.StatusForbidden, ""},
+		{"encrypted event, wrong token", http.MethodPost, "cli_encrypted",
+			encrypted(strings.Replace(event, "vtoken", "other", 1)), true, false, http.StatusForbidden, ""},
+		{"not encrypted", http.MethodPost, "cli_encrypted", []byte(event), true, false, http.StatusBadRequest, ""},
+		{"encrypted with another key", http.MethodPost, "cli_encrypted",
+			[]byte(`{"encrypt":"` + feishuTestEncrypt(t, []byte(event), "other key") + `"}`), true, false,
+			http.StatusBadRequest, ""},
+	}
+	for _, tc := range cases {
+		body := tc.body
+		if tc.tamper {
+			// Another event encrypted with the same key.
+			body = encrypted(strings.Replace(event, "ev-serve", "ev-tampered", 1))
+		}
+		req := httptest.NewRequest(tc.method, "/feishu/events?appid="+tc.app, bytes.NewReader(body))
+		if tc.sign {
+			feishuTestSign(req, tc.body, feishuTestEncryptKey)
+		}
+
+		wrt := httptest.NewRecorder()
+		serveFeishuEvents(wrt, req)
+		if wrt.Code != tc.code {
+			t.Errorf("%s: expected status %d, got %d: %s", tc.name, tc.code, wrt.Code, wrt.Body)
+			continue
+		}
+		if tc.resp != "" && strings.TrimSpace(wrt.Body.String()) != tc.resp {
+			t.Errorf("%s: expected response '%s', got '%s'", tc.name, tc.resp, wrt.Body)
+		}
+	}
+}
+
+// feishuTestAPIKey generates a valid API key for the salt.
+func feishuTestAPIKey(salt []byte) string {
+	data := make([]byte, apikeyLength)
+	data[0] = 1
+	hasher := hmac.New(md5.New, salt)
+	hasher.Write(data[:apikeyVersion+apikeyAppID+apikeySequence+apikeyWho])
+	copy(data[apikeyVersion+apikeyAppID+apikeySequence+apikeyWho:], hasher.Sum(nil))
+	return base64.URLEncoding.EncodeToString(data)
+}
+
+func TestServeFeishuChats(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ss := mock_store.NewMockPersistentStorageInterface(ctrl)
+	tt := mock_store.NewMockTopicsPersistenceInterface(ctrl)
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	aa := mock_auth.NewMockAuthHandler(ctrl)
+	savedStore := store.Store
+	store.Store = ss
+	store.Topics = tt
+	store.Users = uu
+	globals.apiKeySalt = []byte("test salt")
+	globals.hub = &Hub{unreg: make(chan *topicUnreg, 10)}
+	globals.sessionStore = &SessionStore{lru: list.New(), lifeTime: time.Hour, sessCache: make(map[string]*Session)}
+	defer func() {
+		store.Store = savedStore
+		store.Topics = nil
+		store.Users = nil
+		globals.apiKeySalt = nil
+		globals.hub = nil
+		globals.sessionStore = nil
+	}()
+
+	rootUid, userUid := types.Uid(1), types.Uid(2)
+	ss.EXPECT().GetLogicalAuthHandler("token").Return(aa).AnyTimes()
+	aa.EXPECT().Authenticate([]byte("root"), gomock.Any()).
+		Return(&auth.Rec{Uid: rootUid, AuthLevel: auth.LevelRoot}, nil, nil).AnyTimes()
+	aa.EXPECT().Authenticate([]byte("user"), gomock.Any()).
+		Return(&auth.Rec{Uid: userUid, AuthLevel: auth.LevelAuth}, nil, nil).AnyTimes()
+
+	apikey := feishuTestAPIKey(globals.apiKeySalt)
+	request := func(method, who string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/feishu/chats?"+form.Encode(), nil)
+		if apikey != "" {
+			req.Header.Set("X-Tinode-APIKey", apikey)
+		}
+		if who != "" {
+			req.Header.Set("X-Tinode-Auth", "token "+base64.StdEncoding.EncodeToString([]byte(who)))
+		}
+		wrt := httptest.NewRecorder()
+		serveFeishuChats(wrt, req)
+		return wrt
+	}
+	params := func(wrt *httptest.ResponseRecorder) map[string]any {
+		var resp struct {
+			Ctrl struct {
+				Params map[string]any `json:"params"`
+			} `json:"ctrl"`
+		}
+		json.Unmarshal(wrt.Body.Bytes(), &resp)
+		return resp.Ctrl.Params
+	}
+
+	bound := types.StringSlice{"feishuchat:cli_a:oc_1", "other"}
+	tt.EXPECT().Get("grpBound").Return(&types.Topic{Tags: bound}, nil).AnyTimes()
+	tt.EXPECT().Get("grpFree").Return(&types.Topic{Tags: types.StringSlice{"other"}}, nil).AnyTimes()
+	tt.EXPECT().Get("grpMissing").Return(nil, nil).AnyTimes()
+
+	// Only root users can manage bindings.
+	if wrt := request(http.MethodGet, "user", url.Values{"topic": {"grpBound"}}); wrt.Code != http.StatusForbidden {
+		t.Errorf("non-root: expected 403, got %d", wrt.Code)
+	}
+	if wrt := request(http.MethodGet, "", url.Values{"topic": {"grpBound"}}); wrt.Code != http.StatusUnauthorized {
+		t.Errorf("no auth: expected 401, got %d", wrt.Code)
+	}
+	apikey = ""
+	if wrt := request(http.MethodGet, "root", url.Values{"topic": {"grpBound"}}); wrt.Code != http.StatusForbidden {
+		t.Errorf("no API key: expected 403, got %d", wrt.Code)
+	}
+	apikey = feishuTestAPIKey(globals.apiKeySalt)
+
+	if wrt := request(http.MethodGet, "root", url.Values{"topic": {"usrAbc"}}); wrt.Code != http.StatusBadRequest {
+		t.Errorf("not a group topic: expected 400, got %d", wrt.Code)
+	}
+	if wrt := request(http.MethodGet, "root", url.Values{"topic": {"grpMissing"}}); wrt.Code != http.StatusNotFound {
+		t.Errorf("missing topic: expected 404, got %d", wrt.Code)
+	}
+
+	// Get the binding.
+	wrt := request(http.MethodGet, "root", url.Values{"topic": {"grpBound"}})
+	if chat, _ := params(wrt)["chat"].(map[string]any); wrt.Code != http.StatusOK ||
+		chat["appid"] != "cli_a" || chat["chatid"] != "oc_1" {
+		t.Errorf("get: expected chat cli_a:oc_1, got %d %s", wrt.Code, wrt.Body)
+	}
+	wrt = request(http.MethodGet, "root", url.Values{"topic": {"grpFree"}})
+	if chat := params(wrt)["chat"]; wrt.Code != http.StatusOK || chat != nil {
+		t.Errorf("get: expected no chat, got %d %s", wrt.Code, wrt.Body)
+	}
+
+	// Bind the topic to the chat.
+	uu.EXPECT().FindOne("feishuchat:cli_a:oc_2").Return("", nil)
+	tt.EXPECT().Update("grpFree", gomock.Any()).DoAndReturn(func(topic string, update map[string]any) error {
+		if tags := update["Tags"].(types.StringSlice); len(tags) != 2 || tags[1] != "feishuchat:cli_a:oc_2" {
+			t.Errorf("bind: unexpected tags %v", tags)
+		}
+		return nil
+	})
+	if wrt := request(http.MethodPost, "root", url.Values{"topic": {"grpFree"}, "appid": {"cli_a"}, "chatid": {"oc_2"}}); wrt.Code != http.StatusOK {
+		t.Errorf("bind: expected 200, got %d %s", wrt.Code, wrt.Body)
+	}
+	select {
+	case unreg := <-globals.hub.unreg:
+		if unreg.rcptTo != "grpFree" || !unreg.reload {
+			t.Errorf("bind: expected reload of grpFree, got %+v", unreg)
+		}
+	default:
+		t.Error("bind: topic must be reloaded")
+	}
+
+	// The chat is bound to another topic.
+	uu.EXPECT().FindOne("feishuchat:cli_a:oc_1").Return("grpBound", nil)
+	if wrt := request(http.MethodPost, "root", url.Values{"topic": {"grpFree"}, "appid": {"cli_a"}, "chatid": {"oc_1"}}); wrt.Code != http.StatusConflict {
+		t.Errorf("bind to bound chat: expected 409, got %d", wrt.Code)
+	}
+	if wrt := request(http.MethodPost, "root", url.Values{"topic": {"grpFree"}, "appid": {"cli:a"}, "chatid": {"oc_1"}}); wrt.Code != http.StatusBadRequest {
+		t.Errorf("bind to invalid chat: expected 400, got %d", wrt.Code)
+	}
+
+	// Unbind.
+	tt.EXPECT().Update("grpBound", gomock.Any()).DoAndReturn(func(topic string, update map[string]any) error {
+		if tags := update["Tags"].(types.StringSlice); len(tags) != 1 || tags[0] != "other" {
+			t.Errorf("unbind: unexpected tags %v", tags)
+		}
+		return nil
+	})
+	if wrt := request(http.MethodDelete, "root", url.Values{"topic": {"grpBound"}}); wrt.Code != http.StatusOK {
+		t.Errorf("unbind: expected 200, got %d %s", wrt.Code, wrt.Body)
+	}
+	<-globals.hub.unreg
+	if wrt := request(http.MethodDelete, "root", url.Values{"topic": {"grpFree"}}); wrt.Code != http.StatusNotModified {
+		t.Errorf("unbind unbound: expected 304, got %d", wrt.Code)
+	}
+}
+
+func TestFeishuRelayMessage(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	store.Users = uu
+	globals.hub = &Hub{routeCli: make(chan *ClientComMessage, 1)}
+	defer func() {
+		store.Users = nil
+		globals.hub = nil
+	}()
+
+	msg := &feishuMessageEvent{}
+	msg.Sender.SenderType = "user"
+	msg.Sender.SenderId.UnionId = "on_1"
+	msg.Message.ChatId = "oc_1"
+	msg.Message.ChatType = "group"
+	msg.Message.MessageType = "text"
+	msg.Message.Content = `{"text":"@_user_1 hello"}`
+
+	// The sender was linked by the directory sync and has no authentication record yet.
+	uid := types.Uid(5)
+	user := &types.User{State: types.StateOK}
+	user.SetUid(uid)
+	uu.EXPECT().GetAuthUniqueRecord(feishuAuthScheme, "on_1").Return(types.ZeroUid, auth.LevelNone, nil, time.Time{}, nil)
+	uu.EXPECT().GetByUnionId("on_1").Return(uid, nil)
+	uu.EXPECT().AddAuthRecord(uid, auth.LevelAuth, feishuAuthScheme, "on_1", nil, time.Time{}).Return(nil)
+	uu.EXPECT().Get(uid).Return(user, nil)
+	uu.EXPECT().FindOne(feishu.ChatTag("cli_a", "oc_1")).Return("grpAbc", nil)
+
+	feishuRelayMessage("cli_a", msg)
+	select {
+	case pub := <-globals.hub.routeCli:
+		if pub.AsUser != uid.UserId() || pub.RcptTo != "grpAbc" || pub.Pub.Content != "hello" {
+			t.Error("unexpected message", pub.AsUser, pub.RcptTo, pub.Pub.Content)
+		}
+	default:
+		t.Fatal("message is not published")
+	}
+
+	// Unknown sender.
+	uu.EXPECT().GetAuthUniqueRecord(feishuAuthScheme, "on_1").Return(types.ZeroUid, auth.LevelNone, nil, time.Time{}, nil)
+	uu.EXPECT().GetByUnionId("on_1").Return(types.ZeroUid, nil)
+	feishuRelayMessage("cli_a", msg)
+	if len(globals.hub.routeCli) != 0 {
+		t.Error("message from unknown sender must be dropped")
+	}
+}
+
+func TestInitTopicP2PWithoutSub(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	tt := mock_store.NewMockTopicsPersistenceInterface(ctrl)
+	store.Topics = tt
+	defer func() {
+		store.Topics = nil
+	}()
+
+	// A reply from Feishu to a P2P topic where the other user's subscription was deleted.
+	uid1, uid2 := types.Uid(1), types.Uid(2)
+	name := uid1.P2PName(uid2)
+	tt.EXPECT().Get(name).Return(&types.Topic{}, nil)
+	tt.EXPECT().GetUsers(name, nil).Return([]types.Subscription{{User: uid1.String(), Topic: name}}, nil)
+
+	topic := &Topic{name: name, xoriginal: uid2.UserId(), perUser: make(map[types.Uid]perUserData)}
+	join := &ClientComMessage{RcptTo: name, Original: uid2.UserId(), AsUser: uid1.UserId()}
+	if err := initTopicP2P(topic, join); err != types.ErrTopicNotFound {
+		t.Errorf("expected %v, got %v", types.ErrTopicNotFound, err)
+	}
+}
@@ -41,6 +41,9 @@ type topicUnreg struct {
 	forUser types.Uid
 	// Unregister then delete the topic.
 	del bool
+	// Unregister the topic so it's reloaded from the database, e.g. after subscriptions were changed
+	// by the server. Attached sessions are asked to re-attach.
+	reload bool
 	// Channel for reporting operation completion when deleting topics for a user.
 	done chan<- bool
 }
@@ -148,6 +151,47 @@ func newHub() *Hub {
 	return h
 }
 
+// topicLoad creates an in-memory topic for the join request and starts loading it from the database
+// or creating it. Must be called from the hub's goroutine.
+func (h *Hub) topicLoad(join *ClientComMessage) *Topic {
+	t := &Topic{
+		name:      join.RcptTo,
+		xoriginal: join.Original,
+		// Indicates a proxy topic.
+		isProxy:   globals.cluster.isRemoteTopic(join.RcptTo),
+		sessions:  make(map[*Session]perSessionData),
+		clientMsg: make(chan *ClientComMessage, 192),
+		serverMsg: make(chan *ServerComMessage, 64),
+		reg:       make(chan *ClientComMessage, 256),
+		unreg:     make(chan *ClientComMessage, 256),
+		meta:      make(chan *ClientComMessage, 64),
+		perUser:   make(map[types.Uid]perUserData),
+		exit:      make(chan *shutDown, 1),
+	}
+	if !t.isProxy {
+		t.expire = make(chan *expiredMessages, 32)
+	}
+	if globals.cluster != nil {
+		if t.isProxy {
+			t.proxy = make(chan *ClusterResp, 32)
+			t.masterNode = globals.cluster.ring.Get(t.name)
+		} else {
+			// It's a master topic. Make a channel for handling
+			// direct messages from the proxy.
+			t.master = make(chan *ClusterSessUpdate, 8)
+		}
+	}
+	// Topic is created in suspended state because it's not yet configured.
+	t.markPaused(true)
+	// Save topic now to prevent race condition.
+	h.topicPut(join.RcptTo, t)
+
+	// Configure the topic.
+	go topicInit(t, join, h)
+
+	return t
+}
+
 func (h *Hub) run() {
 	for {
 		select {
@@ -165,37 +209,7 @@ func (h *Hub) run() {
 			t := h.topicGet(join.RcptTo)
 			if t == nil {
 				// Topic does not exist or not loaded.
-				t = &Topic{
-					name:      join.RcptTo,
-					xoriginal: join.Original,
-					// Indicates a proxy topic.
-					isProxy:   globals.cluster.isRemoteTopic(join.RcptTo),
-					sessions:  make(map[*Session]perSessionData),
-					clientMsg: make(chan *ClientComMessage, 192),
-					serverMsg: make(chan *ServerComMessage, 64),
-					reg:       make(chan *ClientComMessage, 256),
-					unreg:     make(chan *ClientComMessage, 256),
-					meta:      make(chan *ClientComMessage, 64),
-					perUser:   make(map[types.Uid]perUserData),
-					exit:      make(chan *shutDown, 1),
-				}
-				if globals.cluster != nil {
-					if t.isProxy {
-						t.proxy = make(chan *ClusterResp, 32)
-						t.masterNode = globals.cluster.ring.Get(t.name)
-					} else {
-						// It's a master topic. Make a channel for handling
-						// direct messages from the proxy.
-						t.master = make(chan *ClusterSessUpdate, 8)
-					}
-				}
-				// Topic is created in suspended state because it's not yet configured.
-				t.markPaused(true)
-				// Save topic now to prevent race condition.
-				h.topicPut(join.RcptTo, t)
-
-				// Configure the topic.
-				go topicInit(t, join, h)
+				h.topicLoad(join)
 			} else {
 				// Topic found.
 				if t.isInactive() {
@@ -233,6 +247,11 @@ func (h *Hub) run() {
 				} else {
 					logs.Warn.Println("hub: invalid topic category for broadcast", dst.name)
 				}
+			} else if msg.sess == nil && msg.Pub != nil && !globals.cluster.isRemoteTopic(msg.RcptTo) {
+				// Message is published by the server on behalf of a user, e.g. relayed from Feishu.
+				// Load the topic. The message is processed as soon as the topic is initialized.
+				dst = h.topicLoad(&ClientComMessage{RcptTo: msg.RcptTo, Original: msg.Original, AsUser: msg.AsUser})
+				dst.clientMsg <- msg
 			} else if msg.Note == nil {
 				// Topic is unknown or offline.
 				// Note is silently ignored, all other messages are reported as accepted to prevent
@@ -281,6 +300,8 @@ func (h *Hub) run() {
 			reason := StopNone
 			if unreg.del {
 				reason = StopDeleted
+			} else if unreg.reload {
+				reason = StopReloading
 			}
 			if unreg.forUser.IsZero() {
 				// The topic is being garbage collected or deleted.
@@ -308,6 +329,9 @@ func (h *Hub) run() {
 				return true
 			})
 
+			// Message expiration follows topic masters.
+			globals.expiry.rehash()
+
 			// Check if 'sys' topic has migrated to this node.
 			if h.topicGet("sys") == nil && !globals.cluster.isRemoteTopic("sys") {
 				// Yes, 'sys' has migrated here. Initialize it.
@@ -363,6 +387,18 @@ func (h *Hub) topicsStateForUser(uid types.Uid, suspended bool) {
 	})
 }
 
+// reloadTopic makes the topic pick up changes made directly in the database, such as subscriptions
+// changed by the server. The topic is reloaded by the cluster node which hosts it.
+func reloadTopic(name string) {
+	if globals.cluster.isRemoteTopic(name) {
+		if err := globals.cluster.topicReload(name); err != nil {
+			logs.Warn.Println("hub: failed to reload remote topic", name, err)
+		}
+		return
+	}
+	globals.hub.unreg <- &topicUnreg{rcptTo: name, reload: true}
+}
+
 // topicUnreg deletes or unregisters the topic:
 //
 // Cases:
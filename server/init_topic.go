@@ -163,6 +163,8 @@ func initTopicMe(t *Topic, sreg *ClientComMessage) error {
 	t.public = user.Public
 	t.trusted = user.Trusted
 
+	t.notifyPrefs = user.NotifyPrefs
+
 	t.created = user.CreatedAt
 	t.updated = user.UpdatedAt
 
@@ -300,6 +302,12 @@ func initTopicP2P(t *Topic, sreg *ClientComMessage) error {
 	} else {
 		// Cases 1 (new topic), 2 (one of the two subscriptions is missing: either it's a new request
 		// or the subscription was deleted)
+		if pktsub == nil {
+			// The topic is loaded without a subscription request, e.g. to publish a message on behalf
+			// of the user. Subscriptions are created or restored by the users only.
+			return types.ErrTopicNotFound
+		}
+
 		var userData perUserData
 
 		// Fetching records for both users.
@@ -540,6 +548,14 @@ func initTopicNewGrp(t *Topic, sreg *ClientComMessage, isChan bool) error {
 				userData.private = pktsub.Set.Desc.Private
 			}
 
+			if pktsub.Set.Desc.Retention != nil {
+				if !isValidRetention(pktsub.Set.Desc.Retention) {
+					logs.Warn.Println("hub: retention policy outside of server limits", t.name)
+					return types.ErrPolicy
+				}
+				t.retention = retentionFromWire(pktsub.Set.Desc.Retention)
+			}
+
 			// set default access
 			if pktsub.Set.Desc.DefaultAcs != nil {
 				if authMode, anonMode, err := parseTopicAccess(pktsub.Set.Desc.DefaultAcs,
@@ -600,6 +616,7 @@ func initTopicNewGrp(t *Topic, sreg *ClientComMessage, isChan bool) error {
 		UseBt:     isChan,
 		Public:    t.public,
 		Trusted:   t.trusted,
+		Retention: t.retention,
 	}
 
 	// store.Topics.Create will add a subscription record for the topic creator
@@ -652,6 +669,8 @@ func initTopicGrp(t *Topic) error {
 	t.tags = stopic.Tags
 	t.aux = stopic.Aux
 
+	t.retention = stopic.Retention
+
 	t.public = stopic.Public
 	t.trusted = stopic.Trusted
 
@@ -30,6 +30,7 @@ import (
 	_ "github.com/tinode/chat/server/auth/anon"
 	_ "github.com/tinode/chat/server/auth/basic"
 	_ "github.com/tinode/chat/server/auth/code"
+	_ "github.com/tinode/chat/server/auth/feishu"
 	_ "github.com/tinode/chat/server/auth/rest"
 	_ "github.com/tinode/chat/server/auth/token"
 	"github.com/tinode/chat/server/store/types"
@@ -46,9 +47,13 @@ import (
 	"github.com/tinode/chat/server/push"
 	_ "github.com/tinode/chat/server/push/apns"
 	_ "github.com/tinode/chat/server/push/fcm"
-	_ "github.com/tinode/chat/server/push/feishu"
+	"github.com/tinode/chat/server/push/feishu"
+	_ "github.com/tinode/chat/server/push/huawei"
 	_ "github.com/tinode/chat/server/push/stdout"
 	_ "github.com/tinode/chat/server/push/tnpg"
+	_ "github.com/tinode/chat/server/push/webhook"
+	_ "github.com/tinode/chat/server/push/webpush"
+	_ "github.com/tinode/chat/server/push/xiaomi"
 
 	"github.com/tinode/chat/server/store"
 
@@ -111,6 +116,9 @@ const (
 
 	// Default timeout to drop an unanswered call, seconds.
 	defaultCallEstablishmentTimeout = 30
+
+	// Default expiration period of a read message, seconds.
+	defaultMsgExpirePeriod = 86400
 )
 
 // Build version number defined by the compiler:
@@ -216,6 +224,22 @@ var globals struct {
 
 	// Maximum age of messages which can be deleted with 'D' permission.
 	msgDeleteAge time.Duration
+
+	// Expiration period assigned to messages by default, seconds; -1 if messages don't expire.
+	msgExpireDefault int
+	// Limits on message expiration period, seconds. 0 means no limit.
+	msgExpireMin int
+	msgExpireMax int
+	// Maximum lifetime of messages since being sent, seconds. 0 means no limit.
+	msgMaxLifetime int
+	// Scheduler which deletes messages when they expire.
+	expiry *expiryScheduler
+
+	// Event subscription keys of Feishu apps which relay messages to topics, by app ID.
+	feishuEventKeys map[string]*feishuEventKeys
+
+	// Coalescing of pushes from group topics, nil if disabled.
+	pushDigests *pushDigests
 }
 
 // Credential validator config.
@@ -253,6 +277,21 @@ type mediaConfig struct {
 	Handlers map[string]json.RawMessage `json:"handlers"`
 }
 
+// Message expiration config.
+type msgExpiryConfig struct {
+	// Expiration period of messages which don't have one set by the sender, subscription
+	// or topic retention policy (seconds). Missing or 0 means one day, -1 - never expire.
+	DefaultPeriod int `json:"default_period"`
+	// The shortest allowed expiration period (seconds). 0 means no limit.
+	MinPeriod int `json:"min_period"`
+	// The longest allowed expiration period (seconds). 0 means no limit, i.e. messages
+	// are allowed to never expire.
+	MaxPeriod int `json:"max_period"`
+	// The longest time a message may exist after being sent, whether it's read or not (seconds).
+	// 0 means no limit.
+	MaxLifetime int `json:"max_lifetime"`
+}
+
 // Contentx of the configuration file
 type configType struct {
 	// HTTP(S) address:port to listen on for websocket and long polling clients. Either a
@@ -319,18 +358,24 @@ type configType struct {
 	// Missing or 0 means no age limit.
 	// Does not affect topic owners: owners can delete any message.
 	MsgDeleteAge int `json:"msg_delete_age"`
+	// Server-wide defaults and limits of message expiration.
+	MsgExpiry *msgExpiryConfig `json:"msg_expiry"`
 
 	// Configs for subsystems
-	Cluster   json.RawMessage             `json:"cluster_config"`
-	Plugin    json.RawMessage             `json:"plugins"`
-	Store     json.RawMessage             `json:"store_config"`
-	Push      json.RawMessage             `json:"push"`
-	TLS       json.RawMessage             `json:"tls"`
-	Auth      map[string]json.RawMessage  `json:"auth_config"`
-	Validator map[string]*validatorConfig `json:"acc_validation"`
-	AccountGC *accountGcConfig            `json:"acc_gc_config"`
-	Media     *mediaConfig                `json:"media"`
-	WebRTC    json.RawMessage             `json:"webrtc"`
+	Cluster      json.RawMessage             `json:"cluster_config"`
+	Plugin       json.RawMessage             `json:"plugins"`
+	Store        json.RawMessage             `json:"store_config"`
+	Push         json.RawMessage             `json:"push"`
+	PushDigest   *pushDigestConfig           `json:"push_digest"`
+	TLS          json.RawMessage             `json:"tls"`
+	Auth         map[string]json.RawMessage  `json:"auth_config"`
+	Validator    map[string]*validatorConfig `json:"acc_validation"`
+	AccountGC    *accountGcConfig            `json:"acc_gc_config"`
+	EmailDigest  *emailDigestConfig          `json:"email_digest"`
+	FeishuSync   *feishuSyncConfig           `json:"feishu_sync"`
+	FeishuBridge *feishuBridgeConfig         `json:"feishu_bridge"`
+	Media        *mediaConfig                `json:"media"`
+	WebRTC       json.RawMessage             `json:"webrtc"`
 }
 
 func main() {
@@ -605,6 +650,10 @@ func main() {
 		globals.msgDeleteAge = time.Duration(config.MsgDeleteAge) * time.Second
 	}
 
+	if err = msgExpiryInit(config.MsgExpiry); err != nil {
+		logs.Err.Fatal("Invalid message expiry config: ", err)
+	}
+
 	// Configuration of X-Frame-Options header.
 	globals.xFrameOptions = config.XFrameOptions
 	if globals.xFrameOptions == "" {
@@ -658,6 +707,18 @@ func main() {
 		}()
 	}
 
+	// Email digests of unread messages for users who are offline.
+	stopEmailDigest, err := emailDigestStart(config.EmailDigest)
+	if err != nil {
+		logs.Err.Fatal("Failed to start email digests:", err)
+	}
+	if stopEmailDigest != nil {
+		defer func() {
+			stopEmailDigest <- true
+			logs.Info.Println("Stopped email digests")
+		}()
+	}
+
 	pushHandlers, err := push.Init(config.Push)
 	if err != nil {
 		logs.Err.Fatal("Failed to initialize push notifications:", err)
@@ -667,6 +728,8 @@ func main() {
 		logs.Info.Println("Stopped push notifications")
 	}()
 	logs.Info.Println("Push handlers configured:", pushHandlers)
+	statsRegisterPushStats()
+	pushDigestInit(config.PushDigest)
 
 	if err = initVideoCalls(config.WebRTC); err != nil {
 		logs.Err.Fatal("Failed to init video calls: %w", err)
@@ -677,6 +740,20 @@ func main() {
 	// The hub (the main message router)
 	globals.hub = newHub()
 
+	// Feishu organization directory sync.
+	if config.FeishuSync != nil && config.FeishuSync.Enabled {
+		fsync, err := newFeishuSync(config.FeishuSync)
+		if err != nil {
+			logs.Err.Fatalln("Invalid Feishu sync config:", err)
+		}
+		stopFeishuSync := fsync.start(time.Second * time.Duration(config.FeishuSync.SyncPeriod))
+
+		defer func() {
+			stopFeishuSync <- true
+			logs.Info.Println("Stopped Feishu directory sync")
+		}()
+	}
+
 	// Start accepting cluster traffic.
 	if globals.cluster != nil {
 		globals.cluster.start()
@@ -701,16 +778,12 @@ func main() {
 		logs.Err.Fatal(err)
 	}
 
-	// start auto delete expired messages task
-	delExpMsgStop := deleteExpiredMessages()
+	// Start deleting expired messages.
+	globals.expiry = newExpiryScheduler()
+	globals.expiry.start()
 	defer func() {
-		delExpMsgStop <- true
-	}()
-
-	// start update miss expired messages task
-	updateMissExpMsgStop := updateMissExpiredMessages()
-	defer func() {
-		updateMissExpMsgStop <- true
+		globals.expiry.stop()
+		logs.Info.Println("Stopped message expiry scheduler")
 	}()
 
 	// Serve static content from the directory in -static_data flag if that's
@@ -792,6 +865,17 @@ func main() {
 	mux.HandleFunc(config.ApiPath+"v0/channels", serveWebSocket)
 	// Handle long polling clients. Enable compression.
 	mux.Handle(config.ApiPath+"v0/channels/lp", gh.CompressHandler(http.HandlerFunc(serveLongPoll)))
+	// Handle administrative requests.
+	mux.HandleFunc(config.ApiPath+"v0/admin/hold", serveLegalHold)
+	mux.HandleFunc(config.ApiPath+"v0/admin/feishu/apps", serveFeishuApps)
+	mux.HandleFunc(config.ApiPath+"v0/admin/push/deadletters", servePushDeadLetters)
+	if config.FeishuBridge != nil && config.FeishuBridge.Enabled {
+		// Handle Feishu event callbacks and bindings of topics to Feishu chats.
+		globals.feishuEventKeys = config.FeishuBridge.Apps
+		globals.immutableTagNS[feishu.ChatTagNS] = true
+		mux.HandleFunc(config.ApiPath+"v0/feishu/events", serveFeishuEvents)
+		mux.HandleFunc(config.ApiPath+"v0/admin/feishu/chats", serveFeishuChats)
+	}
 	if config.Media != nil {
 		// Handle uploads of large files.
 		mux.Handle(config.ApiPath+"v0/file/u/", gh.CompressHandler(http.HandlerFunc(largeFileReceiveHTTP)))
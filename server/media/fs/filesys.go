@@ -180,10 +180,8 @@ func (fh *fshandler) Download(url string) (*types.FileDef, media.ReadSeekCloser,
 // Delete deletes files from storage by provided slice of locations.
 func (fh *fshandler) Delete(locations []string) error {
 	for _, loc := range locations {
-		if err, _ := os.Remove(loc).(*os.PathError); err != nil {
-			if err != os.ErrNotExist {
-				logs.Warn.Println("fs: error deleting file", loc, err)
-			}
+		if err := os.Remove(loc); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logs.Warn.Println("fs: error deleting file", loc, err)
 		}
 	}
 	return nil
@@ -77,6 +77,8 @@ func pbServPresSerialize(pres *MsgServerPres) *pbx.ServerMsg_Pres {
 		what = pbx.ServerPres_TAGS
 	case "aux":
 		what = pbx.ServerPres_AUX
+	case "updateMsg":
+		what = pbx.ServerPres_UPDMSG
 	default:
 		logs.Info.Println("Unknown pres.what value", pres.What)
 	}
@@ -92,6 +94,8 @@ func pbServPresSerialize(pres *MsgServerPres) *pbx.ServerMsg_Pres {
 			TargetUserId: pres.AcsTarget,
 			ActorUserId:  pres.AcsActor,
 			Acs:          pbAccessModeSerialize(pres.Acs),
+			Expired:      pbMsgExpirySerialize(pres.Expired),
+			FromUserId:   pres.From,
 		},
 	}
 }
@@ -198,6 +202,8 @@ func pbServDeserialize(pkt *pbx.ServerMsg) *ServerComMessage {
 			what = "tags"
 		case pbx.ServerPres_AUX:
 			what = "aux"
+		case pbx.ServerPres_UPDMSG:
+			what = "updateMsg"
 		}
 		msg.Pres = &MsgServerPres{
 			Topic:     pres.GetTopic(),
@@ -210,6 +216,8 @@ func pbServDeserialize(pkt *pbx.ServerMsg) *ServerComMessage {
 			AcsTarget: pres.GetTargetUserId(),
 			AcsActor:  pres.GetActorUserId(),
 			Acs:       pbAccessModeDeserialize(pres.GetAcs()),
+			Expired:   pbMsgExpiryDeserialize(pres.GetExpired()),
+			From:      pres.GetFromUserId(),
 		}
 	} else if info := pkt.GetInfo(); info != nil {
 		msg.Info = &MsgServerInfo{
@@ -1081,6 +1089,38 @@ func pbDelQueryDeserialize(in []*pbx.SeqRange) []MsgRange {
 	return out
 }
 
+func pbMsgExpirySerialize(in []MsgExpiry) []*pbx.MsgExpiry {
+	if in == nil {
+		return nil
+	}
+
+	out := make([]*pbx.MsgExpiry, len(in))
+	for i, exp := range in {
+		out[i] = &pbx.MsgExpiry{
+			SeqId:        int32(exp.SeqId),
+			ExpirePeriod: int32(exp.ExpirePeriod),
+			ExpiredAt:    timeToInt64(&exp.ExpiredAt),
+		}
+	}
+
+	return out
+}
+
+func pbMsgExpiryDeserialize(in []*pbx.MsgExpiry) []MsgExpiry {
+	if in == nil {
+		return nil
+	}
+
+	out := make([]MsgExpiry, len(in))
+	for i, exp := range in {
+		out[i].SeqId = int(exp.GetSeqId())
+		out[i].ExpirePeriod = int(exp.GetExpirePeriod())
+		out[i].ExpiredAt = time.UnixMilli(exp.GetExpiredAt()).UTC()
+	}
+
+	return out
+}
+
 func pbDelValuesSerialize(in *MsgDelValues) *pbx.DelValues {
 	if in == nil {
 		return nil
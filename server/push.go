@@ -8,15 +8,33 @@
 package main
 
 import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
 	"github.com/tinode/chat/server/drafty"
 	"github.com/tinode/chat/server/logs"
 	"github.com/tinode/chat/server/store"
-	"time"
 
 	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/webpush"
 	"github.com/tinode/chat/server/store/types"
 )
 
+// devicePlatform returns the platform to store with the device ID. Browsers subscribed to Web Push
+// send the subscription as the device ID, it's stored with its own platform.
+func devicePlatform(deviceID, platf string) string {
+	if strings.HasPrefix(deviceID, "{") {
+		if _, err := webpush.ParseSubscription(deviceID); err == nil {
+			return types.PlatformWebPush
+		}
+	}
+	return platf
+}
+
 // Subscribe or unsubscribe user to/from FCM topic (channel).
 func (t *Topic) channelSubUnsub(uid types.Uid, sub bool) {
 	push.ChannelSub(&push.ChannelReq{
@@ -56,6 +74,9 @@ func (t *Topic) pushForData(fromUid types.Uid, data *MsgServerData, msgMarkedAsR
 	if replace, found := data.Head["replace"].(string); found {
 		receipt.Payload.Replace = replace
 	}
+	if origin, found := data.Head["origin"].(string); found {
+		receipt.Payload.Origin = origin
+	}
 
 	if t.isChan {
 		// Channel readers should get a push on a channel name (as an FCM topic push).
@@ -114,6 +135,51 @@ func (t *Topic) pushForData(fromUid types.Uid, data *MsgServerData, msgMarkedAsR
 	return nil
 }
 
+// Prepares a silent push which lets the callees stop ringing when the call is dropped without a finalizing
+// message. The push looks like the finalizing message in the 'disconnected' state. Nothing is sent if the call
+// was answered: the devices stopped ringing then.
+func (t *Topic) pushForCallEnd(fromUid types.Uid, call *videoCall, now time.Time) *push.Receipt {
+	if !call.acceptedAt.IsZero() {
+		return nil
+	}
+	receipt := push.Receipt{
+		To: make(map[types.Uid]push.Recipient, t.subsCount()),
+		Payload: push.Payload{
+			What:      push.ActMsg,
+			Silent:    true,
+			Topic:     t.name,
+			TopicPub:  t.public,
+			From:      fromUid.UserId(),
+			Timestamp: now,
+			SeqId:     call.seq,
+			Webrtc:    constCallMsgDisconnected,
+			Replace:   ":" + strconv.Itoa(call.seq),
+		},
+	}
+	for uid, pud := range t.perUser {
+		if uid != fromUid && (pud.modeWant & pud.modeGiven).IsReader() && !pud.deleted && !pud.isChan {
+			receipt.To[uid] = push.Recipient{}
+		}
+	}
+	if len(receipt.To) > 0 {
+		return &receipt
+	}
+	return nil
+}
+
+// Marks the VoIP token of the session which changed the state of the call, i.e. answered or declined it, as
+// the device which received the message: the app must report every VoIP push to CallKit as a call, but this
+// device has nothing to report.
+func pushSkipCallSession(rcpt *push.Receipt, sess *Session) {
+	if sess == nil || sess.voipToken == "" {
+		return
+	}
+	if to, ok := rcpt.To[sess.uid]; ok {
+		to.Devices = append(to.Devices, sess.voipToken)
+		rcpt.To[sess.uid] = to
+	}
+}
+
 func (t *Topic) preparePushForSubReceipt(fromUid types.Uid, now time.Time) *push.Receipt {
 	// The `Topic` in the push receipt is `t.xoriginal` for group topics, `fromUid` for p2p topics,
 	// not the t.original(fromUid) because it's the topic name as seen by the recipient, not by the sender.
@@ -214,6 +280,382 @@ func (t *Topic) pushForReadRcpt(uid types.Uid, seq int, now time.Time) *push.Rec
 	return receipt
 }
 
+// Prepares a silent push to be delivered to mobile devices when messages expire so the apps
+// can remove the messages from the local cache.
+func pushForExpired(topic string, uids []types.Uid, delSeq []types.Range, now time.Time) *push.Receipt {
+	if len(uids) == 0 {
+		return nil
+	}
+
+	// P2P topic name is rewritten for each recipient when the payload is created.
+	receipt := &push.Receipt{
+		To: make(map[types.Uid]push.Recipient, len(uids)),
+		Payload: push.Payload{
+			What:      push.ActExpire,
+			Silent:    true,
+			Topic:     topic,
+			Timestamp: now,
+			DelSeq:    make([]push.SeqRange, len(delSeq)),
+		},
+	}
+	for i, r := range delSeq {
+		receipt.Payload.DelSeq[i] = push.SeqRange{Low: r.Low, Hi: r.Hi}
+	}
+	for _, uid := range uids {
+		receipt.To[uid] = push.Recipient{}
+	}
+	return receipt
+}
+
+// Maximum number of muted topics in user's notification preferences.
+const maxMutedTopics = 1024
+
+// Cache of time zones of users' quiet hours.
+var quietZones sync.Map
+
+// parseQuietHours parses quiet hours "HH:MM-HH:MM" into minutes since midnight.
+func parseQuietHours(spec string) (start, end int, err error) {
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, errors.New("invalid quiet hours")
+	}
+	parseClock := func(clock string) (int, error) {
+		tm, err := time.Parse("15:04", strings.TrimSpace(clock))
+		if err != nil {
+			return 0, err
+		}
+		return tm.Hour()*60 + tm.Minute(), nil
+	}
+	if start, err = parseClock(from); err != nil {
+		return 0, 0, err
+	}
+	if end, err = parseClock(to); err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+// quietZone returns the time zone of the quiet hours.
+func quietZone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	if loc, ok := quietZones.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	quietZones.Store(name, loc)
+	return loc, nil
+}
+
+// isQuietTime checks if the time falls into the user's quiet hours.
+func isQuietTime(prefs *types.NotifyPrefs, now time.Time) bool {
+	if prefs.Quiet == "" {
+		return false
+	}
+	start, end, err := parseQuietHours(prefs.Quiet)
+	if err != nil || start == end {
+		return false
+	}
+	loc, err := quietZone(prefs.TimeZone)
+	if err != nil {
+		return false
+	}
+	now = now.In(loc)
+	minute := now.Hour()*60 + now.Minute()
+	if start < end {
+		return minute >= start && minute < end
+	}
+	// Quiet hours span midnight.
+	return minute >= start || minute < end
+}
+
+// notifyPrefsFromWire validates notification preferences sent by the client and converts them to
+// the storage format. Expired mutes are dropped. Returns nil if the preferences are empty.
+func notifyPrefsFromWire(src *MsgNotifyPrefs, now time.Time) (*types.NotifyPrefs, error) {
+	prefs := &types.NotifyPrefs{
+		Quiet:         strings.TrimSpace(src.Quiet),
+		TimeZone:      src.TimeZone,
+		MentionsOnly:  src.MentionsOnly,
+		NoEmailDigest: src.NoEmailDigest,
+	}
+	if prefs.Quiet != "" {
+		if _, _, err := parseQuietHours(prefs.Quiet); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := quietZone(prefs.TimeZone); err != nil {
+		return nil, err
+	}
+	if len(src.Mute) > maxMutedTopics {
+		return nil, errors.New("too many muted topics")
+	}
+	for topic, until := range src.Mute {
+		if len(topic) <= 3 || (!strings.HasPrefix(topic, "usr") && !strings.HasPrefix(topic, "grp")) {
+			return nil, errors.New("invalid muted topic '" + topic + "'")
+		}
+		if !until.After(now) {
+			continue
+		}
+		if prefs.Mute == nil {
+			prefs.Mute = make(map[string]time.Time)
+		}
+		prefs.Mute[topic] = until.UTC()
+	}
+
+	if prefs.Quiet == "" && prefs.TimeZone == "" && !prefs.MentionsOnly && len(prefs.Mute) == 0 && !prefs.NoEmailDigest {
+		return nil, nil
+	}
+	return prefs, nil
+}
+
+func notifyPrefsEqual(a, b *types.NotifyPrefs) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Quiet != b.Quiet || a.TimeZone != b.TimeZone || a.MentionsOnly != b.MentionsOnly ||
+		a.NoEmailDigest != b.NoEmailDigest || len(a.Mute) != len(b.Mute) {
+		return false
+	}
+	for topic, until := range a.Mute {
+		if other, ok := b.Mute[topic]; !ok || !other.Equal(until) {
+			return false
+		}
+	}
+	return true
+}
+
+func notifyPrefsToWire(src *types.NotifyPrefs) *MsgNotifyPrefs {
+	if src == nil {
+		return nil
+	}
+	return &MsgNotifyPrefs{
+		Quiet:         src.Quiet,
+		TimeZone:      src.TimeZone,
+		MentionsOnly:  src.MentionsOnly,
+		Mute:          src.Mute,
+		NoEmailDigest: src.NoEmailDigest,
+	}
+}
+
+// setNotifyPrefsAsUser replaces notification preferences of the user on behalf of the user without a session,
+// e.g. when they are changed by a bot command. The user's 'me' topic makes the change if it's loaded at this node.
+func setNotifyPrefsAsUser(uid types.Uid, src *MsgNotifyPrefs) error {
+	now := types.TimeNow()
+	prefs, err := notifyPrefsFromWire(src, now)
+	if err != nil {
+		return err
+	}
+
+	if me := globals.hub.topicGet(uid.UserId()); me != nil {
+		msg := &ClientComMessage{
+			Set:       &MsgClientSet{Topic: "me", MsgSetQuery: MsgSetQuery{Desc: &MsgSetDesc{Notify: src}}},
+			Original:  "me",
+			RcptTo:    uid.UserId(),
+			AsUser:    uid.UserId(),
+			AuthLvl:   int(auth.LevelAuth),
+			MetaWhat:  constMsgMetaDesc,
+			Timestamp: now,
+		}
+		select {
+		case me.meta <- msg:
+			return nil
+		default:
+			return errors.New("topic is busy")
+		}
+	}
+
+	if err := store.Users.Update(uid, map[string]any{"NotifyPrefs": prefs}); err != nil {
+		return err
+	}
+	usersUpdateNotifyPrefs(uid, prefs)
+	return nil
+}
+
+// mentionChecker returns a function which checks if the user is @-mentioned in the message.
+// Mentions are extracted on the first call.
+func mentionChecker(pl *push.Payload) func(types.Uid) bool {
+	var mentions map[string]bool
+	return func(uid types.Uid) bool {
+		if pl.What != push.ActMsg {
+			return false
+		}
+		if mentions == nil {
+			mentions = make(map[string]bool)
+			users, err := drafty.GetMentionUsers(pl.Content)
+			if err != nil {
+				logs.Warn.Printf("push[%s]: failed to get mentions: %v", pl.Topic, err)
+			}
+			for _, user := range users {
+				mentions[user] = true
+			}
+		}
+		return mentions[uid.UserId()]
+	}
+}
+
+// applyNotifyPrefs removes recipients who don't want to be notified according to their notification
+// preferences: the topic is muted, or it's a group topic and the user wants to be notified of mentions
+// only, or it's quiet hours and the message is not a call. Calls during quiet hours are marked as quiet.
+// @-mentions break through mute. Silent pushes and the sender's own pushes are not affected.
+func applyNotifyPrefs(rcpt *push.Receipt, prefsOf func(types.Uid) *types.NotifyPrefs, now time.Time) {
+	if rcpt.Payload.What != push.ActMsg && rcpt.Payload.What != push.ActSub {
+		return
+	}
+
+	mentioned := mentionChecker(&rcpt.Payload)
+	call := rcpt.Payload.Webrtc != ""
+	group := types.GetTopicCat(rcpt.Payload.Topic) == types.TopicCatGrp
+	for uid := range rcpt.To {
+		if uid.UserId() == rcpt.Payload.From {
+			continue
+		}
+		prefs := prefsOf(uid)
+		if prefs == nil {
+			continue
+		}
+
+		topic := rcpt.Payload.Topic
+		if types.GetTopicCat(topic) == types.TopicCatP2P {
+			// P2P topics are muted by the name the user sees.
+			topic, _ = types.P2PNameForUser(uid, topic)
+		}
+		if until, ok := prefs.Mute[topic]; ok && now.Before(until) && !mentioned(uid) {
+			delete(rcpt.To, uid)
+		} else if prefs.MentionsOnly && group && rcpt.Payload.What == push.ActMsg && !mentioned(uid) {
+			delete(rcpt.To, uid)
+		} else if isQuietTime(prefs, now) {
+			if !call {
+				delete(rcpt.To, uid)
+			} else if to, ok := rcpt.To[uid]; ok {
+				to.Quiet = true
+				rcpt.To[uid] = to
+			}
+		}
+	}
+}
+
+// Coalescing of pushes from busy group topics config.
+type pushDigestConfig struct {
+	// Seconds during which pushes from a group topic to a user are collected into one summary push.
+	// The first push is sent right away. 0 or missing disables coalescing.
+	Window int `json:"window"`
+}
+
+type digestKey struct {
+	uid   types.Uid
+	topic string
+}
+
+// Pushes collected for one user and topic.
+type pendingDigest struct {
+	// Number of collected pushes.
+	count int
+	// Payload of the last collected push.
+	payload push.Payload
+	// Recipient of the last collected push.
+	rcpt push.Recipient
+}
+
+// pushDigests collects pushes from group topics and sends one summary push per user and topic at the end
+// of the window. Calls, mentions, edits and pushes to users with attached sessions are not delayed.
+type pushDigests struct {
+	window time.Duration
+	// Sends the summary push.
+	send func(*push.Receipt)
+
+	mu      sync.Mutex
+	pending map[digestKey]*pendingDigest
+}
+
+func pushDigestInit(conf *pushDigestConfig) {
+	if conf == nil || conf.Window <= 0 {
+		return
+	}
+	globals.pushDigests = &pushDigests{
+		window:  time.Duration(conf.Window) * time.Second,
+		send:    push.Push,
+		pending: make(map[digestKey]*pendingDigest),
+	}
+	logs.Info.Printf("Push coalescing enabled, window %ds", conf.Window)
+}
+
+// coalesce removes recipients whose pushes are collected into a digest. The read notification
+// discards the collected pushes of the user.
+func (pd *pushDigests) coalesce(rcpt *push.Receipt) {
+	if pd == nil || types.GetTopicCat(rcpt.Payload.Topic) != types.TopicCatGrp {
+		return
+	}
+
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+
+	if rcpt.Payload.What == push.ActRead {
+		for uid := range rcpt.To {
+			if digest, ok := pd.pending[digestKey{uid, rcpt.Payload.Topic}]; ok {
+				digest.count = 0
+			}
+		}
+		return
+	}
+
+	if rcpt.Payload.What != push.ActMsg || rcpt.Payload.Webrtc != "" || rcpt.Payload.Replace != "" {
+		return
+	}
+
+	mentioned := mentionChecker(&rcpt.Payload)
+	for uid, to := range rcpt.To {
+		if uid.UserId() == rcpt.Payload.From {
+			continue
+		}
+		key := digestKey{uid, rcpt.Payload.Topic}
+		digest, ok := pd.pending[key]
+		if to.Delivered > 0 || mentioned(uid) {
+			// The user will see the collected messages too.
+			if ok {
+				digest.count = 0
+			}
+			continue
+		}
+		if !ok {
+			// The first push opens the window and is sent right away.
+			pd.pending[key] = &pendingDigest{}
+			time.AfterFunc(pd.window, func() { pd.flush(key) })
+			continue
+		}
+		digest.count++
+		digest.payload = rcpt.Payload
+		digest.rcpt = to
+		delete(rcpt.To, uid)
+	}
+}
+
+// flush sends the summary push at the end of the window. The window is extended while there are
+// pushes to collect.
+func (pd *pushDigests) flush(key digestKey) {
+	pd.mu.Lock()
+	digest := pd.pending[key]
+	if digest.count == 0 {
+		delete(pd.pending, key)
+		pd.mu.Unlock()
+		return
+	}
+
+	rcpt := &push.Receipt{
+		Payload: digest.payload,
+		To:      map[types.Uid]push.Recipient{key.uid: digest.rcpt},
+	}
+	rcpt.Payload.Digest = digest.count
+	digest.count = 0
+	time.AfterFunc(pd.window, func() { pd.flush(key) })
+	pd.mu.Unlock()
+
+	pd.send(rcpt)
+}
+
 // Process push notification.
 func sendPush(rcpt *push.Receipt) {
 	if rcpt == nil || globals.usersUpdate == nil {
@@ -2,10 +2,10 @@ package apns
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/sideshow/apns2"
 	"github.com/tinode/chat/server/push/common"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -28,105 +28,43 @@ const (
 	ACT_MISSED = 3
 )
 
+// payloadToData converts the payload to the data fields with the title and the content of the alert.
 func payloadToData(pl *push.Payload) (map[string]string, error) {
-	if pl == nil {
-		return nil, errors.New("empty push payload")
+	data, err := common.PayloadToData(pl)
+	if err != nil || pl.What != push.ActMsg {
+		return data, err
 	}
-	data := make(map[string]string)
-	var err error
-	data["what"] = pl.What
-	if pl.Silent {
-		data["silent"] = "true"
-	}
-
-	data["topic"] = pl.Topic
-	data["ts"] = pl.Timestamp.Format(time.RFC3339Nano)
-	// Must use "xfrom" because "from" is a reserved word. Google did not bother to document it anywhere.
-	data["xfrom"] = pl.From
-	if pl.What == push.ActMsg {
-		data["seq"] = strconv.Itoa(pl.SeqId)
-		if pl.ContentType != "" {
-			data["mime"] = pl.ContentType
-		}
-
-		// Convert Drafty content to plain text (clients 0.16 and below).
-		data["content"], err = drafty.PlainText(pl.Content)
-
-		switch t.GetTopicCat(pl.Topic) {
-		case t.TopicCatP2P:
-			data["title"] = getUserName(pl)
-		case t.TopicCatGrp:
-			fallthrough
-		case t.TopicCatFnd:
-			fallthrough
-		case t.TopicCatSys:
-			data["title"] = getTopicName(pl)
-			data["content"] = fmt.Sprintf("%s: %s", getUserName(pl), data["content"])
-		default:
-		}
-
-		if err != nil {
-			return nil, err
-		}
-		// Trim long strings to 128 runes.
-		// Check byte length first and don't waste time converting short strings.
-		if len(data["content"]) > push.MaxPayloadLength {
-			runes := []rune(data["content"])
-			if len(runes) > push.MaxPayloadLength {
-				data["content"] = string(runes[:push.MaxPayloadLength]) + "…"
-			}
-		}
 
-		// Rich content for clients version 0.17 and above.
-		data["rc"], err = drafty.Preview(pl.Content, push.MaxPayloadLength)
-
-		if pl.Webrtc != "" {
-			fmt.Printf("webrtc %v \n", pl.Webrtc)
-			data["webrtc"] = pl.Webrtc
-			if pl.AudioOnly {
-				data["aonly"] = "true"
-				data["content"] = "[AUDIO CALL]"
-				data["act"] = strconv.Itoa(ACT_AUIDO)
-			} else {
-				data["content"] = "[VIDEO CALL]"
-				data["act"] = strconv.Itoa(ACT_VIDEO)
-			}
-			// when Caller hang-up the call
-			if pl.Webrtc == "missed" {
-				data["content"] = "[MISSED CALL]"
-				data["act"] = strconv.Itoa(ACT_MISSED)
-			}
-			// Video call push notifications are silent.
-			data["silent"] = "true"
-		}
-		if pl.Replace != "" {
-			// Notification of a message edit should be silent too.
-			data["silent"] = "true"
-			data["replace"] = pl.Replace
+	content, err := drafty.PlainText(pl.Content)
+	if err != nil {
+		return nil, err
+	}
+	switch t.GetTopicCat(pl.Topic) {
+	case t.TopicCatP2P:
+		data["title"] = getUserName(pl)
+	case t.TopicCatGrp, t.TopicCatFnd, t.TopicCatSys:
+		data["title"] = getTopicName(pl)
+		content = fmt.Sprintf("%s: %s", getUserName(pl), content)
+	}
+	data["content"] = common.TrimContent(content)
+
+	if pl.Webrtc != "" {
+		if pl.AudioOnly {
+			data["content"] = "[AUDIO CALL]"
+			data["act"] = strconv.Itoa(ACT_AUIDO)
+		} else {
+			data["content"] = "[VIDEO CALL]"
+			data["act"] = strconv.Itoa(ACT_VIDEO)
 		}
-		if err != nil {
-			return nil, err
+		// when Caller hang-up the call
+		if pl.Webrtc == "missed" {
+			data["content"] = "[MISSED CALL]"
+			data["act"] = strconv.Itoa(ACT_MISSED)
 		}
-	} else if pl.What == push.ActSub {
-		data["modeWant"] = pl.ModeWant.String()
-		data["modeGiven"] = pl.ModeGiven.String()
-	} else if pl.What == push.ActRead {
-		data["seq"] = strconv.Itoa(pl.SeqId)
-		data["silent"] = "true"
-	} else {
-		return nil, errors.New("unknown push type")
 	}
 	return data, nil
 }
 
-func clonePayload(src map[string]string) map[string]string {
-	dst := make(map[string]string, len(src))
-	for key, val := range src {
-		dst[key] = val
-	}
-	return dst
-}
-
 func PrepareApnsNotifications(rcpt *push.Receipt, config *configType) ([]*apns2.Notification, []t.Uid) {
 	data, err := payloadToData(&rcpt.Payload)
 	if err != nil {
@@ -175,7 +113,7 @@ func PrepareApnsNotifications(rcpt *push.Receipt, config *configType) ([]*apns2.
 		userData := data
 		tcat := t.GetTopicCat(topic)
 		if rcpt.To[uid].Delivered > 0 || tcat == t.TopicCatP2P {
-			userData = clonePayload(data)
+			userData = common.ClonePayload(data)
 			// Fix topic name for P2P pushes.
 			if tcat == t.TopicCatP2P {
 				topic, _ = t.P2PNameForUser(uid, topic)
@@ -187,9 +125,30 @@ func PrepareApnsNotifications(rcpt *push.Receipt, config *configType) ([]*apns2.
 			}
 		}
 
+		// Users with a VoIP token get incoming calls through PushKit instead of an alert.
+		voip := voipCallState(userData["webrtc"]) != "" && uid.UserId() != userData["xfrom"] &&
+			slices.ContainsFunc(devList, func(d t.DeviceDef) bool { return d.Platform == t.PlatformVoip })
+
 		for i := range devList {
 			d := &devList[i]
-			if _, ok := skipDevices[d.DeviceId]; !ok && d.DeviceId != "" {
+			if d.Platform == t.PlatformVoip {
+				// The device which answered or declined the call is not ringing.
+				if _, skip := skipDevices[d.DeviceId]; !skip && voip && d.DeviceId != "" {
+					msg, err := voipNotification(topic, userData, config, d.DeviceId)
+					if err != nil {
+						logs.Warn.Println("apns: generate voip notification err", err)
+						continue
+					}
+					uids = append(uids, uid)
+					messages = append(messages, msg)
+				}
+				continue
+			}
+			if voip && userData["webrtc"] == "started" {
+				continue
+			}
+			// Devices with their own push services are served by other adapters.
+			if _, ok := skipDevices[d.DeviceId]; !ok && d.DeviceId != "" && !t.HasOwnPushService(d.Platform) {
 				msg := apns2.Notification{
 					DeviceToken: d.DeviceId,
 					Topic:       config.AppTopic,
@@ -247,8 +206,53 @@ func ChannelsForUser(uid t.Uid) []string {
 	return channels
 }
 
+// voipCallState returns the state to report in a VoIP push for the webrtc state of the call message:
+// "started" for a call invite, "ended" when the call must stop ringing, or an empty string if no VoIP push
+// should be sent.
+func voipCallState(webrtc string) string {
+	switch webrtc {
+	case "started":
+		return webrtc
+	case "accepted", "missed", "declined", "disconnected":
+		// The call was answered on another device or is over before it was answered.
+		return "ended"
+	}
+	// A finished call was answered: the devices stopped ringing when it was accepted.
+	return ""
+}
+
+// voipNotification creates a PushKit notification of a call invite or a cancellation. The app must report
+// the call to CallKit on every VoIP push, so the payload carries everything needed to show or end the call.
+func voipNotification(topic string, data map[string]string, config *configType, token string) (*apns2.Notification, error) {
+	payload := map[string]string{"call": voipCallState(data["webrtc"])}
+	for _, key := range []string{"topic", "xfrom", "seq", "ts", "title", "webrtc", "aonly", "act", "replace"} {
+		if val, ok := data[key]; ok {
+			payload[key] = val
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := voipTimeToLive
+	if config.VoipTimeToLive > 0 {
+		ttl = config.VoipTimeToLive
+	}
+	return &apns2.Notification{
+		DeviceToken: token,
+		Topic:       config.AppTopic + ".voip",
+		// The cancellation replaces an undelivered invite.
+		CollapseID: topic,
+		Expiration: time.Now().UTC().Add(time.Duration(ttl) * time.Second),
+		PushType:   apns2.PushTypeVOIP,
+		Priority:   apns2.PriorityHigh,
+		Payload:    body,
+	}, nil
+}
+
 func apnsShouldPresentAlert(what, callStatus, isSilent string, config *configType) bool {
-	return config.Enabled && what != push.ActRead && ((callStatus == "" && isSilent == "") || (callStatus == "started" || callStatus == "missed"))
+	return config.Enabled && what != push.ActRead && what != push.ActExpire && ((callStatus == "" && isSilent == "") || (callStatus == "started" || callStatus == "missed"))
 }
 
 func apnsNotificationConfig(what, topic string, data map[string]string, unread int, config *configType, msg apns2.Notification, uid t.Uid) (apns2.Notification, error) {
@@ -261,17 +265,10 @@ func apnsNotificationConfig(what, topic string, data map[string]string, unread i
 	priority := 10
 	interruptionLevel := common.InterruptionLevelTimeSensitive
 	if callStatus == "started" || callStatus == "missed" {
-		// Send VOIP push only when a new call is started, otherwise send normal alert.
+		// Alert of a call for devices without a VoIP token.
 		interruptionLevel = common.InterruptionLevelCritical
-		// FIXME: PushKit notifications do not work with the current FCM adapter.
-		// Using normal pushes as a poor-man's replacement for VOIP pushes.
-		// Uncomment the following two lines when FCM fixes its problem or when we switch to
-		// a different adapter.
-		// TODO:: why push voip type, return DeviceTokenNotForTopic error
-		//pushType = apns2.PushTypeVOIP
-		//msg.Topic += ".voip"
 		expires = time.Now().UTC().Add(time.Duration(voipTimeToLive) * time.Second)
-	} else if what == push.ActRead {
+	} else if what == push.ActRead || what == push.ActExpire {
 		priority = 5
 		interruptionLevel = common.InterruptionLevelPassive
 		pushType = apns2.PushTypeBackground
@@ -292,7 +289,7 @@ func apnsNotificationConfig(what, topic string, data map[string]string, unread i
 		ThreadID:          topic,
 	}
 
-	// Do not present alert for read notifications and video calls.
+	// Do not present alert for read and expire notifications and video calls.
 	if apnsShouldPresentAlert(what, callStatus, data["silent"], config) {
 		body := config.CommonConfig.GetStringField(what, "Body")
 		if body == "$content" {
@@ -323,6 +320,9 @@ func apnsNotificationConfig(what, topic string, data map[string]string, unread i
 
 	if callStatus == "started" || callStatus == "missed" {
 		tmpPayload = map[string]interface{}{"aps": apsPayload, "act": data["act"]}
+	} else if what == push.ActExpire {
+		// The app needs to know which messages to purge from its cache.
+		tmpPayload = map[string]interface{}{"aps": apsPayload, "what": what, "topic": topic, "delseq": data["delseq"]}
 	} else {
 		tmpPayload = map[string]interface{}{"aps": apsPayload}
 	}
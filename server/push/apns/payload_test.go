@@ -0,0 +1,146 @@
+package apns
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/sideshow/apns2"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/pushtest"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+func TestMain(m *testing.M) {
+	pushtest.Main(m)
+}
+
+func TestVoipCallState(tt *testing.T) {
+	for webrtc, state := range map[string]string{
+		"started":      "started",
+		"accepted":     "ended",
+		"missed":       "ended",
+		"declined":     "ended",
+		"disconnected": "ended",
+		"finished":     "",
+		"":             "",
+	} {
+		if voipCallState(webrtc) != state {
+			tt.Errorf("%q: expected %q, got %q", webrtc, state, voipCallState(webrtc))
+		}
+	}
+}
+
+func TestVoipNotification(tt *testing.T) {
+	data := map[string]string{
+		"topic":   "usrAbc",
+		"xfrom":   "usrAbc",
+		"seq":     "5",
+		"title":   "Alice",
+		"webrtc":  "started",
+		"aonly":   "true",
+		"act":     "1",
+		"content": "[AUDIO CALL]",
+	}
+	config := &configType{AppTopic: "co.tinode.tinodios", VoipTimeToLive: 30}
+
+	msg, err := voipNotification("usrAbc", data, config, "voip-token")
+	if err != nil {
+		tt.Fatal(err)
+	}
+	if msg.DeviceToken != "voip-token" || msg.Topic != "co.tinode.tinodios.voip" || msg.CollapseID != "usrAbc" ||
+		msg.PushType != apns2.PushTypeVOIP || msg.Priority != apns2.PriorityHigh {
+		tt.Error("invalid notification", msg)
+	}
+	if ttl := time.Until(msg.Expiration); ttl < 25*time.Second || ttl > 30*time.Second {
+		tt.Error("configured time to live is not used", ttl)
+	}
+
+	var payload map[string]string
+	if err := json.Unmarshal(msg.Payload.([]byte), &payload); err != nil {
+		tt.Fatal(err)
+	}
+	if payload["call"] != "started" || payload["topic"] != "usrAbc" || payload["title"] != "Alice" ||
+		payload["aonly"] != "true" {
+		tt.Error("invalid payload", payload)
+	}
+	if _, ok := payload["content"]; ok {
+		tt.Error("payload must have only the call data", payload)
+	}
+
+	data["webrtc"] = "declined"
+	msg, _ = voipNotification("usrAbc", data, &configType{AppTopic: "co.tinode.tinodios"}, "voip-token")
+	if json.Unmarshal(msg.Payload.([]byte), &payload); payload["call"] != "ended" {
+		tt.Error("cancellation must end the call", payload)
+	}
+	if ttl := time.Until(msg.Expiration); ttl > voipTimeToLive*time.Second {
+		tt.Error("default time to live is not used", ttl)
+	}
+}
+
+func TestPrepareVoipNotifications(tt *testing.T) {
+	ctrl := gomock.NewController(tt)
+	defer ctrl.Finish()
+
+	dd := mock_store.NewMockDevicePersistenceInterface(ctrl)
+	store.Devices = dd
+	defer func() { store.Devices = nil }()
+
+	alice, bob := t.Uid(1), t.Uid(2)
+	devices := map[t.Uid][]t.DeviceDef{
+		bob: {
+			{DeviceId: "apns-bob", Platform: "ios"},
+			{DeviceId: "voip-phone", Platform: t.PlatformVoip},
+			{DeviceId: "voip-ipad", Platform: t.PlatformVoip},
+		},
+	}
+	receipt := func(webrtc string, answered ...string) *push.Receipt {
+		return &push.Receipt{
+			To: map[t.Uid]push.Recipient{bob: {Devices: answered}},
+			Payload: push.Payload{
+				What:    push.ActMsg,
+				Topic:   alice.P2PName(bob),
+				From:    alice.UserId(),
+				FromPub: map[string]any{"fn": "Alice"},
+				SeqId:   5,
+				Content: "call",
+				Webrtc:  webrtc,
+			},
+		}
+	}
+	// Tokens which receive VoIP pushes and tokens which receive regular notifications.
+	sent := func(rcpt *push.Receipt) (voip, regular []string) {
+		dd.EXPECT().GetAll(bob).Return(devices, 3, nil)
+		messages, _ := PrepareApnsNotifications(rcpt, &configType{AppTopic: "co.tinode.tinodios"})
+		for _, msg := range messages {
+			if msg.PushType == apns2.PushTypeVOIP {
+				voip = append(voip, msg.DeviceToken)
+			} else {
+				regular = append(regular, msg.DeviceToken)
+			}
+		}
+		return
+	}
+
+	// Invite rings all devices through PushKit.
+	if voip, regular := sent(receipt("started")); len(voip) != 2 || len(regular) != 0 {
+		tt.Error("invite must be sent to VoIP tokens only", voip, regular)
+	}
+	// The device which answered must not receive a VoIP push.
+	if voip, regular := sent(receipt("accepted", "voip-phone")); len(voip) != 1 || voip[0] != "voip-ipad" ||
+		len(regular) != 1 {
+		tt.Error("cancellation must be sent to devices which did not answer", voip, regular)
+	}
+	if voip, _ := sent(receipt("finished")); len(voip) != 0 {
+		tt.Error("finished call must not be pushed through PushKit", voip)
+	}
+	// The caller does not get VoIP pushes.
+	rcpt := receipt("missed")
+	rcpt.Payload.From = bob.UserId()
+	if voip, _ := sent(rcpt); len(voip) != 0 {
+		tt.Error("VoIP push must not be sent to the caller", voip)
+	}
+}
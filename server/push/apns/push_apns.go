@@ -37,6 +37,7 @@ type configType struct {
 	CredentialsPassword string         `json:"credentials_password"`
 	AppTopic            string         `json:"app_topic"`
 	TimeToLive          int            `json:"time_to_live,omitempty"`
+	VoipTimeToLive      int            `json:"voip_time_to_live,omitempty"`
 	Env                 string         `json:"env"`
 	CommonConfig        *common.Config `json:"common_config"`
 }
@@ -110,32 +111,40 @@ func sendApns(rcpt *push.Receipt, config *configType) {
 
 		if err != nil {
 			logs.Warn.Println("apns push err:", err)
+			push.Failed("apns", rcpt, err, uids[i:]...)
 			return
 		}
 
 		//fmt.Printf("%v %v %v\n", res.StatusCode, res.ApnsID, res.Reason)
 
-		if res.StatusCode != 200 {
+		if res.StatusCode == 200 {
+			push.Sent("apns", 1)
+		} else {
+			err = errors.New(res.Reason)
 			switch res.Reason {
 			case apns2.ReasonInternalServerError, apns2.ReasonServiceUnavailable:
 				// Transient errors. Stop sending this batch.
 				logs.Warn.Println("apns transient failure:", res.StatusCode, res.Reason)
+				push.Failed("apns", rcpt, err, uids[i:]...)
 				return
-			case apns2.ReasonBadCollapseID, apns2.ReasonBadDeviceToken, apns2.ReasonBadExpirationDate, apns2.ReasonBadMessageID, apns2.ReasonBadPriority:
-			case apns2.ReasonBadTopic, apns2.ReasonDeviceTokenNotForTopic, apns2.ReasonDuplicateHeaders, apns2.ReasonIdleTimeout, apns2.ReasonInvalidPushType:
-			case apns2.ReasonMissingDeviceToken, apns2.ReasonMissingTopic, apns2.ReasonPayloadEmpty, apns2.ReasonTopicDisallowed, apns2.ReasonBadCertificate:
+			case apns2.ReasonBadCollapseID, apns2.ReasonBadDeviceToken, apns2.ReasonBadExpirationDate, apns2.ReasonBadMessageID, apns2.ReasonBadPriority,
+				apns2.ReasonBadTopic, apns2.ReasonDeviceTokenNotForTopic, apns2.ReasonDuplicateHeaders, apns2.ReasonIdleTimeout, apns2.ReasonInvalidPushType,
+				apns2.ReasonMissingDeviceToken, apns2.ReasonMissingTopic, apns2.ReasonPayloadEmpty, apns2.ReasonTopicDisallowed, apns2.ReasonBadCertificate:
 				// Config errors. Stop.
 				logs.Warn.Println("apns invalid config:", res.StatusCode, res.Reason)
+				push.Failed("apns", rcpt, err, uids[i:]...)
 				return
 			case apns2.ReasonUnregistered:
 				// Token is no longer valid. Delete token from DB and continue sending.
 				logs.Warn.Println("apns invalid token:", res.StatusCode, res.Reason)
+				push.InvalidToken("apns", 1)
 				if err := store.Devices.Delete(uids[i], messages[i].DeviceToken); err != nil {
 					logs.Warn.Println("apns failed to delete invalid token:", err)
 				}
 			default:
 				// Unknown error. Stop sending just in case.
 				logs.Warn.Println("apns unrecognized error:", res.StatusCode, res.Reason)
+				push.Failed("apns", rcpt, err, uids[i:]...)
 				return
 			}
 		}
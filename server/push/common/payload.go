@@ -0,0 +1,101 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"strconv"
+	"time"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/push"
+)
+
+// PayloadToData converts the payload to the data fields of FCM data messages. Adapters for other
+// push services send the same fields, so clients handle pushes from all services alike.
+func PayloadToData(pl *push.Payload) (map[string]string, error) {
+	if pl == nil {
+		return nil, errors.New("empty push payload")
+	}
+	data := make(map[string]string)
+	data["what"] = pl.What
+	if pl.Silent {
+		data["silent"] = "true"
+	}
+	data["topic"] = pl.Topic
+	data["ts"] = pl.Timestamp.Format(time.RFC3339Nano)
+	// Must use "xfrom" because "from" is a reserved word. Google did not bother to document it anywhere.
+	data["xfrom"] = pl.From
+	if pl.What == push.ActMsg {
+		data["seq"] = strconv.Itoa(pl.SeqId)
+		if pl.ContentType != "" {
+			data["mime"] = pl.ContentType
+		}
+
+		// Convert Drafty content to plain text (clients 0.16 and below).
+		content, err := drafty.PlainText(pl.Content)
+		if err != nil {
+			return nil, err
+		}
+		data["content"] = TrimContent(content)
+
+		// Rich content for clients version 0.17 and above.
+		data["rc"], err = drafty.Preview(pl.Content, push.MaxPayloadLength)
+		if err != nil {
+			return nil, err
+		}
+
+		if pl.Webrtc != "" {
+			data["webrtc"] = pl.Webrtc
+			if pl.AudioOnly {
+				data["aonly"] = "true"
+			}
+			// Video call push notifications are silent.
+			data["silent"] = "true"
+		}
+		if pl.Replace != "" {
+			// Notification of a message edit should be silent too.
+			data["silent"] = "true"
+			data["replace"] = pl.Replace
+		}
+		if pl.Digest > 0 {
+			// Number of messages summarized by this push.
+			data["digest"] = strconv.Itoa(pl.Digest)
+		}
+	} else if pl.What == push.ActSub {
+		data["modeWant"] = pl.ModeWant.String()
+		data["modeGiven"] = pl.ModeGiven.String()
+	} else if pl.What == push.ActRead {
+		data["seq"] = strconv.Itoa(pl.SeqId)
+		data["silent"] = "true"
+	} else if pl.What == push.ActExpire {
+		delseq, err := json.Marshal(pl.DelSeq)
+		if err != nil {
+			return nil, err
+		}
+		data["delseq"] = string(delseq)
+		data["silent"] = "true"
+	} else {
+		return nil, errors.New("unknown push type")
+	}
+	return data, nil
+}
+
+// TrimContent trims long plain text content to push.MaxPayloadLength runes.
+func TrimContent(content string) string {
+	// Check byte length first and don't waste time converting short strings.
+	if len(content) > push.MaxPayloadLength {
+		runes := []rune(content)
+		if len(runes) > push.MaxPayloadLength {
+			return string(runes[:push.MaxPayloadLength]) + "…"
+		}
+	}
+	return content
+}
+
+// ClonePayload makes a copy of the data fields, e.g. to customize them for one recipient.
+func ClonePayload(src map[string]string) map[string]string {
+	dst := make(map[string]string, len(src))
+	maps.Copy(dst, src)
+	return dst
+}
@@ -0,0 +1,333 @@
+package push
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// Backpressure policies: what to do with a receipt when the handler's queue is full.
+const (
+	// Discard the receipt. This is the default.
+	BackpressureDrop = "drop"
+	// Wait for space in the queue up to "wait_ms" without blocking the caller, then save the receipt
+	// as a dead letter.
+	BackpressureWait = "wait"
+	// Save the receipt as a dead letter right away.
+	BackpressureDeadLetter = "dead_letter"
+)
+
+const (
+	// Default time to wait for space in the queue under the BackpressureWait policy.
+	defaultQueueWait = 100 * time.Millisecond
+	// Default maximum number of dead letters kept per handler.
+	defaultDeadLetterLimit = 256
+	// Maximum number of receipts waiting for space in the queue under the BackpressureWait policy.
+	waitingQueueSize = 256
+	// Log every this many dropped receipts.
+	dropLogInterval = 1000
+)
+
+// ErrQueueFull is the error of the dead letters which could not be queued for delivery.
+var ErrQueueFull = errors.New("queue is full")
+
+// DeadLetter is a receipt which the handler failed to deliver.
+type DeadLetter struct {
+	// Unique ID of the dead letter.
+	Id int64
+	// Name of the handler which failed to deliver the receipt.
+	Handler string
+	// Time of the failure.
+	When time.Time
+	// Reason of the failure.
+	Error string
+	// The receipt with the recipients which were not delivered to.
+	Receipt *Receipt
+}
+
+// HandlerStats are delivery counters of a push handler.
+type HandlerStats struct {
+	// Receipts accepted into the handler's queue.
+	Queued int64 `json:"queued"`
+	// Notifications accepted by the push service.
+	Sent int64 `json:"sent"`
+	// Deliveries which failed.
+	Failed int64 `json:"failed"`
+	// Receipts which did not fit into the handler's queue.
+	Dropped int64 `json:"dropped"`
+	// Device tokens rejected by the push service as invalid or expired.
+	InvalidToken int64 `json:"invalid_token"`
+	// Current number of dead letters.
+	DeadLetters int `json:"dead_letters"`
+}
+
+// delivery tracks deliveries of one handler.
+type delivery struct {
+	name   string
+	policy string
+	wait   time.Duration
+
+	queued       atomic.Int64
+	sent         atomic.Int64
+	failed       atomic.Int64
+	dropped      atomic.Int64
+	invalidToken atomic.Int64
+
+	// Receipts waiting for space in the handler's queue under the BackpressureWait policy.
+	waiting     chan *Receipt
+	waitingOnce sync.Once
+
+	mu          sync.Mutex
+	limit       int
+	deadLetters []DeadLetter
+}
+
+// Created by Register, configured by Init, read-only afterwards.
+var deliveries map[string]*delivery
+
+// ID of the last dead letter.
+var lastDeadLetterId atomic.Int64
+
+func newDelivery(name string) *delivery {
+	return &delivery{name: name, policy: BackpressureDrop, limit: defaultDeadLetterLimit}
+}
+
+// configure applies the backpressure policy and the dead letter limit from the handler's config.
+func (d *delivery) configure(cc *configType) error {
+	switch cc.Backpressure {
+	case "", BackpressureDrop:
+		d.policy = BackpressureDrop
+	case BackpressureWait, BackpressureDeadLetter:
+		d.policy = cc.Backpressure
+	default:
+		return errors.New("unknown backpressure policy '" + cc.Backpressure + "'")
+	}
+	d.wait = time.Duration(cc.WaitMs) * time.Millisecond
+	if d.wait <= 0 {
+		d.wait = defaultQueueWait
+	}
+	if cc.DeadLetters > 0 {
+		d.limit = cc.DeadLetters
+	}
+	return nil
+}
+
+// enqueue sends the receipt to the handler's queue applying the backpressure policy if the queue is full.
+func (d *delivery) enqueue(queue chan<- *Receipt, rcpt *Receipt) {
+	select {
+	case queue <- rcpt:
+		d.queued.Add(1)
+		return
+	default:
+	}
+
+	if d.policy == BackpressureWait {
+		// Push is called by the user updater shared by all users: wait for space on another goroutine.
+		d.waitingOnce.Do(func() {
+			d.waiting = make(chan *Receipt, waitingQueueSize)
+			go d.waitLoop(queue)
+		})
+		select {
+		case d.waiting <- rcpt:
+			return
+		default:
+		}
+	}
+
+	d.drop(rcpt)
+}
+
+// waitLoop moves waiting receipts to the handler's queue, each one waiting for space up to the configured time.
+func (d *delivery) waitLoop(queue chan<- *Receipt) {
+	for rcpt := range d.waiting {
+		timer := time.NewTimer(d.wait)
+		select {
+		case queue <- rcpt:
+			d.queued.Add(1)
+		case <-timer.C:
+			d.drop(rcpt)
+		}
+		timer.Stop()
+	}
+}
+
+// drop records the receipt which did not fit into the handler's queue.
+func (d *delivery) drop(rcpt *Receipt) {
+	if count := d.dropped.Add(1); count == 1 || count%dropLogInterval == 0 {
+		logs.Warn.Println("push: queue is full, handler", d.name, "dropped", count, "receipts")
+	}
+	if d.policy != BackpressureDrop {
+		d.addDeadLetter(copyReceipt(rcpt, nil), ErrQueueFull)
+	}
+}
+
+// copyReceipt returns a copy of the receipt with the given recipients only, or with all of them if uids
+// are empty, so the dead letter is not changed by the handlers which still process the receipt. The zero
+// uid stands for the receipt's Channel.
+func copyReceipt(rcpt *Receipt, uids []t.Uid) *Receipt {
+	cp := &Receipt{Payload: rcpt.Payload, To: make(map[t.Uid]Recipient, len(rcpt.To))}
+	if len(uids) == 0 {
+		cp.Channel = rcpt.Channel
+		for uid, to := range rcpt.To {
+			to.Devices = slices.Clone(to.Devices)
+			cp.To[uid] = to
+		}
+		return cp
+	}
+
+	for _, uid := range uids {
+		if uid.IsZero() {
+			cp.Channel = rcpt.Channel
+		} else if to, ok := rcpt.To[uid]; ok {
+			to.Devices = slices.Clone(to.Devices)
+			cp.To[uid] = to
+		}
+	}
+	return cp
+}
+
+func (d *delivery) addDeadLetter(rcpt *Receipt, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.deadLetters) >= d.limit {
+		// Discard the oldest.
+		d.deadLetters = slices.Delete(d.deadLetters, 0, len(d.deadLetters)-d.limit+1)
+	}
+	d.deadLetters = append(d.deadLetters, DeadLetter{
+		Id:      lastDeadLetterId.Add(1),
+		Handler: d.name,
+		When:    time.Now().UTC().Round(time.Millisecond),
+		Error:   err.Error(),
+		Receipt: rcpt,
+	})
+}
+
+// takeDeadLetters removes dead letters with the given IDs, or all of them if ids is empty, and returns them.
+func (d *delivery) takeDeadLetters(ids []int64) []DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var taken []DeadLetter
+	d.deadLetters = slices.DeleteFunc(d.deadLetters, func(dl DeadLetter) bool {
+		if len(ids) == 0 || slices.Contains(ids, dl.Id) {
+			taken = append(taken, dl)
+			return true
+		}
+		return false
+	})
+	return taken
+}
+
+// restoreDeadLetters puts back the dead letters which could not be replayed.
+func (d *delivery) restoreDeadLetters(list []DeadLetter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.deadLetters = slices.Concat(list, d.deadLetters)
+	if len(d.deadLetters) > d.limit {
+		d.deadLetters = slices.Delete(d.deadLetters, 0, len(d.deadLetters)-d.limit)
+	}
+}
+
+// Sent records the count of notifications accepted by the push service. Called by handlers.
+func Sent(name string, count int) {
+	if d := deliveries[name]; d != nil {
+		d.sent.Add(int64(count))
+	}
+}
+
+// InvalidToken records the count of device tokens rejected by the push service as invalid or expired.
+// Called by handlers.
+func InvalidToken(name string, count int) {
+	if d := deliveries[name]; d != nil {
+		d.invalidToken.Add(int64(count))
+	}
+}
+
+// Failed records a failed delivery and saves it as a dead letter. Called by handlers. If uids are given,
+// only these recipients are saved; the zero uid stands for the receipt's Channel.
+func Failed(name string, rcpt *Receipt, err error, uids ...t.Uid) {
+	d := deliveries[name]
+	if d == nil {
+		return
+	}
+	d.failed.Add(1)
+	d.addDeadLetter(copyReceipt(rcpt, uids), err)
+}
+
+// Stats returns delivery counters of initialized handlers.
+func Stats() map[string]HandlerStats {
+	stats := make(map[string]HandlerStats)
+	for name, hnd := range handlers {
+		d := deliveries[name]
+		if !hnd.IsReady() || d == nil {
+			continue
+		}
+		d.mu.Lock()
+		deadLetters := len(d.deadLetters)
+		d.mu.Unlock()
+		stats[name] = HandlerStats{
+			Queued:       d.queued.Load(),
+			Sent:         d.sent.Load(),
+			Failed:       d.failed.Load(),
+			Dropped:      d.dropped.Load(),
+			InvalidToken: d.invalidToken.Load(),
+			DeadLetters:  deadLetters,
+		}
+	}
+	return stats
+}
+
+// DeadLetters returns dead letters of the handler, or of all handlers if name is empty, oldest first.
+func DeadLetters(name string) []DeadLetter {
+	var list []DeadLetter
+	for hname, d := range deliveries {
+		if name != "" && name != hname {
+			continue
+		}
+		d.mu.Lock()
+		list = append(list, d.deadLetters...)
+		d.mu.Unlock()
+	}
+	slices.SortFunc(list, func(a, b DeadLetter) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return list
+}
+
+// Replay queues dead letters of the handler with the given IDs, or all of them if no IDs are given,
+// for delivery again. Replayed dead letters are removed. Returns the number of replayed dead letters.
+func Replay(name string, ids ...int64) (int, error) {
+	hnd, d := handlers[name], deliveries[name]
+	if hnd == nil || d == nil || !hnd.IsReady() {
+		return 0, errors.New("push handler '" + name + "' is not initialized")
+	}
+
+	list := d.takeDeadLetters(ids)
+	for i := range list {
+		select {
+		case hnd.Push() <- list[i].Receipt:
+			d.queued.Add(1)
+		default:
+			d.restoreDeadLetters(list[i:])
+			return i, ErrQueueFull
+		}
+	}
+	return len(list), nil
+}
+
+// Discard deletes dead letters of the handler with the given IDs, or all of them if no IDs are given.
+// Returns the number of deleted dead letters.
+func Discard(name string, ids ...int64) int {
+	if d := deliveries[name]; d != nil {
+		return len(d.takeDeadLetters(ids))
+	}
+	return 0
+}
@@ -0,0 +1,173 @@
+package push
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/push/pushtest"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// testHandler is a push handler with a queue which is never read.
+type testHandler struct {
+	input chan *Receipt
+}
+
+func (h *testHandler) Init(jsonconf json.RawMessage) (bool, error) {
+	h.input = make(chan *Receipt, 1)
+	return true, nil
+}
+
+func (h *testHandler) IsReady() bool {
+	return h.input != nil
+}
+
+func (h *testHandler) Push() chan<- *Receipt {
+	return h.input
+}
+
+func (h *testHandler) Channel() chan<- *ChannelReq {
+	return nil
+}
+
+func (h *testHandler) Stop() {}
+
+func TestMain(m *testing.M) {
+	pushtest.Main(m)
+}
+
+func initTestHandler(tt *testing.T, name, config string) *testHandler {
+	tt.Helper()
+	hnd := &testHandler{}
+	Register(name, hnd)
+	tt.Cleanup(func() {
+		delete(handlers, name)
+		delete(deliveries, name)
+	})
+	if _, err := Init(json.RawMessage(`[{"name":"` + name + `",` + config + `}]`)); err != nil {
+		tt.Fatal(err)
+	}
+	return hnd
+}
+
+func TestBackpressure(tt *testing.T) {
+	initTestHandler(tt, "drop", `"backpressure":"drop"`)
+	deadLetter := initTestHandler(tt, "deadletter", `"backpressure":"dead_letter","dead_letters":2`)
+	initTestHandler(tt, "wait", `"backpressure":"wait","wait_ms":1`)
+
+	for i := 1; i <= 4; i++ {
+		Push(&Receipt{Payload: Payload{What: ActMsg, SeqId: i}})
+	}
+	// Receipts wait for space on another goroutine.
+	for i := 0; i < 100 && Stats()["wait"].Dropped < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := Stats()
+	for _, name := range []string{"drop", "deadletter", "wait"} {
+		if stats[name].Queued != 1 || stats[name].Dropped != 3 {
+			tt.Errorf("%s: expected 1 queued and 3 dropped, got %+v", name, stats[name])
+		}
+	}
+	if stats["drop"].DeadLetters != 0 || stats["wait"].DeadLetters != 3 {
+		tt.Error("unexpected dead letters", stats)
+	}
+
+	// The oldest dead letters are discarded.
+	letters := DeadLetters("deadletter")
+	if len(letters) != 2 || letters[0].Receipt.Payload.SeqId != 3 || letters[1].Receipt.Payload.SeqId != 4 {
+		tt.Fatal("unexpected dead letters", letters)
+	}
+	if letters[0].Error != ErrQueueFull.Error() {
+		tt.Error("unexpected error", letters[0].Error)
+	}
+
+	// Queue is still full.
+	if count, err := Replay("deadletter"); count != 0 || err != ErrQueueFull {
+		tt.Error("replay into a full queue must fail", count, err)
+	}
+	if len(DeadLetters("deadletter")) != 2 {
+		tt.Error("dead letters must be kept if they cannot be replayed")
+	}
+
+	<-deadLetter.input
+	if count, err := Replay("deadletter", letters[1].Id); count != 1 || err != nil {
+		tt.Fatal("failed to replay", count, err)
+	}
+	if rcpt := <-deadLetter.input; rcpt.Payload.SeqId != 4 {
+		tt.Error("wrong receipt replayed", rcpt.Payload.SeqId)
+	}
+	if letters = DeadLetters("deadletter"); len(letters) != 1 || letters[0].Receipt.Payload.SeqId != 3 {
+		tt.Error("replayed dead letter must be removed", letters)
+	}
+
+	if count := Discard("wait"); count != 3 || len(DeadLetters("wait")) != 0 {
+		tt.Error("failed to discard dead letters", count)
+	}
+}
+
+func TestBackpressureWait(tt *testing.T) {
+	hnd := initTestHandler(tt, "slow", `"backpressure":"wait","wait_ms":10000`)
+
+	start := time.Now()
+	Push(&Receipt{Payload: Payload{What: ActMsg, SeqId: 1}})
+	Push(&Receipt{Payload: Payload{What: ActMsg, SeqId: 2}})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		tt.Fatal("push must not wait for space in the queue", elapsed)
+	}
+
+	// The waiting receipt is queued when there is space.
+	for seq := 1; seq <= 2; seq++ {
+		select {
+		case rcpt := <-hnd.input:
+			if rcpt.Payload.SeqId != seq {
+				tt.Error("unexpected receipt", rcpt.Payload.SeqId)
+			}
+		case <-time.After(time.Second):
+			tt.Fatal("receipt is not queued", seq)
+		}
+	}
+	if stats := Stats()["slow"]; stats.Queued != 2 || stats.Dropped != 0 {
+		tt.Error("unexpected counters", stats)
+	}
+}
+
+func TestFailed(tt *testing.T) {
+	initTestHandler(tt, "failed", `"dead_letters":10`)
+
+	uid1, uid2 := t.Uid(1), t.Uid(2)
+	rcpt := &Receipt{
+		To:      map[t.Uid]Recipient{uid1: {Unread: 1}, uid2: {Unread: 2}},
+		Channel: "grpAbc",
+		Payload: Payload{What: ActMsg, Topic: "grpAbc"},
+	}
+
+	Sent("failed", 3)
+	InvalidToken("failed", 1)
+	Failed("failed", rcpt, ErrQueueFull, uid2)
+	Failed("failed", rcpt, ErrQueueFull, t.ZeroUid)
+	Failed("failed", rcpt, ErrQueueFull)
+
+	stats := Stats()["failed"]
+	if stats.Sent != 3 || stats.InvalidToken != 1 || stats.Failed != 3 || stats.DeadLetters != 3 {
+		tt.Error("unexpected counters", stats)
+	}
+
+	letters := DeadLetters("failed")
+	if to := letters[0].Receipt.To; len(to) != 1 || to[uid2].Unread != 2 || letters[0].Receipt.Channel != "" {
+		tt.Error("dead letter must contain only the failed recipient", letters[0].Receipt)
+	}
+	if len(letters[1].Receipt.To) != 0 || letters[1].Receipt.Channel != "grpAbc" {
+		tt.Error("dead letter must contain only the channel", letters[1].Receipt)
+	}
+	if len(letters[2].Receipt.To) != 2 || letters[2].Receipt.Channel != "grpAbc" {
+		tt.Error("dead letter must contain the entire receipt", letters[2].Receipt)
+	}
+
+	// Dead letters are not changed by other handlers.
+	delete(rcpt.To, uid2)
+	if letters = DeadLetters("failed"); len(letters[0].Receipt.To) != 1 || len(letters[2].Receipt.To) != 2 {
+		tt.Error("dead letter must contain a copy of the receipt")
+	}
+}
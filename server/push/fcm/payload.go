@@ -2,19 +2,16 @@ package fcm
 
 import (
 	"encoding/json"
-	"errors"
 	"strconv"
 	"time"
 
 	fcmv1 "google.golang.org/api/fcm/v1"
 
-	"github.com/tinode/chat/server/drafty"
 	"github.com/tinode/chat/server/logs"
 	"github.com/tinode/chat/server/push"
 	"github.com/tinode/chat/server/push/common"
 	"github.com/tinode/chat/server/store"
 	t "github.com/tinode/chat/server/store/types"
-	"maps"
 )
 
 const (
@@ -24,81 +21,10 @@ const (
 	defaultTimeToLive = 3600
 )
 
-func payloadToData(pl *push.Payload) (map[string]string, error) {
-	if pl == nil {
-		return nil, errors.New("empty push payload")
-	}
-	data := make(map[string]string)
-	var err error
-	data["what"] = pl.What
-	if pl.Silent {
-		data["silent"] = "true"
-	}
-	data["topic"] = pl.Topic
-	data["ts"] = pl.Timestamp.Format(time.RFC3339Nano)
-	// Must use "xfrom" because "from" is a reserved word. Google did not bother to document it anywhere.
-	data["xfrom"] = pl.From
-	if pl.What == push.ActMsg {
-		data["seq"] = strconv.Itoa(pl.SeqId)
-		if pl.ContentType != "" {
-			data["mime"] = pl.ContentType
-		}
-
-		// Convert Drafty content to plain text (clients 0.16 and below).
-		data["content"], err = drafty.PlainText(pl.Content)
-		if err != nil {
-			return nil, err
-		}
-		// Trim long strings to 128 runes.
-		// Check byte length first and don't waste time converting short strings.
-		if len(data["content"]) > push.MaxPayloadLength {
-			runes := []rune(data["content"])
-			if len(runes) > push.MaxPayloadLength {
-				data["content"] = string(runes[:push.MaxPayloadLength]) + "…"
-			}
-		}
-
-		// Rich content for clients version 0.17 and above.
-		data["rc"], err = drafty.Preview(pl.Content, push.MaxPayloadLength)
-
-		if pl.Webrtc != "" {
-			data["webrtc"] = pl.Webrtc
-			if pl.AudioOnly {
-				data["aonly"] = "true"
-			}
-			// Video call push notifications are silent.
-			data["silent"] = "true"
-		}
-		if pl.Replace != "" {
-			// Notification of a message edit should be silent too.
-			data["silent"] = "true"
-			data["replace"] = pl.Replace
-		}
-		if err != nil {
-			return nil, err
-		}
-	} else if pl.What == push.ActSub {
-		data["modeWant"] = pl.ModeWant.String()
-		data["modeGiven"] = pl.ModeGiven.String()
-	} else if pl.What == push.ActRead {
-		data["seq"] = strconv.Itoa(pl.SeqId)
-		data["silent"] = "true"
-	} else {
-		return nil, errors.New("unknown push type")
-	}
-	return data, nil
-}
-
-func clonePayload(src map[string]string) map[string]string {
-	dst := make(map[string]string, len(src))
-	maps.Copy(dst, src)
-	return dst
-}
-
 // PrepareV1Notifications creates notification payloads ready to be posted
 // to push notification server for the provided receipt.
 func PrepareV1Notifications(rcpt *push.Receipt, config *configType) ([]*fcmv1.Message, []t.Uid) {
-	data, err := payloadToData(&rcpt.Payload)
+	data, err := common.PayloadToData(&rcpt.Payload)
 	if err != nil {
 		logs.Warn.Println("fcm push: could not parse payload:", err)
 		return nil, nil
@@ -145,7 +71,7 @@ func PrepareV1Notifications(rcpt *push.Receipt, config *configType) ([]*fcmv1.Me
 		userData := data
 		tcat := t.GetTopicCat(topic)
 		if rcpt.To[uid].Delivered > 0 || tcat == t.TopicCatP2P {
-			userData = clonePayload(data)
+			userData = common.ClonePayload(data)
 			// Fix topic name for P2P pushes.
 			if tcat == t.TopicCatP2P {
 				topic, _ = t.P2PNameForUser(uid, topic)
@@ -159,7 +85,8 @@ func PrepareV1Notifications(rcpt *push.Receipt, config *configType) ([]*fcmv1.Me
 
 		for i := range devList {
 			d := &devList[i]
-			if _, ok := skipDevices[d.DeviceId]; !ok && d.DeviceId != "" {
+			// Devices with their own push services are served by other adapters.
+			if _, ok := skipDevices[d.DeviceId]; !ok && d.DeviceId != "" && !t.HasOwnPushService(d.Platform) {
 				msg := fcmv1.Message{
 					Token: d.DeviceId,
 					Data:  userData,
@@ -188,7 +115,7 @@ func PrepareV1Notifications(rcpt *push.Receipt, config *configType) ([]*fcmv1.Me
 
 	if rcpt.Channel != "" {
 		topic := rcpt.Channel
-		userData := clonePayload(data)
+		userData := common.ClonePayload(data)
 		userData["topic"] = topic
 		// Channel receiver should not know the ID of the message sender.
 		delete(userData, "xfrom")
@@ -221,9 +148,11 @@ func DevicesForUser(uid t.Uid) []string {
 		return nil
 	}
 
-	devices := make([]string, count)
-	for i, dd := range ddef[uid] {
-		devices[i] = dd.DeviceId
+	devices := make([]string, 0, count)
+	for _, dd := range ddef[uid] {
+		if !t.HasOwnPushService(dd.Platform) {
+			devices = append(devices, dd.DeviceId)
+		}
 	}
 	return devices
 }
@@ -244,7 +173,7 @@ func androidNotificationConfig(what, topic string, data map[string]string, confi
 		timeToLive = strconv.Itoa(config.TimeToLive) + "s"
 	}
 
-	if what == push.ActRead {
+	if what == push.ActRead || what == push.ActExpire {
 		return &fcmv1.AndroidConfig{
 			Priority:     string(common.AndroidPriorityNormal),
 			Notification: nil,
@@ -301,7 +230,8 @@ func androidNotificationConfig(what, topic string, data map[string]string, confi
 }
 
 func apnsShouldPresentAlert(what, callStatus, isSilent string, config *configType) bool {
-	return config.Apns != nil && config.Apns.Enabled && what != push.ActRead && callStatus == "" && isSilent == ""
+	return config.Apns != nil && config.Apns.Enabled && what != push.ActRead && what != push.ActExpire &&
+		callStatus == "" && isSilent == ""
 }
 
 func apnsNotificationConfig(what, topic string, data map[string]string, unread int, config *configType) *fcmv1.ApnsConfig {
@@ -324,7 +254,7 @@ func apnsNotificationConfig(what, topic string, data map[string]string, unread i
 		// pushType = common.ApnsPushTypeVoip
 		// bundleId += ".voip"
 		expires = time.Now().UTC().Add(time.Duration(voipTimeToLive) * time.Second)
-	} else if what == push.ActRead {
+	} else if what == push.ActRead || what == push.ActExpire {
 		priority = 5
 		interruptionLevel = common.InterruptionLevelPassive
 		pushType = common.ApnsPushTypeBackground
@@ -339,7 +269,7 @@ func apnsNotificationConfig(what, topic string, data map[string]string, unread i
 		ThreadID:          topic,
 	}
 
-	// Do not present alert for read notifications and video calls.
+	// Do not present alert for read and expire notifications and video calls.
 	if apnsShouldPresentAlert(what, callStatus, data["silent"], config) {
 		body := config.Apns.GetStringField(what, "Body")
 		if body == "$content" {
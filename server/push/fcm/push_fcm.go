@@ -138,30 +138,40 @@ func sendFcmV1(rcpt *push.Receipt, config *configType) {
 			ValidateOnly: config.DryRun,
 		}
 		_, err := handler.v1.Projects.Messages.Send("projects/"+handler.projectID, req).Do()
-		if err != nil {
+		if err == nil {
+			push.Sent("fcm", 1)
+		} else {
 			gerr, decodingErrs := common.DecodeGoogleApiError(err)
 			for _, err := range decodingErrs {
 				logs.Info.Println("fcm googleapi.Error decoding:", err)
 			}
 			switch strings.ToUpper(gerr.FcmErrCode) {
-			case "": // no error
+			case "":
+				// Not an FCM error, e.g. the request could not be sent. Stop sending this batch.
+				logs.Warn.Println("fcm request failed:", err)
+				push.Failed("fcm", rcpt, err, uids[i:]...)
+				return
 			case common.ErrorQuotaExceeded, common.ErrorUnavailable, common.ErrorInternal, common.ErrorUnspecified:
 				// Transient errors. Stop sending this batch.
 				logs.Warn.Println("fcm transient failure:", gerr.FcmErrCode, gerr.ErrMessage)
+				push.Failed("fcm", rcpt, err, uids[i:]...)
 				return
 			case common.ErrorSenderIDMismatch, common.ErrorInvalidArgument, common.ErrorThirdPartyAuth:
 				// Config errors. Stop.
 				logs.Warn.Println("fcm invalid config:", gerr.FcmErrCode, gerr.ErrMessage)
+				push.Failed("fcm", rcpt, err, uids[i:]...)
 				return
 			case common.ErrorUnregistered:
 				// Token is no longer valid. Delete token from DB and continue sending.
 				logs.Warn.Println("fcm invalid token:", gerr.FcmErrCode, gerr.ErrMessage)
+				push.InvalidToken("fcm", 1)
 				if err := store.Devices.Delete(uids[i], messages[i].Token); err != nil {
 					logs.Warn.Println("tnpg failed to delete invalid token:", err)
 				}
 			default:
 				// Unknown error. Stop sending just in case.
 				logs.Warn.Println("tnpg unrecognized error:", gerr.FcmErrCode, gerr.ErrMessage)
+				push.Failed("fcm", rcpt, err, uids[i:]...)
 				return
 			}
 		}
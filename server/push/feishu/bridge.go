@@ -0,0 +1,161 @@
+package feishu
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/push"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Tag namespace which binds a group topic to a Feishu group chat, e.g. feishuchat:cli_a1b2c3:oc_1a2b3c.
+	ChatTagNS = "feishuchat"
+
+	// Cards can be answered from Feishu for this long after they were sent.
+	cardReplyTTL = 24 * time.Hour
+	// Maximum number of remembered cards.
+	maxRememberedCards = 10000
+	// Maximum length of a message relayed to a Feishu chat.
+	relayTextLength = 4000
+)
+
+// sentCard is a card sent to a user. Replies to the card are published to the topic.
+type sentCard struct {
+	messageId string
+	topic     string
+	uid       t.Uid
+	sentAt    time.Time
+}
+
+// Cards sent by this node, oldest first.
+var cards struct {
+	sync.Mutex
+	byId map[string]*sentCard
+	// The most recent card sent to each user.
+	latest map[t.Uid]*sentCard
+	queue  []*sentCard
+}
+
+// rememberCard records the topic the card was sent for, so the user can answer it.
+func rememberCard(messageId, topic string, uid t.Uid) {
+	card := &sentCard{messageId: messageId, topic: topic, uid: uid, sentAt: time.Now()}
+
+	cards.Lock()
+	defer cards.Unlock()
+
+	if cards.byId == nil {
+		cards.byId = make(map[string]*sentCard)
+		cards.latest = make(map[t.Uid]*sentCard)
+	}
+
+	// Forget expired cards and the oldest cards over the limit.
+	expired := card.sentAt.Add(-cardReplyTTL)
+	for len(cards.queue) > 0 && (len(cards.queue) >= maxRememberedCards || cards.queue[0].sentAt.Before(expired)) {
+		old := cards.queue[0]
+		cards.queue[0] = nil
+		cards.queue = cards.queue[1:]
+		delete(cards.byId, old.messageId)
+		if cards.latest[old.uid] == old {
+			delete(cards.latest, old.uid)
+		}
+	}
+
+	cards.byId[messageId] = card
+	cards.latest[uid] = card
+	cards.queue = append(cards.queue, card)
+}
+
+// TopicForReply finds the topic of the card the user is answering from Feishu. The parentId is ID of
+// the Feishu message being replied to. If it's empty, the topic of the most recent card sent to the user
+// is returned. Returns an empty string if the card is not known: it has expired or was sent by another
+// cluster node.
+func TopicForReply(uid t.Uid, parentId string) string {
+	cards.Lock()
+	defer cards.Unlock()
+
+	card := cards.latest[uid]
+	if parentId != "" {
+		card = cards.byId[parentId]
+	}
+	if card == nil || card.uid != uid || time.Since(card.sentAt) > cardReplyTTL {
+		return ""
+	}
+	return card.topic
+}
+
+// ChatTag returns the topic tag which binds the topic to the Feishu chat.
+func ChatTag(appId, chatId string) string {
+	return ChatTagNS + ":" + appId + ":" + chatId
+}
+
+// parseChatTag extracts the app ID and the chat ID from the binding tag.
+func parseChatTag(tag string) (appId, chatId string, ok bool) {
+	rest, found := strings.CutPrefix(tag, ChatTagNS+":")
+	if !found {
+		return "", "", false
+	}
+	appId, chatId, ok = strings.Cut(rest, ":")
+	return appId, chatId, ok && appId != "" && chatId != ""
+}
+
+// RelayToChat copies the message published to the group topic to the Feishu group chat bound to the
+// topic with one of the tags. It's called by the master topic once per message. Messages which came from
+// Feishu and video calls are not sent back.
+func RelayToChat(topic string, tags []string, from string, head map[string]any, content any) {
+	if handler.input == nil || t.GetTopicCat(topic) != t.TopicCatGrp {
+		return
+	}
+	if origin, _ := head["origin"].(string); origin == "feishu" {
+		return
+	}
+	if head["webrtc"] != nil {
+		return
+	}
+
+	var appId, chatId string
+	for _, tag := range tags {
+		var ok bool
+		if appId, chatId, ok = parseChatTag(tag); ok {
+			break
+		}
+	}
+	if chatId == "" || previewHidden(topic) {
+		// Content of sensitive topics never leaves the server.
+		return
+	}
+
+	// Don't block the topic while the sender is fetched and the message is sent.
+	go relayToChat(appId, chatId, from, content)
+}
+
+// relayToChat sends the text of the message to the Feishu chat prefixed with the name of the sender.
+func relayToChat(appId, chatId, from string, content any) {
+	text := previewText(content, relayTextLength)
+	if text == "" {
+		return
+	}
+	if sender := senderName(&push.Payload{From: from}); sender != "" {
+		text = sender + ": " + text
+	}
+	msg, _ := json.Marshal(map[string]string{"text": text})
+
+	sendMessage("chat_id", feishuUser{unionId: chatId, feishuAppId: appId}, "text", string(msg), false)
+}
+
+// SendText sends a plain text message from the app's bot to the Feishu user.
+func SendText(appId, unionId, text string) {
+	content, _ := json.Marshal(map[string]string{"text": text})
+	sendMessage("union_id", feishuUser{unionId: unionId, feishuAppId: appId}, "text", string(content), false)
+}
+
+// TimeZone returns the time zone of quiet hours set with the bot command when the user did not specify
+// one, or an empty string if it's not configured.
+func TimeZone() string {
+	if handler.config == nil {
+		return ""
+	}
+	return handler.config.Timezone
+}
@@ -0,0 +1,256 @@
+package feishu
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	textt "text/template"
+
+	i18n "golang.org/x/text/language"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+	"github.com/tinode/chat/server/validate"
+)
+
+// Default length of the message preview in characters.
+const defaultPreviewLength = 80
+
+// Parts of the card template.
+var cardTemplateParts = []string{"title", "message", "hidden", "call_audio", "call_video"}
+
+// Built-in template used when no template files are configured.
+const defaultCardTemplate = `{{define "title"}}{{if .Topic}}{{.Topic}}{{else}}{{.Sender}}{{end}}{{end}}
+{{define "message"}}{{if .Count}}[{{.Count}}条新消息] {{end}}{{.Sender}}: {{.Preview}}{{end}}
+{{define "hidden"}}{{if .Count}}{{.Sender}} 等人发来 {{.Count}} 条新消息{{else}}{{.Sender}} 发来一条新消息{{end}}，快打开软件看看吧{{end}}
+{{define "call_audio"}}{{.Sender}} 给你打音频通话，快打开软件看看吧{{end}}
+{{define "call_video"}}{{.Sender}} 给你打视频通话，快打开软件看看吧{{end}}`
+
+// Card templates, one per language.
+var cardTempl []*textt.Template
+
+// Matcher of user's language to the index of the template. Nil if only the default template is used.
+var cardLangMatcher i18n.Matcher
+
+// cardData is passed to the card template.
+type cardData struct {
+	// Name of the sender.
+	Sender string
+	// Name of the group topic, empty for p2p topics.
+	Topic string
+	// Plain text preview of the message, empty if the preview is hidden or not available.
+	Preview string
+	// Number of new messages summarized by the card, 0 for a single message.
+	Count int
+}
+
+// Feishu interactive card.
+type cardText struct {
+	Tag     string `json:"tag"`
+	Content string `json:"content"`
+}
+
+type cardElement struct {
+	Tag  string    `json:"tag"`
+	Text *cardText `json:"text,omitempty"`
+}
+
+type card struct {
+	Config struct {
+		WideScreenMode bool `json:"wide_screen_mode"`
+	} `json:"config"`
+	Header struct {
+		Template string   `json:"template"`
+		Title    cardText `json:"title"`
+	} `json:"header"`
+	Elements []cardElement `json:"elements"`
+}
+
+// initCardTemplates loads card templates for the configured languages.
+func initCardTemplates(config *configType) error {
+	cardTempl, cardLangMatcher = nil, nil
+
+	if config.CardTemplFile == "" {
+		templ, err := textt.New("card").Parse(defaultCardTemplate)
+		if err != nil {
+			return err
+		}
+		cardTempl = []*textt.Template{templ}
+		return nil
+	}
+
+	path, err := validate.ResolveTemplatePath(config.CardTemplFile)
+	if err != nil {
+		return err
+	}
+	// Path to templates could be a template itself: it may be language-dependent.
+	pathTempl, err := textt.New("card").Parse(path)
+	if err != nil {
+		return err
+	}
+
+	if len(config.Languages) == 0 {
+		templ, path, err := validate.ReadTemplateFile(pathTempl, "")
+		if err != nil {
+			return errors.New("failed to parse card template '" + path + "': " + err.Error())
+		}
+		cardTempl = []*textt.Template{templ}
+		return nil
+	}
+
+	var langTags []i18n.Tag
+	// Find actual content templates for each defined language.
+	for _, lang := range config.Languages {
+		tag, err := i18n.Parse(lang)
+		if err != nil {
+			return errors.New("invalid language tag '" + lang + "': " + err.Error())
+		}
+		langTags = append(langTags, tag)
+		templ, path, err := validate.ReadTemplateFile(pathTempl, lang)
+		if err != nil {
+			return errors.New("failed to parse card template '" + path + "': " + err.Error())
+		}
+		cardTempl = append(cardTempl, templ)
+	}
+	cardLangMatcher = i18n.NewMatcher(langTags)
+	return nil
+}
+
+// cardTemplate returns the template for the given language. The first template is the default.
+func cardTemplate(lang string) *textt.Template {
+	if cardLangMatcher == nil || lang == "" {
+		return cardTempl[0]
+	}
+	// Make sure the language tag is standardized. Matcher is a bit dumber than Parse().
+	normalized, _ := i18n.Parse(lang)
+	// Use index to find the template instead of tag.
+	_, idx := i18n.MatchStrings(cardLangMatcher, normalized.String())
+	return cardTempl[idx]
+}
+
+// renderCard builds the card JSON from the template. The call is the kind of the video call
+// ("audio" or "video"), empty if the message is not a call.
+func renderCard(templ *textt.Template, data *cardData, call string) (string, error) {
+	content, err := validate.ExecuteTemplate(templ, cardTemplateParts, map[string]any{
+		"Sender":  data.Sender,
+		"Topic":   data.Topic,
+		"Preview": data.Preview,
+		"Count":   data.Count,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var c card
+	c.Config.WideScreenMode = true
+	c.Header.Template = "blue"
+	c.Header.Title = cardText{Tag: "plain_text", Content: strings.TrimSpace(content["title"])}
+
+	var body string
+	switch {
+	case call != "":
+		c.Header.Template = "red"
+		body = content["call_"+call]
+	case data.Preview != "":
+		body = content["message"]
+	default:
+		body = content["hidden"]
+	}
+	c.Elements = []cardElement{{Tag: "div", Text: &cardText{Tag: "plain_text", Content: strings.TrimSpace(body)}}}
+
+	result, err := json.Marshal(&c)
+	return string(result), err
+}
+
+// publicName extracts the full name from topic's or user's public.
+func publicName(pub any) string {
+	if info, ok := pub.(map[string]any); ok {
+		if name, ok := info["fn"].(string); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// senderName returns the name of the message sender.
+func senderName(pl *push.Payload) string {
+	if name := publicName(pl.FromPub); name != "" {
+		return name
+	}
+	if uid := t.ParseUserId(pl.From); !uid.IsZero() {
+		if user, err := store.Users.Get(uid); err != nil {
+			logs.Warn.Println("feishu push: failed to get sender", err)
+		} else if user != nil {
+			return publicName(user.Public)
+		}
+	}
+	return ""
+}
+
+// newCardData collects sender and topic names and the message preview from the payload.
+func newCardData(pl *push.Payload) *cardData {
+	data := &cardData{Sender: senderName(pl), Count: pl.Digest}
+
+	// P2P topics don't have a name, the card is titled by the sender.
+	if t.GetTopicCat(pl.Topic) == t.TopicCatGrp {
+		data.Topic = publicName(pl.TopicPub)
+		if data.Topic == "" {
+			if topic, err := store.Topics.Get(pl.Topic); err != nil {
+				logs.Warn.Println("feishu push: failed to get topic", err)
+			} else if topic != nil {
+				data.Topic = publicName(topic.Public)
+			}
+		}
+	}
+
+	if !previewHidden(pl.Topic) {
+		data.Preview = previewText(pl.Content, handler.config.PreviewLength)
+	}
+	return data
+}
+
+// previewHidden checks if message previews must not be shown for the topic.
+func previewHidden(topic string) bool {
+	return handler.config.HidePreview || handler.config.hidePreviewTopics[topic]
+}
+
+// previewText converts message content to a short plain text preview.
+func previewText(content any, length int) string {
+	preview, err := drafty.Preview(content, length)
+	if err != nil || preview == "" {
+		return ""
+	}
+	var doc struct {
+		Txt string `json:"txt"`
+	}
+	if err := json.Unmarshal([]byte(preview), &doc); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(doc.Txt)
+}
+
+// userLanguages returns the language of the most recently used device of each user.
+func userLanguages(uids []t.Uid) map[t.Uid]string {
+	devices, _, err := store.Devices.GetAll(uids...)
+	if err != nil {
+		logs.Warn.Println("feishu push: failed to get devices", err)
+		return nil
+	}
+
+	langs := make(map[t.Uid]string, len(devices))
+	for uid, devs := range devices {
+		var latest *t.DeviceDef
+		for i := range devs {
+			if devs[i].Lang != "" && (latest == nil || devs[i].LastSeen.After(latest.LastSeen)) {
+				latest = &devs[i]
+			}
+		}
+		if latest != nil {
+			langs[uid] = latest.Lang
+		}
+	}
+	return langs
+}
@@ -0,0 +1,83 @@
+package feishu
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/push"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default limit of urgent call notifications per user.
+	defaultUrgentLimit = 3
+	// Default period of the urgent notification limit in seconds.
+	defaultUrgentPeriod = 600
+)
+
+// Urgent notifications sent to a user in the current period.
+type urgentWindow struct {
+	// Start of the user's period.
+	since time.Time
+	count int
+}
+
+// Counts of urgent notifications sent to users, each user has a period of their own.
+var urgentCount struct {
+	sync.Mutex
+	// The last time expired periods were removed.
+	swept time.Time
+	byUid map[t.Uid]*urgentWindow
+}
+
+// allowUrgent checks if one more urgent notification may be sent to the user and counts it.
+func allowUrgent(uid t.Uid, now time.Time) bool {
+	urgentCount.Lock()
+	defer urgentCount.Unlock()
+
+	period := time.Duration(handler.config.UrgentPeriod) * time.Second
+	if urgentCount.byUid == nil {
+		urgentCount.byUid = make(map[t.Uid]*urgentWindow)
+	}
+	if now.Sub(urgentCount.swept) >= period {
+		// Forget users whose periods have ended.
+		for id, win := range urgentCount.byUid {
+			if now.Sub(win.since) >= period {
+				delete(urgentCount.byUid, id)
+			}
+		}
+		urgentCount.swept = now
+	}
+
+	win := urgentCount.byUid[uid]
+	if win == nil || now.Sub(win.since) >= period {
+		win = &urgentWindow{since: now}
+		urgentCount.byUid[uid] = win
+	}
+	if win.count >= handler.config.UrgentLimit {
+		return false
+	}
+	win.count++
+	return true
+}
+
+// resetUrgentCount forgets all counted urgent notifications.
+func resetUrgentCount() {
+	urgentCount.Lock()
+	defer urgentCount.Unlock()
+
+	urgentCount.swept = time.Time{}
+	urgentCount.byUid = nil
+}
+
+// shouldNotify decides if the recipient gets a card and if the card may be urgent. The server includes
+// only recipients with notifications enabled (P in access mode) or who were mentioned, and skips
+// messages during the recipient's quiet hours.
+func shouldNotify(rcpt *push.Recipient, call bool) (notify, urgent bool) {
+	if rcpt.Delivered > 0 {
+		// The user has the topic open already.
+		return false, false
+	}
+	// Calls during quiet hours are delivered as regular cards.
+	return true, call && !rcpt.Quiet
+}
@@ -6,9 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
+	"strings"
 	"sync"
+	textt "text/template"
 	"time"
 
 	"github.com/tinode/chat/server/logs"
@@ -19,51 +20,83 @@ import (
 
 var handler Handler
 
-var tokenLock TokenLock
+// Guards handler.tokenInfo map. Individual tokens are guarded by their own locks.
+var tokenLock sync.RWMutex
 
 const (
 	// Size of the input channel buffer.
 	bufferSize = 1024
 
-	// Tenant access token URL
-	tenantAccessTokenURL = "https://open.feishu.cn/open-apis/auth/v3/tenant_access_token/internal"
+	// Default base URL of Feishu API. Lark international uses https://open.larksuite.com.
+	defaultBaseURL = "https://open.feishu.cn"
 
-	// Message push URL
-	messagePushURL = "https://open.feishu.cn/open-apis/im/v1/messages"
+	// Tenant access token path
+	tenantAccessTokenPath = "/open-apis/auth/v3/tenant_access_token/internal"
 
-	// Urgent app message push URL
-	urgentAppMessagePushURL = "https://open.feishu.cn/open-apis/im/v1/messages"
-)
+	// Message push path
+	messagePushPath = "/open-apis/im/v1/messages"
 
-type Content struct {
-	Tag  string `json:"tag"`
-	Text string `json:"text,omitempty"`
-}
+	// Urgent app message push path
+	urgentAppMessagePushPath = "/open-apis/im/v1/messages"
 
-type ContentList struct {
-	ZhCn struct {
-		Title   string      `json:"title"`
-		Content [][]Content `json:"content"`
-	} `json:"zh_cn"`
-}
+	// Refresh the token this many seconds before it expires.
+	tokenRefreshAhead = 300
+	// How often the refresher checks the tokens.
+	tokenCheckInterval = 30 * time.Second
+	// Backoff between failed attempts to obtain a token: doubles after each failure.
+	tokenBackoffMin = 5 * time.Second
+	tokenBackoffMax = 10 * time.Minute
+)
 
-type TokenLock struct {
-	mu sync.RWMutex
+// Feishu API error codes indicating that the tenant access token is invalid or expired.
+var tokenInvalidCodes = map[int]bool{
+	99991663: true,
+	99991664: true,
+	99991668: true,
 }
 
+// Guards config.AppList which may be replaced at runtime.
+var appsLock sync.RWMutex
+
 // Handler handles Feishu push notifications
 type Handler struct {
 	input      chan *push.Receipt
 	channel    chan *push.ChannelReq
 	stop       chan bool
 	config     *configType
-	tokenInfo  map[string]tenantAccessTokenInfo
+	tokenInfo  map[string]*appToken
 	httpClient *http.Client
 }
 
 type configType struct {
 	Enabled bool                   `json:"enabled"`
 	AppList map[string]t.FeishuApp `json:"app_list"`
+	// Base URL of Feishu API for apps which don't define their own.
+	BaseURL string `json:"base_url"`
+	// Interval in seconds between re-reading the list of apps from the database, 0 to disable.
+	// The list is also reloaded when it's changed through the admin API.
+	AppReloadInterval int `json:"app_reload_interval"`
+
+	// List of languages supported by card templates. The first one is the default.
+	Languages []string `json:"languages"`
+	// Path to card templates. The path itself is a template, e.g. ./templ/feishu-card-{{.Language}}.templ.
+	// The built-in template is used if missing.
+	CardTemplFile string `json:"card_templ"`
+	// Length of the message preview in characters.
+	PreviewLength int `json:"preview_length"`
+	// Don't show message content in notifications.
+	HidePreview bool `json:"hide_preview"`
+	// Topics with sensitive content: message content is not shown in notifications.
+	HidePreviewTopics []string `json:"hide_preview_topics"`
+	// Time zone of quiet hours set with the bot command when the user did not specify one, e.g. "Asia/Shanghai".
+	Timezone string `json:"timezone"`
+	// Maximum number of urgent call notifications sent to a user per UrgentPeriod. Calls over the
+	// limit are sent as regular cards.
+	UrgentLimit int `json:"urgent_limit"`
+	// Period of the urgent notification limit in seconds.
+	UrgentPeriod int `json:"urgent_period"`
+
+	hidePreviewTopics map[string]bool
 }
 
 type tenantAccessTokenInfo struct {
@@ -72,6 +105,72 @@ type tenantAccessTokenInfo struct {
 	Timestamp         int64  `json:"timestamp"`
 }
 
+// appToken is the tenant access token of one app.
+type appToken struct {
+	// Serializes requests for a new token so only one request per app is in flight.
+	refreshLock sync.Mutex
+
+	// Guards the fields below.
+	mu   sync.RWMutex
+	info tenantAccessTokenInfo
+	// Number of consecutive failures to obtain the token.
+	failures int
+	// Don't try to obtain the token before this time.
+	retryAt time.Time
+}
+
+// needsRefresh checks if the token expires soon and the backoff period is over.
+func (at *appToken) needsRefresh(now time.Time) bool {
+	at.mu.RLock()
+	defer at.mu.RUnlock()
+
+	return now.Unix() >= at.info.Timestamp+int64(at.info.Expire)-tokenRefreshAhead && !now.Before(at.retryAt)
+}
+
+// valid returns the token if it has not expired yet.
+func (at *appToken) valid(now time.Time) (string, bool) {
+	at.mu.RLock()
+	defer at.mu.RUnlock()
+
+	if at.info.TenantAccessToken == "" || now.Unix() >= at.info.Timestamp+int64(at.info.Expire) {
+		return "", false
+	}
+	return at.info.TenantAccessToken, true
+}
+
+// invalidate discards the token if it's the same as the given one, i.e. it has not been
+// replaced by another goroutine yet.
+func (at *appToken) invalidate(token string) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	if at.info.TenantAccessToken == token {
+		at.info = tenantAccessTokenInfo{}
+		at.retryAt = time.Time{}
+	}
+}
+
+// update stores the result of an attempt to obtain the token.
+func (at *appToken) update(info *tenantAccessTokenInfo, err error) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	if err == nil {
+		at.info = *info
+		at.failures = 0
+		at.retryAt = time.Time{}
+		return
+	}
+
+	backoff := tokenBackoffMin << at.failures
+	if backoff > tokenBackoffMax || backoff <= 0 {
+		backoff = tokenBackoffMax
+	} else {
+		at.failures++
+	}
+	at.retryAt = time.Now().Add(backoff)
+}
+
 type feishuUser struct {
 	unionId     string
 	feishuAppId string
@@ -89,12 +188,28 @@ func (h Handler) Init(jsonconf json.RawMessage) (bool, error) {
 		return false, nil
 	}
 
-	config.AppList = make(map[string]t.FeishuApp)
-
-	// Init feishu app
-	feishuApps, err := store.FeishuApps.GetAll()
-	for _, feishuApp := range feishuApps {
-		config.AppList[feishuApp.AppId] = feishuApp
+	if config.BaseURL == "" {
+		config.BaseURL = defaultBaseURL
+	}
+	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
+	if config.PreviewLength <= 0 {
+		config.PreviewLength = defaultPreviewLength
+	}
+	config.hidePreviewTopics = make(map[string]bool, len(config.HidePreviewTopics))
+	for _, topic := range config.HidePreviewTopics {
+		config.hidePreviewTopics[topic] = true
+	}
+	if _, err = time.LoadLocation(config.Timezone); err != nil {
+		return false, errors.New("invalid timezone: " + err.Error())
+	}
+	if config.UrgentLimit <= 0 {
+		config.UrgentLimit = defaultUrgentLimit
+	}
+	if config.UrgentPeriod <= 0 {
+		config.UrgentPeriod = defaultUrgentPeriod
+	}
+	if err := initCardTemplates(&config); err != nil {
+		return false, err
 	}
 
 	handler.config = &config
@@ -104,18 +219,16 @@ func (h Handler) Init(jsonconf json.RawMessage) (bool, error) {
 	handler.httpClient = &http.Client{
 		Timeout: 10 * time.Second,
 	}
-	handler.tokenInfo = make(map[string]tenantAccessTokenInfo)
+	handler.tokenInfo = make(map[string]*appToken)
 
-	// Initialize token
-	for _, feishuApp := range handler.config.AppList {
-		if err := refreshTenantAccessToken(feishuApp.AppId, feishuApp.AppSecret); err != nil {
-			logs.Warn.Println("Failed to initialize tenant access token:", err, feishuApp.AppId)
-			continue
-		}
+	// Init feishu app
+	handler.config.AppList = make(map[string]t.FeishuApp)
+	if err := loadApps(); err != nil {
+		logs.Warn.Println("feishu push: failed to load apps:", err)
 	}
 
-	// Start token refresher
-	// go h.tokenRefresher()
+	// Start token refresher, it obtains the initial tokens too.
+	go tokenRefresher()
 
 	// Start message processor
 	go processMessages()
@@ -123,40 +236,100 @@ func (h Handler) Init(jsonconf json.RawMessage) (bool, error) {
 	return true, nil
 }
 
-// refreshTenantAccessToken refresh tenant access token
-func refreshTenantAccessToken(appId string, appSecret string) error {
-	tokenLock.mu.Lock()
-	defer tokenLock.mu.Unlock()
+// loadApps reads the list of Feishu apps from the database and replaces the current list.
+// Cached tokens of apps which were removed or changed are discarded.
+func loadApps() error {
+	feishuApps, err := store.FeishuApps.GetAll()
+	if err != nil {
+		return err
+	}
+
+	appList := make(map[string]t.FeishuApp, len(feishuApps))
+	for _, feishuApp := range feishuApps {
+		appList[feishuApp.AppId] = feishuApp
+	}
+
+	appsLock.Lock()
+	oldList := handler.config.AppList
+	handler.config.AppList = appList
+	appsLock.Unlock()
+
+	tokenLock.Lock()
+	for appId := range handler.tokenInfo {
+		if app, ok := appList[appId]; !ok || app != oldList[appId] {
+			delete(handler.tokenInfo, appId)
+		}
+	}
+	tokenLock.Unlock()
+
+	return nil
+}
+
+// getApp returns the Feishu app by ID.
+func getApp(appId string) (t.FeishuApp, bool) {
+	appsLock.RLock()
+	defer appsLock.RUnlock()
 
+	app, ok := handler.config.AppList[appId]
+	return app, ok
+}
+
+// apiURL returns the URL of Feishu API endpoint for the app.
+func apiURL(app *t.FeishuApp, path string) string {
+	if app.BaseUrl != "" {
+		return strings.TrimSuffix(app.BaseUrl, "/") + path
+	}
+	return handler.config.BaseURL + path
+}
+
+// getAppToken returns the token holder of the app, creating it if necessary.
+func getAppToken(appId string) *appToken {
+	tokenLock.RLock()
+	at := handler.tokenInfo[appId]
+	tokenLock.RUnlock()
+	if at != nil {
+		return at
+	}
+
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+	if at = handler.tokenInfo[appId]; at == nil {
+		at = &appToken{}
+		handler.tokenInfo[appId] = at
+	}
+	return at
+}
+
+// requestTenantAccessToken requests a new tenant access token from Feishu.
+func requestTenantAccessToken(app *t.FeishuApp) (*tenantAccessTokenInfo, error) {
 	// Prepare request body
 	body := map[string]string{
-		"app_id":     appId,
-		"app_secret": appSecret,
+		"app_id":     app.AppId,
+		"app_secret": app.AppSecret,
 	}
 
 	jsonBody, err := json.Marshal(body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Send request
-	req, err := http.NewRequest("POST", tenantAccessTokenURL, nil)
+	req, err := http.NewRequest("POST", apiURL(app, tenantAccessTokenPath), bytes.NewReader(jsonBody))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	req.Body = ioutil.NopCloser(bytes.NewReader(jsonBody))
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := handler.httpClient.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	// Parse response
-	respBody, err := ioutil.ReadAll(resp.Body)
+	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var result struct {
@@ -167,51 +340,84 @@ func refreshTenantAccessToken(appId string, appSecret string) error {
 	}
 
 	if err := json.Unmarshal(respBody, &result); err != nil {
-		return err
+		return nil, err
 	}
 
 	if result.Code != 0 {
-		return fmt.Errorf("failed to get tenant_access_token: code=%d, msg=%s", result.Code, result.Msg)
+		return nil, fmt.Errorf("failed to get tenant_access_token: code=%d, msg=%s", result.Code, result.Msg)
 	}
 
-	// Update token info
-	handler.tokenInfo[appId] = tenantAccessTokenInfo{
+	return &tenantAccessTokenInfo{
 		TenantAccessToken: result.TenantAccessToken,
 		Expire:            result.Expire,
 		Timestamp:         time.Now().Unix(),
+	}, nil
+}
+
+// refreshTenantAccessToken obtains a new token for the app unless another goroutine has already
+// done it while this one was waiting. Only the app being refreshed is locked. If wait is false
+// and the token is being refreshed already, returns immediately.
+func refreshTenantAccessToken(app t.FeishuApp, at *appToken, wait bool) {
+	if wait {
+		at.refreshLock.Lock()
+	} else if !at.refreshLock.TryLock() {
+		return
 	}
+	defer at.refreshLock.Unlock()
 
-	logs.Info.Println("Feishu tenant access token refreshed successfully", result, appId)
-	return nil
+	if !at.needsRefresh(time.Now()) {
+		return
+	}
+
+	info, err := requestTenantAccessToken(&app)
+	at.update(info, err)
+	if err != nil {
+		logs.Warn.Println("feishu push: failed to refresh tenant access token:", err, app.AppId)
+		return
+	}
+	logs.Info.Println("feishu push: tenant access token refreshed", app.AppId)
 }
 
-// tokenRefresher timer to refresh tenant access token
-// func (h Handler) tokenRefresher() {
-// 	ticker := time.NewTicker(time.Hour)
-// 	defer ticker.Stop()
-
-// 	for {
-// 		select {
-// 		case <-ticker.C:
-// 			h.mu.RLock()
-// 			expireTime := h.tokenInfo.Timestamp + int64(h.tokenInfo.Expire) - 300 // Refresh 5 minutes before expiration
-// 			h.mu.RUnlock()
-
-// 			if time.Now().Unix() >= expireTime {
-// 				if err := refreshTenantAccessToken(); err != nil {
-// 					logs.Warn.Println("Failed to refresh tenant access token:", err)
-// 				}
-// 			}
-// 		case <-h.stop:
-// 			return
-// 		}
-// 	}
-// }
+// tokenRefresher refreshes tokens of all apps ahead of expiration.
+func tokenRefresher() {
+	ticker := time.NewTicker(tokenCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		appsLock.RLock()
+		for _, app := range handler.config.AppList {
+			if at := getAppToken(app.AppId); at.needsRefresh(now) {
+				// Refresh apps in parallel so one slow app does not delay the others.
+				go refreshTenantAccessToken(app, at, false)
+			}
+		}
+		appsLock.RUnlock()
+
+		select {
+		case <-ticker.C:
+		case <-handler.stop:
+			return
+		}
+	}
+}
 
 // processMessages handle message
 func processMessages() {
+	// Nil channel blocks forever if periodic reloading is disabled.
+	var reload <-chan time.Time
+	if handler.config.AppReloadInterval > 0 {
+		ticker := time.NewTicker(time.Duration(handler.config.AppReloadInterval) * time.Second)
+		defer ticker.Stop()
+		reload = ticker.C
+	}
+
 	for {
 		select {
+		case <-reload:
+			if err := loadApps(); err != nil {
+				logs.Warn.Println("feishu push: failed to reload apps:", err)
+			}
 		case rcpt := <-handler.input:
 			go sendFeishuMessage(rcpt)
 		case sub := <-handler.channel:
@@ -222,24 +428,80 @@ func processMessages() {
 	}
 }
 
-// getTenantAccessToken
-func getTenantAccessToken(appId string) (token string, err error) {
-	// check token expire
-	tokenLock.mu.RLock()
-	expireTime := handler.tokenInfo[appId].Timestamp + int64(handler.tokenInfo[appId].Expire) - 300
-	tokenLock.mu.RUnlock()
-
-	if time.Now().Unix() >= expireTime {
-		if err = refreshTenantAccessToken(appId, handler.config.AppList[appId].AppSecret); err != nil {
-			logs.Warn.Println("Failed to refresh tenant access token before sending message:", err)
-			return token, err
-		}
+// getTenantAccessToken returns a valid token of the app, obtaining a new one if necessary.
+func getTenantAccessToken(appId string) (string, error) {
+	at := getAppToken(appId)
+	if token, ok := at.valid(time.Now()); ok {
+		return token, nil
+	}
+
+	app, ok := getApp(appId)
+	if !ok {
+		return "", fmt.Errorf("unknown feishu app %s", appId)
 	}
 
-	return handler.tokenInfo[appId].TenantAccessToken, nil
+	refreshTenantAccessToken(app, at, true)
+	if token, ok := at.valid(time.Now()); ok {
+		return token, nil
+	}
+	return "", fmt.Errorf("no valid tenant access token for feishu app %s", appId)
+}
+
+// feishuResponse is the common envelope of Feishu API responses.
+type feishuResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	Data struct {
+		MessageId string `json:"message_id"`
+	} `json:"data"`
 }
 
-// sendFeishuMessage
+// callFeishuApi sends an authorized request to Feishu API endpoint on behalf of the app. If Feishu
+// rejects the token as invalid, the token is refreshed and the request is retried once.
+func callFeishuApi(method, path, appId string, body []byte) (*feishuResponse, error) {
+	for attempt := 0; ; attempt++ {
+		token, err := getTenantAccessToken(appId)
+		if err != nil {
+			return nil, err
+		}
+		app, ok := getApp(appId)
+		if !ok {
+			return nil, fmt.Errorf("unknown feishu app %s", appId)
+		}
+
+		req, err := http.NewRequest(method, apiURL(&app, path), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := handler.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		var result feishuResponse
+		if err := json.Unmarshal(respBody, &result); err != nil {
+			return nil, err
+		}
+
+		if tokenInvalidCodes[result.Code] && attempt == 0 {
+			logs.Info.Println("feishu push: tenant access token rejected, retrying", result.Code, appId)
+			getAppToken(appId).invalidate(token)
+			continue
+		}
+		return &result, nil
+	}
+}
+
+// sendFeishuMessage sends a card with the sender, topic and message preview to each recipient
+// in the recipient's language.
 func sendFeishuMessage(rcpt *push.Receipt) {
 	// just push message
 	if rcpt.Payload.What != push.ActMsg {
@@ -252,159 +514,108 @@ func sendFeishuMessage(rcpt *push.Receipt) {
 	}
 
 	// get user union_id
-	var users []t.User
-	var err error
-	if len(rcpt.To) > 0 {
-		fromUid := t.ParseUserId(rcpt.Payload.From)
-		// List of UIDs for querying the database
-		uids := make([]t.Uid, len(rcpt.To))
-		i := 0
-		for uid, _ := range rcpt.To {
-			// skip user from message
-			if uid == fromUid {
-				continue
-			}
-			uids[i] = uid
-			i++
+	fromUid := t.ParseUserId(rcpt.Payload.From)
+	// if message is webrtc, should urgent the message
+	var call string
+	if rcpt.Payload.Webrtc != "" {
+		call = "video"
+		if rcpt.Payload.AudioOnly {
+			call = "audio"
 		}
+	}
 
-		users, err = store.Users.GetAll(uids...)
-		if err != nil {
-			logs.Warn.Println("feishu push: db error", err)
-			return
+	// List of UIDs for querying the database
+	now := time.Now()
+	var uids []t.Uid
+	urgent := make(map[t.Uid]bool)
+	for uid, to := range rcpt.To {
+		// skip user from message
+		if uid == fromUid {
+			continue
+		}
+		if notify, urgentCall := shouldNotify(&to, call != ""); notify {
+			uids = append(uids, uid)
+			urgent[uid] = urgentCall
 		}
 	}
-
-	var feishuUsers []feishuUser
-	for _, user := range users {
-		feishuUsers = append(feishuUsers, feishuUser{
-			unionId:     user.UnionId,
-			feishuAppId: user.FeishuAppId,
-		})
+	if len(uids) == 0 {
+		return
 	}
 
-	if len(feishuUsers) == 0 {
+	users, err := store.Users.GetAll(uids...)
+	if err != nil {
+		logs.Warn.Println("feishu push: db error", err)
 		return
 	}
 
-	// build message
-	var messageText string
-	var isUrgent bool
+	data := newCardData(&rcpt.Payload)
+	langs := userLanguages(uids)
+	// Cards are rendered once per template.
+	cards := make(map[*textt.Template]string)
+	for i := range users {
+		user := &users[i]
+		// if app_id empty, skip
+		if user.FeishuAppId == "" || user.UnionId == "" {
+			continue
+		}
 
-	// if message is webrtc, should urgent the message
-	if rcpt.Payload.Webrtc != "" {
-		// audio
-		if rcpt.Payload.AudioOnly {
-			messageText = "有人给你打音频通话，快打开软件看看吧"
-		} else {
-			messageText = "有人给你打视频通话，快打开软件看看吧"
+		templ := cardTemplate(langs[user.Uid()])
+		content, ok := cards[templ]
+		if !ok {
+			if content, err = renderCard(templ, data, call); err != nil {
+				logs.Warn.Println("feishu push: failed to render card:", err)
+				return
+			}
+			cards[templ] = content
 		}
-		isUrgent = true
-	} else {
-		// message
-		messageText = "收到一条新消息，快打开软件看看吧"
-		isUrgent = false
-	}
-
-	msgContent := ContentList{
-		ZhCn: struct {
-			Title   string      `json:"title"`
-			Content [][]Content `json:"content"`
-		}{
-			Title: "IM",
-			Content: [][]Content{
-				{
-					{Tag: "text", Text: messageText},
-				},
-			},
-		},
-	}
-
-	msgContentJson, err := json.Marshal(msgContent)
-	if err != nil {
-		logs.Warn.Println("Failed to marshal message content:", err)
-		return
-	}
 
-	// 发送消息给每个用户
-	for _, feishuUser := range feishuUsers {
-		sendMessage("union_id", feishuUser, string(msgContentJson), isUrgent)
+		messageId, err := sendMessage("union_id", feishuUser{unionId: user.UnionId, feishuAppId: user.FeishuAppId},
+			"interactive", content, urgent[user.Uid()] && allowUrgent(user.Uid(), now))
+		if err != nil {
+			push.Failed("feishu", rcpt, err, user.Uid())
+			continue
+		}
+		if messageId != "" {
+			push.Sent("feishu", 1)
+			// The user may answer the card from Feishu.
+			rememberCard(messageId, rcpt.Payload.Topic, user.Uid())
+		}
 	}
 }
 
-// sendSingleMessage
-func sendMessage(receiveIdType string, sendUser feishuUser, content string, urgent bool) {
+// sendMessage sends a message to a single receiver. Returns ID of the sent message, or an empty string
+// if the receiver has no Feishu app.
+func sendMessage(receiveIdType string, sendUser feishuUser, msgType, content string, urgent bool) (string, error) {
 	// if app_id empty, skip
 	if sendUser.feishuAppId == "" {
-		return
-	}
-
-	token, err := getTenantAccessToken(sendUser.feishuAppId)
-	if err != nil {
-		logs.Warn.Println("Failed to get tenantAccessToken:", err)
-		return
+		return "", nil
 	}
 
 	// message struct
 	requestBody := map[string]interface{}{
 		"receive_id": sendUser.unionId,
-		"msg_type":   "post",
+		"msg_type":   msgType,
 		"content":    content,
 	}
 
 	jsonBody, err := json.Marshal(requestBody)
 	if err != nil {
 		logs.Warn.Println("Failed to marshal message content:", err)
-		return
+		return "", err
 	}
 
-	url := fmt.Sprintf("%s?receive_id_type=%s", messagePushURL, receiveIdType)
+	path := fmt.Sprintf("%s?receive_id_type=%s", messagePushPath, receiveIdType)
 
 	// 发送请求
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(jsonBody))
-	if err != nil {
-		logs.Warn.Println("Failed to create request:", err)
-		return
-	}
-
-	req.Header.Set("Content-Type", "application/json; charset=utf-8")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-
-	logs.Warn.Println("feishu header", requestBody)
-
-	resp, err := handler.httpClient.Do(req)
+	result, err := callFeishuApi(http.MethodPost, path, sendUser.feishuAppId, jsonBody)
 	if err != nil {
 		logs.Warn.Println("Failed to send message:", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		logs.Warn.Println("Failed to read response:", err)
-		return
-	}
-
-	var result struct {
-		Code int    `json:"code"`
-		Msg  string `json:"msg"`
-		Data struct {
-			MessageId string `json:"message_id"`
-		} `json:"data"`
-		error struct {
-			Message string `json:"message"`
-		}
-	}
-
-	if err := json.Unmarshal(respBody, &result); err != nil {
-		logs.Warn.Println("Failed to parse response:", err)
-		return
+		return "", err
 	}
 
 	if result.Code != 0 {
-		logs.Warn.Println(result)
-		logs.Warn.Printf("Failed to send message to %s: code=%d, msg=%s, token=%s, app_id=%s\n", sendUser.unionId, result.Code, result.Msg, token, sendUser.feishuAppId)
-		return
+		logs.Warn.Printf("Failed to send message to %s: code=%d, msg=%s, app_id=%s\n", sendUser.unionId, result.Code, result.Msg, sendUser.feishuAppId)
+		return "", fmt.Errorf("code=%d, msg=%s", result.Code, result.Msg)
 	}
 
 	logs.Info.Printf("Message sent successfully to %s, message_id: %s, app_id=%s\n", sendUser.unionId, result.Data.MessageId, sendUser.feishuAppId)
@@ -412,16 +623,11 @@ func sendMessage(receiveIdType string, sendUser feishuUser, content string, urge
 	if urgent {
 		sendUrgentMessage(receiveIdType, sendUser, result.Data.MessageId)
 	}
+	return result.Data.MessageId, nil
 }
 
 // sendUrgentMessage send urgent message to feishu
 func sendUrgentMessage(receiveIdType string, sendUser feishuUser, messageId string) {
-	token, err := getTenantAccessToken(sendUser.feishuAppId)
-	if err != nil {
-		logs.Warn.Println("Failed to get tenantAccessToken:", err)
-		return
-	}
-
 	// message struct
 	requestBody := map[string]interface{}{
 		"user_id_list": []string{sendUser.unionId},
@@ -433,43 +639,14 @@ func sendUrgentMessage(receiveIdType string, sendUser feishuUser, messageId stri
 		return
 	}
 
-	url := fmt.Sprintf("%s/%s/urgent_app?user_id_type=%s", urgentAppMessagePushURL, messageId, receiveIdType)
+	path := fmt.Sprintf("%s/%s/urgent_app?user_id_type=%s", urgentAppMessagePushPath, messageId, receiveIdType)
 
 	// 发送请求
-	req, err := http.NewRequest(http.MethodPatch, url, bytes.NewBuffer(jsonBody))
-	if err != nil {
-		logs.Warn.Println("Failed to create urgent app message request:", err)
-		return
-	}
-
-	req.Header.Set("Content-Type", "application/json; charset=utf-8")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-
-	resp, err := handler.httpClient.Do(req)
+	result, err := callFeishuApi(http.MethodPatch, path, sendUser.feishuAppId, jsonBody)
 	if err != nil {
 		logs.Warn.Println("Failed to send urgent app message:", err)
 		return
 	}
-	defer resp.Body.Close()
-
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		logs.Warn.Println("Failed to read urgent app message response:", err)
-		return
-	}
-
-	var result struct {
-		Code int    `json:"code"`
-		Msg  string `json:"msg"`
-		Data struct {
-			MessageId string `json:"message_id"`
-		} `json:"data"`
-	}
-
-	if err := json.Unmarshal(respBody, &result); err != nil {
-		logs.Warn.Println("Failed to parse urgent app message response:", err)
-		return
-	}
 
 	if result.Code != 0 {
 		logs.Warn.Printf("Failed to send urgent app message to %s: code=%d, msg=%s, app_id=%s\n", sendUser.unionId, result.Code, result.Msg, sendUser.feishuAppId)
@@ -494,9 +671,15 @@ func (h Handler) Channel() chan<- *push.ChannelReq {
 	return handler.channel
 }
 
+// Reload re-reads the list of Feishu apps from the database.
+func (h Handler) Reload() error {
+	return loadApps()
+}
+
 // Stop stops the handler
 func (h Handler) Stop() {
-	handler.stop <- true
+	// Closing the channel stops both the message processor and the token refresher.
+	close(handler.stop)
 }
 
 func init() {
@@ -0,0 +1,488 @@
+package feishu
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/pushtest"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// fakeFeishu is a stand-in for Feishu API server.
+type fakeFeishu struct {
+	*pushtest.Server
+
+	// Respond to token requests with an error.
+	tokenFail bool
+	// Number of token requests received.
+	tokenRequests int
+	// Currently valid token.
+	token string
+	// Bodies of received messages.
+	messages []map[string]any
+	// Paths of received urgent requests.
+	urgent []string
+}
+
+func newFakeFeishu(tt *testing.T) *fakeFeishu {
+	ff := &fakeFeishu{Server: pushtest.NewServer(tt)}
+	ff.Handle(tenantAccessTokenPath, ff.serveToken)
+	ff.Handle(messagePushPath, ff.serveMessage)
+	ff.Handle(urgentAppMessagePushPath+"/", ff.serveUrgent)
+	return ff
+}
+
+func (ff *fakeFeishu) serveToken(req *pushtest.Request) (int, any) {
+	ff.tokenRequests++
+	if ff.tokenFail {
+		return http.StatusOK, map[string]any{"code": 10003, "msg": "invalid param"}
+	}
+	ff.token = fmt.Sprintf("t-%d", ff.tokenRequests)
+	return http.StatusOK, map[string]any{"code": 0, "msg": "ok", "tenant_access_token": ff.token, "expire": 7200}
+}
+
+// unauthorized checks the token and returns an error response if it's invalid.
+func (ff *fakeFeishu) unauthorized(req *pushtest.Request) any {
+	if req.Header.Get("Authorization") != "Bearer "+ff.token {
+		return map[string]any{"code": 99991663, "msg": "Invalid access token for authorization"}
+	}
+	return nil
+}
+
+func (ff *fakeFeishu) serveMessage(req *pushtest.Request) (int, any) {
+	if resp := ff.unauthorized(req); resp != nil {
+		return http.StatusOK, resp
+	}
+	var body map[string]any
+	req.JSON(&body)
+	ff.messages = append(ff.messages, body)
+	return http.StatusOK, map[string]any{"code": 0, "msg": "success",
+		"data": map[string]any{"message_id": fmt.Sprintf("om_%d", len(ff.messages))}}
+}
+
+func (ff *fakeFeishu) serveUrgent(req *pushtest.Request) (int, any) {
+	if resp := ff.unauthorized(req); resp != nil {
+		return http.StatusOK, resp
+	}
+	ff.urgent = append(ff.urgent, req.Method+" "+req.Path)
+	return http.StatusOK, map[string]any{"code": 0, "msg": "success"}
+}
+
+// expireToken makes the current token invalid as if it was revoked by Feishu.
+func (ff *fakeFeishu) expireToken() {
+	ff.Lock()
+	ff.token = "expired"
+	ff.Unlock()
+}
+
+func (ff *fakeFeishu) counts() (tokens, messages, urgent int) {
+	ff.Lock()
+	defer ff.Unlock()
+	return ff.tokenRequests, len(ff.messages), len(ff.urgent)
+}
+
+// setupHandler initializes the handler to talk to the fake server by default.
+func setupHandler(tt *testing.T, apps ...t.FeishuApp) *fakeFeishu {
+	ff := newFakeFeishu(tt)
+
+	appList := make(map[string]t.FeishuApp, len(apps))
+	for _, app := range apps {
+		appList[app.AppId] = app
+	}
+	handler.config = &configType{Enabled: true, AppList: appList, BaseURL: ff.URL()}
+	handler.httpClient = &http.Client{Timeout: time.Second}
+	handler.tokenInfo = make(map[string]*appToken)
+	return ff
+}
+
+func TestMain(m *testing.M) {
+	pushtest.Main(m)
+}
+
+func TestTokenIsCached(tt *testing.T) {
+	ff := setupHandler(tt, t.FeishuApp{AppId: "app1", AppSecret: "secret1"})
+
+	for i := 0; i < 3; i++ {
+		token, err := getTenantAccessToken("app1")
+		if err != nil {
+			tt.Fatal("failed to get token:", err)
+		}
+		if token != "t-1" {
+			tt.Error("unexpected token", token)
+		}
+	}
+	if tokens, _, _ := ff.counts(); tokens != 1 {
+		tt.Error("expected one token request, got", tokens)
+	}
+}
+
+func TestTokenRefreshAhead(tt *testing.T) {
+	ff := setupHandler(tt, t.FeishuApp{AppId: "app1", AppSecret: "secret1"})
+
+	if _, err := getTenantAccessToken("app1"); err != nil {
+		tt.Fatal("failed to get token:", err)
+	}
+
+	at := getAppToken("app1")
+	if at.needsRefresh(time.Now()) {
+		tt.Error("fresh token should not need refresh")
+	}
+	// The token expires in less than tokenRefreshAhead: still valid but due for refresh.
+	at.mu.Lock()
+	at.info.Timestamp = time.Now().Unix() - int64(at.info.Expire) + tokenRefreshAhead/2
+	at.mu.Unlock()
+	if _, ok := at.valid(time.Now()); !ok {
+		tt.Error("token should still be valid")
+	}
+	if !at.needsRefresh(time.Now()) {
+		tt.Error("token should need refresh")
+	}
+
+	refreshTenantAccessToken(handler.config.AppList["app1"], at, false)
+	if token, _ := at.valid(time.Now()); token != "t-2" {
+		tt.Error("expected refreshed token, got", token)
+	}
+	if tokens, _, _ := ff.counts(); tokens != 2 {
+		tt.Error("expected two token requests, got", tokens)
+	}
+}
+
+func TestTokenBackoff(tt *testing.T) {
+	ff := setupHandler(tt, t.FeishuApp{AppId: "app1", AppSecret: "secret1"})
+	ff.tokenFail = true
+
+	if _, err := getTenantAccessToken("app1"); err == nil {
+		tt.Fatal("expected error")
+	}
+	// Backoff is in effect, Feishu must not be contacted again.
+	if _, err := getTenantAccessToken("app1"); err == nil {
+		tt.Fatal("expected error")
+	}
+	if tokens, _, _ := ff.counts(); tokens != 1 {
+		tt.Error("expected one token request, got", tokens)
+	}
+
+	at := getAppToken("app1")
+	at.mu.RLock()
+	first := time.Until(at.retryAt)
+	at.mu.RUnlock()
+	if first <= 0 || first > tokenBackoffMin {
+		tt.Error("unexpected backoff", first)
+	}
+
+	// Backoff doubles after each failure.
+	at.mu.Lock()
+	at.retryAt = time.Time{}
+	at.mu.Unlock()
+	getTenantAccessToken("app1")
+	at.mu.RLock()
+	second := time.Until(at.retryAt)
+	at.mu.RUnlock()
+	if second <= tokenBackoffMin || second > 2*tokenBackoffMin {
+		tt.Error("backoff did not grow", second)
+	}
+
+	// Success resets the backoff.
+	ff.Lock()
+	ff.tokenFail = false
+	ff.Unlock()
+	at.mu.Lock()
+	at.retryAt = time.Time{}
+	at.mu.Unlock()
+	if _, err := getTenantAccessToken("app1"); err != nil {
+		tt.Fatal("failed to get token:", err)
+	}
+	at.mu.RLock()
+	defer at.mu.RUnlock()
+	if at.failures != 0 || !at.retryAt.IsZero() {
+		tt.Error("backoff not reset", at.failures, at.retryAt)
+	}
+}
+
+func TestBackoffLimit(tt *testing.T) {
+	at := &appToken{}
+	for i := 0; i < 100; i++ {
+		at.update(nil, fmt.Errorf("failed"))
+	}
+	if backoff := time.Until(at.retryAt); backoff <= 0 || backoff > tokenBackoffMax {
+		tt.Error("backoff out of range", backoff)
+	}
+}
+
+func TestRetryOnInvalidToken(tt *testing.T) {
+	ff := setupHandler(tt, t.FeishuApp{AppId: "app1", AppSecret: "secret1"})
+
+	if _, err := getTenantAccessToken("app1"); err != nil {
+		tt.Fatal("failed to get token:", err)
+	}
+	ff.expireToken()
+
+	sendMessage("union_id", feishuUser{unionId: "on_1", feishuAppId: "app1"}, "interactive", "{}", false)
+
+	tokens, messages, _ := ff.counts()
+	if tokens != 2 {
+		tt.Error("expected token to be refreshed once, got requests:", tokens)
+	}
+	if messages != 1 {
+		tt.Error("expected message to be delivered after retry, got", messages)
+	}
+	if ff.messages[0]["receive_id"] != "on_1" {
+		tt.Error("unexpected receiver", ff.messages[0]["receive_id"])
+	}
+}
+
+func TestUrgentMessage(tt *testing.T) {
+	ff := setupHandler(tt, t.FeishuApp{AppId: "app1", AppSecret: "secret1"})
+
+	sendMessage("union_id", feishuUser{unionId: "on_1", feishuAppId: "app1"}, "interactive", "{}", true)
+
+	_, messages, urgent := ff.counts()
+	if messages != 1 || urgent != 1 {
+		tt.Fatal("expected message and urgent request, got", messages, urgent)
+	}
+	if expected := "PATCH " + urgentAppMessagePushPath + "/om_1/urgent_app"; ff.urgent[0] != expected {
+		tt.Error("unexpected urgent request", ff.urgent[0])
+	}
+}
+
+func TestPerAppBaseURL(tt *testing.T) {
+	lark := newFakeFeishu(tt)
+
+	ff := setupHandler(tt,
+		t.FeishuApp{AppId: "app1", AppSecret: "secret1"},
+		t.FeishuApp{AppId: "app2", AppSecret: "secret2", BaseUrl: lark.URL() + "/"})
+
+	sendMessage("union_id", feishuUser{unionId: "on_1", feishuAppId: "app1"}, "interactive", "{}", false)
+	sendMessage("union_id", feishuUser{unionId: "on_2", feishuAppId: "app2"}, "interactive", "{}", false)
+
+	if tokens, messages, _ := ff.counts(); tokens != 1 || messages != 1 {
+		tt.Error("default endpoint: unexpected requests", tokens, messages)
+	}
+	if tokens, messages, _ := lark.counts(); tokens != 1 || messages != 1 {
+		tt.Error("app endpoint: unexpected requests", tokens, messages)
+	}
+	if !strings.HasPrefix(apiURL(&t.FeishuApp{}, messagePushPath), ff.URL()) {
+		tt.Error("default URL not used")
+	}
+}
+
+func TestUnknownApp(tt *testing.T) {
+	ff := setupHandler(tt, t.FeishuApp{AppId: "app1", AppSecret: "secret1"})
+
+	if _, err := getTenantAccessToken("app2"); err == nil {
+		tt.Error("expected error for unknown app")
+	}
+	sendMessage("union_id", feishuUser{unionId: "on_1", feishuAppId: "app2"}, "interactive", "{}", false)
+	if tokens, messages, _ := ff.counts(); tokens != 0 || messages != 0 {
+		tt.Error("unknown app must not reach Feishu", tokens, messages)
+	}
+}
+
+// decodeCard returns the title and the text of the rendered card.
+func decodeCard(tt *testing.T, content string) (string, string, string) {
+	var c card
+	if err := json.Unmarshal([]byte(content), &c); err != nil {
+		tt.Fatal("invalid card:", err)
+	}
+	if len(c.Elements) != 1 || c.Elements[0].Text == nil {
+		tt.Fatal("unexpected card elements", content)
+	}
+	return c.Header.Template, c.Header.Title.Content, c.Elements[0].Text.Content
+}
+
+func TestRenderCard(tt *testing.T) {
+	if err := initCardTemplates(&configType{}); err != nil {
+		tt.Fatal("failed to init default template:", err)
+	}
+	templ := cardTemplate("en")
+
+	cases := []struct {
+		data  cardData
+		call  string
+		color string
+		title string
+		text  string
+	}{
+		{cardData{Sender: "Alice", Preview: "hi"}, "", "blue", "Alice", "Alice: hi"},
+		{cardData{Sender: "Alice", Topic: "Team", Preview: "hi"}, "", "blue", "Team", "Alice: hi"},
+		{cardData{Sender: "Alice", Topic: "Team"}, "", "blue", "Team", "Alice 发来一条新消息，快打开软件看看吧"},
+		{cardData{Sender: "Alice", Topic: "Team", Preview: "hi", Count: 5}, "", "blue", "Team", "[5条新消息] Alice: hi"},
+		{cardData{Sender: "Alice", Topic: "Team", Count: 5}, "", "blue", "Team", "Alice 等人发来 5 条新消息，快打开软件看看吧"},
+		{cardData{Sender: "Alice", Preview: "hi"}, "audio", "red", "Alice", "Alice 给你打音频通话，快打开软件看看吧"},
+		{cardData{Sender: "Alice"}, "video", "red", "Alice", "Alice 给你打视频通话，快打开软件看看吧"},
+	}
+	for i, tc := range cases {
+		content, err := renderCard(templ, &tc.data, tc.call)
+		if err != nil {
+			tt.Fatal(i, "failed to render card:", err)
+		}
+		color, title, text := decodeCard(tt, content)
+		if color != tc.color || title != tc.title || text != tc.text {
+			tt.Errorf("%d: expected %s '%s' '%s', got %s '%s' '%s'", i, tc.color, tc.title, tc.text, color, title, text)
+		}
+	}
+}
+
+func TestCardLanguages(tt *testing.T) {
+	err := initCardTemplates(&configType{
+		Languages:     []string{"zh", "en"},
+		CardTemplFile: "../../templ/feishu-card-{{.Language}}.templ",
+	})
+	if err != nil {
+		tt.Fatal("failed to load templates:", err)
+	}
+	defer initCardTemplates(&configType{})
+
+	data := &cardData{Sender: "Alice"}
+	cases := map[string]string{
+		"":      "Alice 发来一条新消息，快打开软件看看吧",
+		"zh-CN": "Alice 发来一条新消息，快打开软件看看吧",
+		"en-US": "Alice sent you a new message, open the app to read it",
+		"en_GB": "Alice sent you a new message, open the app to read it",
+		"fr":    "Alice 发来一条新消息，快打开软件看看吧",
+	}
+	for lang, expected := range cases {
+		content, err := renderCard(cardTemplate(lang), data, "")
+		if err != nil {
+			tt.Fatal(lang, "failed to render card:", err)
+		}
+		if _, _, text := decodeCard(tt, content); text != expected {
+			tt.Errorf("%s: expected '%s', got '%s'", lang, expected, text)
+		}
+	}
+}
+
+func TestPreview(tt *testing.T) {
+	handler.config = &configType{
+		HidePreviewTopics: []string{"grpSecret"},
+		hidePreviewTopics: map[string]bool{"grpSecret": true},
+	}
+	if !previewHidden("grpSecret") || previewHidden("grpPublic") {
+		tt.Error("preview must be hidden for sensitive topics only")
+	}
+	handler.config.HidePreview = true
+	if !previewHidden("grpPublic") {
+		tt.Error("preview must be hidden for all topics")
+	}
+
+	if preview := previewText("  Hello, world  ", 80); preview != "Hello, world" {
+		tt.Errorf("unexpected plain text preview '%s'", preview)
+	}
+	drafty := map[string]any{
+		"txt": "This is bold",
+		"fmt": []any{map[string]any{"at": 8, "len": 4, "tp": "ST"}},
+	}
+	if preview := previewText(drafty, 80); preview != "This is bold" {
+		tt.Errorf("unexpected drafty preview '%s'", preview)
+	}
+	if preview := previewText(nil, 80); preview != "" {
+		tt.Errorf("expected empty preview, got '%s'", preview)
+	}
+}
+
+func TestCardReplies(tt *testing.T) {
+	alice, bob := t.Uid(1), t.Uid(2)
+	rememberCard("om_1", "grpAbc", alice)
+	rememberCard("om_2", "p2pXyz", alice)
+	rememberCard("om_3", "grpAbc", bob)
+
+	if topic := TopicForReply(alice, "om_1"); topic != "grpAbc" {
+		tt.Errorf("reply to card: expected 'grpAbc', got '%s'", topic)
+	}
+	if topic := TopicForReply(alice, ""); topic != "p2pXyz" {
+		tt.Errorf("message without reply: expected the latest card 'p2pXyz', got '%s'", topic)
+	}
+	if topic := TopicForReply(bob, "om_1"); topic != "" {
+		tt.Errorf("card sent to another user must not be answered, got '%s'", topic)
+	}
+	if topic := TopicForReply(bob, "om_unknown"); topic != "" {
+		tt.Errorf("unknown card must not be answered, got '%s'", topic)
+	}
+}
+
+func TestChatTag(tt *testing.T) {
+	appId, chatId, ok := parseChatTag(ChatTag("cli_a1", "oc_b2"))
+	if !ok || appId != "cli_a1" || chatId != "oc_b2" {
+		tt.Error("failed to parse chat tag", appId, chatId, ok)
+	}
+	for _, tag := range []string{"feishuchat:cli_a1", "feishuchat::oc_b2", "dept:od_1", "feishuchat:cli_a1:"} {
+		if _, _, ok := parseChatTag(tag); ok {
+			tt.Errorf("tag '%s' must not be parsed", tag)
+		}
+	}
+}
+
+func TestRelayToChat(tt *testing.T) {
+	ff := setupHandler(tt, t.FeishuApp{AppId: "cli_a1", AppSecret: "secret1"})
+	handler.config.hidePreviewTopics = map[string]bool{"grpSecret": true}
+	handler.input = make(chan *push.Receipt, 1)
+	defer func() { handler.input = nil }()
+
+	tags := []string{"dept:od_1", ChatTag("cli_a1", "oc_b2")}
+	// None of these is relayed.
+	RelayToChat("grpUnbound", []string{"dept:od_1"}, "", nil, "hello")
+	RelayToChat("grpSecret", tags, "", nil, "hello")
+	RelayToChat("grpBound", tags, "", map[string]any{"origin": "feishu"}, "hello")
+	RelayToChat("grpBound", tags, "", map[string]any{"webrtc": "started"}, "hello")
+	RelayToChat("usrAbc", tags, "", nil, "hello")
+
+	RelayToChat("grpBound", tags, "", nil, "hello")
+	for i := 0; i < 100; i++ {
+		if _, messages, _ := ff.counts(); messages > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ff.Lock()
+	defer ff.Unlock()
+	if len(ff.messages) != 1 {
+		tt.Fatal("expected one relayed message, got", len(ff.messages))
+	}
+	if msg := ff.messages[0]; msg["receive_id"] != "oc_b2" || msg["content"] != `{"text":"hello"}` {
+		tt.Error("unexpected relayed message", msg)
+	}
+}
+
+func TestShouldNotify(tt *testing.T) {
+	handler.config = &configType{UrgentLimit: 2, UrgentPeriod: 60}
+	now := time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC)
+	alice, bob := t.Uid(11), t.Uid(12)
+
+	if notify, _ := shouldNotify(&push.Recipient{Delivered: 1}, false); notify {
+		tt.Error("user reading the topic must not be notified")
+	}
+	if notify, urgent := shouldNotify(&push.Recipient{}, false); !notify || urgent {
+		tt.Error("offline user must be notified", notify, urgent)
+	}
+	if notify, urgent := shouldNotify(&push.Recipient{Quiet: true}, true); !notify || urgent {
+		tt.Error("call during quiet hours must be delivered as a regular card", notify, urgent)
+	}
+	if notify, urgent := shouldNotify(&push.Recipient{}, true); !notify || !urgent {
+		tt.Error("call must be urgent", notify, urgent)
+	}
+
+	resetUrgentCount()
+	defer resetUrgentCount()
+	if !allowUrgent(bob, now) || !allowUrgent(bob, now) || allowUrgent(bob, now) {
+		tt.Error("urgent notifications over the limit must be rejected")
+	}
+	// Alice's period starts later than Bob's and doesn't affect it.
+	if !allowUrgent(alice, now.Add(30*time.Second)) || !allowUrgent(alice, now.Add(30*time.Second)) {
+		tt.Error("limit of urgent notifications must be per user")
+	}
+	if !allowUrgent(bob, now.Add(time.Minute)) {
+		tt.Error("limit of urgent notifications must be reset after the period")
+	}
+	if allowUrgent(alice, now.Add(time.Minute)) {
+		tt.Error("period of urgent notifications must be per user")
+	}
+	if !allowUrgent(alice, now.Add(90*time.Second)) {
+		tt.Error("limit of urgent notifications must be reset after the user's period")
+	}
+}
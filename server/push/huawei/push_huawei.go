@@ -0,0 +1,441 @@
+// Package huawei implements push notification plugin for Huawei Push Kit. It delivers notifications
+// to Android devices with Huawei Mobile Services and without Google Play services.
+// https://developer.huawei.com/consumer/en/doc/HMSCore-References/https-send-api-0000001050986197
+package huawei
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/common"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+var handler Handler
+
+const (
+	// Size of the input channel buffer.
+	bufferSize = 1024
+
+	// Default OAuth endpoint.
+	defaultAuthURL = "https://oauth-login.cloud.huawei.com/oauth2/v3/token"
+	// Default Push Kit endpoint.
+	defaultPushURL = "https://push-api.cloud.huawei.com"
+	// Path of the send API relative to the push endpoint, the parameter is the app ID.
+	sendPath = "/v1/%s/messages:send"
+
+	// TTL of a regular push notification in seconds.
+	defaultTimeToLive = 3600
+	// TTL of a call notification in seconds.
+	callTimeToLive = 30
+
+	// Obtain a new access token this long before the current one expires.
+	tokenRefreshAhead = 5 * time.Minute
+
+	// The maximum number of tokens in one request. Push Kit constant.
+	pushBatchSize = 1000
+)
+
+// Push Kit result codes.
+const (
+	codeSuccess = "80000000"
+	// Some tokens are invalid, the message lists them.
+	codePartialSuccess = "80100000"
+	// OAuth token is invalid or expired.
+	codeAuthFailed  = "80200001"
+	codeAuthExpired = "80200003"
+	// All tokens are invalid.
+	codeAllTokensInvalid = "80300007"
+)
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input      chan *push.Receipt
+	channel    chan *push.ChannelReq
+	stop       chan bool
+	config     *configType
+	httpClient *http.Client
+}
+
+// OAuth access token.
+var accessToken struct {
+	sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// App ID and secret from AppGallery Connect.
+	AppId     string `json:"app_id"`
+	AppSecret string `json:"app_secret"`
+	// OAuth and Push Kit endpoints, optional.
+	AuthURL string `json:"auth_url"`
+	PushURL string `json:"push_url"`
+	// Only validate messages, don't deliver them.
+	DryRun     bool `json:"dry_run"`
+	TimeToLive int  `json:"time_to_live,omitempty"`
+	// Self-classification of messages, e.g. "IM". Required for high priority delivery.
+	Category string `json:"category,omitempty"`
+	// Notification to display. Data-only messages are sent if disabled.
+	Android *common.Config `json:"android,omitempty"`
+}
+
+// Push Kit message, only the used fields.
+type hmsMessage struct {
+	Data    string      `json:"data,omitempty"`
+	Android *hmsAndroid `json:"android,omitempty"`
+	Token   []string    `json:"token"`
+}
+
+type hmsAndroid struct {
+	Urgency      string           `json:"urgency,omitempty"`
+	Category     string           `json:"category,omitempty"`
+	TTL          string           `json:"ttl,omitempty"`
+	Notification *hmsNotification `json:"notification,omitempty"`
+}
+
+type hmsNotification struct {
+	Title       string          `json:"title,omitempty"`
+	Body        string          `json:"body,omitempty"`
+	TitleLocKey string          `json:"title_loc_key,omitempty"`
+	BodyLocKey  string          `json:"body_loc_key,omitempty"`
+	Icon        string          `json:"icon,omitempty"`
+	Color       string          `json:"color,omitempty"`
+	Tag         string          `json:"tag,omitempty"`
+	Importance  string          `json:"importance,omitempty"`
+	ClickAction *hmsClickAction `json:"click_action"`
+}
+
+type hmsClickAction struct {
+	// 1: custom intent or action, 3: open the app.
+	Type   int    `json:"type"`
+	Action string `json:"action,omitempty"`
+}
+
+type hmsResponse struct {
+	Code      string `json:"code"`
+	Msg       string `json:"msg"`
+	RequestId string `json:"requestId"`
+}
+
+// Init initializes the push handler
+func (Handler) Init(jsonconf json.RawMessage) (bool, error) {
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return false, errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return false, nil
+	}
+
+	if config.AppId == "" || config.AppSecret == "" {
+		return false, errors.New("missing app ID or secret")
+	}
+	if config.AuthURL == "" {
+		config.AuthURL = defaultAuthURL
+	}
+	if config.PushURL == "" {
+		config.PushURL = defaultPushURL
+	}
+	config.PushURL = strings.TrimSuffix(config.PushURL, "/")
+	if config.TimeToLive <= 0 {
+		config.TimeToLive = defaultTimeToLive
+	}
+
+	handler.config = &config
+	handler.httpClient = &http.Client{Timeout: 10 * time.Second}
+	handler.input = make(chan *push.Receipt, bufferSize)
+	handler.channel = make(chan *push.ChannelReq, bufferSize)
+	handler.stop = make(chan bool, 1)
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				go sendPushes(rcpt)
+			case <-handler.channel:
+				// Push Kit topics are not used.
+			case <-handler.stop:
+				return
+			}
+		}
+	}()
+
+	return true, nil
+}
+
+// getToken returns a valid access token, obtaining a new one if necessary.
+func getToken() (string, error) {
+	accessToken.Lock()
+	defer accessToken.Unlock()
+
+	if accessToken.token != "" && time.Now().Before(accessToken.expiry.Add(-tokenRefreshAhead)) {
+		return accessToken.token, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", handler.config.AppId)
+	form.Set("client_secret", handler.config.AppSecret)
+	resp, err := handler.httpClient.PostForm(handler.config.AuthURL, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            int    `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.AccessToken == "" {
+		return "", fmt.Errorf("failed to obtain access token: %d %s", result.Error, result.ErrorDescription)
+	}
+
+	accessToken.token = result.AccessToken
+	accessToken.expiry = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	return accessToken.token, nil
+}
+
+// invalidateToken discards the token if it has not been replaced yet.
+func invalidateToken(token string) {
+	accessToken.Lock()
+	defer accessToken.Unlock()
+
+	if accessToken.token == token {
+		accessToken.token = ""
+	}
+}
+
+// prepareMessage converts the user's data to a Push Kit message.
+func prepareMessage(what, topic string, data map[string]string, tokens []string) (*hmsMessage, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	config := handler.config
+
+	msg := &hmsMessage{Data: string(payload), Token: tokens}
+	msg.Android = &hmsAndroid{
+		Urgency:  string(common.AndroidPriorityHigh),
+		Category: config.Category,
+		TTL:      strconv.Itoa(config.TimeToLive) + "s",
+	}
+	_, call := data["webrtc"]
+	if call {
+		msg.Android.TTL = strconv.Itoa(callTimeToLive) + "s"
+	}
+	if what == push.ActRead || what == push.ActExpire {
+		msg.Android.Urgency = string(common.AndroidPriorityNormal)
+		// Category is only allowed for high priority messages.
+		msg.Android.Category = ""
+		return msg, nil
+	}
+
+	if config.Android == nil || !config.Android.Enabled || data["silent"] == "true" {
+		return msg, nil
+	}
+
+	body := config.Android.GetStringField(what, "Body")
+	if body == "$content" {
+		body = data["content"]
+	}
+	msg.Android.Notification = &hmsNotification{
+		// Show just one notification per topic.
+		Tag:         topic,
+		Title:       config.Android.GetStringField(what, "Title"),
+		TitleLocKey: config.Android.GetStringField(what, "TitleLocKey"),
+		Body:        body,
+		BodyLocKey:  config.Android.GetStringField(what, "BodyLocKey"),
+		Icon:        config.Android.GetStringField(what, "Icon"),
+		Color:       config.Android.GetStringField(what, "Color"),
+		Importance:  "NORMAL",
+		ClickAction: &hmsClickAction{Type: 3},
+	}
+	if action := config.Android.GetStringField(what, "ClickAction"); action != "" {
+		msg.Android.Notification.ClickAction = &hmsClickAction{Type: 1, Action: action}
+	}
+	return msg, nil
+}
+
+// sendPushes sends the receipt to Huawei devices of all recipients.
+func sendPushes(rcpt *push.Receipt) {
+	if len(rcpt.To) == 0 {
+		return
+	}
+
+	data, err := common.PayloadToData(&rcpt.Payload)
+	if err != nil {
+		logs.Warn.Println("huawei push: could not parse payload:", err)
+		return
+	}
+
+	uids := make([]t.Uid, 0, len(rcpt.To))
+	// Devices which were online and received the message.
+	skipDevices := make(map[string]struct{})
+	for uid, to := range rcpt.To {
+		uids = append(uids, uid)
+		for _, deviceID := range to.Devices {
+			skipDevices[deviceID] = struct{}{}
+		}
+	}
+	devices, _, err := store.Devices.GetAll(uids...)
+	if err != nil {
+		logs.Warn.Println("huawei push: db error", err)
+		return
+	}
+
+	order := slices.Collect(maps.Keys(devices))
+	for n, uid := range order {
+		devList := devices[uid]
+		var tokens []string
+		for i := range devList {
+			d := &devList[i]
+			if _, skip := skipDevices[d.DeviceId]; !skip && d.DeviceId != "" && d.Platform == t.PlatformHuawei {
+				tokens = append(tokens, d.DeviceId)
+			}
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		if len(tokens) > pushBatchSize {
+			tokens = tokens[:pushBatchSize]
+		}
+
+		topic := rcpt.Payload.Topic
+		userData := common.ClonePayload(data)
+		// Fix topic name for P2P pushes.
+		if t.GetTopicCat(topic) == t.TopicCatP2P {
+			topic, _ = t.P2PNameForUser(uid, topic)
+			userData["topic"] = topic
+		}
+		// Silence the push for user who have received the data interactively.
+		if rcpt.To[uid].Delivered > 0 {
+			userData["silent"] = "true"
+		}
+
+		msg, err := prepareMessage(rcpt.Payload.What, topic, userData, tokens)
+		if err != nil {
+			logs.Warn.Println("huawei push: failed to prepare message:", err)
+			continue
+		}
+		invalid, err := sendMessage(msg)
+		push.InvalidToken("huawei", len(invalid))
+		for _, token := range invalid {
+			// Token is no longer valid. Delete token from DB and continue sending.
+			if err := store.Devices.Delete(uid, token); err != nil {
+				logs.Warn.Println("huawei push: failed to delete invalid token:", err)
+			}
+		}
+		if err != nil {
+			logs.Warn.Println("huawei push:", err)
+			push.Failed("huawei", rcpt, err, order[n:]...)
+			return
+		}
+		push.Sent("huawei", len(tokens)-len(invalid))
+	}
+}
+
+// sendMessage posts the message to Push Kit. Returns the tokens rejected as invalid. An error means
+// sending should stop.
+func sendMessage(msg *hmsMessage) ([]string, error) {
+	body, err := json.Marshal(map[string]any{"validate_only": handler.config.DryRun, "message": msg})
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		token, err := getToken()
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequest(http.MethodPost, handler.config.PushURL+fmt.Sprintf(sendPath, handler.config.AppId),
+			bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := handler.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		var result hmsResponse
+		if err := json.Unmarshal(respBody, &result); err != nil {
+			return nil, fmt.Errorf("invalid response, http status %s", resp.Status)
+		}
+
+		switch result.Code {
+		case codeSuccess:
+			return nil, nil
+		case codePartialSuccess:
+			var partial struct {
+				IllegalTokens []string `json:"illegal_tokens"`
+			}
+			json.Unmarshal([]byte(result.Msg), &partial)
+			return partial.IllegalTokens, nil
+		case codeAllTokensInvalid:
+			return msg.Token, nil
+		case codeAuthFailed, codeAuthExpired:
+			invalidateToken(token)
+			if attempt == 0 {
+				continue
+			}
+		}
+		return nil, fmt.Errorf("send failed: %s %s", result.Code, result.Msg)
+	}
+}
+
+// IsReady checks if the push handler has been initialized.
+func (Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Channel returns a channel for subscribing/unsubscribing devices to channels. Channels are not
+// supported, requests are discarded.
+func (Handler) Channel() chan<- *push.ChannelReq {
+	return handler.channel
+}
+
+// Stop shuts down the handler
+func (Handler) Stop() {
+	handler.stop <- true
+}
+
+func init() {
+	push.Register("huawei", &handler)
+}
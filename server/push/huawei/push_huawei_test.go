@@ -0,0 +1,127 @@
+package huawei
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/common"
+	"github.com/tinode/chat/server/push/pushtest"
+)
+
+// fakePushKit is a stand-in for Huawei OAuth and Push Kit endpoints.
+type fakePushKit struct {
+	*pushtest.Server
+
+	// Number of issued access tokens.
+	issued int
+	// Access token accepted by the push endpoint.
+	valid string
+	// Response to send requests.
+	code, msg string
+	messages  []map[string]json.RawMessage
+}
+
+func newFakePushKit(tt *testing.T) *fakePushKit {
+	pk := &fakePushKit{Server: pushtest.NewServer(tt), code: codeSuccess}
+	pk.Handle("/oauth", func(req *pushtest.Request) (int, any) {
+		if req.Form.Get("client_id") != "app" || req.Form.Get("client_secret") != "secret" {
+			return http.StatusOK, map[string]any{"error": 1101, "error_description": "invalid client"}
+		}
+		pk.issued++
+		pk.valid = "token" + strconv.Itoa(pk.issued)
+		return http.StatusOK, map[string]any{"access_token": pk.valid, "expires_in": 3600}
+	})
+	pk.Handle("/v1/app/messages:send", func(req *pushtest.Request) (int, any) {
+		if req.Header.Get("Authorization") != "Bearer "+pk.valid {
+			return http.StatusOK, hmsResponse{Code: codeAuthExpired, Msg: "token expired"}
+		}
+		var body map[string]json.RawMessage
+		req.JSON(&body)
+		pk.messages = append(pk.messages, body)
+		return http.StatusOK, hmsResponse{Code: pk.code, Msg: pk.msg}
+	})
+
+	handler.config = &configType{
+		AppId:      "app",
+		AppSecret:  "secret",
+		AuthURL:    pk.URL() + "/oauth",
+		PushURL:    pk.URL(),
+		TimeToLive: defaultTimeToLive,
+	}
+	handler.httpClient = &http.Client{Timeout: time.Second}
+	invalidateToken(accessToken.token)
+	return pk
+}
+
+func TestTokenRefresh(tt *testing.T) {
+	pk := newFakePushKit(tt)
+
+	msg := &hmsMessage{Data: "{}", Token: []string{"a"}}
+	if _, err := sendMessage(msg); err != nil {
+		tt.Fatal(err)
+	}
+	if _, err := sendMessage(msg); err != nil {
+		tt.Fatal(err)
+	}
+	if pk.issued != 1 {
+		tt.Error("access token must be reused, issued", pk.issued)
+	}
+
+	// Server-side expiration: the token is refreshed and the request is retried.
+	pk.valid = "revoked"
+	if _, err := sendMessage(msg); err != nil {
+		tt.Fatal(err)
+	}
+	if pk.issued != 2 || len(pk.messages) != 3 {
+		tt.Error("message must be resent with a new token", pk.issued, len(pk.messages))
+	}
+}
+
+func TestInvalidTokens(tt *testing.T) {
+	pk := newFakePushKit(tt)
+	msg := &hmsMessage{Data: "{}", Token: []string{"a", "b", "c"}}
+
+	pk.code, pk.msg = codePartialSuccess, `{"success":2,"failure":1,"illegal_tokens":["b"]}`
+	if invalid, err := sendMessage(msg); err != nil || len(invalid) != 1 || invalid[0] != "b" {
+		tt.Error("illegal token is not reported", invalid, err)
+	}
+
+	pk.code, pk.msg = codeAllTokensInvalid, "all the tokens are invalid"
+	if invalid, err := sendMessage(msg); err != nil || len(invalid) != 3 {
+		tt.Error("all tokens must be reported as invalid", invalid, err)
+	}
+
+	pk.code, pk.msg = "80300008", "message body is too large"
+	if invalid, err := sendMessage(msg); err == nil || len(invalid) != 0 {
+		tt.Error("failure must be reported as an error", invalid, err)
+	}
+}
+
+func TestPrepareMessage(tt *testing.T) {
+	newFakePushKit(tt)
+	handler.config.Android = &common.Config{
+		Enabled: true,
+		Msg:     common.Payload{Title: "New message", Body: "$content"},
+	}
+
+	data := map[string]string{"topic": "usrAbc", "content": "hello"}
+	msg, err := prepareMessage(push.ActMsg, "usrAbc", data, []string{"a"})
+	if err != nil {
+		tt.Fatal(err)
+	}
+	if n := msg.Android.Notification; n == nil || n.Body != "hello" || n.Tag != "usrAbc" || n.ClickAction.Type != 3 {
+		tt.Errorf("invalid notification %+v", n)
+	}
+
+	data["silent"] = "true"
+	if msg, _ = prepareMessage(push.ActMsg, "usrAbc", data, []string{"a"}); msg.Android.Notification != nil {
+		tt.Error("silent push must be data-only")
+	}
+	if msg, _ = prepareMessage(push.ActRead, "usrAbc", data, []string{"a"}); msg.Android.Urgency != "NORMAL" {
+		tt.Error("read notification must have normal priority", msg.Android.Urgency)
+	}
+}
@@ -19,6 +19,8 @@ const (
 	ActSub = "sub"
 	// Messages read: clear unread count.
 	ActRead = "read"
+	// Messages expired: remove them from the local cache.
+	ActExpire = "expire"
 )
 
 // MaxPayloadLength is the maximum length of push payload in multibyte characters.
@@ -34,6 +36,8 @@ type Recipient struct {
 	Unread int `json:"unread"`
 	// Indicates whether unread counter in the cache should be incremented before sending the push.
 	ShouldIncrementUnreadCountInCache bool `json:"-"`
+	// It's the user's quiet hours: only calls are pushed and they should not be intrusive.
+	Quiet bool `json:"quiet,omitempty"`
 }
 
 // Receipt is the push payload with a list of recipients.
@@ -91,6 +95,10 @@ type Payload struct {
 	AudioOnly bool `json:"aonly,omitempty"`
 	// Seq id the message is supposed to replace.
 	Replace string `json:"replace,omitempty"`
+	// Messenger the message was relayed from, e.g. "feishu". Empty for messages sent by Tinode clients.
+	Origin string `json:"origin,omitempty"`
+	// Number of messages summarized by this push, the payload is of the last one. 0 for a single message.
+	Digest int `json:"digest,omitempty"`
 
 	// Subscription change notification.
 
@@ -98,6 +106,18 @@ type Payload struct {
 	// ModeNone for both means the subscription is removed.
 	ModeWant  t.AccessMode `json:"want,omitempty"`
 	ModeGiven t.AccessMode `json:"given,omitempty"`
+
+	// Expired messages notification.
+
+	// Ranges of seq IDs of the expired messages.
+	DelSeq []SeqRange `json:"delseq,omitempty"`
+}
+
+// SeqRange is a range of message seq IDs, same as the {pres what="del"} delseq:
+// [Low, Hi), Hi is zero if the range contains a single ID.
+type SeqRange struct {
+	Low int `json:"low,omitempty"`
+	Hi  int `json:"hi,omitempty"`
 }
 
 // Handler is an interface which must be implemented by handlers.
@@ -109,7 +129,7 @@ type Handler interface {
 	IsReady() bool
 
 	// Push returns a channel that the server will use to send messages to.
-	// The message will be dropped if the channel blocks.
+	// If the channel blocks, the message is handled according to the backpressure policy.
 	Push() chan<- *Receipt
 
 	// Subscribe/unsubscribe device from FCM topic (channel).
@@ -119,9 +139,22 @@ type Handler interface {
 	Stop()
 }
 
+// Reloader is an optional interface implemented by handlers which can reload their
+// configuration at runtime, e.g. after it has changed in the database.
+type Reloader interface {
+	// Reload re-reads the configuration.
+	Reload() error
+}
+
 type configType struct {
-	Name   string          `json:"name"`
-	Config json.RawMessage `json:"config"`
+	Name string `json:"name"`
+	// What to do when the handler's queue is full: "drop" (default), "wait" or "dead_letter".
+	Backpressure string `json:"backpressure"`
+	// Milliseconds to wait for space in the queue under the "wait" policy.
+	WaitMs int `json:"wait_ms"`
+	// The maximum number of failed deliveries kept for inspection and replay.
+	DeadLetters int             `json:"dead_letters"`
+	Config      json.RawMessage `json:"config"`
 }
 
 var handlers map[string]Handler
@@ -139,6 +172,11 @@ func Register(name string, hnd Handler) {
 		panic("Register: called twice for handler " + name)
 	}
 	handlers[name] = hnd
+
+	if deliveries == nil {
+		deliveries = make(map[string]*delivery)
+	}
+	deliveries[name] = newDelivery(name)
 	fmt.Println("register: ", name)
 }
 
@@ -153,6 +191,9 @@ func Init(jsconfig json.RawMessage) ([]string, error) {
 	var enabled []string
 	for _, cc := range config {
 		if hnd := handlers[cc.Name]; hnd != nil {
+			if err := deliveries[cc.Name].configure(&cc); err != nil {
+				return nil, errors.New(cc.Name + ": " + err.Error())
+			}
 			if ok, err := hnd.Init(cc.Config); err != nil {
 				logs.Info.Println("Push handlers configured:", err)
 				return nil, err
@@ -171,16 +212,12 @@ func Push(msg *Receipt) {
 		return
 	}
 
-	for _, hnd := range handlers {
+	for name, hnd := range handlers {
 		if !hnd.IsReady() {
 			continue
 		}
 
-		// Push without delay or skip
-		select {
-		case hnd.Push() <- msg:
-		default:
-		}
+		deliveries[name].enqueue(hnd.Push(), msg)
 	}
 }
 
@@ -203,6 +240,22 @@ func ChannelSub(msg *ChannelReq) {
 	}
 }
 
+// Reload asks initialized handlers to reload their configuration if they support it.
+func Reload() error {
+	var firstErr error
+	for name, hnd := range handlers {
+		if rl, ok := hnd.(Reloader); ok && hnd.IsReady() {
+			if err := rl.Reload(); err != nil {
+				logs.Warn.Println("push: failed to reload handler", name, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+	return firstErr
+}
+
 // Stop all pushes
 func Stop() {
 	if handlers == nil {
@@ -0,0 +1,176 @@
+// Package pushtest provides utilities for testing push handlers: a stand-in for the API
+// of a push service which records received requests and responds as configured.
+package pushtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+// Main initializes logging and runs the tests of the package. Call it from TestMain.
+func Main(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	os.Exit(m.Run())
+}
+
+// Request is a request received by the server.
+type Request struct {
+	Method string
+	// URL path, e.g. /v1/messages:send.
+	Path   string
+	Header http.Header
+	// Parsed query and form parameters.
+	Form url.Values
+	Body []byte
+}
+
+// JSON decodes the body of the request into the value.
+func (r *Request) JSON(val any) error {
+	return json.Unmarshal(r.Body, val)
+}
+
+// HandlerFunc responds to a request with an HTTP status and a body which is sent as JSON unless it's
+// nil or []byte. It's called with the server locked, so it may use the state guarded by the server.
+type HandlerFunc func(req *Request) (int, any)
+
+// Server is a stand-in for the API of a push service.
+type Server struct {
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	handlers map[string]HandlerFunc
+	status   int
+	body     any
+	requests []*Request
+}
+
+// NewServer starts a server which responds with 200 and an empty body to all requests. It's closed
+// when the test ends.
+func NewServer(tt *testing.T) *Server {
+	s := newServer()
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serve))
+	tt.Cleanup(s.srv.Close)
+	return s
+}
+
+// NewTLSServer is the same as NewServer, but the server uses HTTPS. Use Client to make requests to it.
+func NewTLSServer(tt *testing.T) *Server {
+	s := newServer()
+	s.srv = httptest.NewTLSServer(http.HandlerFunc(s.serve))
+	tt.Cleanup(s.srv.Close)
+	return s
+}
+
+func newServer() *Server {
+	return &Server{handlers: make(map[string]HandlerFunc), status: http.StatusOK}
+}
+
+func (s *Server) serve(wrt http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ParseForm()
+	r := &Request{Method: req.Method, Path: req.URL.Path, Header: req.Header, Form: req.Form, Body: body}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = append(s.requests, r)
+	status, resp := s.status, s.body
+	if handler := s.handler(r.Path); handler != nil {
+		status, resp = handler(r)
+	}
+
+	switch resp := resp.(type) {
+	case nil:
+		wrt.WriteHeader(status)
+	case []byte:
+		wrt.WriteHeader(status)
+		wrt.Write(resp)
+	default:
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(status)
+		json.NewEncoder(wrt).Encode(resp)
+	}
+}
+
+// handler finds the handler for the path: the exact match or the longest matching subtree.
+func (s *Server) handler(path string) HandlerFunc {
+	if handler := s.handlers[path]; handler != nil {
+		return handler
+	}
+	var found string
+	for pattern := range s.handlers {
+		if strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern) && len(pattern) > len(found) {
+			found = pattern
+		}
+	}
+	return s.handlers[found]
+}
+
+// URL returns the base URL of the server.
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// Client returns an HTTP client which trusts the server.
+func (s *Server) Client() *http.Client {
+	return s.srv.Client()
+}
+
+// Handle sets the handler of requests with the given path. A path ending with a slash
+// matches all paths which start with it, unless there is a more specific handler.
+func (s *Server) Handle(path string, handler HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[path] = handler
+}
+
+// Respond sets the response to requests without a handler.
+func (s *Server) Respond(status int, body any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status, s.body = status, body
+}
+
+// Lock locks the server to access the state used by the handlers.
+func (s *Server) Lock() {
+	s.mu.Lock()
+}
+
+// Unlock unlocks the server.
+func (s *Server) Unlock() {
+	s.mu.Unlock()
+}
+
+// Requests returns the requests received so far.
+func (s *Server) Requests() []*Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Request(nil), s.requests...)
+}
+
+// Count returns the number of requests received so far with the given path, or all requests if the path is blank.
+func (s *Server) Count(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if path == "" {
+		return len(s.requests)
+	}
+	count := 0
+	for _, r := range s.requests {
+		if r.Path == path {
+			count++
+		}
+	}
+	return count
+}
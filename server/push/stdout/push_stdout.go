@@ -58,6 +58,7 @@ func (stdoutPush) Init(jsonconf json.RawMessage) (bool, error) {
 			select {
 			case msg := <-handler.input:
 				fmt.Printf("这个是正常信息%+v\n", msg)
+				push.Sent("stdout", 1)
 			case msg := <-handler.channel:
 				fmt.Printf("这个是订阅频道信息%+v\n", msg)
 			case <-handler.stop:
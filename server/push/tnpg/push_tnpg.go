@@ -217,18 +217,21 @@ func sendPushes(rcpt *push.Receipt, config *configType) {
 		resp, err := postMessage(handler.pushUrl, payloads, config)
 		if err != nil {
 			logs.Warn.Println("tnpg push request failed:", err)
+			push.Failed("tnpg", rcpt, err, uids[i:]...)
 			break
 		}
 		if resp.httpCode >= 300 {
 			logs.Warn.Println("tnpg push rejected:", resp.httpStatus)
+			push.Failed("tnpg", rcpt, errors.New(resp.httpStatus), uids[i:]...)
 			break
 		}
 		if resp.FatalCode != "" {
 			logs.Err.Println("tnpg push failed:", resp.FatalMessage)
+			push.Failed("tnpg", rcpt, errors.New(resp.FatalMessage), uids[i:]...)
 			break
 		}
 		// Check for expired tokens and other errors.
-		handlePushResponse(resp, messages[i:upper], uids[i:upper])
+		handlePushResponse(rcpt, resp, messages[i:upper], uids[i:upper])
 	}
 }
 
@@ -272,7 +275,8 @@ func processSubscription(req *push.ChannelReq, config *configType) {
 	handleSubResponse(resp, req, su.Devices, su.Channels)
 }
 
-func handlePushResponse(batch *batchResponse, messages []*fcmv1.Message, uids []types.Uid) {
+func handlePushResponse(rcpt *push.Receipt, batch *batchResponse, messages []*fcmv1.Message, uids []types.Uid) {
+	push.Sent("tnpg", batch.SuccessCount)
 	if batch.FailureCount <= 0 {
 		return
 	}
@@ -283,11 +287,13 @@ func handlePushResponse(batch *batchResponse, messages []*fcmv1.Message, uids []
 		case common.ErrorQuotaExceeded, common.ErrorUnavailable, common.ErrorInternal, common.ErrorUnspecified:
 			// Transient errors. Stop sending this batch.
 			logs.Warn.Println("tnpg transient failure:", resp.ErrorMessage)
+			push.Failed("tnpg", rcpt, errors.New(resp.ErrorCode), uids[i])
 			return
 		case common.ErrorInvalidArgument:
 			// Usually an invalid token.
 			logs.Warn.Println("tnpg invalid argument:", resp.ExtendedError, resp.ErrorMessage)
 			if strings.Contains(resp.ExtendedError, "message.token") {
+				push.InvalidToken("tnpg", 1)
 				if err := store.Devices.Delete(uids[i], messages[i].Token); err != nil {
 					logs.Warn.Println("tnpg failed to delete invalid token:", err)
 				}
@@ -295,15 +301,18 @@ func handlePushResponse(batch *batchResponse, messages []*fcmv1.Message, uids []
 		case common.ErrorSenderIDMismatch, common.ErrorThirdPartyAuth:
 			// Config errors
 			logs.Warn.Println("tnpg invalid config:", resp.ExtendedError, resp.ErrorMessage)
+			push.Failed("tnpg", rcpt, errors.New(resp.ErrorCode), uids[i])
 			return
 		case common.ErrorUnregistered:
 			// Token is no longer valid.
 			logs.Info.Println("tnpg invalid token:", resp.ErrorMessage, resp.ExtendedError, resp.MessageID)
+			push.InvalidToken("tnpg", 1)
 			if err := store.Devices.Delete(uids[i], messages[i].Token); err != nil {
 				logs.Warn.Println("tnpg failed to delete invalid token:", err)
 			}
 		default:
 			logs.Warn.Println("tnpg unrecognized error:", resp.ErrorCode, resp.ErrorMessage, resp.ExtendedError, resp.Code)
+			push.Failed("tnpg", rcpt, errors.New(resp.ErrorCode), uids[i])
 		}
 	}
 }
@@ -0,0 +1,413 @@
+// Package webhook implements push notification plugin which POSTs notifications as JSON to
+// configured URLs, e.g. to feed them into WeCom, DingTalk or a pager.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Size of the input channel buffer.
+	defaultBuffer = 1024
+	// Number of concurrent deliveries.
+	defaultWorkers = 4
+	// HTTP request timeout in seconds.
+	defaultTimeout = 10
+	// Total number of attempts to deliver a notification.
+	defaultMaxAttempts = 6
+	// Delay before the first retry in seconds, doubles after each attempt.
+	defaultRetryMin = 5
+	// Maximum delay between retries in seconds.
+	defaultRetryMax = 3600
+	// Maximum number of notifications waiting to be retried.
+	defaultQueueSize = 10000
+
+	// How often the retry queue is checked for due notifications.
+	retryCheckInterval = time.Second
+
+	// Request headers.
+
+	// HMAC-SHA256 of the timestamp, a dot and the request body, keyed by the endpoint secret: "sha256=<hex>".
+	SignatureHeader = "X-Tinode-Signature"
+	// Unix time in seconds when the request was signed.
+	TimestampHeader = "X-Tinode-Timestamp"
+	// Payload.What of the notification.
+	EventHeader = "X-Tinode-Event"
+	// Unique ID of the notification, the same for all attempts to deliver it.
+	DeliveryHeader = "X-Tinode-Delivery"
+)
+
+var handler Handler
+
+// Handler posts push notifications to webhooks.
+type Handler struct {
+	input   chan *push.Receipt
+	channel chan *push.ChannelReq
+	stop    chan bool
+
+	config *configType
+	// Endpoints by URL.
+	endpoints  map[string]*endpointConfig
+	httpClient *http.Client
+
+	// Notifications ready to be sent.
+	deliveries chan *delivery
+	// Notifications waiting to be retried.
+	queue *retryQueue
+}
+
+// Sequence number for generating delivery IDs.
+var deliverySeq atomic.Uint64
+
+type endpointConfig struct {
+	URL string `json:"url"`
+	// Key for signing requests. Requests are not signed if blank.
+	Secret string `json:"secret"`
+	// Payload.What values to post to this endpoint, e.g. ["msg", "sub"]. All if empty.
+	What []string `json:"what"`
+	// Additional request headers, e.g. authorization.
+	Headers map[string]string `json:"headers"`
+
+	what map[string]bool
+}
+
+type configType struct {
+	Enabled   bool              `json:"enabled"`
+	Endpoints []*endpointConfig `json:"endpoints"`
+	Buffer    int               `json:"buffer"`
+	Workers   int               `json:"workers"`
+	// HTTP request timeout in seconds.
+	Timeout int `json:"timeout"`
+	// Total number of attempts to deliver a notification.
+	MaxAttempts int `json:"max_attempts"`
+	// Delay before the first retry in seconds, doubles after each attempt up to RetryMax.
+	RetryMin int `json:"retry_min"`
+	RetryMax int `json:"retry_max"`
+	// Directory where notifications waiting to be retried are saved, so they survive a restart.
+	// Notifications are kept in memory only if blank.
+	QueueDir string `json:"queue_dir"`
+	// Maximum number of notifications waiting to be retried. The oldest ones are dropped.
+	QueueSize int `json:"queue_size"`
+}
+
+// message is the body of the request. Recipients are keyed by user ID 'usrXXX'.
+type message struct {
+	To      map[string]push.Recipient `json:"to"`
+	Channel string                    `json:"channel,omitempty"`
+	Payload *push.Payload             `json:"payload"`
+}
+
+// delivery is a notification to be posted to one endpoint.
+type delivery struct {
+	Id       string          `json:"id"`
+	URL      string          `json:"url"`
+	What     string          `json:"what"`
+	Body     json.RawMessage `json:"body"`
+	Attempts int             `json:"attempts"`
+	// Time of the next attempt.
+	NextAt time.Time `json:"next_at"`
+}
+
+// errPermanent indicates that the delivery must not be retried.
+type errPermanent struct {
+	error
+}
+
+// Init initializes the handler.
+func (Handler) Init(jsonconf json.RawMessage) (bool, error) {
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return false, errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return false, nil
+	}
+
+	if len(config.Endpoints) == 0 {
+		return false, errors.New("no endpoints configured")
+	}
+	endpoints := make(map[string]*endpointConfig, len(config.Endpoints))
+	for _, ep := range config.Endpoints {
+		if ep.URL == "" {
+			return false, errors.New("endpoint URL is missing")
+		}
+		if _, dup := endpoints[ep.URL]; dup {
+			return false, errors.New("duplicate endpoint " + ep.URL)
+		}
+		if len(ep.What) > 0 {
+			ep.what = make(map[string]bool, len(ep.What))
+			for _, what := range ep.What {
+				ep.what[what] = true
+			}
+		}
+		endpoints[ep.URL] = ep
+	}
+
+	if config.Buffer <= 0 {
+		config.Buffer = defaultBuffer
+	}
+	if config.Workers <= 0 {
+		config.Workers = defaultWorkers
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultMaxAttempts
+	}
+	if config.RetryMin <= 0 {
+		config.RetryMin = defaultRetryMin
+	}
+	if config.RetryMax < config.RetryMin {
+		config.RetryMax = defaultRetryMax
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultQueueSize
+	}
+
+	queue, err := newRetryQueue(config.QueueDir, config.QueueSize)
+	if err != nil {
+		return false, err
+	}
+	// Notifications saved before restart may be addressed to endpoints which are no longer configured.
+	for _, d := range append([]*delivery(nil), queue.pending...) {
+		if endpoints[d.URL] == nil {
+			logs.Warn.Println("webhook push: endpoint removed, dropping notification", d.Id, d.URL)
+			queue.remove(d)
+		}
+	}
+
+	handler.config = &config
+	handler.endpoints = endpoints
+	handler.httpClient = &http.Client{Timeout: time.Duration(config.Timeout) * time.Second}
+	handler.queue = queue
+	handler.input = make(chan *push.Receipt, config.Buffer)
+	handler.channel = make(chan *push.ChannelReq, config.Buffer)
+	handler.deliveries = make(chan *delivery, config.Buffer)
+	handler.stop = make(chan bool)
+
+	for i := 0; i < config.Workers; i++ {
+		go worker()
+	}
+	go processMessages()
+
+	return true, nil
+}
+
+// processMessages converts receipts to deliveries and re-sends due notifications from the retry queue.
+func processMessages() {
+	ticker := time.NewTicker(retryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case rcpt := <-handler.input:
+			for _, d := range newDeliveries(rcpt) {
+				dispatch(d)
+			}
+		case <-handler.channel:
+			// Webhooks have no channels.
+		case now := <-ticker.C:
+			for _, d := range handler.queue.due(now) {
+				dispatch(d)
+			}
+		case <-handler.stop:
+			return
+		}
+	}
+}
+
+// dispatch passes the delivery to workers or queues it if the workers are busy.
+func dispatch(d *delivery) {
+	select {
+	case handler.deliveries <- d:
+	default:
+		d.NextAt = time.Now().Add(retryCheckInterval)
+		handler.queue.put(d)
+	}
+}
+
+// newDeliveries creates a delivery of the receipt for each endpoint which accepts it.
+func newDeliveries(rcpt *push.Receipt) []*delivery {
+	msg := message{
+		To:      make(map[string]push.Recipient, len(rcpt.To)),
+		Channel: rcpt.Channel,
+		Payload: &rcpt.Payload,
+	}
+	for uid, to := range rcpt.To {
+		msg.To[uid.UserId()] = to
+	}
+	body, err := json.Marshal(&msg)
+	if err != nil {
+		logs.Warn.Println("webhook push: failed to serialize receipt", err)
+		return nil
+	}
+
+	id := strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatUint(deliverySeq.Add(1), 36)
+	var deliveries []*delivery
+	for i, ep := range handler.config.Endpoints {
+		if ep.what != nil && !ep.what[rcpt.Payload.What] {
+			continue
+		}
+		deliveries = append(deliveries, &delivery{
+			Id:   id + "-" + strconv.Itoa(i),
+			URL:  ep.URL,
+			What: rcpt.Payload.What,
+			Body: body,
+		})
+	}
+	return deliveries
+}
+
+// receipt restores the receipt from the body of the notification.
+func (d *delivery) receipt() *push.Receipt {
+	var msg message
+	if err := json.Unmarshal(d.Body, &msg); err != nil || msg.Payload == nil {
+		return &push.Receipt{}
+	}
+	rcpt := &push.Receipt{
+		To:      make(map[t.Uid]push.Recipient, len(msg.To)),
+		Channel: msg.Channel,
+		Payload: *msg.Payload,
+	}
+	for user, to := range msg.To {
+		if uid := t.ParseUserId(user); !uid.IsZero() {
+			rcpt.To[uid] = to
+		}
+	}
+	return rcpt
+}
+
+// worker posts notifications and schedules retries of failed ones.
+func worker() {
+	for {
+		select {
+		case d := <-handler.deliveries:
+			deliver(d)
+		case <-handler.stop:
+			return
+		}
+	}
+}
+
+// deliver makes one attempt to post the notification.
+func deliver(d *delivery) {
+	ep := handler.endpoints[d.URL]
+	d.Attempts++
+	err := post(ep, d, time.Now())
+	if err == nil {
+		push.Sent("webhook", 1)
+		handler.queue.remove(d)
+		return
+	}
+
+	var perm errPermanent
+	if errors.As(err, &perm) || d.Attempts >= handler.config.MaxAttempts {
+		logs.Warn.Println("webhook push: dropping notification", d.Id, d.URL, "after", d.Attempts, "attempts:", err)
+		push.Failed("webhook", d.receipt(), err)
+		handler.queue.remove(d)
+		return
+	}
+
+	d.NextAt = time.Now().Add(retryDelay(d.Attempts))
+	logs.Info.Println("webhook push: failed to post notification", d.Id, d.URL, err, "retry at", d.NextAt)
+	handler.queue.put(d)
+}
+
+// retryDelay is the delay before the next attempt after the given number of attempts.
+func retryDelay(attempts int) time.Duration {
+	delay := time.Duration(handler.config.RetryMin) * time.Second << (attempts - 1)
+	if limit := time.Duration(handler.config.RetryMax) * time.Second; delay > limit || delay <= 0 {
+		delay = limit
+	}
+	return delay
+}
+
+// Sign computes the signature of the request body. Receivers should compare it with the
+// SignatureHeader and reject requests with stale TimestampHeader.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post sends the notification to the endpoint.
+func post(ep *endpointConfig, d *delivery, now time.Time) error {
+	req, err := http.NewRequest(http.MethodPost, ep.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return errPermanent{err}
+	}
+	for name, value := range ep.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set(EventHeader, d.What)
+	req.Header.Set(DeliveryHeader, d.Id)
+	if ep.Secret != "" {
+		ts := now.Unix()
+		req.Header.Set(TimestampHeader, strconv.FormatInt(ts, 10))
+		req.Header.Set(SignatureHeader, Sign(ep.Secret, ts, d.Body))
+	}
+
+	resp, err := handler.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode >= 500:
+		return fmt.Errorf("http status %s", resp.Status)
+	default:
+		// The endpoint rejected the notification, it won't accept it next time either.
+		return errPermanent{fmt.Errorf("http status %s", resp.Status)}
+	}
+}
+
+// IsReady checks if the handler is initialized.
+func (Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Channel returns a channel that caller can use to subscribe/unsubscribe devices to channels (FCM topics).
+// Webhooks have no channels, requests are discarded.
+func (Handler) Channel() chan<- *push.ChannelReq {
+	return handler.channel
+}
+
+// Stop terminates the handler's workers. Notifications waiting to be retried remain in the queue directory.
+func (Handler) Stop() {
+	close(handler.stop)
+}
+
+func init() {
+	push.Register("webhook", &handler)
+}
@@ -0,0 +1,157 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/pushtest"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// setupHandler initializes the handler to post to the given endpoints without starting workers.
+func setupHandler(tt *testing.T, queueDir string, endpoints ...*endpointConfig) {
+	handler.config = &configType{Endpoints: endpoints, MaxAttempts: 3, RetryMin: 1, RetryMax: 2, QueueSize: 10}
+	handler.endpoints = make(map[string]*endpointConfig)
+	for _, ep := range endpoints {
+		handler.endpoints[ep.URL] = ep
+	}
+	handler.httpClient = &http.Client{Timeout: time.Second}
+	queue, err := newRetryQueue(queueDir, handler.config.QueueSize)
+	if err != nil {
+		tt.Fatal(err)
+	}
+	handler.queue = queue
+}
+
+func TestMain(m *testing.M) {
+	pushtest.Main(m)
+}
+
+func TestNewDeliveries(tt *testing.T) {
+	setupHandler(tt, "",
+		&endpointConfig{URL: "http://all"},
+		&endpointConfig{URL: "http://sub", what: map[string]bool{push.ActSub: true}})
+
+	rcpt := &push.Receipt{
+		To:      map[t.Uid]push.Recipient{t.Uid(1): {Unread: 3}},
+		Payload: push.Payload{What: push.ActMsg, Topic: "grpAbc"},
+	}
+	deliveries := newDeliveries(rcpt)
+	if len(deliveries) != 1 || deliveries[0].URL != "http://all" {
+		tt.Fatal("expected a single delivery to the endpoint without filter, got", len(deliveries))
+	}
+
+	var msg message
+	if err := json.Unmarshal(deliveries[0].Body, &msg); err != nil {
+		tt.Fatal(err)
+	}
+	if msg.To[t.Uid(1).UserId()].Unread != 3 || msg.Payload.Topic != "grpAbc" {
+		tt.Errorf("unexpected body %s", deliveries[0].Body)
+	}
+
+	rcpt.Payload.What = push.ActSub
+	if deliveries = newDeliveries(rcpt); len(deliveries) != 2 || deliveries[0].Id == deliveries[1].Id {
+		tt.Error("expected two deliveries with distinct IDs")
+	}
+}
+
+func TestSignedPost(tt *testing.T) {
+	srv := pushtest.NewServer(tt)
+	ep := &endpointConfig{URL: srv.URL(), Secret: "s3cr3t", Headers: map[string]string{"Authorization": "Bearer abc"}}
+	setupHandler(tt, "", ep)
+
+	d := &delivery{Id: "abc-1", URL: ep.URL, What: push.ActMsg, Body: []byte(`{"payload":{}}`)}
+	deliver(d)
+	if srv.Count("") != 1 || handler.queue.pending != nil {
+		tt.Fatal("expected a single successful request")
+	}
+
+	req := srv.Requests()[0]
+	ts, _ := strconv.ParseInt(req.Header.Get(TimestampHeader), 10, 64)
+	if sig := req.Header.Get(SignatureHeader); sig == "" || sig != Sign(ep.Secret, ts, req.Body) {
+		tt.Errorf("invalid signature '%s'", sig)
+	}
+	if req.Header.Get(EventHeader) != push.ActMsg || req.Header.Get(DeliveryHeader) != d.Id {
+		tt.Error("event or delivery headers are missing")
+	}
+	if req.Header.Get("Authorization") != "Bearer abc" {
+		tt.Error("custom header is missing")
+	}
+}
+
+func TestRetry(tt *testing.T) {
+	srv := pushtest.NewServer(tt)
+	dir := tt.TempDir()
+	setupHandler(tt, dir, &endpointConfig{URL: srv.URL()})
+
+	srv.Respond(http.StatusServiceUnavailable, nil)
+	d := &delivery{Id: "abc-1", URL: srv.URL(), What: push.ActMsg, Body: []byte(`{}`)}
+	deliver(d)
+	if len(handler.queue.due(time.Now())) != 0 {
+		tt.Error("notification must not be retried before the delay")
+	}
+
+	// The queue survives restart.
+	queue, err := newRetryQueue(dir, 10)
+	if err != nil {
+		tt.Fatal(err)
+	}
+	if len(queue.pending) != 1 || queue.pending[0].Attempts != 1 {
+		tt.Fatal("failed notification is not saved")
+	}
+
+	ready := handler.queue.due(time.Now().Add(time.Second))
+	if len(ready) != 1 {
+		tt.Fatal("notification is not due after the delay")
+	}
+	srv.Respond(http.StatusOK, nil)
+	deliver(ready[0])
+	if len(handler.queue.known) != 0 {
+		tt.Error("delivered notification must be removed from the queue")
+	}
+	if queue, _ = newRetryQueue(dir, 10); len(queue.pending) != 0 {
+		tt.Error("delivered notification must be removed from the directory")
+	}
+}
+
+func TestNoRetry(tt *testing.T) {
+	srv := pushtest.NewServer(tt)
+	setupHandler(tt, "", &endpointConfig{URL: srv.URL()})
+
+	// Rejected notifications are not retried.
+	srv.Respond(http.StatusBadRequest, nil)
+	deliver(&delivery{Id: "abc-1", URL: srv.URL(), Body: []byte(`{}`)})
+	if len(handler.queue.known) != 0 {
+		tt.Error("rejected notification must not be retried")
+	}
+
+	// Give up after the last attempt.
+	srv.Respond(http.StatusInternalServerError, nil)
+	d := &delivery{Id: "abc-2", URL: srv.URL(), Body: []byte(`{}`)}
+	for i := 0; i < handler.config.MaxAttempts; i++ {
+		handler.queue.due(time.Now().Add(time.Hour))
+		deliver(d)
+	}
+	if srv.Count("") != 1+handler.config.MaxAttempts || len(handler.queue.known) != 0 {
+		tt.Error("notification must be dropped after the last attempt", srv.Count(""))
+	}
+}
+
+func TestQueueSize(tt *testing.T) {
+	dir := tt.TempDir()
+	queue, _ := newRetryQueue(dir, 2)
+	for i := 1; i <= 3; i++ {
+		queue.put(&delivery{Id: "abc-" + strconv.Itoa(i), URL: "http://test", Body: []byte(`{}`)})
+	}
+	if len(queue.pending) != 2 || queue.pending[0].Id != "abc-2" {
+		tt.Error("the oldest notification must be dropped")
+	}
+	if _, err := os.Stat(queue.fileName("abc-1")); !os.IsNotExist(err) {
+		tt.Error("file of the dropped notification must be deleted")
+	}
+}
@@ -0,0 +1,157 @@
+package webhook
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+)
+
+// retryQueue holds notifications waiting to be retried. If the directory is set, each notification
+// is also saved there as a file, so it survives a restart.
+type retryQueue struct {
+	mu  sync.Mutex
+	dir string
+	// Maximum number of notifications in the queue.
+	size int
+	// Notifications waiting for the next attempt, oldest first.
+	pending []*delivery
+	// Notifications in the queue or being retried, by ID.
+	known map[string]*delivery
+}
+
+// newRetryQueue creates the queue and loads notifications saved in the directory.
+func newRetryQueue(dir string, size int) (*retryQueue, error) {
+	q := &retryQueue{dir: dir, size: size, known: make(map[string]*delivery)}
+	if dir == "" {
+		return q, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var d delivery
+		if err := json.Unmarshal(data, &d); err != nil || q.fileName(d.Id) != name {
+			logs.Warn.Println("webhook push: invalid queue file", name, err)
+			os.Remove(name)
+			continue
+		}
+		q.pending = append(q.pending, &d)
+		q.known[d.Id] = &d
+	}
+	// IDs start with the creation time.
+	sort.Slice(q.pending, func(i, j int) bool {
+		return q.pending[i].Id < q.pending[j].Id
+	})
+	for len(q.pending) > q.size {
+		q.drop()
+	}
+	if len(q.pending) > 0 {
+		logs.Info.Println("webhook push: loaded", len(q.pending), "notifications to retry")
+	}
+	return q, nil
+}
+
+func (q *retryQueue) fileName(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+// put adds the notification to the queue or updates it, if it's already queued. The oldest
+// notification is dropped if the queue is full.
+func (q *retryQueue) put(d *delivery) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.known[d.Id]; !ok && len(q.known) >= q.size {
+		q.drop()
+	}
+	q.known[d.Id] = d
+	q.pending = append(q.pending, d)
+
+	if q.dir != "" {
+		// Ids and bodies are generated by the handler, marshaling cannot fail.
+		data, _ := json.Marshal(d)
+		if err := os.WriteFile(q.fileName(d.Id), data, 0600); err != nil {
+			logs.Warn.Println("webhook push: failed to save notification", d.Id, err)
+		}
+	}
+}
+
+// drop removes the oldest notification from the queue. The lock must be held.
+func (q *retryQueue) drop() {
+	var d *delivery
+	if len(q.pending) > 0 {
+		d = q.pending[0]
+		q.pending[0] = nil
+		q.pending = q.pending[1:]
+	} else {
+		// All queued notifications are being retried now, drop any.
+		for _, d = range q.known {
+			break
+		}
+	}
+	logs.Warn.Println("webhook push: queue is full, dropping notification", d.Id, d.URL)
+	push.Failed("webhook", d.receipt(), push.ErrQueueFull)
+	q.forget(d.Id)
+}
+
+// forget deletes the notification from the index and the directory. The lock must be held.
+func (q *retryQueue) forget(id string) {
+	delete(q.known, id)
+	if q.dir != "" {
+		if err := os.Remove(q.fileName(id)); err != nil && !os.IsNotExist(err) {
+			logs.Warn.Println("webhook push: failed to delete notification", id, err)
+		}
+	}
+}
+
+// remove deletes the delivered or failed notification from the queue.
+func (q *retryQueue) remove(d *delivery) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.known[d.Id]; !ok {
+		return
+	}
+	for i, p := range q.pending {
+		if p == d {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			break
+		}
+	}
+	q.forget(d.Id)
+}
+
+// due takes notifications ready to be retried out of the pending list. They stay in the index and
+// the directory until removed.
+func (q *retryQueue) due(now time.Time) []*delivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var ready []*delivery
+	pending := q.pending[:0]
+	for _, d := range q.pending {
+		if d.NextAt.After(now) {
+			pending = append(pending, d)
+		} else {
+			ready = append(ready, d)
+		}
+	}
+	clear(q.pending[len(pending):])
+	q.pending = pending
+	return ready
+}
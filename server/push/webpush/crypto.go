@@ -0,0 +1,238 @@
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Size of the salt of the encrypted content.
+	saltLength = 16
+	// Size of the record of the encrypted content. The entire payload is a single record.
+	recordSize = 4096
+	// Overhead of AES-GCM authentication tag.
+	gcmTagLength = 16
+	// Size of the header of the encrypted content: salt, record size, key ID length and the key ID.
+	headerLength = saltLength + 4 + 1 + 65
+
+	// MaxPayloadSize is the maximum size of unencrypted payload which fits into a single record.
+	MaxPayloadSize = recordSize - headerLength - gcmTagLength - 1
+
+	// Lifetime of VAPID tokens. Push services reject tokens valid for longer than 24 hours.
+	vapidTokenLifetime = 12 * time.Hour
+)
+
+// Subscription is the browser's PushSubscription as returned by PushSubscription.toJSON().
+type Subscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		// User agent's P-256 public key, base64url-encoded uncompressed point.
+		P256dh string `json:"p256dh"`
+		// User agent's authentication secret, base64url-encoded.
+		Auth string `json:"auth"`
+	} `json:"keys"`
+}
+
+// subscriber is the parsed subscription.
+type subscriber struct {
+	endpoint  *url.URL
+	publicKey *ecdh.PublicKey
+	// Raw public key, uncompressed point.
+	publicKeyBytes []byte
+	authSecret     []byte
+}
+
+// isPublicIP checks if the address is routable on the Internet, i.e. it's not a loopback, private,
+// link-local or otherwise special address. A variable to allow local servers in tests.
+var isPublicIP = func(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// decodeBase64 decodes base64url with or without padding as produced by browsers.
+func decodeBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// ParseSubscription parses device ID of a Web Push device, i.e. JSON-serialized PushSubscription.
+func ParseSubscription(deviceId string) (*Subscription, error) {
+	var sub Subscription
+	if err := json.Unmarshal([]byte(deviceId), &sub); err != nil {
+		return nil, err
+	}
+	if _, err := sub.parse(); err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+func (sub *Subscription) parse() (*subscriber, error) {
+	endpoint, err := url.Parse(sub.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "https" || endpoint.Hostname() == "" {
+		return nil, errors.New("invalid push endpoint")
+	}
+	// The endpoint is provided by the client: make sure it cannot be used to reach the internal network.
+	// Host names are checked again when connecting.
+	host := strings.ToLower(strings.TrimSuffix(endpoint.Hostname(), "."))
+	if ip := net.ParseIP(host); ip != nil && !isPublicIP(ip) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return nil, errors.New("push endpoint is not public")
+	}
+
+	var s subscriber
+	s.endpoint = endpoint
+	if s.publicKeyBytes, err = decodeBase64(sub.Keys.P256dh); err != nil {
+		return nil, errors.New("invalid p256dh key")
+	}
+	if s.publicKey, err = ecdh.P256().NewPublicKey(s.publicKeyBytes); err != nil {
+		return nil, errors.New("invalid p256dh key")
+	}
+	if s.authSecret, err = decodeBase64(sub.Keys.Auth); err != nil || len(s.authSecret) == 0 {
+		return nil, errors.New("invalid auth secret")
+	}
+	return &s, nil
+}
+
+// encrypt encrypts the payload for the subscriber as described in RFC 8291 using the aes128gcm
+// content coding of RFC 8188.
+func encrypt(sub *subscriber, payload []byte) ([]byte, error) {
+	if len(payload) > MaxPayloadSize {
+		return nil, errors.New("payload is too large")
+	}
+
+	// Ephemeral application server key.
+	asKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return encryptWith(sub, payload, asKey, salt)
+}
+
+// encryptWith encrypts the payload using the given application server key and salt.
+func encryptWith(sub *subscriber, payload []byte, asKey *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	asPublic := asKey.PublicKey().Bytes()
+	ecdhSecret, err := asKey.ECDH(sub.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// IKM = HKDF(auth_secret, ecdh_secret, "WebPush: info" || 0x00 || ua_public || as_public, 32).
+	keyInfo := append([]byte("WebPush: info\x00"), sub.publicKeyBytes...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm, err := hkdf.Key(sha256.New, ecdhSecret, sub.authSecret, string(keyInfo), 32)
+	if err != nil {
+		return nil, err
+	}
+
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Header: salt || record size || key ID length || key ID (application server public key).
+	body := make([]byte, 0, headerLength+len(payload)+1+gcmTagLength)
+	body = append(body, salt...)
+	body = binary.BigEndian.AppendUint32(body, recordSize)
+	body = append(body, byte(len(asPublic)))
+	body = append(body, asPublic...)
+
+	// The single record is the last one: the plaintext is followed by the 0x02 delimiter.
+	plaintext := append(append(make([]byte, 0, len(payload)+1), payload...), 2)
+	return gcm.Seal(body, nonce, plaintext, nil), nil
+}
+
+// vapidKey is the application server key used to identify the server to push services, RFC 8292.
+type vapidKey struct {
+	private *ecdsa.PrivateKey
+	// Public key as base64url-encoded uncompressed point.
+	public string
+}
+
+// parseVapidKey parses the private key given as base64url-encoded 32 byte scalar.
+func parseVapidKey(privateKey string) (*vapidKey, error) {
+	raw, err := decodeBase64(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	// Validate the scalar and compute the public key.
+	key, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	pub := key.PublicKey().Bytes()
+	curve := elliptic.P256()
+	private := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(pub[1:33]),
+			Y:     new(big.Int).SetBytes(pub[33:]),
+		},
+		D: new(big.Int).SetBytes(raw),
+	}
+	return &vapidKey{private: private, public: base64.RawURLEncoding.EncodeToString(pub)}, nil
+}
+
+// authorization returns the value of Authorization header for the push service at the endpoint:
+// ES256 JWT with the push service origin as the audience.
+func (vk *vapidKey) authorization(endpoint *url.URL, subject string, now time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]any{
+		"aud": endpoint.Scheme + "://" + endpoint.Host,
+		"exp": now.Add(vapidTokenLifetime).Unix(),
+		"sub": subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, vk.private, hash[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS signature is R || S, each padded to 32 bytes.
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return "vapid t=" + unsigned + "." + base64.RawURLEncoding.EncodeToString(sig) + ", k=" + vk.public, nil
+}
@@ -0,0 +1,278 @@
+// Package webpush implements push notification plugin which delivers notifications to browsers
+// using the Web Push protocol (RFC 8030) with VAPID (RFC 8292) and payload encryption (RFC 8291).
+package webpush
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/common"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Size of the input channel buffer.
+	bufferSize = 1024
+	// Time in seconds the push service keeps an undelivered notification.
+	defaultTimeToLive = 3600
+	// Time to live of a call notification in seconds: the call is over by then.
+	callTimeToLive = 30
+)
+
+var handler Handler
+
+// Handler sends push notifications to browsers.
+type Handler struct {
+	input      chan *push.Receipt
+	channel    chan *push.ChannelReq
+	stop       chan bool
+	config     *configType
+	vapid      *vapidKey
+	httpClient *http.Client
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// VAPID private key: base64url-encoded 32 byte P-256 scalar.
+	VapidPrivateKey string `json:"vapid_private_key"`
+	// Contact of the server operator for push services, "mailto:" or "https:" URL.
+	Subject string `json:"subject"`
+	// Time in seconds the push service keeps an undelivered notification.
+	TimeToLive int `json:"time_to_live"`
+}
+
+// Init initializes the handler.
+func (Handler) Init(jsonconf json.RawMessage) (bool, error) {
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return false, errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return false, nil
+	}
+
+	vapid, err := parseVapidKey(config.VapidPrivateKey)
+	if err != nil {
+		return false, errors.New("invalid VAPID private key: " + err.Error())
+	}
+	if config.Subject == "" {
+		return false, errors.New("subject is missing")
+	}
+	if config.TimeToLive <= 0 {
+		config.TimeToLive = defaultTimeToLive
+	}
+
+	handler.config = &config
+	handler.vapid = vapid
+	handler.httpClient = newHTTPClient()
+	handler.input = make(chan *push.Receipt, bufferSize)
+	handler.channel = make(chan *push.ChannelReq, bufferSize)
+	handler.stop = make(chan bool, 1)
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				go sendPushes(rcpt)
+			case <-handler.channel:
+				// Web Push has no channels.
+			case <-handler.stop:
+				return
+			}
+		}
+	}()
+
+	return true, nil
+}
+
+// newHTTPClient creates a client which connects to public addresses only and does not follow redirects:
+// push endpoints are provided by clients and must not be used to reach the internal network.
+func newHTTPClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return errors.New("push endpoint is not public: " + host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// PublicKey returns the VAPID public key which browsers need to subscribe to pushes
+// (applicationServerKey), or an empty string if the handler is disabled.
+func PublicKey() string {
+	if handler.vapid == nil {
+		return ""
+	}
+	return handler.vapid.public
+}
+
+// sendPushes sends the receipt to Web Push subscriptions of all recipients.
+func sendPushes(rcpt *push.Receipt) {
+	if len(rcpt.To) == 0 {
+		return
+	}
+
+	data, err := common.PayloadToData(&rcpt.Payload)
+	if err != nil {
+		logs.Warn.Println("webpush: could not parse payload:", err)
+		return
+	}
+
+	uids := make([]t.Uid, 0, len(rcpt.To))
+	// Devices which were online and received the message.
+	skipDevices := make(map[string]struct{})
+	for uid, to := range rcpt.To {
+		uids = append(uids, uid)
+		for _, deviceID := range to.Devices {
+			skipDevices[deviceID] = struct{}{}
+		}
+	}
+	devices, _, err := store.Devices.GetAll(uids...)
+	if err != nil {
+		logs.Warn.Println("webpush: db error", err)
+		return
+	}
+
+	ttl, urgency := handler.config.TimeToLive, "normal"
+	if rcpt.Payload.Webrtc != "" {
+		ttl, urgency = callTimeToLive, "high"
+	} else if rcpt.Payload.What != push.ActMsg {
+		urgency = "low"
+	}
+
+	for uid, devList := range devices {
+		userData := common.ClonePayload(data)
+		// Fix topic name for P2P pushes.
+		if t.GetTopicCat(rcpt.Payload.Topic) == t.TopicCatP2P {
+			userData["topic"], _ = t.P2PNameForUser(uid, rcpt.Payload.Topic)
+		}
+		// Silence the push for user who have received the data interactively.
+		if rcpt.To[uid].Delivered > 0 {
+			userData["silent"] = "true"
+		}
+		payload, err := json.Marshal(userData)
+		if err != nil {
+			logs.Warn.Println("webpush: failed to serialize payload:", err)
+			continue
+		}
+
+		for i := range devList {
+			d := &devList[i]
+			if _, skip := skipDevices[d.DeviceId]; skip || d.Platform != t.PlatformWebPush {
+				continue
+			}
+			gone, err := send(d.DeviceId, payload, ttl, urgency)
+			if gone {
+				// The browser has unsubscribed.
+				push.InvalidToken("webpush", 1)
+				if err := store.Devices.Delete(uid, d.DeviceId); err != nil {
+					logs.Warn.Println("webpush: failed to delete expired subscription:", err)
+				}
+			} else if err != nil {
+				logs.Warn.Println("webpush: failed to send push", uid.UserId(), err)
+				push.Failed("webpush", rcpt, err, uid)
+			} else {
+				push.Sent("webpush", 1)
+			}
+		}
+	}
+}
+
+// send posts the payload to the subscription. Returns true if the subscription has expired.
+func send(deviceId string, payload []byte, ttl int, urgency string) (bool, error) {
+	var sub Subscription
+	if err := json.Unmarshal([]byte(deviceId), &sub); err != nil {
+		return true, err
+	}
+	s, err := sub.parse()
+	if err != nil {
+		return true, err
+	}
+
+	body, err := encrypt(s, payload)
+	if err != nil {
+		return false, err
+	}
+	vapid, err := handler.vapid.authorization(s.endpoint, handler.config.Subject, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(ttl))
+	req.Header.Set("Urgency", urgency)
+	req.Header.Set("Authorization", vapid)
+
+	resp, err := handler.httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusAccepted:
+		return false, nil
+	case http.StatusNotFound, http.StatusGone:
+		return true, errors.New("subscription expired")
+	default:
+		return false, errors.New("push service responded with " + resp.Status)
+	}
+}
+
+// IsReady checks if the handler is initialized.
+func (Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Channel returns a channel that caller can use to subscribe/unsubscribe devices to channels (FCM topics).
+// Web Push has no channels, requests are discarded.
+func (Handler) Channel() chan<- *push.ChannelReq {
+	return handler.channel
+}
+
+// Stop terminates the handler's worker and stops sending pushes.
+func (Handler) Stop() {
+	handler.stop <- true
+}
+
+func init() {
+	push.Register("webpush", &handler)
+}
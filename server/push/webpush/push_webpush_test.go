@@ -0,0 +1,270 @@
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/push/pushtest"
+)
+
+func b64(s string) []byte {
+	b, _ := decodeBase64(s)
+	return b
+}
+
+// Test vector from RFC 8291, Appendix A.
+func TestEncryptRFC8291(tt *testing.T) {
+	sub := &Subscription{Endpoint: "https://push.example.net/push/JzLQ3raZJfFBR0aqvOMsLrt54w4rJUsV"}
+	sub.Keys.P256dh = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	sub.Keys.Auth = "BTBZMqHH6r4Tts7J_aSIgg"
+	s, err := sub.parse()
+	if err != nil {
+		tt.Fatal(err)
+	}
+	asKey, err := ecdh.P256().NewPrivateKey(b64("yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"))
+	if err != nil {
+		tt.Fatal(err)
+	}
+
+	body, err := encryptWith(s, []byte("When I grow up, I want to be a watermelon"), asKey, b64("DGv6ra1nlYgDCS1FRnbzlw"))
+	if err != nil {
+		tt.Fatal(err)
+	}
+	expected := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	if actual := base64.RawURLEncoding.EncodeToString(body); actual != expected {
+		tt.Errorf("encrypted body mismatch:\n got %s\nwant %s", actual, expected)
+	}
+}
+
+// userAgent is a browser subscribed to pushes.
+type userAgent struct {
+	key  *ecdh.PrivateKey
+	auth []byte
+}
+
+func newUserAgent(tt *testing.T) *userAgent {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		tt.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	rand.Read(auth)
+	return &userAgent{key: key, auth: auth}
+}
+
+func (ua *userAgent) subscription(endpoint string) string {
+	var sub Subscription
+	sub.Endpoint = endpoint
+	sub.Keys.P256dh = base64.RawURLEncoding.EncodeToString(ua.key.PublicKey().Bytes())
+	sub.Keys.Auth = base64.RawURLEncoding.EncodeToString(ua.auth)
+	data, _ := json.Marshal(&sub)
+	return string(data)
+}
+
+// decrypt decrypts the push message as the browser does.
+func (ua *userAgent) decrypt(body []byte) ([]byte, error) {
+	salt := body[:saltLength]
+	rs := binary.BigEndian.Uint32(body[saltLength:])
+	idLen := int(body[saltLength+4])
+	asPublicBytes := body[saltLength+5 : saltLength+5+idLen]
+	if rs != recordSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	asPublic, err := ecdh.P256().NewPublicKey(asPublicBytes)
+	if err != nil {
+		return nil, err
+	}
+	ecdhSecret, err := ua.key.ECDH(asPublic)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo := append([]byte("WebPush: info\x00"), ua.key.PublicKey().Bytes()...)
+	keyInfo = append(keyInfo, asPublicBytes...)
+	ikm, _ := hkdf.Key(sha256.New, ecdhSecret, ua.auth, string(keyInfo), 32)
+	prk, _ := hkdf.Extract(sha256.New, ikm, salt)
+	cek, _ := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	nonce, _ := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	plaintext, err := gcm.Open(nil, nonce, body[saltLength+5+idLen:], nil)
+	if err != nil {
+		return nil, err
+	}
+	// Strip the padding delimiter.
+	return plaintext[:len(plaintext)-1], nil
+}
+
+// newFakePushService starts a stand-in for a push service which accepts messages for a single subscription
+// and makes the handler trust it.
+func newFakePushService(tt *testing.T) *pushtest.Server {
+	ps := pushtest.NewTLSServer(tt)
+	ps.Respond(http.StatusCreated, nil)
+	handler.httpClient = ps.Client()
+
+	// The service listens on the loopback interface.
+	isPublic := isPublicIP
+	isPublicIP = func(net.IP) bool { return true }
+	tt.Cleanup(func() { isPublicIP = isPublic })
+	return ps
+}
+
+// verifyVapid checks the VAPID authorization header and returns the JWT claims.
+func verifyVapid(tt *testing.T, header string) map[string]any {
+	tt.Helper()
+
+	token, key, ok := strings.Cut(strings.TrimPrefix(header, "vapid t="), ", k=")
+	if !ok || key != PublicKey() {
+		tt.Fatal("invalid authorization header", header)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		tt.Fatal("invalid JWT", token)
+	}
+
+	pub := b64(key)
+	pubKey := &ecdsa.PublicKey{
+		Curve: handler.vapid.private.Curve,
+		X:     new(big.Int).SetBytes(pub[1:33]),
+		Y:     new(big.Int).SetBytes(pub[33:]),
+	}
+	sig := b64(parts[2])
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(pubKey, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		tt.Fatal("invalid JWT signature")
+	}
+
+	var claims map[string]any
+	if err := json.Unmarshal(b64(parts[1]), &claims); err != nil {
+		tt.Fatal(err)
+	}
+	return claims
+}
+
+func setupHandler(tt *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	vapid, err := parseVapidKey(base64.RawURLEncoding.EncodeToString(key))
+	if err != nil {
+		tt.Fatal(err)
+	}
+	handler.config = &configType{Subject: "mailto:admin@example.com", TimeToLive: defaultTimeToLive}
+	handler.vapid = vapid
+	handler.httpClient = &http.Client{Timeout: time.Second}
+}
+
+func TestMain(m *testing.M) {
+	pushtest.Main(m)
+}
+
+func TestSend(tt *testing.T) {
+	setupHandler(tt)
+	ps := newFakePushService(tt)
+	ua := newUserAgent(tt)
+
+	payload := []byte(`{"what":"msg","topic":"grpAbc"}`)
+	gone, err := send(ua.subscription(ps.URL()+"/push/abc"), payload, 60, "high")
+	if gone || err != nil {
+		tt.Fatal("failed to send push", gone, err)
+	}
+
+	req := ps.Requests()[0]
+	if req.Header.Get("Content-Encoding") != "aes128gcm" || req.Header.Get("TTL") != "60" ||
+		req.Header.Get("Urgency") != "high" {
+		tt.Error("invalid headers", req.Header)
+	}
+	claims := verifyVapid(tt, req.Header.Get("Authorization"))
+	if claims["aud"] != ps.URL() || claims["sub"] != handler.config.Subject {
+		tt.Error("invalid JWT claims", claims)
+	}
+
+	decrypted, err := ua.decrypt(req.Body)
+	if err != nil {
+		tt.Fatal("failed to decrypt", err)
+	}
+	if string(decrypted) != string(payload) {
+		tt.Errorf("decrypted payload mismatch: %s", decrypted)
+	}
+}
+
+func TestExpiredSubscription(tt *testing.T) {
+	setupHandler(tt)
+	ps := newFakePushService(tt)
+	ua := newUserAgent(tt)
+
+	ps.Respond(http.StatusGone, nil)
+	if gone, _ := send(ua.subscription(ps.URL()), []byte(`{}`), 60, "normal"); !gone {
+		tt.Error("subscription must be reported as expired")
+	}
+
+	ps.Respond(http.StatusTooManyRequests, nil)
+	if gone, err := send(ua.subscription(ps.URL()), []byte(`{}`), 60, "normal"); gone || err == nil {
+		tt.Error("throttled push must be reported as a failure", gone, err)
+	}
+
+	if gone, _ := send(`{"endpoint":"ftp://example.com"}`, []byte(`{}`), 60, "normal"); !gone {
+		tt.Error("invalid subscription must be reported as expired")
+	}
+}
+
+func TestParseSubscription(tt *testing.T) {
+	ua := newUserAgent(tt)
+	if _, err := ParseSubscription(ua.subscription("https://push.example.com/abc")); err != nil {
+		tt.Error("valid subscription is rejected", err)
+	}
+	for _, deviceId := range []string{
+		"fcm-token-abc123",
+		`{"endpoint":"https://push.example.com/abc"}`,
+		`{"endpoint":"https://push.example.com/abc","keys":{"p256dh":"AAAA","auth":"AAAA"}}`,
+	} {
+		if _, err := ParseSubscription(deviceId); err == nil {
+			tt.Errorf("invalid subscription '%s' is accepted", deviceId)
+		}
+	}
+
+	for _, endpoint := range []string{
+		"http://push.example.com/abc",
+		"https://localhost/abc",
+		"https://LocalHost./abc",
+		"https://127.0.0.1/abc",
+		"https://[::1]:8443/abc",
+		"https://10.1.2.3/abc",
+		"https://192.168.0.1/abc",
+		"https://169.254.169.254/latest/meta-data",
+		"https://[fe80::1]/abc",
+		"https://0.0.0.0/abc",
+	} {
+		if _, err := ParseSubscription(ua.subscription(endpoint)); err == nil {
+			tt.Errorf("non-public endpoint '%s' is accepted", endpoint)
+		}
+	}
+}
+
+func TestHTTPClientRefusesLocal(tt *testing.T) {
+	// A host name which resolves to a local address is rejected when connecting.
+	ps := pushtest.NewServer(tt)
+	resp, err := newHTTPClient().Get(ps.URL())
+	if err == nil {
+		resp.Body.Close()
+		tt.Error("local address must not be contacted")
+	}
+	if ps.Count("") != 0 {
+		tt.Error("local server received a request")
+	}
+}
@@ -0,0 +1,321 @@
+// Package xiaomi implements push notification plugin for Xiaomi MiPush. It delivers notifications
+// to Android devices with MIUI and without Google Play services.
+// https://dev.mi.com/console/doc/detail?pId=1163
+package xiaomi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/common"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+var handler Handler
+
+const (
+	// Size of the input channel buffer.
+	bufferSize = 1024
+
+	// Default MiPush endpoint. Use https://api.xmpush.global.xiaomi.com outside of mainland China.
+	defaultEndpoint = "https://api.xmpush.xiaomi.com"
+	// Path of the API which sends a message to registration IDs.
+	sendPath = "/v3/message/regid"
+
+	// TTL of a regular push notification in seconds.
+	defaultTimeToLive = 3600
+	// TTL of a call notification in seconds.
+	callTimeToLive = 30
+
+	// The maximum number of registration IDs in one request. MiPush constant.
+	pushBatchSize = 1000
+)
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input      chan *push.Receipt
+	channel    chan *push.ChannelReq
+	stop       chan bool
+	config     *configType
+	httpClient *http.Client
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// App secret and package name from Xiaomi open platform.
+	AppSecret   string `json:"app_secret"`
+	PackageName string `json:"package_name"`
+	// MiPush endpoint, optional.
+	Endpoint   string `json:"endpoint"`
+	TimeToLive int    `json:"time_to_live,omitempty"`
+	// ID of the notification channel on Android 8 and above, registered with Xiaomi.
+	ChannelId string `json:"channel_id,omitempty"`
+	// Notification to display. Pass-through messages are sent if disabled.
+	Android *common.Config `json:"android,omitempty"`
+}
+
+type miResponse struct {
+	Result      string `json:"result"`
+	Code        int    `json:"code"`
+	Reason      string `json:"reason"`
+	Description string `json:"description"`
+	Data        struct {
+		Id string `json:"id"`
+		// Comma-separated registration IDs which are not valid.
+		BadRegIds string `json:"bad_regids"`
+	} `json:"data"`
+}
+
+// Init initializes the push handler
+func (Handler) Init(jsonconf json.RawMessage) (bool, error) {
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return false, errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return false, nil
+	}
+
+	if config.AppSecret == "" || config.PackageName == "" {
+		return false, errors.New("missing app secret or package name")
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = defaultEndpoint
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	if config.TimeToLive <= 0 {
+		config.TimeToLive = defaultTimeToLive
+	}
+
+	handler.config = &config
+	handler.httpClient = &http.Client{Timeout: 10 * time.Second}
+	handler.input = make(chan *push.Receipt, bufferSize)
+	handler.channel = make(chan *push.ChannelReq, bufferSize)
+	handler.stop = make(chan bool, 1)
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				go sendPushes(rcpt)
+			case <-handler.channel:
+				// MiPush topics are not used.
+			case <-handler.stop:
+				return
+			}
+		}
+	}()
+
+	return true, nil
+}
+
+// notifyId returns the ID which groups notifications of the topic together.
+func notifyId(topic string) string {
+	h := fnv.New32a()
+	h.Write([]byte(topic))
+	return strconv.Itoa(int(h.Sum32() & 0x7fffffff))
+}
+
+// prepareMessage converts the user's data to MiPush request parameters.
+func prepareMessage(what, topic string, data map[string]string, regIds []string) (url.Values, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	config := handler.config
+
+	ttl := config.TimeToLive
+	if _, call := data["webrtc"]; call {
+		ttl = callTimeToLive
+	}
+
+	form := url.Values{}
+	form.Set("registration_id", strings.Join(regIds, ","))
+	form.Set("restricted_package_name", config.PackageName)
+	form.Set("payload", string(payload))
+	form.Set("time_to_live", strconv.Itoa(ttl*1000))
+	// Pass-through message: delivered to the app without showing a notification.
+	form.Set("pass_through", "1")
+
+	if what == push.ActRead || what == push.ActExpire || data["silent"] == "true" ||
+		config.Android == nil || !config.Android.Enabled {
+		return form, nil
+	}
+
+	body := config.Android.GetStringField(what, "Body")
+	if body == "$content" {
+		body = data["content"]
+	}
+	form.Set("pass_through", "0")
+	form.Set("title", config.Android.GetStringField(what, "Title"))
+	form.Set("description", body)
+	// Show just one notification per topic.
+	form.Set("notify_id", notifyId(topic))
+	// Default sound, vibration and lights.
+	form.Set("notify_type", "-1")
+	if config.ChannelId != "" {
+		form.Set("extra.channel_id", config.ChannelId)
+	}
+	if action := config.Android.GetStringField(what, "ClickAction"); action != "" {
+		// Open the activity by intent URI.
+		form.Set("extra.notify_effect", "2")
+		form.Set("extra.intent_uri", action)
+	} else {
+		// Open the launcher activity.
+		form.Set("extra.notify_effect", "1")
+	}
+	return form, nil
+}
+
+// sendPushes sends the receipt to Xiaomi devices of all recipients.
+func sendPushes(rcpt *push.Receipt) {
+	if len(rcpt.To) == 0 {
+		return
+	}
+
+	data, err := common.PayloadToData(&rcpt.Payload)
+	if err != nil {
+		logs.Warn.Println("xiaomi push: could not parse payload:", err)
+		return
+	}
+
+	uids := make([]t.Uid, 0, len(rcpt.To))
+	// Devices which were online and received the message.
+	skipDevices := make(map[string]struct{})
+	for uid, to := range rcpt.To {
+		uids = append(uids, uid)
+		for _, deviceID := range to.Devices {
+			skipDevices[deviceID] = struct{}{}
+		}
+	}
+	devices, _, err := store.Devices.GetAll(uids...)
+	if err != nil {
+		logs.Warn.Println("xiaomi push: db error", err)
+		return
+	}
+
+	order := slices.Collect(maps.Keys(devices))
+	for n, uid := range order {
+		devList := devices[uid]
+		var regIds []string
+		for i := range devList {
+			d := &devList[i]
+			if _, skip := skipDevices[d.DeviceId]; !skip && d.DeviceId != "" && d.Platform == t.PlatformXiaomi {
+				regIds = append(regIds, d.DeviceId)
+			}
+		}
+		if len(regIds) == 0 {
+			continue
+		}
+		if len(regIds) > pushBatchSize {
+			regIds = regIds[:pushBatchSize]
+		}
+
+		topic := rcpt.Payload.Topic
+		userData := common.ClonePayload(data)
+		// Fix topic name for P2P pushes.
+		if t.GetTopicCat(topic) == t.TopicCatP2P {
+			topic, _ = t.P2PNameForUser(uid, topic)
+			userData["topic"] = topic
+		}
+		// Silence the push for user who have received the data interactively.
+		if rcpt.To[uid].Delivered > 0 {
+			userData["silent"] = "true"
+		}
+
+		form, err := prepareMessage(rcpt.Payload.What, topic, userData, regIds)
+		if err != nil {
+			logs.Warn.Println("xiaomi push: failed to prepare message:", err)
+			continue
+		}
+		invalid, err := sendMessage(form)
+		push.InvalidToken("xiaomi", len(invalid))
+		for _, regId := range invalid {
+			// Registration ID is no longer valid. Delete it from DB and continue sending.
+			if err := store.Devices.Delete(uid, regId); err != nil {
+				logs.Warn.Println("xiaomi push: failed to delete invalid registration ID:", err)
+			}
+		}
+		if err != nil {
+			logs.Warn.Println("xiaomi push:", err)
+			push.Failed("xiaomi", rcpt, err, order[n:]...)
+			return
+		}
+		push.Sent("xiaomi", len(regIds)-len(invalid))
+	}
+}
+
+// sendMessage posts the message to MiPush. Returns registration IDs rejected as invalid. An error
+// means sending should stop.
+func sendMessage(form url.Values) ([]string, error) {
+	req, err := http.NewRequest(http.MethodPost, handler.config.Endpoint+sendPath, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded;charset=UTF-8")
+	req.Header.Set("Authorization", "key="+handler.config.AppSecret)
+
+	resp, err := handler.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var result miResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("invalid response, http status %s", resp.Status)
+	}
+
+	var invalid []string
+	if result.Data.BadRegIds != "" {
+		invalid = strings.Split(result.Data.BadRegIds, ",")
+	}
+	if result.Result != "ok" {
+		return invalid, fmt.Errorf("send failed: %d %s %s", result.Code, result.Reason, result.Description)
+	}
+	return invalid, nil
+}
+
+// IsReady checks if the push handler has been initialized.
+func (Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Channel returns a channel for subscribing/unsubscribing devices to channels. Channels are not
+// supported, requests are discarded.
+func (Handler) Channel() chan<- *push.ChannelReq {
+	return handler.channel
+}
+
+// Stop shuts down the handler
+func (Handler) Stop() {
+	handler.stop <- true
+}
+
+func init() {
+	push.Register("xiaomi", &handler)
+}
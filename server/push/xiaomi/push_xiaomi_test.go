@@ -0,0 +1,90 @@
+package xiaomi
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/common"
+	"github.com/tinode/chat/server/push/pushtest"
+)
+
+// fakeMiPush is a stand-in for MiPush server.
+type fakeMiPush struct {
+	*pushtest.Server
+	// Response to send requests.
+	response map[string]any
+}
+
+func newFakeMiPush(tt *testing.T) *fakeMiPush {
+	mp := &fakeMiPush{Server: pushtest.NewServer(tt), response: map[string]any{"result": "ok", "code": 0}}
+	mp.Handle(sendPath, func(req *pushtest.Request) (int, any) {
+		if req.Header.Get("Authorization") != "key=secret" {
+			return http.StatusOK, map[string]any{"result": "error", "code": 22000, "reason": "unauthorized"}
+		}
+		return http.StatusOK, mp.response
+	})
+
+	handler.config = &configType{
+		AppSecret:   "secret",
+		PackageName: "co.tinode.tindroidx",
+		Endpoint:    mp.URL(),
+		TimeToLive:  defaultTimeToLive,
+	}
+	handler.httpClient = &http.Client{Timeout: time.Second}
+	return mp
+}
+
+func TestSendMessage(tt *testing.T) {
+	mp := newFakeMiPush(tt)
+
+	form, err := prepareMessage(push.ActMsg, "grpAbc", map[string]string{"topic": "grpAbc"}, []string{"a", "b"})
+	if err != nil {
+		tt.Fatal(err)
+	}
+	if invalid, err := sendMessage(form); err != nil || len(invalid) != 0 {
+		tt.Fatal("failed to send", invalid, err)
+	}
+	sent := mp.Requests()[0].Form
+	if sent.Get("registration_id") != "a,b" || sent.Get("restricted_package_name") != "co.tinode.tindroidx" ||
+		sent.Get("pass_through") != "1" || sent.Get("payload") != `{"topic":"grpAbc"}` {
+		tt.Error("invalid request", sent)
+	}
+
+	mp.response = map[string]any{"result": "ok", "code": 0, "data": map[string]any{"bad_regids": "b"}}
+	if invalid, err := sendMessage(form); err != nil || len(invalid) != 1 || invalid[0] != "b" {
+		tt.Error("bad registration ID is not reported", invalid, err)
+	}
+
+	mp.response = map[string]any{"result": "error", "code": 21301, "reason": "authentication failed"}
+	if _, err := sendMessage(form); err == nil {
+		tt.Error("failure must be reported as an error")
+	}
+}
+
+func TestPrepareNotification(tt *testing.T) {
+	newFakeMiPush(tt)
+	handler.config.ChannelId = "messages"
+	handler.config.Android = &common.Config{
+		Enabled: true,
+		Msg:     common.Payload{Title: "New message", Body: "$content"},
+	}
+
+	data := map[string]string{"topic": "usrAbc", "content": "hello"}
+	form, err := prepareMessage(push.ActMsg, "usrAbc", data, []string{"a"})
+	if err != nil {
+		tt.Fatal(err)
+	}
+	if form.Get("pass_through") != "0" || form.Get("title") != "New message" || form.Get("description") != "hello" ||
+		form.Get("notify_id") != notifyId("usrAbc") || form.Get("extra.channel_id") != "messages" {
+		tt.Error("invalid notification", form)
+	}
+
+	data["webrtc"] = "started"
+	data["silent"] = "true"
+	if form, _ = prepareMessage(push.ActMsg, "usrAbc", data, []string{"a"}); form.Get("pass_through") != "1" ||
+		form.Get("time_to_live") != "30000" {
+		tt.Error("silent call must be a short-lived pass-through message", form)
+	}
+}
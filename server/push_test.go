@@ -0,0 +1,383 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestNotifyPrefsFromWire(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	later, earlier := now.Add(time.Hour), now.Add(-time.Hour)
+
+	prefs, err := notifyPrefsFromWire(&MsgNotifyPrefs{
+		Quiet:        " 22:00-08:00 ",
+		TimeZone:     "Asia/Shanghai",
+		MentionsOnly: true,
+		Mute:         map[string]time.Time{"grpAbc": later, "usrXyz": earlier},
+	}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefs.Quiet != "22:00-08:00" || prefs.TimeZone != "Asia/Shanghai" || !prefs.MentionsOnly {
+		t.Error("preferences are not converted", prefs)
+	}
+	if len(prefs.Mute) != 1 || !prefs.Mute["grpAbc"].Equal(later) {
+		t.Error("expired mute must be dropped", prefs.Mute)
+	}
+
+	if prefs, err := notifyPrefsFromWire(&MsgNotifyPrefs{Mute: map[string]time.Time{"grpAbc": earlier}}, now); prefs != nil || err != nil {
+		t.Error("empty preferences must be nil", prefs, err)
+	}
+
+	tooMany := make(map[string]time.Time)
+	for i := 0; i <= maxMutedTopics; i++ {
+		tooMany["grp"+types.Uid(i+1).String()] = later
+	}
+	for name, src := range map[string]*MsgNotifyPrefs{
+		"quiet hours": {Quiet: "22:00"},
+		"clock":       {Quiet: "22:00-25:00"},
+		"time zone":   {Quiet: "22:00-08:00", TimeZone: "Nowhere/City"},
+		"muted topic": {Mute: map[string]time.Time{"me": later}},
+		"muted count": {Mute: tooMany},
+	} {
+		if _, err := notifyPrefsFromWire(src, now); err == nil {
+			t.Errorf("invalid %s must be rejected", name)
+		}
+	}
+}
+
+func TestIsQuietTime(t *testing.T) {
+	at := func(clock string) time.Time {
+		tm, _ := time.Parse("2006-01-02 15:04", "2024-05-01 "+clock)
+		return tm
+	}
+
+	prefs := &types.NotifyPrefs{Quiet: "22:00-08:00"}
+	for clock, quiet := range map[string]bool{"21:59": false, "22:00": true, "03:00": true, "07:59": true, "08:00": false} {
+		if isQuietTime(prefs, at(clock)) != quiet {
+			t.Errorf("22:00-08:00 at %s: expected quiet=%t", clock, quiet)
+		}
+	}
+
+	prefs = &types.NotifyPrefs{Quiet: "12:00-13:00", TimeZone: "Asia/Shanghai"}
+	if !isQuietTime(prefs, at("04:30")) || isQuietTime(prefs, at("12:30")) {
+		t.Error("time zone of quiet hours is ignored")
+	}
+
+	if isQuietTime(&types.NotifyPrefs{}, at("03:00")) || isQuietTime(&types.NotifyPrefs{Quiet: "08:00-08:00"}, at("08:00")) {
+		t.Error("empty quiet hours must not be quiet")
+	}
+}
+
+func TestApplyNotifyPrefs(t *testing.T) {
+	now := time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC)
+	sender, muted, mentioned, mentionsOnly, quiet, plain := types.Uid(1), types.Uid(2), types.Uid(3),
+		types.Uid(4), types.Uid(5), types.Uid(6)
+	prefs := map[types.Uid]*types.NotifyPrefs{
+		sender:       {Quiet: "22:00-08:00"},
+		muted:        {Mute: map[string]time.Time{"grpAbc": now.Add(time.Hour)}},
+		mentioned:    {Mute: map[string]time.Time{"grpAbc": now.Add(time.Hour)}, MentionsOnly: true},
+		mentionsOnly: {MentionsOnly: true},
+		quiet:        {Quiet: "22:00-08:00"},
+	}
+	prefsOf := func(uid types.Uid) *types.NotifyPrefs { return prefs[uid] }
+	receipt := func(webrtc string) *push.Receipt {
+		rcpt := &push.Receipt{
+			To: make(map[types.Uid]push.Recipient),
+			Payload: push.Payload{
+				What:  push.ActMsg,
+				Topic: "grpAbc",
+				From:  sender.UserId(),
+				Content: map[string]any{
+					"txt": "@alice hi",
+					"fmt": []any{map[string]any{"at": 0, "len": 6, "key": 0}},
+					"ent": []any{map[string]any{"tp": "MN", "data": map[string]any{"id": mentioned.UserId()}}},
+				},
+				Webrtc: webrtc,
+			},
+		}
+		for _, uid := range []types.Uid{sender, muted, mentioned, mentionsOnly, quiet, plain} {
+			rcpt.To[uid] = push.Recipient{}
+		}
+		return rcpt
+	}
+
+	rcpt := receipt("")
+	applyNotifyPrefs(rcpt, prefsOf, now)
+	for uid, notified := range map[types.Uid]bool{sender: true, muted: false, mentioned: true, mentionsOnly: false,
+		quiet: false, plain: true} {
+		if _, ok := rcpt.To[uid]; ok != notified {
+			t.Errorf("message: user %d expected notified=%t", uid, notified)
+		}
+	}
+
+	rcpt = receipt("started")
+	applyNotifyPrefs(rcpt, prefsOf, now)
+	if to, ok := rcpt.To[quiet]; !ok || !to.Quiet {
+		t.Error("call during quiet hours must be delivered as quiet", to, ok)
+	}
+	if to := rcpt.To[plain]; to.Quiet {
+		t.Error("call outside of quiet hours must not be quiet")
+	}
+	if _, ok := rcpt.To[muted]; ok {
+		t.Error("call in a muted topic must not be notified")
+	}
+
+	rcpt = receipt("")
+	rcpt.Payload.What = push.ActRead
+	applyNotifyPrefs(rcpt, prefsOf, now)
+	if len(rcpt.To) != 6 {
+		t.Error("silent pushes must not be affected", len(rcpt.To))
+	}
+}
+
+func TestSetNotifyPrefsAsUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	store.Users = uu
+	globals.hub = &Hub{topics: &sync.Map{}}
+	defer func() {
+		store.Users = nil
+		globals.hub = nil
+	}()
+
+	uid := types.Uid(1)
+	src := &MsgNotifyPrefs{Quiet: "22:00-08:00", TimeZone: "Asia/Shanghai"}
+
+	// The user is offline: preferences are saved directly.
+	uu.EXPECT().Update(uid, map[string]any{"NotifyPrefs": &types.NotifyPrefs{Quiet: "22:00-08:00", TimeZone: "Asia/Shanghai"}}).Return(nil)
+	if err := setNotifyPrefsAsUser(uid, src); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := setNotifyPrefsAsUser(uid, &MsgNotifyPrefs{Quiet: "22:00"}); err == nil {
+		t.Error("invalid preferences must be rejected")
+	}
+
+	// The user's 'me' topic is loaded: it makes the change.
+	me := &Topic{name: uid.UserId(), meta: make(chan *ClientComMessage, 1)}
+	globals.hub.topics.Store(uid.UserId(), me)
+	if err := setNotifyPrefsAsUser(uid, src); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-me.meta:
+		if msg.AsUser != uid.UserId() || msg.MetaWhat != constMsgMetaDesc || msg.Set.Desc.Notify != src {
+			t.Error("unexpected request to 'me'", msg)
+		}
+	default:
+		t.Error("'me' topic did not receive the request")
+	}
+}
+
+func TestPushForCallEnd(t *testing.T) {
+	alice, bob, gone := types.Uid(1), types.Uid(2), types.Uid(3)
+	topic := &Topic{
+		name: alice.P2PName(bob),
+		perUser: map[types.Uid]perUserData{
+			alice: {modeWant: types.ModeCP2P, modeGiven: types.ModeCP2P},
+			bob:   {modeWant: types.ModeCP2P, modeGiven: types.ModeCP2P},
+			gone:  {modeWant: types.ModeCP2P, modeGiven: types.ModeCP2P, deleted: true},
+		},
+	}
+	now := time.Now()
+	call := &videoCall{seq: 5}
+
+	rcpt := topic.pushForCallEnd(alice, call, now)
+	if rcpt == nil {
+		t.Fatal("the callee must be notified")
+	}
+	if _, ok := rcpt.To[bob]; !ok || len(rcpt.To) != 1 {
+		t.Error("push must be sent to the callee only", rcpt.To)
+	}
+	pl := rcpt.Payload
+	if pl.From != alice.UserId() || pl.SeqId != 5 || pl.Replace != ":5" || pl.Webrtc != constCallMsgDisconnected ||
+		!pl.Silent || !pl.Timestamp.Equal(now) {
+		t.Error("invalid payload", pl)
+	}
+
+	// The originator is unknown.
+	if rcpt := topic.pushForCallEnd(types.ZeroUid, call, now); rcpt == nil || len(rcpt.To) != 2 {
+		t.Error("all subscribers must be notified")
+	}
+
+	call.acceptedAt = now
+	if rcpt := topic.pushForCallEnd(alice, call, now); rcpt != nil {
+		t.Error("answered call must not be cancelled", rcpt.To)
+	}
+}
+
+func TestPushSkipCallSession(t *testing.T) {
+	bob := types.Uid(2)
+	rcpt := &push.Receipt{To: map[types.Uid]push.Recipient{bob: {Delivered: 1}}}
+
+	pushSkipCallSession(rcpt, &Session{uid: bob})
+	pushSkipCallSession(rcpt, nil)
+	if len(rcpt.To[bob].Devices) != 0 {
+		t.Error("session without a VoIP token must not change recipients", rcpt.To[bob])
+	}
+
+	pushSkipCallSession(rcpt, &Session{uid: bob, voipToken: "voip-phone"})
+	if to := rcpt.To[bob]; len(to.Devices) != 1 || to.Devices[0] != "voip-phone" || to.Delivered != 1 {
+		t.Error("VoIP token of the session must be skipped", to)
+	}
+
+	pushSkipCallSession(rcpt, &Session{uid: types.Uid(3), voipToken: "voip-other"})
+	if _, ok := rcpt.To[types.Uid(3)]; ok {
+		t.Error("session of a non-recipient must not add recipients")
+	}
+}
+
+// digestReceipt creates a push of a message in a group topic from carol to the recipients.
+func digestReceipt(seq int, to map[types.Uid]push.Recipient) *push.Receipt {
+	rcpt := &push.Receipt{
+		To:      map[types.Uid]push.Recipient{types.Uid(3): {}},
+		Payload: push.Payload{What: push.ActMsg, Topic: "grpAbc", From: types.Uid(3).UserId(), SeqId: seq, Content: "hi"},
+	}
+	for uid, r := range to {
+		rcpt.To[uid] = r
+	}
+	return rcpt
+}
+
+func TestPushDigests(t *testing.T) {
+	sent := make(chan *push.Receipt, 10)
+	pd := &pushDigests{
+		window:  100 * time.Millisecond,
+		send:    func(rcpt *push.Receipt) { sent <- rcpt },
+		pending: make(map[digestKey]*pendingDigest),
+	}
+	alice, bob, carol := types.Uid(1), types.Uid(2), types.Uid(3)
+
+	// The first push opens the window and is sent right away.
+	rcpt := digestReceipt(1, map[types.Uid]push.Recipient{alice: {}, bob: {}})
+	pd.coalesce(rcpt)
+	if len(rcpt.To) != 3 {
+		t.Fatal("the first push must not be delayed", rcpt.To)
+	}
+
+	// Alice is offline: her pushes are collected. Bob reads the topic.
+	rcpt = digestReceipt(2, map[types.Uid]push.Recipient{alice: {Unread: 2}, bob: {Delivered: 1}})
+	pd.coalesce(rcpt)
+	if _, ok := rcpt.To[alice]; ok {
+		t.Error("push to alice must be collected")
+	}
+	if _, ok := rcpt.To[bob]; !ok {
+		t.Error("push to the user with an attached session must not be delayed")
+	}
+	if _, ok := rcpt.To[carol]; !ok {
+		t.Error("push to the sender must not be touched")
+	}
+	pd.coalesce(digestReceipt(3, map[types.Uid]push.Recipient{alice: {Unread: 3}}))
+
+	// Bob goes offline, then reads the topic on another device.
+	pd.coalesce(digestReceipt(4, map[types.Uid]push.Recipient{bob: {}}))
+	pd.coalesce(&push.Receipt{
+		To:      map[types.Uid]push.Recipient{bob: {}},
+		Payload: push.Payload{What: push.ActRead, Topic: "grpAbc", SeqId: 4},
+	})
+
+	select {
+	case digest := <-sent:
+		to, ok := digest.To[alice]
+		if len(digest.To) != 1 || !ok || to.Unread != 3 {
+			t.Error("digest must be sent to alice only", digest.To)
+		}
+		if digest.Payload.Digest != 2 || digest.Payload.SeqId != 3 {
+			t.Error("digest must summarize collected pushes", digest.Payload.Digest, digest.Payload.SeqId)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("digest was not sent")
+	}
+
+	// Nothing else is collected: the windows close.
+	deadline := time.Now().Add(time.Second)
+	for {
+		pd.mu.Lock()
+		pending := len(pd.pending)
+		pd.mu.Unlock()
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("windows must close when there is nothing to collect", pending)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(sent) != 0 {
+		t.Error("unexpected digest", <-sent)
+	}
+}
+
+func TestPushDigestsBypass(t *testing.T) {
+	var sent []*push.Receipt
+	pd := &pushDigests{
+		// The window does not end during the test, it's closed explicitly.
+		window:  time.Hour,
+		send:    func(rcpt *push.Receipt) { sent = append(sent, rcpt) },
+		pending: make(map[digestKey]*pendingDigest),
+	}
+	alice := types.Uid(1)
+	key := digestKey{alice, "grpAbc"}
+
+	pd.coalesce(digestReceipt(1, map[types.Uid]push.Recipient{alice: {}}))
+	pd.coalesce(digestReceipt(2, map[types.Uid]push.Recipient{alice: {}}))
+
+	for name, rcpt := range map[string]*push.Receipt{
+		"call": digestReceipt(3, map[types.Uid]push.Recipient{alice: {}}),
+		"edit": digestReceipt(4, map[types.Uid]push.Recipient{alice: {}}),
+		"p2p":  digestReceipt(5, map[types.Uid]push.Recipient{alice: {}}),
+	} {
+		switch name {
+		case "call":
+			rcpt.Payload.Webrtc = "started"
+		case "edit":
+			rcpt.Payload.Replace = ":2"
+		case "p2p":
+			rcpt.Payload.Topic = alice.P2PName(types.Uid(3))
+		}
+		pd.coalesce(rcpt)
+		if _, ok := rcpt.To[alice]; !ok {
+			t.Errorf("%s must not be delayed", name)
+		}
+	}
+	if pd.pending[key].count != 1 {
+		t.Error("bypassing pushes must not be collected", pd.pending[key].count)
+	}
+
+	// Mention is sent right away and the user sees the collected messages.
+	rcpt := digestReceipt(6, map[types.Uid]push.Recipient{alice: {}})
+	rcpt.Payload.Content = map[string]any{
+		"txt": "@alice hi",
+		"fmt": []any{map[string]any{"at": 0, "len": 6, "key": 0}},
+		"ent": []any{map[string]any{"tp": "MN", "data": map[string]any{"id": alice.UserId()}}},
+	}
+	pd.coalesce(rcpt)
+	if _, ok := rcpt.To[alice]; !ok {
+		t.Error("mention must not be delayed")
+	}
+
+	pd.flush(key)
+	if len(sent) != 0 {
+		t.Error("no digest is expected after a mention", sent)
+	}
+	if _, ok := pd.pending[key]; ok {
+		t.Error("the window must be closed")
+	}
+
+	var none *pushDigests
+	rcpt = digestReceipt(7, map[types.Uid]push.Recipient{alice: {}})
+	none.coalesce(rcpt)
+	if len(rcpt.To) != 2 {
+		t.Error("disabled coalescing must not change recipients")
+	}
+}
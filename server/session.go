@@ -23,6 +23,7 @@ import (
 	"github.com/tinode/chat/pbx"
 	"github.com/tinode/chat/server/auth"
 	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push/webpush"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
 
@@ -93,7 +94,9 @@ type Session struct {
 
 	// Device ID of the client
 	deviceID string
-	// Platform: web, ios, android
+	// PushKit VoIP token of the iOS client
+	voipToken string
+	// Platform: web, ios, android, huawei, xiaomi
 	platf string
 	// Human language of the client
 	lang string
@@ -768,6 +771,10 @@ func (s *Session) hello(msg *ClientComMessage) {
 		if globals.callEstablishmentTimeout > 0 {
 			params["callTimeout"] = globals.callEstablishmentTimeout
 		}
+		if vapidKey := webpush.PublicKey(); vapidKey != "" {
+			// Browsers need the key to subscribe to Web Push.
+			params["vapidKey"] = vapidKey
+		}
 
 		if s.proto == GRPC {
 			// gRPC client may need server address to be able to fetch large files over http(s).
@@ -785,7 +792,8 @@ func (s *Session) hello(msg *ClientComMessage) {
 		// Don't change them later.
 		s.userAgent = msg.Hi.UserAgent
 		s.platf = msg.Hi.Platform
-		if s.platf == "" {
+		if s.platf == "" || s.platf == types.PlatformVoip {
+			// VoIP tokens are registered separately, see below.
 			s.platf = platformFromUA(msg.Hi.UserAgent)
 		}
 		// This is a background session. Start a timer.
@@ -804,7 +812,7 @@ func (s *Session) hello(msg *ClientComMessage) {
 				deviceIDUpdate = true
 				err = store.Devices.Update(s.uid, s.deviceID, &types.DeviceDef{
 					DeviceId: msg.Hi.DeviceID,
-					Platform: s.platf,
+					Platform: devicePlatform(msg.Hi.DeviceID, s.platf),
 					LastSeen: msg.Timestamp,
 					Lang:     msg.Hi.Lang,
 				})
@@ -817,6 +825,29 @@ func (s *Session) hello(msg *ClientComMessage) {
 				s.queueOut(ErrUnknown(msg.Id, "", msg.Timestamp))
 				return
 			}
+
+			// VoIP token is a device of its own: changing it does not affect the device ID and vice versa.
+			if msg.Hi.Voip == types.NullValue {
+				deviceIDUpdate = true
+				// Blank device ID would delete all user's devices.
+				if s.voipToken != "" {
+					err = store.Devices.Delete(s.uid, s.voipToken)
+				}
+			} else if msg.Hi.Voip != "" && s.voipToken != msg.Hi.Voip {
+				deviceIDUpdate = true
+				err = store.Devices.Update(s.uid, s.voipToken, &types.DeviceDef{
+					DeviceId: msg.Hi.Voip,
+					Platform: types.PlatformVoip,
+					LastSeen: msg.Timestamp,
+					Lang:     msg.Hi.Lang,
+				})
+			}
+
+			if err != nil {
+				logs.Warn.Println("s.hello:", "voip token", err, s.sid)
+				s.queueOut(ErrUnknown(msg.Id, "", msg.Timestamp))
+				return
+			}
 		}
 	} else {
 		// Version cannot be changed mid-session.
@@ -829,6 +860,10 @@ func (s *Session) hello(msg *ClientComMessage) {
 		msg.Hi.DeviceID = ""
 	}
 	s.deviceID = msg.Hi.DeviceID
+	if msg.Hi.Voip == types.NullValue {
+		msg.Hi.Voip = ""
+	}
+	s.voipToken = msg.Hi.Voip
 	s.lang = msg.Hi.Lang
 	// Try to deduce the country from the locale.
 	// Tag may be well-defined even if err != nil. For example, for 'zh_CN_#Hans'
@@ -944,6 +979,15 @@ func (s *Session) login(msg *ClientComMessage) {
 		return
 	}
 
+	if rec.Uid.IsZero() && challenge == nil && handler.GetRealName() == feishuAuthScheme {
+		// The Feishu authenticator has recognized the user, but the user has no account yet.
+		if rec, err = createFeishuUser(handler, msg.Login.Secret, rec, s.remoteAddr); err != nil {
+			logs.Warn.Println("s.login: failed to create account", err, s.sid)
+			s.queueOut(decodeStoreError(err, msg.Id, msg.Timestamp, nil))
+			return
+		}
+	}
+
 	// If authenticator did not check user state, it returns state "undef". If so, check user state here.
 	if rec.State == types.StateUndefined {
 		rec.State, err = userGetState(rec.Uid)
@@ -1074,13 +1118,23 @@ func (s *Session) onLogin(msgID string, timestamp time.Time, rec *auth.Rec, miss
 		if s.deviceID != "" {
 			if err := store.Devices.Update(rec.Uid, "", &types.DeviceDef{
 				DeviceId: s.deviceID,
-				Platform: s.platf,
+				Platform: devicePlatform(s.deviceID, s.platf),
 				LastSeen: timestamp,
 				Lang:     s.lang,
 			}); err != nil {
 				logs.Warn.Println("failed to update device record", err)
 			}
 		}
+		if s.voipToken != "" {
+			if err := store.Devices.Update(rec.Uid, "", &types.DeviceDef{
+				DeviceId: s.voipToken,
+				Platform: types.PlatformVoip,
+				LastSeen: timestamp,
+				Lang:     s.lang,
+			}); err != nil {
+				logs.Warn.Println("failed to update voip token record", err)
+			}
+		}
 	}
 
 	// GenSecret fails only if tokenLifetime is < 0. It can't be < 0 here,
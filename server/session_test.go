@@ -77,6 +77,58 @@ func TestDispatchHello(t *testing.T) {
 	}
 }
 
+func TestDispatchHelloVoip(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	dd := mock_store.NewMockDevicePersistenceInterface(ctrl)
+	store.Devices = dd
+	defer func() {
+		store.Devices = nil
+		ctrl.Finish()
+	}()
+
+	uid := types.Uid(1)
+	s := &Session{
+		send:    make(chan any, 10),
+		uid:     uid,
+		authLvl: auth.LevelAuth,
+		ver:     parseVersion("0.22"),
+		platf:   "ios",
+	}
+	wg := sync.WaitGroup{}
+	r := responses{}
+	wg.Add(1)
+	go s.testWriteLoop(&r, &wg)
+
+	var registered []types.DeviceDef
+	update := func(_ types.Uid, _ string, dev *types.DeviceDef) error {
+		registered = append(registered, *dev)
+		return nil
+	}
+	gomock.InOrder(
+		dd.EXPECT().Update(uid, "", gomock.Any()).DoAndReturn(update),
+		dd.EXPECT().Update(uid, "", gomock.Any()).DoAndReturn(update),
+		// The device ID is unchanged, the VoIP token replaces the old one.
+		dd.EXPECT().Update(uid, "voip-1", gomock.Any()).DoAndReturn(update),
+		dd.EXPECT().Delete(uid, "voip-2").Return(nil),
+	)
+
+	for _, voip := range []string{"voip-1", "voip-2", types.NullValue} {
+		s.dispatch(&ClientComMessage{Hi: &MsgClientHi{Id: "123", DeviceID: "apns-1", Voip: voip}})
+	}
+	close(s.send)
+	wg.Wait()
+	verifyResponseCodes(&r, []int{http.StatusOK, http.StatusOK, http.StatusOK}, t)
+
+	if len(registered) != 3 || registered[0].DeviceId != "apns-1" || registered[0].Platform != "ios" ||
+		registered[1].DeviceId != "voip-1" || registered[1].Platform != types.PlatformVoip ||
+		registered[2].DeviceId != "voip-2" || registered[2].Platform != types.PlatformVoip {
+		t.Error("unexpected devices", registered)
+	}
+	if s.deviceID != "apns-1" || s.voipToken != "" {
+		t.Error("unexpected session devices", s.deviceID, s.voipToken)
+	}
+}
+
 func verifyResponseCodes(r *responses, codes []int, t *testing.T) {
 	if len(r.messages) != len(codes) {
 		t.Errorf("responses: expected %d, received %d.", len(codes), len(r.messages))
@@ -219,6 +271,152 @@ func TestDispatchLogin(t *testing.T) {
 	}
 }
 
+func TestDispatchLoginNewAccount(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ss := mock_store.NewMockPersistentStorageInterface(ctrl)
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	aa := mock_auth.NewMockAuthHandler(ctrl)
+
+	uid := types.Uid(1)
+	store.Store = ss
+	store.Users = uu
+	defer func() {
+		store.Store = nil
+		store.Users = nil
+		ctrl.Finish()
+	}()
+
+	secret := "<==auth-secret==>"
+	public := map[string]any{"fn": "John Doe"}
+	// The authenticator knows the user but there is no account.
+	newRec := &auth.Rec{
+		AuthLevel: auth.LevelAuth,
+		Features:  auth.FeatureValidated,
+		State:     types.StateOK,
+		Public:    public,
+	}
+	authRec := &auth.Rec{
+		Uid:       uid,
+		AuthLevel: auth.LevelAuth,
+	}
+	ss.EXPECT().GetLogicalAuthHandler("feishu").Return(aa)
+	aa.EXPECT().Authenticate([]byte(secret), gomock.Any()).Return(newRec, nil, nil)
+	aa.EXPECT().GetRealName().Return("feishu")
+	uu.EXPECT().Create(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(user *types.User, private any) (*types.User, error) {
+			if user.Access != defaultUserAccess() {
+				t.Errorf("Access: expected server default %+v, got %+v", defaultUserAccess(), user.Access)
+			}
+			if user.Public.(map[string]any)["fn"] != "John Doe" {
+				t.Errorf("Public: expected %v, got %v", public, user.Public)
+			}
+			user.SetUid(uid)
+			return user, nil
+		})
+	aa.EXPECT().AddRecord(gomock.Any(), []byte(secret), gomock.Any()).DoAndReturn(
+		func(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+			if rec.Uid != uid {
+				t.Errorf("Auth record: expected uid %s, got %s", uid, rec.Uid)
+			}
+			return authRec, nil
+		})
+	// Token generation.
+	ss.EXPECT().GetLogicalAuthHandler("token").Return(aa)
+	aa.EXPECT().GenSecret(authRec).Return([]byte("<==auth-token==>"), time.Now(), nil)
+
+	s := &Session{
+		send:    make(chan any, 10),
+		authLvl: auth.LevelAuth,
+		ver:     16,
+	}
+	wg := sync.WaitGroup{}
+	r := responses{}
+	wg.Add(1)
+	go s.testWriteLoop(&r, &wg)
+
+	msg := &ClientComMessage{
+		Login: &MsgClientLogin{
+			Id:     "123",
+			Scheme: "feishu",
+			Secret: []byte(secret),
+		},
+	}
+
+	s.dispatch(msg)
+	close(s.send)
+	wg.Wait()
+
+	if len(r.messages) != 1 {
+		t.Fatalf("responses: expected 1, received %d.", len(r.messages))
+	}
+	resp := r.messages[0].(*ServerComMessage)
+	if resp.Ctrl == nil || resp.Ctrl.Code != 200 {
+		t.Fatalf("Response: expected ctrl 200, got %+v", resp.Ctrl)
+	}
+	if user := resp.Ctrl.Params.(map[string]any)["user"]; user != uid.UserId() {
+		t.Errorf("Response uid: expected '%s', found '%v'.", uid.UserId(), user)
+	}
+	if authRec.Features&auth.FeatureValidated == 0 {
+		t.Error("Features of the authenticator must be kept")
+	}
+}
+
+func TestDispatchLoginNewAccountOtherAuth(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ss := mock_store.NewMockPersistentStorageInterface(ctrl)
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	aa := mock_auth.NewMockAuthHandler(ctrl)
+
+	store.Store = ss
+	store.Users = uu
+	defer func() {
+		store.Store = nil
+		store.Users = nil
+		ctrl.Finish()
+	}()
+
+	// Only the Feishu authenticator may have the account created on login.
+	newRec := &auth.Rec{
+		AuthLevel: auth.LevelAuth,
+		State:     types.StateUndefined,
+		Public:    map[string]any{"fn": "John Doe"},
+	}
+	ss.EXPECT().GetLogicalAuthHandler("rest").Return(aa)
+	aa.EXPECT().Authenticate(gomock.Any(), gomock.Any()).Return(newRec, nil, nil)
+	aa.EXPECT().GetRealName().Return("rest")
+	uu.EXPECT().Get(types.ZeroUid).Return(nil, nil)
+
+	s := &Session{
+		send:    make(chan any, 10),
+		authLvl: auth.LevelAuth,
+		ver:     16,
+	}
+	wg := sync.WaitGroup{}
+	r := responses{}
+	wg.Add(1)
+	go s.testWriteLoop(&r, &wg)
+
+	msg := &ClientComMessage{
+		Login: &MsgClientLogin{
+			Id:     "123",
+			Scheme: "rest",
+			Secret: []byte("<==auth-secret==>"),
+		},
+	}
+
+	s.dispatch(msg)
+	close(s.send)
+	wg.Wait()
+
+	if len(r.messages) != 1 {
+		t.Fatalf("responses: expected 1, received %d.", len(r.messages))
+	}
+	resp := r.messages[0].(*ServerComMessage)
+	if resp.Ctrl == nil || resp.Ctrl.Code == 200 {
+		t.Fatalf("Response: expected error, got %+v", resp.Ctrl)
+	}
+}
+
 func TestDispatchSubscribe(t *testing.T) {
 	uid := types.Uid(1)
 	s := test_makeSession(uid)
@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
 	"github.com/tinode/chat/server/store"
 )
 
@@ -81,6 +82,13 @@ func statsRegisterDbStats() {
 	}
 }
 
+// Publish delivery counters of push handlers.
+func statsRegisterPushStats() {
+	expvar.Publish("PushHandlers", expvar.Func(func() any {
+		return push.Stats()
+	}))
+}
+
 // Register integer variable. Don't check for initialization.
 func statsRegisterInt(name string) {
 	expvar.Publish(name, new(expvar.Int))
@@ -559,6 +559,21 @@ func (mr *MockUsersPersistenceInterfaceMockRecorder) GetByCred(method, value int
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetByCred", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).GetByCred), method, value)
 }
 
+// GetByUnionId mocks base method.
+func (m *MockUsersPersistenceInterface) GetByUnionId(unionId string) (types.Uid, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetByUnionId", unionId)
+	ret0, _ := ret[0].(types.Uid)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetByUnionId indicates an expected call of GetByUnionId.
+func (mr *MockUsersPersistenceInterfaceMockRecorder) GetByUnionId(unionId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetByUnionId", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).GetByUnionId), unionId)
+}
+
 // GetChannels mocks base method.
 func (m *MockUsersPersistenceInterface) GetChannels(id types.Uid) ([]string, error) {
 	m.ctrl.T.Helper()
@@ -574,6 +589,21 @@ func (mr *MockUsersPersistenceInterfaceMockRecorder) GetChannels(id interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetChannels", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).GetChannels), id)
 }
 
+// GetOffline mocks base method.
+func (m *MockUsersPersistenceInterface) GetOffline(lastSeenAfter time.Time, afterId types.Uid, lastSeenBefore time.Time, limit int) ([]types.User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetOffline", lastSeenAfter, afterId, lastSeenBefore, limit)
+	ret0, _ := ret[0].([]types.User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetOffline indicates an expected call of GetOffline.
+func (mr *MockUsersPersistenceInterfaceMockRecorder) GetOffline(lastSeenAfter, afterId, lastSeenBefore, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOffline", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).GetOffline), lastSeenAfter, afterId, lastSeenBefore, limit)
+}
+
 // GetOwnTopics mocks base method.
 func (m *MockUsersPersistenceInterface) GetOwnTopics(id types.Uid) ([]string, error) {
 	m.ctrl.T.Helper()
@@ -668,6 +698,20 @@ func (mr *MockUsersPersistenceInterfaceMockRecorder) GetUnvalidated(lastUpdatedB
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUnvalidated", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).GetUnvalidated), lastUpdatedBefore, limit)
 }
 
+// SetLegalHold mocks base method.
+func (m *MockUsersPersistenceInterface) SetLegalHold(uid types.Uid, hold *types.LegalHold) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetLegalHold", uid, hold)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetLegalHold indicates an expected call of SetLegalHold.
+func (mr *MockUsersPersistenceInterfaceMockRecorder) SetLegalHold(uid, hold interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetLegalHold", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).SetLegalHold), uid, hold)
+}
+
 // Update mocks base method.
 func (m *MockUsersPersistenceInterface) Update(uid types.Uid, update map[string]any) error {
 	m.ctrl.T.Helper()
@@ -908,6 +952,20 @@ func (mr *MockTopicsPersistenceInterfaceMockRecorder) OwnerChange(topic, newOwne
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OwnerChange", reflect.TypeOf((*MockTopicsPersistenceInterface)(nil).OwnerChange), topic, newOwner)
 }
 
+// SetLegalHold mocks base method.
+func (m *MockTopicsPersistenceInterface) SetLegalHold(topic string, hold *types.LegalHold) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetLegalHold", topic, hold)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetLegalHold indicates an expected call of SetLegalHold.
+func (mr *MockTopicsPersistenceInterfaceMockRecorder) SetLegalHold(topic, hold interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetLegalHold", reflect.TypeOf((*MockTopicsPersistenceInterface)(nil).SetLegalHold), topic, hold)
+}
+
 // Update mocks base method.
 func (m *MockTopicsPersistenceInterface) Update(topic string, update map[string]any) error {
 	m.ctrl.T.Helper()
@@ -1029,6 +1087,20 @@ func (m *MockMessagesPersistenceInterface) EXPECT() *MockMessagesPersistenceInte
 	return m.recorder
 }
 
+// ApplyLifetime mocks base method.
+func (m *MockMessagesPersistenceInterface) ApplyLifetime(topic string, lifetime int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ApplyLifetime", topic, lifetime)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ApplyLifetime indicates an expected call of ApplyLifetime.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) ApplyLifetime(topic, lifetime interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ApplyLifetime", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).ApplyLifetime), topic, lifetime)
+}
+
 // DeleteList mocks base method.
 func (m *MockMessagesPersistenceInterface) DeleteList(topic string, delID int, forUser types.Uid, msgDelAge time.Duration, ranges []types.Range) error {
 	m.ctrl.T.Helper()
@@ -1043,6 +1115,20 @@ func (mr *MockMessagesPersistenceInterfaceMockRecorder) DeleteList(topic, delID,
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteList", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).DeleteList), topic, delID, forUser, msgDelAge, ranges)
 }
 
+// ExpireForUser mocks base method.
+func (m *MockMessagesPersistenceInterface) ExpireForUser(topic string, forUser types.Uid, seqId int, expired time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ExpireForUser", topic, forUser, seqId, expired)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ExpireForUser indicates an expected call of ExpireForUser.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) ExpireForUser(topic, forUser, seqId, expired interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExpireForUser", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).ExpireForUser), topic, forUser, seqId, expired)
+}
+
 // GetAll mocks base method.
 func (m *MockMessagesPersistenceInterface) GetAll(topic string, forUser types.Uid, opt *types.QueryOpt) ([]types.Message, error) {
 	m.ctrl.T.Helper()
@@ -1058,6 +1144,21 @@ func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetAll(topic, forUser, o
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetAll), topic, forUser, opt)
 }
 
+// GetAttachments mocks base method.
+func (m *MockMessagesPersistenceInterface) GetAttachments(topic string, ranges []types.Range) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAttachments", topic, ranges)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAttachments indicates an expected call of GetAttachments.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetAttachments(topic, ranges interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAttachments", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetAttachments), topic, ranges)
+}
+
 // GetDeleted mocks base method.
 func (m *MockMessagesPersistenceInterface) GetDeleted(topic string, forUser types.Uid, opt *types.QueryOpt) ([]types.Range, int, error) {
 	m.ctrl.T.Helper()
@@ -1074,6 +1175,66 @@ func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetDeleted(topic, forUse
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDeleted", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetDeleted), topic, forUser, opt)
 }
 
+// GetExpiredForUserList mocks base method.
+func (m *MockMessagesPersistenceInterface) GetExpiredForUserList(after *types.MessageExpiry, before time.Time, limit int) ([]types.MessageExpiry, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetExpiredForUserList", after, before, limit)
+	ret0, _ := ret[0].([]types.MessageExpiry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetExpiredForUserList indicates an expected call of GetExpiredForUserList.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetExpiredForUserList(after, before, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExpiredForUserList", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetExpiredForUserList), after, before, limit)
+}
+
+// GetExpiredList mocks base method.
+func (m *MockMessagesPersistenceInterface) GetExpiredList(after *types.MessageExpiry, before time.Time, limit int) ([]types.MessageExpiry, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetExpiredList", after, before, limit)
+	ret0, _ := ret[0].([]types.MessageExpiry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetExpiredList indicates an expected call of GetExpiredList.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetExpiredList(after, before, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExpiredList", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetExpiredList), after, before, limit)
+}
+
+// GetListBySeqIdRange mocks base method.
+func (m *MockMessagesPersistenceInterface) GetListBySeqIdRange(topic string, forUser types.Uid, seqIdStart, seqIdEnd int) ([]types.Message, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetListBySeqIdRange", topic, forUser, seqIdStart, seqIdEnd)
+	ret0, _ := ret[0].([]types.Message)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetListBySeqIdRange indicates an expected call of GetListBySeqIdRange.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetListBySeqIdRange(topic, forUser, seqIdStart, seqIdEnd interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetListBySeqIdRange", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetListBySeqIdRange), topic, forUser, seqIdStart, seqIdEnd)
+}
+
+// GetMessageByTopicSeqId mocks base method.
+func (m *MockMessagesPersistenceInterface) GetMessageByTopicSeqId(topic string, seqId int) (*types.Message, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetMessageByTopicSeqId", topic, seqId)
+	ret0, _ := ret[0].(*types.Message)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetMessageByTopicSeqId indicates an expected call of GetMessageByTopicSeqId.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetMessageByTopicSeqId(topic, seqId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMessageByTopicSeqId", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetMessageByTopicSeqId), topic, seqId)
+}
+
 // Save mocks base method.
 func (m *MockMessagesPersistenceInterface) Save(msg *types.Message, attachmentURLs []string, readBySender bool) (error, bool) {
 	m.ctrl.T.Helper()
@@ -1089,6 +1250,34 @@ func (mr *MockMessagesPersistenceInterfaceMockRecorder) Save(msg, attachmentURLs
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Save", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).Save), msg, attachmentURLs, readBySender)
 }
 
+// UpdateMessage mocks base method.
+func (m *MockMessagesPersistenceInterface) UpdateMessage(topic string, seqId int, expired time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateMessage", topic, seqId, expired)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateMessage indicates an expected call of UpdateMessage.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) UpdateMessage(topic, seqId, expired interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateMessage", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).UpdateMessage), topic, seqId, expired)
+}
+
+// UpdateMissExpired mocks base method.
+func (m *MockMessagesPersistenceInterface) UpdateMissExpired() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateMissExpired")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateMissExpired indicates an expected call of UpdateMissExpired.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) UpdateMissExpired() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateMissExpired", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).UpdateMissExpired))
+}
+
 // MockDevicePersistenceInterface is a mock of DevicePersistenceInterface interface.
 type MockDevicePersistenceInterface struct {
 	ctrl     *gomock.Controller
@@ -1183,6 +1372,20 @@ func (m *MockFilePersistenceInterface) EXPECT() *MockFilePersistenceInterfaceMoc
 	return m.recorder
 }
 
+// DeleteIfUnused mocks base method.
+func (m *MockFilePersistenceInterface) DeleteIfUnused(fids []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteIfUnused", fids)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteIfUnused indicates an expected call of DeleteIfUnused.
+func (mr *MockFilePersistenceInterfaceMockRecorder) DeleteIfUnused(fids interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteIfUnused", reflect.TypeOf((*MockFilePersistenceInterface)(nil).DeleteIfUnused), fids)
+}
+
 // DeleteUnused mocks base method.
 func (m *MockFilePersistenceInterface) DeleteUnused(olderThan time.Time, limit int) error {
 	m.ctrl.T.Helper()
@@ -1334,3 +1537,83 @@ func (mr *MockPersistentCacheInterfaceMockRecorder) Upsert(key, value, failOnDup
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Upsert", reflect.TypeOf((*MockPersistentCacheInterface)(nil).Upsert), key, value, failOnDuplicate)
 }
+
+// MockFeishuAppInterface is a mock of FeishuAppInterface interface.
+type MockFeishuAppInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockFeishuAppInterfaceMockRecorder
+}
+
+// MockFeishuAppInterfaceMockRecorder is the mock recorder for MockFeishuAppInterface.
+type MockFeishuAppInterfaceMockRecorder struct {
+	mock *MockFeishuAppInterface
+}
+
+// NewMockFeishuAppInterface creates a new mock instance.
+func NewMockFeishuAppInterface(ctrl *gomock.Controller) *MockFeishuAppInterface {
+	mock := &MockFeishuAppInterface{ctrl: ctrl}
+	mock.recorder = &MockFeishuAppInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockFeishuAppInterface) EXPECT() *MockFeishuAppInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Create mocks base method.
+func (m *MockFeishuAppInterface) Create(app *types.FeishuApp) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Create", app)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Create indicates an expected call of Create.
+func (mr *MockFeishuAppInterfaceMockRecorder) Create(app interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockFeishuAppInterface)(nil).Create), app)
+}
+
+// Delete mocks base method.
+func (m *MockFeishuAppInterface) Delete(appId string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", appId)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockFeishuAppInterfaceMockRecorder) Delete(appId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockFeishuAppInterface)(nil).Delete), appId)
+}
+
+// GetAll mocks base method.
+func (m *MockFeishuAppInterface) GetAll() ([]types.FeishuApp, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll")
+	ret0, _ := ret[0].([]types.FeishuApp)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockFeishuAppInterfaceMockRecorder) GetAll() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockFeishuAppInterface)(nil).GetAll))
+}
+
+// Update mocks base method.
+func (m *MockFeishuAppInterface) Update(app *types.FeishuApp) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Update", app)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Update indicates an expected call of Update.
+func (mr *MockFeishuAppInterfaceMockRecorder) Update(app interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockFeishuAppInterface)(nil).Update), app)
+}
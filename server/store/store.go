@@ -4,6 +4,7 @@ package store
 import (
 	"encoding/json"
 	"errors"
+	"net/url"
 	"sort"
 	"strings"
 	"time"
@@ -259,11 +260,13 @@ type UsersPersistenceInterface interface {
 	Get(uid types.Uid) (*types.User, error)
 	GetAll(uid ...types.Uid) ([]types.User, error)
 	GetByCred(method, value string) (types.Uid, error)
+	GetByUnionId(unionId string) (types.Uid, error)
 	Delete(id types.Uid, hard bool) error
 	UpdateLastSeen(uid types.Uid, userAgent string, when time.Time) error
 	Update(uid types.Uid, update map[string]any) error
 	UpdateTags(uid types.Uid, add, remove, reset []string) ([]string, error)
 	UpdateState(uid types.Uid, state types.ObjState) error
+	SetLegalHold(uid types.Uid, hold *types.LegalHold) error
 	GetSubs(id types.Uid) ([]types.Subscription, error)
 	FindSubs(caller types.Uid, prefPrefix string, required [][]string, optional []string, activeOnly bool) ([]types.Subscription, error)
 	FindOne(tag string) (string, error)
@@ -279,6 +282,7 @@ type UsersPersistenceInterface interface {
 	DelCred(id types.Uid, method, value string) error
 	GetUnreadCount(ids ...types.Uid) (map[types.Uid]int, error)
 	GetUnvalidated(lastUpdatedBefore time.Time, limit int) ([]types.Uid, error)
+	GetOffline(lastSeenAfter time.Time, afterId types.Uid, lastSeenBefore time.Time, limit int) ([]types.User, error)
 }
 
 // usersMapper is a concrete type which implements UsersPersistenceInterface.
@@ -383,6 +387,11 @@ func (usersMapper) GetByCred(method, value string) (types.Uid, error) {
 	return adp.UserGetByCred(method, value)
 }
 
+// GetByUnionId returns ID of the user linked to the given Feishu union ID or zero if there is no such user.
+func (usersMapper) GetByUnionId(unionId string) (types.Uid, error) {
+	return adp.UserGetByUnionId(unionId)
+}
+
 // Delete deletes user records.
 func (usersMapper) Delete(id types.Uid, hard bool) error {
 	return adp.UserDelete(id, hard)
@@ -406,6 +415,11 @@ func (usersMapper) UpdateTags(uid types.Uid, add, remove, reset []string) ([]str
 	return adp.UserUpdateTags(uid, add, remove, reset)
 }
 
+// SetLegalHold places (hold is not nil) or releases (hold is nil) legal hold on the user's conversations.
+func (usersMapper) SetLegalHold(uid types.Uid, hold *types.LegalHold) error {
+	return adp.UserSetLegalHold(uid, hold)
+}
+
 // UpdateState changes user's state and state of some topics associated with the user.
 func (usersMapper) UpdateState(uid types.Uid, state types.ObjState) error {
 	update := map[string]any{
@@ -500,6 +514,12 @@ func (usersMapper) GetUnvalidated(lastUpdatedBefore time.Time, limit int) ([]typ
 	return adp.UserGetUnvalidated(lastUpdatedBefore, limit)
 }
 
+// GetOffline returns active users who were last seen after lastSeenAfter but no later than lastSeenBefore.
+// Users last seen at lastSeenAfter are returned if their ID is greater than non-zero afterId.
+func (usersMapper) GetOffline(lastSeenAfter time.Time, afterId types.Uid, lastSeenBefore time.Time, limit int) ([]types.User, error) {
+	return adp.UserGetOffline(lastSeenAfter, afterId, lastSeenBefore, limit)
+}
+
 // TopicsPersistenceInterface is an interface which defines methods for persistent storage of topics.
 type TopicsPersistenceInterface interface {
 	Create(topic *types.Topic, owner types.Uid, private any) error
@@ -511,6 +531,7 @@ type TopicsPersistenceInterface interface {
 	GetSubsAny(topic string, opts *types.QueryOpt) ([]types.Subscription, error)
 	Update(topic string, update map[string]any) error
 	OwnerChange(topic string, newOwner types.Uid) error
+	SetLegalHold(topic string, hold *types.LegalHold) error
 	Delete(topic string, isChan, hard bool) error
 }
 
@@ -597,6 +618,11 @@ func (topicsMapper) OwnerChange(topic string, newOwner types.Uid) error {
 	return adp.TopicOwnerChange(topic, newOwner)
 }
 
+// SetLegalHold places (hold is not nil) or releases (hold is nil) legal hold on the topic.
+func (topicsMapper) SetLegalHold(topic string, hold *types.LegalHold) error {
+	return adp.TopicSetLegalHold(topic, hold)
+}
+
 // Delete deletes topic, messages, attachments, and subscriptions.
 func (topicsMapper) Delete(topic string, isChan, hard bool) error {
 	return adp.TopicDelete(topic, isChan, hard)
@@ -650,8 +676,12 @@ type MessagesPersistenceInterface interface {
 	GetMessageByTopicSeqId(topic string, seqId int) (*types.Message, error)
 	GetListBySeqIdRange(topic string, forUser types.Uid, seqIdStart int, seqIdEnd int) ([]types.Message, error)
 	UpdateMessage(topic string, seqId int, expired time.Time) error
-	GetExpiredList() ([]types.Message, error)
+	GetExpiredList(after *types.MessageExpiry, before time.Time, limit int) ([]types.MessageExpiry, error)
+	GetAttachments(topic string, ranges []types.Range) ([]string, error)
+	ExpireForUser(topic string, forUser types.Uid, seqId int, expired time.Time) error
+	GetExpiredForUserList(after *types.MessageExpiry, before time.Time, limit int) ([]types.MessageExpiry, error)
 	UpdateMissExpired() error
+	ApplyLifetime(topic string, lifetime int) error
 }
 
 // messagesMapper is a concrete type implementing MessagesPersistenceInterface.
@@ -792,15 +822,38 @@ func (messagesMapper) UpdateMessage(topic string, seqId int, expired time.Time)
 	return adp.MessageUpdate(topic, seqId, expired)
 }
 
-// GetExpiredList Get all expired messages
-func (messagesMapper) GetExpiredList() ([]types.Message, error) {
-	return adp.MessageExpiredList()
+// GetExpiredList returns up to limit messages which expire before the given time, ordered by expiration time,
+// starting after the given position: the last message of the previous page or nil for the first page.
+func (messagesMapper) GetExpiredList(after *types.MessageExpiry, before time.Time, limit int) ([]types.MessageExpiry, error) {
+	return adp.MessageExpiredList(after, before, limit)
+}
+
+// GetAttachments returns IDs of files attached to messages in the topic with seq IDs within the ranges.
+func (messagesMapper) GetAttachments(topic string, ranges []types.Range) ([]string, error) {
+	return adp.MessageAttachments(topic, ranges)
+}
+
+// ExpireForUser sets the time when the message expires for the given user only.
+func (messagesMapper) ExpireForUser(topic string, forUser types.Uid, seqId int, expired time.Time) error {
+	return adp.MessageExpireForUser(topic, forUser, seqId, expired)
+}
+
+// GetExpiredForUserList returns up to limit per-user message expirations which are due before the given time,
+// starting after the given position: the last expiration of the previous page or nil for the first page.
+func (messagesMapper) GetExpiredForUserList(after *types.MessageExpiry, before time.Time, limit int) ([]types.MessageExpiry, error) {
+	return adp.MessageExpiredForUserList(after, before, limit)
 }
 
 func (messagesMapper) UpdateMissExpired() error {
 	return adp.MessageUpdateMissExpired()
 }
 
+// ApplyLifetime makes messages in the topic expire no later than lifetime seconds after being sent.
+// If topic is empty, the lifetime is applied to messages in all topics.
+func (messagesMapper) ApplyLifetime(topic string, lifetime int) error {
+	return adp.MessageApplyLifetime(topic, lifetime)
+}
+
 // Registered authentication handlers.
 var authHandlers map[string]auth.AuthHandler
 
@@ -1021,6 +1074,8 @@ type FilePersistenceInterface interface {
 	Get(fid string) (*types.FileDef, error)
 	// DeleteUnused removes unused attachments.
 	DeleteUnused(olderThan time.Time, limit int) error
+	// DeleteIfUnused removes the given attachments if they are no longer used.
+	DeleteIfUnused(fids []string) error
 	// LinkAttachments connects earlier uploaded attachments to a message or topic to prevent it
 	// from being garbage collected.
 	LinkAttachments(topic string, msgId types.Uid, attachments []string) error
@@ -1061,6 +1116,22 @@ func (fileMapper) DeleteUnused(olderThan time.Time, limit int) error {
 	return nil
 }
 
+// DeleteIfUnused removes the given attachments if they are not linked to any message, topic or user.
+func (fileMapper) DeleteIfUnused(fids []string) error {
+	if mediaHandler == nil {
+		// Media handling is not configured, files are not stored.
+		return nil
+	}
+	toDel, err := adp.FileDeleteIfUnused(fids)
+	if err != nil {
+		return err
+	}
+	if len(toDel) > 0 {
+		return Store.GetMediaHandler().Delete(toDel)
+	}
+	return nil
+}
+
 // LinkAttachments connects earlier uploaded attachments to a message or topic to prevent it
 // from being garbage collected.
 func (fileMapper) LinkAttachments(topic string, msgId types.Uid, attachments []string) error {
@@ -1123,6 +1194,9 @@ func (pcacheMapper) Expire(keyPrefix string, olderThan time.Time) error {
 // FeishuAppInterface is an interface which defines methods for feishu app records.
 type FeishuAppInterface interface {
 	GetAll() ([]types.FeishuApp, error)
+	Create(app *types.FeishuApp) error
+	Update(app *types.FeishuApp) error
+	Delete(appId string) error
 }
 
 // feishuAppMapper is a concrete type which implements FeishuAppInterface.
@@ -1136,6 +1210,41 @@ func (feishuAppMapper) GetAll() ([]types.FeishuApp, error) {
 	return adp.FeishuAppGetAll()
 }
 
+// validFeishuApp checks that the app has credentials and the base URL, if any, is an absolute http(s) URL.
+func validFeishuApp(app *types.FeishuApp) bool {
+	if app.AppId == "" || app.AppSecret == "" {
+		return false
+	}
+	if app.BaseUrl != "" {
+		u, err := url.Parse(app.BaseUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Create adds a new Feishu app.
+func (feishuAppMapper) Create(app *types.FeishuApp) error {
+	if !validFeishuApp(app) {
+		return types.ErrMalformed
+	}
+	return adp.FeishuAppCreate(app)
+}
+
+// Update replaces credentials and base URL of an existing Feishu app.
+func (feishuAppMapper) Update(app *types.FeishuApp) error {
+	if !validFeishuApp(app) {
+		return types.ErrMalformed
+	}
+	return adp.FeishuAppUpdate(app)
+}
+
+// Delete deletes a Feishu app.
+func (feishuAppMapper) Delete(appId string) error {
+	return adp.FeishuAppDelete(appId)
+}
+
 func init() {
 	Store = storeObj{}
 	Users = usersMapper{}
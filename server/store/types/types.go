@@ -531,6 +531,63 @@ type User struct {
 
 	// feishu_app_id
 	FeishuAppId string `json:"FeishuAppId,omitempty" bson:"feishu_app_id,omitempty"`
+
+	// Legal hold on the user's conversations, nil if none.
+	LegalHold *LegalHold `json:"LegalHold,omitempty" bson:",omitempty"`
+
+	// Push notification preferences, nil if none.
+	NotifyPrefs *NotifyPrefs `json:"NotifyPrefs,omitempty" bson:",omitempty"`
+}
+
+// NotifyPrefs is the user's push notification preferences.
+type NotifyPrefs struct {
+	// Quiet hours as "HH:MM-HH:MM" in the time zone below, e.g. "22:00-08:00".
+	Quiet string `json:"Quiet,omitempty"`
+	// IANA time zone name of the quiet hours, UTC if empty.
+	TimeZone string `json:"TimeZone,omitempty"`
+	// Notify of messages in group topics only if the user is mentioned.
+	MentionsOnly bool `json:"MentionsOnly,omitempty"`
+	// Topics muted until the given time. P2P topics are keyed by the other user's ID.
+	Mute map[string]time.Time `json:"Mute,omitempty"`
+	// Do not send email digests of unread messages.
+	NoEmailDigest bool `json:"NoEmailDigest,omitempty"`
+}
+
+// Scan implements sql.Scanner interface.
+func (np *NotifyPrefs) Scan(val any) error {
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), np)
+}
+
+// Value implements sql's driver.Valuer interface.
+func (np NotifyPrefs) Value() (driver.Value, error) {
+	return json.Marshal(np)
+}
+
+// LegalHold prevents data from being purged. Messages and topics deleted while on hold
+// are hidden from users but retained in the database until the hold is released.
+type LegalHold struct {
+	// ID of the root user who placed the hold.
+	By string
+	// Time when the hold was placed.
+	At time.Time
+	// Optional free-form explanation, e.g. a case number.
+	Reason string `json:"Reason,omitempty"`
+}
+
+// Scan implements sql.Scanner interface.
+func (lh *LegalHold) Scan(val any) error {
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), lh)
+}
+
+// Value implements sql's driver.Valuer interface.
+func (lh LegalHold) Value() (driver.Value, error) {
+	return json.Marshal(lh)
 }
 
 // AccessMode is a definition of access mode bits.
@@ -1095,6 +1152,42 @@ func (kvm KVMap) Value() (driver.Value, error) {
 	return json.Marshal(kvm)
 }
 
+// Events which start the message expiration countdown.
+const (
+	// The countdown starts when the first recipient reads the message. The message is deleted for everyone.
+	MsgExpireFirstRead = "first"
+	// The countdown starts when all recipients have read the message. The message is deleted for everyone.
+	MsgExpireAllRead = "all"
+	// Each recipient has its own countdown started when the recipient reads the message.
+	// The message is deleted for that recipient only; the sender's copy does not expire.
+	MsgExpireEachRead = "recipient"
+)
+
+// MessageRetention is a topic-level policy which controls expiration of messages.
+type MessageRetention struct {
+	// Number of seconds a message lives after being read: 0 - use server default, -1 - never expire.
+	Period int
+	// If true, Period overrides periods requested by message senders and set on subscriptions.
+	Enforced bool
+	// Event which starts the expiration countdown, one of MsgExpire* values. Empty means MsgExpireFirstRead.
+	Trigger string `json:"Trigger,omitempty"`
+	// Number of seconds a message lives after being sent whether it's read or not: 0 - use server limit.
+	Lifetime int `json:"Lifetime,omitempty"`
+}
+
+// Scan implements sql.Scanner interface.
+func (mr *MessageRetention) Scan(val any) error {
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), mr)
+}
+
+// Value implements sql's driver.Valuer interface.
+func (mr MessageRetention) Value() (driver.Value, error) {
+	return json.Marshal(mr)
+}
+
 // Topic stored in database. Topic's name is Id
 type Topic struct {
 	ObjHeader `bson:",inline"`
@@ -1129,6 +1222,12 @@ type Topic struct {
 	// Auxiliary set of key-value pairs.
 	Aux KVMap `json:"Aux,omitempty" bson:",omitempty"`
 
+	// Message retention policy. Nil means no topic-level policy.
+	Retention *MessageRetention `json:"Retention,omitempty" bson:",omitempty"`
+
+	// Legal hold on the topic, nil if none.
+	LegalHold *LegalHold `json:"LegalHold,omitempty" bson:",omitempty"`
+
 	// Deserialized ephemeral params
 	perUser map[Uid]*perUserData // deserialized from Subscription
 }
@@ -1234,6 +1333,14 @@ type Message struct {
 	ExpiredAt    *time.Time `json:"ExpiredAt,omitempty" bson:",omitempty"`
 }
 
+// MessageExpiry is the time when a message expires for a single recipient.
+type MessageExpiry struct {
+	Topic     string
+	SeqId     int
+	User      string
+	ExpiredAt time.Time
+}
+
 // Range is a range of message SeqIDs. Low end is inclusive (closed), high end is exclusive (open): [Low, Hi).
 // If the range contains just one ID, Hi is set to 0
 type Range struct {
@@ -1312,7 +1419,7 @@ func SliceToRanges(in []int) []Range {
 		}
 
 		prev := &out[size-1]
-		if (prev.Hi == 0 && (id != prev.Low+1)) || (id > prev.Hi) {
+		if (prev.Hi == 0 && id != prev.Low+1) || (prev.Hi > 0 && id > prev.Hi) {
 			// New range.
 			out = append(out, Range{Low: id})
 		} else {
@@ -1398,12 +1505,35 @@ func GetTopicCat(name string) TopicCat {
 	}
 }
 
+// Platforms of devices which receive pushes through their own push services rather than FCM or regular
+// APNs notifications.
+const (
+	// PlatformWebPush is the platform of browsers subscribed to Web Push. DeviceId of such devices is
+	// the JSON-serialized PushSubscription.
+	PlatformWebPush = "webpush"
+	// PlatformHuawei is the platform of Android devices with Huawei Mobile Services. DeviceId is the Push Kit token.
+	PlatformHuawei = "huawei"
+	// PlatformXiaomi is the platform of Android devices with Xiaomi MiPush. DeviceId is the registration ID.
+	PlatformXiaomi = "xiaomi"
+	// PlatformVoip is the platform of iOS PushKit tokens. The app registers the token in the 'voip' field
+	// of {hi}, and the token is stored as a separate device.
+	// APNs sends only call invites and cancellations to such devices.
+	PlatformVoip = "voip"
+)
+
+// HasOwnPushService checks if devices of the platform receive pushes through their own push service.
+// FCM adapter and regular APNs notifications skip such devices.
+func HasOwnPushService(platform string) bool {
+	return platform == PlatformWebPush || platform == PlatformHuawei || platform == PlatformXiaomi ||
+		platform == PlatformVoip
+}
+
 // DeviceDef is the data provided by connected device. Used primarily for
 // push notifications.
 type DeviceDef struct {
 	// Device registration ID
 	DeviceId string
-	// Device platform (iOS, Android, Web)
+	// Device platform (iOS, Android, Web or one of the Platform* constants)
 	Platform string
 	// Last logged in
 	LastSeen time.Time
@@ -1449,7 +1579,11 @@ func FlattenDoubleSlice(data [][]string) []string {
 	return result
 }
 
+// FeishuApp is credentials of a Feishu (Lark) app used for sending notifications.
 type FeishuApp struct {
-	AppId     string `json:"appid"`
+	AppId     string `json:"appid" bson:"_id"`
 	AppSecret string `json:"appsecret"`
+	// Base URL of Feishu API, such as https://open.larksuite.com for Lark international.
+	// Empty to use the default endpoint of the push handler.
+	BaseUrl string `json:"baseurl,omitempty"`
 }
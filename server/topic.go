@@ -14,12 +14,12 @@ import (
 	"github.com/tinode/chat/server/drafty"
 	"sort"
 	"strings"
-	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/tinode/chat/server/auth"
 	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push/feishu"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
 )
@@ -66,6 +66,12 @@ type Topic struct {
 	// Auxiliary set of key-value pairs
 	aux map[string]any
 
+	// Message retention policy (group topics only).
+	retention *types.MessageRetention
+
+	// User's push notification preferences ('me' topic only).
+	notifyPrefs *types.NotifyPrefs
+
 	// Topic's public data
 	public any
 	// Topic's trusted data
@@ -106,6 +112,8 @@ type Topic struct {
 	supd chan *sessionUpdate
 	// Channel to terminate topic  -- either the topic is deleted or system is being shut down. Buffered = 1.
 	exit chan *shutDown
+	// Channel for receiving IDs of expired messages to delete (not used by proxy topics). Buffered = 32.
+	expire chan *expiredMessages
 	// Channel to receive topic master responses (used only by proxy topics).
 	proxy chan *ClusterResp
 	// Channel to receive topic proxy service requests, e.g. sending deferred notifications.
@@ -194,6 +202,9 @@ const (
 	StopDeleted
 	// StopRehashing terminated due to cluster rehashing (moved to a different node).
 	StopRehashing
+	// StopReloading terminated because subscriptions were changed outside of the topic.
+	// The topic is loaded again from the database when accessed next time.
+	StopReloading
 )
 
 // Topic shutdown
@@ -523,11 +534,12 @@ func (t *Topic) handleTopicTimeout(hub *Hub, currentUA string, uaTimer, defrNoti
 }
 
 func (t *Topic) handleTopicTermination(sd *shutDown) {
-	// Handle four cases:
+	// Handle five cases:
 	// 1. Topic is shutting down by timer due to inactivity (reason == StopNone)
 	// 2. Topic is being deleted (reason == StopDeleted)
 	// 3. System shutdown (reason == StopShutdown, done != nil).
 	// 4. Cluster rehashing (reason == StopRehashing)
+	// 5. Subscriptions changed outside of the topic (reason == StopReloading)
 
 	if sd.reason == StopDeleted {
 		if t.cat == types.TopicCatGrp {
@@ -538,7 +550,7 @@ func (t *Topic) handleTopicTermination(sd *shutDown) {
 		// Inform plugins that the topic is deleted
 		pluginTopic(t, plgActDel)
 
-	} else if sd.reason == StopRehashing {
+	} else if sd.reason == StopRehashing || sd.reason == StopReloading {
 		// Must send individual messages to sessions because normal sending through the topic's
 		// broadcast channel won't work - it will be shut down too soon.
 		t.presSubsOnlineDirect("term", nilPresParams, nilPresFilters, "")
@@ -562,6 +574,11 @@ func (t *Topic) runLocal(hub *Hub) {
 	// Kills topic after a period of inactivity.
 	t.killTimer = time.NewTimer(time.Hour)
 	t.killTimer.Stop()
+	if len(t.reg) == 0 && t.cat != types.TopicCatSys {
+		// Topic is loaded without a session, e.g. to deliver a message published by the server.
+		// Let it go once the message is processed.
+		t.killTimer.Reset(idleMasterTopicTimeout)
+	}
 
 	// Notifies about user agent change. 'me' only
 	uaTimer := time.NewTimer(time.Minute)
@@ -594,6 +611,9 @@ func (t *Topic) runLocal(hub *Hub) {
 		case upd := <-t.supd:
 			t.handleSessionUpdate(upd, &currentUA, uaTimer)
 
+		case exp := <-t.expire:
+			t.handleExpiredMessages(exp)
+
 		case <-uaTimer.C:
 			t.handleUATimerEvent(currentUA)
 
@@ -1012,17 +1032,16 @@ func (t *Topic) saveAndBroadcastMessage(msg *ClientComMessage, asUid types.Uid,
 	}
 
 	markedReadBySender := false
-	// first use server msg expire period
-	expirePeriod := 86400
+	var requestedPeriod int
 	if msg.Pub != nil {
-		expirePeriod = msg.Pub.ExpirePeriod
+		requestedPeriod = msg.Pub.ExpirePeriod
 	}
-	if pud.expirePeriod != expirePeriod {
-		expirePeriod = pud.expirePeriod
-	}
-	// TODO ios 上线可取消注释，并且更改数据库默认值 -1 改 86400
-	if expirePeriod <= 0 {
-		expirePeriod = 86400
+	expirePeriod := t.msgExpirePeriod(&pud, requestedPeriod)
+	// The message is deleted at the end of its lifetime even if nobody reads it.
+	var expiredAt *time.Time
+	if lifetime := t.msgLifetime(); lifetime > 0 {
+		deadline := msg.Timestamp.Add(time.Duration(lifetime) * time.Second)
+		expiredAt = &deadline
 	}
 
 	if err, unreadUpdated := store.Messages.Save(
@@ -1034,6 +1053,7 @@ func (t *Topic) saveAndBroadcastMessage(msg *ClientComMessage, asUid types.Uid,
 			Head:         head,
 			Content:      content,
 			ExpirePeriod: expirePeriod,
+			ExpiredAt:    expiredAt,
 		}, attachments, (pud.modeGiven & pud.modeWant).IsReader()); err != nil {
 		logs.Warn.Printf("topic[%s]: failed to save message: %v", t.name, err)
 		msg.sess.queueOut(ErrUnknown(msg.Id, t.original(asUid), msg.Timestamp))
@@ -1045,6 +1065,9 @@ func (t *Topic) saveAndBroadcastMessage(msg *ClientComMessage, asUid types.Uid,
 
 	t.lastID++
 	t.touched = msg.Timestamp
+	if expiredAt != nil {
+		globals.expiry.schedule(t.name, t.lastID, types.ZeroUid, *expiredAt)
+	}
 
 	if userFound {
 		pud.readID = t.lastID
@@ -1067,6 +1090,7 @@ func (t *Topic) saveAndBroadcastMessage(msg *ClientComMessage, asUid types.Uid,
 			Head:         head,
 			Content:      content,
 			ExpirePeriod: expirePeriod,
+			ExpiredAt:    expiredAt,
 		},
 		// Internal-only values.
 		Id:        msg.Id,
@@ -1097,8 +1121,16 @@ func (t *Topic) saveAndBroadcastMessage(msg *ClientComMessage, asUid types.Uid,
 
 	t.broadcastToSessions(data)
 
+	if t.cat == types.TopicCatGrp {
+		// Copy the message to the Feishu chat bound to the topic, if any.
+		feishu.RelayToChat(t.name, t.tags, data.Data.From, head, content)
+	}
+
 	// sendPush will update unread message count and send push notification.
 	if pushRcpt := t.pushForData(asUid, data.Data, markedReadBySender); pushRcpt != nil {
+		if pushRcpt.Payload.Webrtc != "" {
+			pushSkipCallSession(pushRcpt, msg.sess)
+		}
 		sendPush(pushRcpt)
 	}
 	return nil
@@ -1291,72 +1323,65 @@ func (t *Topic) handleNoteBroadcast(msg *ClientComMessage) {
 
 	t.broadcastToSessions(info)
 
-	if len(unreadMsgs) > 0 {
-		now := types.TimeNow()
-		//toriginal := t.original(asUid)
-		//outgoingMessages := make([]*ServerComMessage, len(unreadMsgs))
-		var notifyUpdateExpired *ServerComMessage
-		for i, unreadMsg := range unreadMsgs {
-			expiredAt := now.Add(time.Duration(unreadMsg.ExpirePeriod) * time.Second)
-			unreadMsg.ExpiredAt = &expiredAt
-			unreadMsgs[i] = unreadMsg
-
-			//from := ""
-			//if !asChan {
-			//	// Don't show sender for channel readers
-			//	from = types.ParseUid(unreadMsg.From).UserId()
-			//}
-
-			// update database messages
-			if err = store.Messages.UpdateMessage(t.name, unreadMsg.SeqId, *unreadMsg.ExpiredAt); err != nil {
-				logs.Warn.Printf("topic[%s]: update message err: %v", t.name, err)
-				return
-			}
+	// Messages expiring for the reader only, or zero for everyone.
+	var expireFor types.Uid
+	switch t.msgExpireTrigger() {
+	case types.MsgExpireAllRead:
+		unreadMsgs = t.readByAll(unreadMsgs)
+	case types.MsgExpireEachRead:
+		expireFor = asUid
+	}
 
-			for sess, pssd := range t.sessions {
-				notifyUpdateExpired = &ServerComMessage{
-					Pres: &MsgServerPres{
-						What:         "updateMsg",
-						Topic:        msg.Original,
-						SeqId:        unreadMsg.SeqId,
-						ExpirePeriod: unreadMsg.ExpirePeriod,
-						ExpiredAt:    unreadMsg.ExpiredAt,
-						From:         msg.AsUser,
-					},
-				}
-				msgCopy := notifyUpdateExpired.copy()
-				t.prepareBroadcastableMessage(msgCopy, pssd.uid, pssd.isChanSub)
+	t.expireMessages(msg.Original, msg.AsUser, expireFor, unreadMsgs)
+}
 
-				sess.queueOut(msgCopy)
-			}
+// presPubMessagesExpired sends a single {pres what="updateMsg"} with expiration times of messages
+// to every session attached to the topic or to the 'me' topic of a subscriber. If forUser is not
+// zero, the messages expire for this user only and the notification is sent to the user's sessions only.
+func (t *Topic) presPubMessagesExpired(topic, from string, forUser types.Uid, expired []MsgExpiry) {
+	pres := &ServerComMessage{
+		Pres: &MsgServerPres{
+			What:    "updateMsg",
+			Topic:   topic,
+			Expired: expired,
+			From:    from,
+		},
+	}
+	if !forUser.IsZero() {
+		// Proxy topics deliver it to the reader only.
+		pres.Pres.SingleUser = forUser.UserId()
+	}
 
-			for uid, _ := range t.perUser {
-				user := uid.UserId()
-				// send to subs offline user
-				if dst := globals.hub.topicGet(user); dst != nil {
-					for sess, pssd := range dst.sessions {
-						notifyUpdateExpired = &ServerComMessage{
-							Pres: &MsgServerPres{
-								What:         "updateMsg",
-								Topic:        msg.Original,
-								SeqId:        unreadMsg.SeqId,
-								ExpirePeriod: unreadMsg.ExpirePeriod,
-								ExpiredAt:    unreadMsg.ExpiredAt,
-								From:         msg.AsUser,
-							},
-						}
-						msgCopy := notifyUpdateExpired.copy()
-						t.prepareBroadcastableMessage(msgCopy, pssd.uid, pssd.isChanSub)
+	// Sessions which have already received the notification.
+	notified := make(map[*Session]struct{})
+	queueOut := func(sess *Session, pssd perSessionData) {
+		if _, ok := notified[sess]; ok {
+			return
+		}
+		notified[sess] = struct{}{}
 
-						sess.queueOut(msgCopy)
-					}
-				}
-			}
+		msgCopy := pres.copy()
+		t.prepareBroadcastableMessage(msgCopy, pssd.uid, pssd.isChanSub)
+		sess.queueOut(msgCopy)
+	}
+
+	for sess, pssd := range t.sessions {
+		if !forUser.IsZero() && !sess.isMultiplex() && pssd.uid != forUser {
+			continue
 		}
+		queueOut(sess, pssd)
+	}
 
-		//for sess, _ := range t.sessions {
-		//	sess.queueOutBatch(outgoingMessages)
-		//}
+	// Subscribers who are online but not attached to the topic.
+	for uid := range t.perUser {
+		if !forUser.IsZero() && uid != forUser {
+			continue
+		}
+		if dst := globals.hub.topicGet(uid.UserId()); dst != nil {
+			for sess, pssd := range dst.sessions {
+				queueOut(sess, pssd)
+			}
+		}
 	}
 }
 
@@ -1936,6 +1961,7 @@ func (t *Topic) thisUserSub(sess *Session, pkt *ClientComMessage, asUid types.Ui
 	}
 	// Apply changes.
 	t.perUser[asUid] = userData
+	t.expireReleased(asUid, perUserData{readID: userData.readID, modeWant: oldWant, modeGiven: oldGiven})
 
 	var modeChanged *MsgAccessMode
 	// Send presence notifications and update cached unread count.
@@ -2153,6 +2179,7 @@ func (t *Topic) anotherUserSub(sess *Session, asUid, target types.Uid, asChan bo
 
 			userData.modeGiven = modeGiven
 			t.perUser[target] = userData
+			t.expireReleased(target, perUserData{readID: userData.readID, modeWant: oldWant, modeGiven: oldGiven})
 		}
 	}
 
@@ -2233,6 +2260,17 @@ func (t *Topic) replyGetDesc(sess *Session, asUid types.Uid, _ bool, opts *MsgGe
 	if full {
 		// return message expire period
 		desc.ExpirePeriod = pud.expirePeriod
+		desc.Retention = retentionToWire(t.retention)
+		if lifetime := t.msgLifetime(); lifetime > 0 {
+			// Report the effective lifetime which includes the server limit.
+			if desc.Retention == nil {
+				desc.Retention = &MsgRetention{}
+			}
+			desc.Retention.Lifetime = lifetime
+		}
+		if t.cat == types.TopicCatMe {
+			desc.Notify = notifyPrefsToWire(t.notifyPrefs)
+		}
 		if t.cat == types.TopicCatP2P {
 			// For p2p topics default access mode makes no sense: only participants have access to topic.
 			// Don't report it.
@@ -2373,12 +2411,31 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, asChan bool,
 			return errors.New("attempt to change Trusted by non-root")
 		}
 
+		if set.Desc.Retention != nil && t.cat != types.TopicCatGrp {
+			// Retention policy is supported by group topics only.
+			sess.queueOut(ErrPermissionDeniedReply(msg, now))
+			return errors.New("attempt to set retention policy of a non-group topic")
+		}
+
+		if set.Desc.Notify != nil && t.cat != types.TopicCatMe {
+			// Notification preferences are set at 'me' only.
+			sess.queueOut(ErrPermissionDeniedReply(msg, now))
+			return errors.New("attempt to set notification preferences outside of 'me'")
+		}
+
 		switch t.cat {
 		case types.TopicCatMe:
 			// Update current user
 			err = assignAccess(core, set.Desc.DefaultAcs)
 			sendCommon = assignGenericValues(core, "Public", t.public, set.Desc.Public)
 			sendCommon = assignGenericValues(core, "Trusted", t.trusted, set.Desc.Trusted) || sendCommon
+			if set.Desc.Notify != nil {
+				var prefs *types.NotifyPrefs
+				if prefs, err = notifyPrefsFromWire(set.Desc.Notify, now); err == nil &&
+					!notifyPrefsEqual(prefs, t.notifyPrefs) {
+					core["NotifyPrefs"] = prefs
+				}
+			}
 		case types.TopicCatFnd:
 			// set.Desc.DefaultAcs is ignored.
 			if set.Desc.Trusted != nil {
@@ -2400,7 +2457,18 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, asChan bool,
 				err = assignAccess(core, set.Desc.DefaultAcs)
 				sendCommon = assignGenericValues(core, "Public", t.public, set.Desc.Public)
 				sendCommon = assignGenericValues(core, "Trusted", t.trusted, set.Desc.Trusted) || sendCommon
-			} else if set.Desc.DefaultAcs != nil || set.Desc.Public != nil || set.Desc.Trusted != nil {
+				if set.Desc.Retention != nil {
+					if !isValidRetention(set.Desc.Retention) {
+						sess.queueOut(ErrPolicyReply(msg, now))
+						return errors.New("retention policy is outside of server limits")
+					}
+					if ret := retentionFromWire(set.Desc.Retention); !retentionEqual(ret, t.retention) {
+						core["Retention"] = ret
+						sendCommon = true
+					}
+				}
+			} else if set.Desc.DefaultAcs != nil || set.Desc.Public != nil || set.Desc.Trusted != nil ||
+				set.Desc.Retention != nil {
 				// This is a request from non-owner
 				sess.queueOut(ErrPermissionDeniedReply(msg, now))
 				return errors.New("attempt to change public or permissions by non-owner")
@@ -2464,6 +2532,21 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, asChan bool,
 		if trusted, ok := core["Trusted"]; ok {
 			t.trusted = trusted
 		}
+		if prefs, ok := core["NotifyPrefs"]; ok {
+			t.notifyPrefs = prefs.(*types.NotifyPrefs)
+			usersUpdateNotifyPrefs(asUid, t.notifyPrefs)
+		}
+		if retention, ok := core["Retention"]; ok {
+			lifetime := t.msgLifetime()
+			t.retention = retention.(*types.MessageRetention)
+			if newLifetime := t.msgLifetime(); newLifetime > 0 && (lifetime == 0 || newLifetime < lifetime) {
+				// Lifetime has become shorter: apply it to existing messages too.
+				if err := store.Messages.ApplyLifetime(t.name, newLifetime); err != nil {
+					logs.Warn.Printf("topic[%s]: failed to apply message lifetime: %v", t.name, err)
+				}
+				globals.expiry.reload()
+			}
+		}
 	} else if t.cat == types.TopicCatFnd {
 		// Assign per-session fnd.Public.
 		t.fndSetPublic(sess, core["Public"])
@@ -3676,6 +3759,7 @@ func (t *Topic) evictUser(uid types.Uid, unsub bool, skip string) {
 
 	// Detach user from topic
 	if unsub {
+		defer t.expireReleased(uid, pud)
 		if t.cat == types.TopicCatP2P {
 			// P2P: mark user as deleted
 			pud.online = 0
@@ -4155,107 +4239,3 @@ func topicNameForUser(name string, uid types.Uid, isChan bool) string {
 	}
 	return name
 }
-
-var delExpMsgLock sync.Mutex
-var updateMissExpMsgLock sync.Mutex
-
-// deleteExpiredMessages auto delete expired messages
-// and notify topic's subscriptions
-func deleteExpiredMessages() chan<- bool {
-	stop := make(chan bool)
-	go func() {
-		ticker := time.Tick(time.Second)
-		for {
-			select {
-			case <-ticker:
-				if delExpMsgLock.TryLock() {
-					topicMsgs := make(map[string][]types.Message)
-					if msgs, err := store.Messages.GetExpiredList(); err == nil {
-						if len(msgs) > 0 {
-							logs.Info.Println("find expired message will delete:", len(msgs))
-							for _, msg := range msgs {
-								topicMsgs[msg.Topic] = append(topicMsgs[msg.Topic], msg)
-							}
-							var delID int
-							for topic, messages := range topicMsgs {
-								t := globals.hub.topicGet(topic)
-								if t != nil {
-									delID = t.delID
-								} else {
-									// select the db
-									stopic, err := store.Topics.Get(topic)
-									if err != nil {
-										logs.Warn.Println("db get topic error:", topic, err)
-										continue
-									}
-									if stopic != nil {
-										delID = stopic.DelId
-									}
-								}
-
-								for _, message := range messages {
-									var ranges []types.Range
-									ranges = append(ranges, types.Range{Low: message.SeqId, Hi: 0})
-									if err = store.Messages.DeleteList(topic, delID+1, types.ZeroUid, 0, ranges); err != nil {
-										logs.Warn.Println("db delete expired message error:", err)
-									}
-									delID++
-
-									if t != nil {
-										dr := rangeDeserialize(ranges)
-										t.delID = delID
-										for uid, pud := range t.perUser {
-											pud.delID = t.delID
-											t.perUser[uid] = pud
-										}
-
-										// Broadcast the change to all, online and offline, exclude the session making the change.
-										params := &presParams{delID: t.delID, delSeq: dr, actor: message.From}
-										filters := &presFilters{filterIn: types.ModeRead}
-										t.presSubsOnline("del", params.actor, params, filters, "")
-										t.presSubsOffline("del", params, filters, nilPresFilters, "", true, &ServerComMessage{})
-										logs.Info.Println("topic delete expired message success:", topic, delID)
-									}
-								}
-								logs.Info.Println("topic delete expired message success:", topic, delID)
-							}
-						}
-					} else {
-						logs.Warn.Println("get expired messages error:", err)
-					}
-					delExpMsgLock.Unlock()
-				}
-			case <-stop:
-				return
-			}
-		}
-	}()
-
-	return stop
-}
-
-// updateMissExpiredMessages update miss expired message's expired
-func updateMissExpiredMessages() chan<- bool {
-	stop := make(chan bool)
-	go func() {
-		ticker := time.Tick(time.Minute)
-		for {
-			select {
-			case <-ticker:
-				if updateMissExpMsgLock.TryLock() {
-					if err := store.Messages.UpdateMissExpired(); err != nil {
-						logs.Warn.Println("update miss expired messages error:", err)
-					} else {
-						logs.Info.Println("update miss expired messages success")
-					}
-
-					updateMissExpMsgLock.Unlock()
-				}
-			case <-stop:
-				return
-			}
-		}
-	}()
-
-	return stop
-}
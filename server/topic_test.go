@@ -178,7 +178,8 @@ func (h *Hub) testHubLoop(t *testing.T, results map[string][]*ServerComMessage,
 	t.Helper()
 	for msg := range h.routeSrv {
 		if msg.RcptTo == "" {
-			t.Fatal("Hub.route received a message without addressee.")
+			t.Error("Hub.route received a message without addressee.")
+			continue
 		}
 		results[msg.RcptTo] = append(results[msg.RcptTo], msg)
 	}
@@ -626,6 +627,7 @@ func TestHandleBroadcastInfoP2P(t *testing.T) {
 	from := helper.uids[0]
 	to := helper.uids[1]
 
+	helper.mm.EXPECT().GetListBySeqIdRange(topicName, from, 1, readId).Return(nil, nil)
 	helper.ss.EXPECT().Update(topicName, from, map[string]any{"ReadSeqId": readId}).Return(nil)
 
 	msg := &ClientComMessage{
@@ -918,6 +920,7 @@ func TestHandleBroadcastInfoDbError(t *testing.T) {
 	from := helper.uids[0]
 	to := helper.uids[1]
 
+	helper.mm.EXPECT().GetListBySeqIdRange(topicName, from, 1, readId).Return(nil, nil)
 	helper.ss.EXPECT().Update(topicName, from, map[string]any{"ReadSeqId": readId}).Return(types.ErrInternal)
 
 	msg := &ClientComMessage{
@@ -1022,6 +1025,7 @@ func TestHandleBroadcastInfoChannelProcessing(t *testing.T) {
 		helper.topic.perUser[uid] = pud
 	}
 
+	helper.mm.EXPECT().GetListBySeqIdRange(topicName, from, 1, readId).Return(nil, nil)
 	helper.ss.EXPECT().Update(chanName, from, map[string]any{"ReadSeqId": readId}).Return(nil)
 
 	msg := &ClientComMessage{
@@ -97,10 +97,7 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 	}
 
 	// Assign default access values in case the acc creator has not provided them
-	user.Access.Auth = getDefaultAccess(types.TopicCatP2P, true, false) |
-		getDefaultAccess(types.TopicCatGrp, true, false)
-	user.Access.Anon = getDefaultAccess(types.TopicCatP2P, false, false) |
-		getDefaultAccess(types.TopicCatGrp, false, false)
+	user.Access = defaultUserAccess()
 
 	// Assign actual access values, public and private.
 	if msg.Acc.Desc != nil {
@@ -218,6 +215,42 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 	pluginAccount(&user, plgActCreate)
 }
 
+// defaultUserAccess returns the default access mode of a new account.
+func defaultUserAccess() types.DefaultAccess {
+	return types.DefaultAccess{
+		Auth: getDefaultAccess(types.TopicCatP2P, true, false) | getDefaultAccess(types.TopicCatGrp, true, false),
+		Anon: getDefaultAccess(types.TopicCatP2P, false, false) | getDefaultAccess(types.TopicCatGrp, false, false),
+	}
+}
+
+// createFeishuUser creates an account for a Feishu user who has logged in with the Feishu authenticator
+// but has no account yet. The account is created with the server default access and the public data
+// from the Feishu profile, then the authentication record is added.
+func createFeishuUser(authhdl auth.AuthHandler, secret []byte, rec *auth.Rec, remoteAddr string) (*auth.Rec, error) {
+	user := types.User{
+		Public: rec.Public,
+		Access: defaultUserAccess(),
+	}
+	if _, err := store.Users.Create(&user, nil); err != nil {
+		return nil, err
+	}
+
+	added, err := authhdl.AddRecord(&auth.Rec{Uid: user.Uid(), AuthLevel: rec.AuthLevel}, secret, remoteAddr)
+	if err != nil {
+		// Attempt to delete incomplete user record
+		if err := store.Users.Delete(user.Uid(), true); err != nil {
+			logs.Warn.Println("create user: failed to delete incomplete user record", err)
+		}
+		return nil, err
+	}
+	added.Features |= rec.Features
+	added.State = types.StateOK
+
+	pluginAccount(&user, plgActCreate)
+
+	return added, nil
+}
+
 // Process update to an account:
 // * Authentication update, i.e. login/password change
 // * Credentials update
@@ -558,6 +591,12 @@ func changeUserState(s *Session, uid types.Uid, user *types.User, msg *ClientCom
 		return false, types.ErrMalformed
 	}
 
+	return updateUserState(uid, user, state)
+}
+
+// updateUserState applies the new state to the user account. It does not need a session so it can
+// be used by server-side jobs. Returns true if the state has changed.
+func updateUserState(uid types.Uid, user *types.User, state types.ObjState) (bool, error) {
 	// State unchanged.
 	if user.State == state {
 		return false, nil
@@ -568,8 +607,7 @@ func changeUserState(s *Session, uid types.Uid, user *types.User, msg *ClientCom
 		globals.sessionStore.EvictUser(uid, "")
 	}
 
-	err = store.Users.UpdateState(uid, state)
-	if err != nil {
+	if err := store.Users.UpdateState(uid, state); err != nil {
 		return false, err
 	}
 
@@ -577,7 +615,7 @@ func changeUserState(s *Session, uid types.Uid, user *types.User, msg *ClientCom
 	globals.hub.userStatus <- &userStatusReq{forUser: uid, state: state}
 	user.State = state
 
-	return true, err
+	return true, nil
 }
 
 // Request to delete a user:
@@ -724,11 +762,16 @@ type UserCacheReq struct {
 
 	// Optional push notification
 	PushRcpt *push.Receipt
+
+	// Updated push notification preferences (UserId is set), empty if cleared.
+	NotifyPrefs *types.NotifyPrefs
 }
 
 type userCacheEntry struct {
 	unread int
 	topics int
+	// Push notification preferences, loaded together with the unread count.
+	prefs *types.NotifyPrefs
 }
 
 // Preserved update entry kept while we read the unread counter from the DB.
@@ -739,6 +782,7 @@ type bufferedUpdate struct {
 
 type ioResult struct {
 	counts map[types.Uid]int
+	prefs  map[types.Uid]*types.NotifyPrefs
 	err    error
 }
 
@@ -822,6 +866,27 @@ func usersUpdateUnread(uid types.Uid, val int, inc bool) {
 	}
 }
 
+// usersUpdateNotifyPrefs updates cached push notification preferences of the user.
+func usersUpdateNotifyPrefs(uid types.Uid, prefs *types.NotifyPrefs) {
+	if globals.usersUpdate == nil {
+		return
+	}
+
+	if prefs == nil {
+		prefs = &types.NotifyPrefs{}
+	}
+	upd := &UserCacheReq{UserId: uid, NotifyPrefs: prefs}
+	if globals.cluster.isRemoteTopic(uid.UserId()) {
+		// Send request to remote node which owns the user.
+		globals.cluster.routeUserReq(upd)
+	} else {
+		select {
+		case globals.usersUpdate <- upd:
+		default:
+		}
+	}
+}
+
 // Start tracking a single user. Used for cache management.
 // 'add' increments/decrements user's count of subscribed topics.
 func usersRegisterUser(uid types.Uid, add bool) {
@@ -939,6 +1004,17 @@ func userUpdater() {
 	// IO callback queue.
 	ioDone := make(chan *ioResult, 1024)
 
+	// Applies notification preferences of the recipients and sends the push.
+	pushWithPrefs := func(rcpt *push.Receipt) {
+		applyNotifyPrefs(rcpt, func(uid types.Uid) *types.NotifyPrefs {
+			return usersCache[uid].prefs
+		}, time.Now())
+		globals.pushDigests.coalesce(rcpt)
+		if len(rcpt.To) > 0 || rcpt.Channel != "" {
+			push.Push(rcpt)
+		}
+	}
+
 	unreadUpdater := func(uids []types.Uid, vals []int, inc bool) map[types.Uid]int {
 		var dbPending []types.Uid
 		counts := make(map[types.Uid]int, len(uids))
@@ -983,7 +1059,16 @@ func userUpdater() {
 				if err != nil {
 					logs.Warn.Println("users: failed to load unread count: ", err)
 				}
-				ioDone <- &ioResult{counts: dbUnread, err: err}
+				// Notification preferences are not essential: pushes are sent if they failed to load.
+				prefs := make(map[types.Uid]*types.NotifyPrefs)
+				if users, err := store.Users.GetAll(dbPending...); err != nil {
+					logs.Warn.Println("users: failed to load notification preferences: ", err)
+				} else {
+					for i := range users {
+						prefs[users[i].Uid()] = users[i].NotifyPrefs
+					}
+				}
+				ioDone <- &ioResult{counts: dbUnread, prefs: prefs, err: err}
 			}()
 		}
 
@@ -1020,6 +1105,7 @@ func userUpdater() {
 						logs.Warn.Println("users: unread count double initialization, uid", uid)
 					}
 					uce.unread = count
+					uce.prefs = io.prefs[uid]
 					usersCache[uid] = uce
 				} else {
 					logs.Warn.Println("users: missing users cache entry after IO completion, uid", uid)
@@ -1050,7 +1136,7 @@ func userUpdater() {
 						rcpt.To[uid] = rcptTo
 					}
 				}
-				push.Push(rcpt)
+				pushWithPrefs(rcpt)
 			}
 		case upd := <-globals.usersUpdate:
 			if globals.shuttingDown {
@@ -1096,7 +1182,7 @@ func userUpdater() {
 
 				if len(pendingUsers) == 0 {
 					// All data present in memory. Just send the push.
-					push.Push(upd.PushRcpt)
+					pushWithPrefs(upd.PushRcpt)
 				} else {
 					// We are waiting for IO. Add this receipt to the queues.
 					pp := &pendingReceipt{
@@ -1150,6 +1236,15 @@ func userUpdater() {
 				continue
 			}
 
+			if upd.NotifyPrefs != nil {
+				// Preferences of users not in cache are loaded from the DB later.
+				if uce, ok := usersCache[upd.UserId]; ok {
+					uce.prefs = upd.NotifyPrefs
+					usersCache[upd.UserId] = uce
+				}
+				continue
+			}
+
 			// Request to update unread count for one user.
 			unreadUpdater([]types.Uid{upd.UserId}, []int{upd.Unread}, upd.Inc)
 		}
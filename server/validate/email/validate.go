@@ -9,6 +9,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
+	"maps"
 	"math/big"
 	"math/rand"
 	"mime"
@@ -39,6 +41,8 @@ type validator struct {
 	ValidationTemplFile string `json:"validation_templ"`
 	// Path to templates for resetting the authentication secret.
 	ResetTemplFile string `json:"reset_secret_templ"`
+	// Optional path to templates of the digest of unread messages.
+	DigestTemplFile string `json:"digest_templ"`
 	// Sender RFC 5322 email address.
 	SendFrom string `json:"sender"`
 	// Login to use for SMTP authentication.
@@ -69,6 +73,7 @@ type validator struct {
 	// https://github.com/golang/go/issues/24211
 	validationTempl []*textt.Template
 	resetTempl      []*textt.Template
+	digestTempl     []*textt.Template
 	auth            smtp.Auth
 	senderEmail     string
 	langMatcher     i18n.Matcher
@@ -187,6 +192,12 @@ func (v *validator) Init(jsonconf string) error {
 		}
 	}
 
+	if v.DigestTemplFile != "" {
+		if v.digestTempl, err = v.readDigestTemplates(); err != nil {
+			return err
+		}
+	}
+
 	if v.HostUrl, err = validate.ValidateHostURL(v.HostUrl); err != nil {
 		return err
 	}
@@ -344,6 +355,83 @@ func (v *validator) ResetSecret(email, scheme, lang string, code []byte, params
 	return nil
 }
 
+// readDigestTemplates loads templates of the unread messages digest. Digest templates are optional
+// for individual languages: the template of the default language is used if one is missing.
+func (v *validator) readDigestTemplates() ([]*textt.Template, error) {
+	templPath, err := validate.ResolveTemplatePath(v.DigestTemplFile)
+	if err != nil {
+		return nil, err
+	}
+	pathTempl, err := textt.New("digest").Parse(templPath)
+	if err != nil {
+		return nil, err
+	}
+
+	langs := v.Languages
+	if len(langs) == 0 {
+		langs = []string{""}
+	}
+	templs := make([]*textt.Template, len(langs))
+	for idx, lang := range langs {
+		templ, path, err := validate.ReadTemplateFile(pathTempl, lang)
+		if err != nil {
+			if idx > 0 && errors.Is(err, fs.ErrNotExist) {
+				templs[idx] = templs[0]
+				continue
+			}
+			return nil, err
+		}
+		if err = isTemplateValid(templ); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		templs[idx] = templ
+	}
+	return templs, nil
+}
+
+// sendDigest sends a digest of unread messages. Unlike other emails, the digest is sent synchronously.
+func (v *validator) sendDigest(email, lang string, params map[string]any) error {
+	if !v.IsInitialized() {
+		return errors.New("email validator is not initialized")
+	}
+	if len(v.digestTempl) == 0 {
+		return errors.New("email digest template is not configured")
+	}
+
+	var template *textt.Template
+	if v.langMatcher != nil {
+		_, idx := i18n.MatchStrings(v.langMatcher, lang)
+		template = v.digestTempl[idx]
+	} else {
+		template = v.digestTempl[0]
+	}
+
+	params = maps.Clone(params)
+	if params == nil {
+		params = map[string]any{}
+	}
+	params["HostUrl"] = v.HostUrl
+
+	content, err := validate.ExecuteTemplate(template, templateParts, params)
+	if err != nil {
+		return err
+	}
+
+	return v.send(email, content)
+}
+
+// DigestConfigured checks if the email validator is initialized and has the templates of the digest
+// of unread messages.
+func DigestConfigured() bool {
+	return instance.IsInitialized() && len(instance.digestTempl) > 0
+}
+
+// SendDigest sends an email with a digest of unread messages using the SMTP settings and templates of
+// the email validator. The params are passed to the "digest_templ" template.
+func SendDigest(email, lang string, params map[string]any) error {
+	return instance.sendDigest(email, lang, params)
+}
+
 // Check checks if the provided validation response matches the expected response.
 // Returns the value of validated credential on success.
 func (v *validator) Check(user t.Uid, resp string) (string, error) {
@@ -548,6 +636,9 @@ func randomBoundary() string {
 	return fmt.Sprintf("tinode--%x", buf[:])
 }
 
+// The validator registered with the store.
+var instance = &validator{}
+
 func init() {
-	store.RegisterValidator(validatorName, &validator{})
+	store.RegisterValidator(validatorName, instance)
 }
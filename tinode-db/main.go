@@ -197,6 +197,9 @@ func main() {
 	noInit := flag.Bool("no_init", false, "check that database exists but don't create if missing")
 	addRoot := flag.String("add_root", "", "create ROOT user, auth scheme 'basic'")
 	makeRoot := flag.String("make_root", "", "promote ordinary user to ROOT, auth scheme 'basic'")
+	addFeishuApp := flag.String("add_feishu_app", "", "add Feishu app used for push notifications, APP_ID:APP_SECRET[:BASE_URL]")
+	updFeishuApp := flag.String("update_feishu_app", "", "replace secret and base URL of Feishu app, APP_ID:APP_SECRET[:BASE_URL]")
+	delFeishuApp := flag.String("del_feishu_app", "", "delete Feishu app APP_ID")
 	datafile := flag.String("data", "", "name of file with sample data to load")
 	conffile := flag.String("config", "./tinode.conf", "config of the database connection")
 
@@ -353,7 +356,37 @@ func main() {
 		log.Printf("ROOT user created: '%s:%s'", uname, password)
 	}
 
+	// Manage Feishu apps.
+	if *addFeishuApp != "" {
+		if err := store.FeishuApps.Create(parseFeishuApp(*addFeishuApp)); err != nil {
+			log.Fatalln("Failed to add Feishu app:", err)
+		}
+		log.Println("Feishu app added")
+	}
+	if *updFeishuApp != "" {
+		if err := store.FeishuApps.Update(parseFeishuApp(*updFeishuApp)); err != nil {
+			log.Fatalln("Failed to update Feishu app:", err)
+		}
+		log.Println("Feishu app updated")
+	}
+	if *delFeishuApp != "" {
+		if err := store.FeishuApps.Delete(*delFeishuApp); err != nil {
+			log.Fatalln("Failed to delete Feishu app:", err)
+		}
+		log.Printf("Feishu app '%s' deleted", *delFeishuApp)
+	}
+
 	log.Println("All done.")
 
 	os.Exit(0)
 }
+
+// parseFeishuApp parses Feishu app credentials in the form APP_ID:APP_SECRET[:BASE_URL].
+func parseFeishuApp(val string) *types.FeishuApp {
+	appId, rest, _ := strings.Cut(val, ":")
+	appSecret, baseUrl, _ := strings.Cut(rest, ":")
+	if appId == "" || appSecret == "" {
+		log.Fatalf("Invalid Feishu app '%s', expected APP_ID:APP_SECRET[:BASE_URL]", appId)
+	}
+	return &types.FeishuApp{AppId: appId, AppSecret: appSecret, BaseUrl: baseUrl}
+}